@@ -0,0 +1,141 @@
+// Command audit works on the audit log in the database named by
+// DATABASE_URL:
+//
+//	audit verify [-key <base64 Ed25519 public key>]...
+//	audit restore [-key <base64 Ed25519 public key>]... <archive ID or location>
+//
+// verify checks the hash chain and exits with status 1 if it is broken.
+// restore checks an archive written by retention and loads its entries
+// into audit_restored for investigation; the location may be a local path,
+// a file:// URL or an s3:// URL.
+package main
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/config"
+	"idam-pam-platform/internal/database"
+
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+)
+
+const usage = `usage:
+  audit verify [-key <base64 public key>]...
+  audit restore [-key <base64 public key>]... <archive ID or location>`
+
+// keyList collects repeated -key flags.
+type keyList []ed25519.PublicKey
+
+func (k *keyList) String() string {
+	encoded := make([]string, len(*k))
+	for i, key := range *k {
+		encoded[i] = base64.StdEncoding.EncodeToString(key)
+	}
+	return strings.Join(encoded, ",")
+}
+
+func (k *keyList) Set(value string) error {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("not a base64 Ed25519 public key")
+	}
+	*k = append(*k, ed25519.PublicKey(key))
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "verify" && os.Args[1] != "restore") {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var trusted keyList
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	flags.Var(&trusted, "key", "only accept checkpoints and archives signed by this key (repeatable)")
+	flags.Parse(os.Args[2:])
+	if os.Args[1] == "restore" && flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+	cfg := config.Load()
+
+	db, err := database.Init(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatal("Failed to initialize database:", err)
+	}
+	defer db.Close()
+
+	if os.Args[1] == "restore" {
+		restore(cfg, db, flags.Arg(0), trusted)
+		return
+	}
+
+	result, err := audit.Verify(db, trusted)
+	if err != nil {
+		log.Fatal("Failed to verify audit log:", err)
+	}
+
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+	if !result.Valid {
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+func restore(cfg *config.Config, db *sql.DB, archive string, trusted keyList) {
+	location := archive
+	if id, err := uuid.Parse(archive); err == nil {
+		if location, err = audit.ArchiveLocation(db, id); err != nil {
+			log.Fatal("Failed to find archive:", err)
+		}
+	}
+
+	var store audit.ArchiveStore
+	if strings.HasPrefix(location, "s3://") {
+		s3Store, err := audit.NewS3Store("", "", cfg.AWSRegion, cfg.ArchiveEndpoint)
+		if err != nil {
+			log.Fatal("Failed to open S3:", err)
+		}
+		store = s3Store
+	} else {
+		store = &audit.LocalStore{}
+	}
+	data, err := store.Get(location)
+	if err != nil {
+		log.Fatal("Failed to read archive:", err)
+	}
+
+	keys, err := audit.ArchiveKeys(db)
+	if err != nil {
+		log.Fatal("Failed to load archive keys:", err)
+	}
+	manifest, entries, err := audit.ReadArchive(data, keys, trusted)
+	if err != nil {
+		log.Fatal("Archive failed verification: ", err)
+	}
+	restored, err := audit.Restore(db, manifest, entries)
+	if err != nil {
+		log.Fatal("Failed to restore archive:", err)
+	}
+
+	out, _ := json.MarshalIndent(map[string]interface{}{
+		"archive":  manifest,
+		"restored": restored,
+	}, "", "  ")
+	fmt.Println(string(out))
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"log"
-	
+	"os"
+	"os/signal"
+	"syscall"
 
 	"idam-pam-platform/internal/config"
 	"idam-pam-platform/internal/database"
@@ -33,11 +35,27 @@ func main() {
 	}
 
 	// Start server
-	srv := server.New(cfg, db)
+	srv, err := server.New(cfg, db)
+	if err != nil {
+		log.Fatal("Failed to initialize server:", err)
+	}
+
+	// Shut down on SIGINT/SIGTERM so queued audit events are flushed
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+		if err := srv.Shutdown(cfg.ShutdownTimeout); err != nil {
+			log.Println("Shutdown failed:", err)
+		}
+		close(stopped)
+	}()
+
 	log.Printf("Server starting on port %s", cfg.Port)
-	log.Fatal(srv.Listen(":" + cfg.Port))
+	if err := srv.Listen(":" + cfg.Port); err != nil {
+		log.Fatal(err)
+	}
+	<-stopped
 }
-
-// roles : psql -h localhost -p 5432 -U postgres -d idam_pam -c "SELECT id, name FROM roles;"
-//  7XVM2OYSH7EJVGIDJDB73TWFM7LKCHPC : Mkm
-// 2PAZXCEQMUQKYKWAMIJHAF3E3HCKHJPU : admin
\ No newline at end of file
@@ -0,0 +1,299 @@
+package alerts
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+
+	"github.com/google/uuid"
+)
+
+// Alert is a rule firing. Seq is the audit entry that set it off.
+type Alert struct {
+	ID             uuid.UUID       `json:"id"`
+	RuleID         *uuid.UUID      `json:"rule_id"`
+	RuleName       string          `json:"rule_name"`
+	Severity       string          `json:"severity"`
+	Summary        string          `json:"summary"`
+	GroupKey       string          `json:"group_key,omitempty"`
+	Seq            int64           `json:"seq"`
+	Details        json.RawMessage `json:"details"`
+	Status         string          `json:"status"`
+	EventAt        time.Time       `json:"event_at"`
+	CreatedAt      time.Time       `json:"created_at"`
+	AcknowledgedBy *uuid.UUID      `json:"acknowledged_by"`
+	AcknowledgedAt *time.Time      `json:"acknowledged_at"`
+	ResolvedBy     *uuid.UUID      `json:"resolved_by"`
+	ResolvedAt     *time.Time      `json:"resolved_at"`
+}
+
+// Engine evaluates the enabled rules against audit entries. It is fed as
+// an audit sink, so it sees every entry once in order, picks up where it
+// left off after a restart, and retries a batch it failed on. Rules are
+// read on every batch, so changes apply without a restart.
+type Engine struct {
+	db        *sql.DB
+	notifiers map[string]bool
+}
+
+// NewEngine takes the names of the configured notifiers; an alert is
+// queued for those its rule lists, or all of them when it lists none.
+func NewEngine(db *sql.DB, notifiers []Notifier) *Engine {
+	names := make(map[string]bool, len(notifiers))
+	for _, n := range notifiers {
+		names[n.Name()] = true
+	}
+	return &Engine{db: db, notifiers: names}
+}
+
+func (e *Engine) Name() string {
+	return "alerts"
+}
+
+func (e *Engine) Close() error {
+	return nil
+}
+
+// Send evaluates records. A batch is only retried when the database
+// fails, and alerts are unique per rule and entry, so a retry does not
+// raise any alert twice.
+func (e *Engine) Send(records []audit.Record) error {
+	rules, err := LoadRules(e.db, true)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	for _, r := range records {
+		for i := range rules {
+			rule := &rules[i]
+			if !rule.matches(r.Action, r.Details) {
+				continue
+			}
+			if err := e.evaluate(rule, r); err != nil {
+				return fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (e *Engine) evaluate(rule *Rule, r audit.Record) error {
+	switch rule.Type {
+	case TypeMatch:
+		return e.raise(rule, r, "", fmt.Sprintf("%s by %s", r.Action, actor(r)), nil)
+
+	case TypeOffHours:
+		if !rule.offHours(r.CreatedAt) {
+			return nil
+		}
+		return e.raise(rule, r, "", fmt.Sprintf("%s by %s outside business hours (%s)",
+			r.Action, actor(r), r.CreatedAt.In(rule.location).Format("Mon 15:04 MST")), nil)
+
+	case TypeThreshold:
+		key := groupKey(rule.Params.GroupBy, r)
+		if key == "" {
+			return nil
+		}
+		window := time.Duration(rule.Params.WindowMinutes) * time.Minute
+
+		// One alert per key per window, however long the burst goes on
+		var raised bool
+		if err := e.db.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM alerts
+				WHERE rule_id = $1 AND group_key = $2 AND event_at > $3
+			)`,
+			rule.ID, key, r.CreatedAt.Add(-window),
+		).Scan(&raised); err != nil {
+			return err
+		}
+		if raised {
+			return nil
+		}
+
+		count, err := e.count(rule, r, key, window)
+		if err != nil {
+			return err
+		}
+		if count < rule.Params.Count {
+			return nil
+		}
+		return e.raise(rule, r, key, fmt.Sprintf("%d %s for %s %s within %d minutes",
+			count, r.Action, rule.Params.GroupBy, key, rule.Params.WindowMinutes),
+			map[string]interface{}{"count": count})
+	}
+	return nil
+}
+
+// count counts the entries matching rule for key in the window ending at
+// r, r included.
+func (e *Engine) count(rule *Rule, r audit.Record, key string, window time.Duration) (int, error) {
+	args := []interface{}{r.Seq, r.CreatedAt.Add(-window), r.CreatedAt, key}
+	actionCond := "a.action = $5"
+	if prefix, ok := strings.CutSuffix(rule.Action, "*"); ok {
+		actionCond = "starts_with(a.action, $5)"
+		args = append(args, prefix)
+	} else {
+		args = append(args, rule.Action)
+	}
+	matchCond := ""
+	if len(rule.Match) > 0 {
+		match, _ := json.Marshal(rule.Match)
+		args = append(args, string(match))
+		matchCond = " AND a.details @> $6::jsonb"
+	}
+
+	var count int
+	err := e.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM audit_logs a
+		LEFT JOIN users u ON a.user_id = u.id
+		WHERE a.seq <= $1 AND a.created_at > $2 AND a.created_at <= $3
+		  AND `+groupColumns[rule.Params.GroupBy]+` = $4
+		  AND `+actionCond+matchCond,
+		args...,
+	).Scan(&count)
+	return count, err
+}
+
+// raise records an alert and queues its notifications.
+func (e *Engine) raise(rule *Rule, r audit.Record, key, summary string, extra map[string]interface{}) error {
+	details := map[string]interface{}{"entry": r}
+	for k, v := range extra {
+		details[k] = v
+	}
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var alertID uuid.UUID
+	err = tx.QueryRow(`
+		INSERT INTO alerts (rule_id, rule_name, severity, summary, group_key, seq, details, event_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8)
+		ON CONFLICT (rule_id, seq) DO NOTHING
+		RETURNING id`,
+		rule.ID, rule.Name, rule.Severity, summary, key, r.Seq, string(encoded), r.CreatedAt,
+	).Scan(&alertID)
+	if err == sql.ErrNoRows {
+		// Raised already, before a retry
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for name := range e.notifiers {
+		if len(rule.Notify) > 0 && !contains(rule.Notify, name) {
+			continue
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO alert_notifications (alert_id, notifier)
+			VALUES ($1, $2)`,
+			alertID, name,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetAlert loads one alert.
+func GetAlert(db *sql.DB, id uuid.UUID) (*Alert, error) {
+	return scanAlert(db.QueryRow(alertSelect+` WHERE id = $1`, id))
+}
+
+const alertSelect = `
+	SELECT id, rule_id, rule_name, severity, summary, COALESCE(group_key, ''), seq, details, status,
+	       event_at, created_at, acknowledged_by, acknowledged_at, resolved_by, resolved_at
+	FROM alerts`
+
+// ListAlerts returns alerts newest first, optionally with one status.
+func ListAlerts(db *sql.DB, status string, limit int) ([]Alert, error) {
+	rows, err := db.Query(alertSelect+`
+		WHERE $1 = '' OR status = $1
+		ORDER BY created_at DESC
+		LIMIT $2`,
+		status, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, *a)
+	}
+	return alerts, rows.Err()
+}
+
+func scanAlert(row scanner) (*Alert, error) {
+	var (
+		a       Alert
+		details []byte
+	)
+	if err := row.Scan(&a.ID, &a.RuleID, &a.RuleName, &a.Severity, &a.Summary, &a.GroupKey, &a.Seq, &details,
+		&a.Status, &a.EventAt, &a.CreatedAt, &a.AcknowledgedBy, &a.AcknowledgedAt, &a.ResolvedBy, &a.ResolvedAt); err != nil {
+		return nil, err
+	}
+	a.Details = json.RawMessage(details)
+	return &a, nil
+}
+
+func groupKey(groupBy string, r audit.Record) string {
+	switch groupBy {
+	case "username":
+		if r.Username != "" {
+			return r.Username
+		}
+		var details struct {
+			Username string `json:"username"`
+		}
+		json.Unmarshal(r.Details, &details)
+		return details.Username
+	case "user_id":
+		if r.UserID != nil {
+			return r.UserID.String()
+		}
+	case "ip_address":
+		return r.IPAddress
+	}
+	return ""
+}
+
+func actor(r audit.Record) string {
+	if r.Username != "" {
+		return r.Username
+	}
+	if r.UserID != nil {
+		return r.UserID.String()
+	}
+	return "the platform"
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
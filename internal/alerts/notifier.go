@@ -0,0 +1,299 @@
+package alerts
+
+import (
+	"bytes"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/config"
+	"idam-pam-platform/internal/siem"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	// notifyTimeout bounds one delivery through one notifier
+	notifyTimeout = 10 * time.Second
+	// claimLease is how long a claimed notification is left to the
+	// deliverer that took it before another may try it
+	claimLease = 5 * time.Minute
+	// deliverBatch is the most notifications sent in one pass
+	deliverBatch = 100
+)
+
+// Notifier tells someone about an alert.
+type Notifier interface {
+	Name() string
+	Notify(a *Alert) error
+}
+
+// NewNotifiers builds a notifier for every destination configured.
+func NewNotifiers(cfg *config.Config) ([]Notifier, error) {
+	var notifiers []Notifier
+	if cfg.AlertWebhookURL != "" {
+		n, err := NewWebhookNotifier(cfg.AlertWebhookURL, cfg.AlertWebhookKey)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	if cfg.AlertSMTPAddr != "" {
+		n, err := NewSMTPNotifier(cfg.AlertSMTPAddr, cfg.AlertSMTPFrom, cfg.AlertSMTPTo)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+// WebhookNotifier POSTs each alert as JSON. With a secret, requests carry
+// X-Alert-Timestamp and X-Alert-Signature: sha256=<hex HMAC-SHA256 of
+// "<timestamp>.<body>">.
+type WebhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhookNotifier requires an https URL, except on loopback.
+func NewWebhookNotifier(rawURL, secret string) (*WebhookNotifier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alert webhook URL: %w", err)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && siem.IsLoopback(u.Hostname())) {
+		return nil, fmt.Errorf("alert webhook URL must use https")
+	}
+	return &WebhookNotifier{
+		url:    rawURL,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: notifyTimeout},
+	}, nil
+}
+
+func (w *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (w *WebhookNotifier) Notify(a *Alert) error {
+	body, err := json.Marshal(map[string]*Alert{"alert": a})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Alert-Timestamp", timestamp)
+		req.Header.Set("X-Alert-Signature", siem.Sign(w.secret, timestamp, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// SMTPNotifier mails alerts through a relay, normally one on the local
+// host. It does not authenticate; STARTTLS is used when the relay offers
+// it.
+type SMTPNotifier struct {
+	addr string
+	from string
+	to   []string
+}
+
+// NewSMTPNotifier takes the relay as host:port and a comma-separated
+// recipient list.
+func NewSMTPNotifier(addr, from, to string) (*SMTPNotifier, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("alert SMTP address must be host:port")
+	}
+	var recipients []string
+	for _, r := range strings.Split(to, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			recipients = append(recipients, r)
+		}
+	}
+	if from == "" || len(recipients) == 0 {
+		return nil, fmt.Errorf("alert SMTP needs a sender and at least one recipient")
+	}
+	return &SMTPNotifier{addr: addr, from: from, to: recipients}, nil
+}
+
+func (s *SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+func (s *SMTPNotifier) Notify(a *Alert) error {
+	details, _ := json.MarshalIndent(a.Details, "", "  ")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", headerSafe(fmt.Sprintf("[IDAM-PAM %s] %s", strings.ToUpper(a.Severity), a.RuleName)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@idam-pam>\r\n", a.ID)
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n", a.Summary)
+	fmt.Fprintf(&msg, "Alert:    %s\r\nRule:     %s\r\nSeverity: %s\r\nEntry:    %d\r\nAt:       %s\r\n\r\n",
+		a.ID, a.RuleName, a.Severity, a.Seq, a.EventAt.UTC().Format(time.RFC3339))
+	msg.Write(bytes.ReplaceAll(details, []byte("\n"), []byte("\r\n")))
+	msg.WriteString("\r\n")
+
+	return s.send(msg.Bytes())
+}
+
+// send is smtp.SendMail without authentication, under notifyTimeout so a
+// relay that stops answering cannot hold up the deliverer.
+func (s *SMTPNotifier) send(msg []byte) error {
+	host, _, _ := net.SplitHostPort(s.addr)
+	conn, err := net.DialTimeout("tcp", s.addr, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Deliverer sends queued notifications. Each notifier's delivery of an
+// alert is tracked separately, so one failing does not resend through
+// the others.
+type Deliverer struct {
+	db          *sql.DB
+	notifiers   map[string]Notifier
+	maxAttempts int
+}
+
+func NewDeliverer(db *sql.DB, notifiers []Notifier, maxAttempts int) *Deliverer {
+	byName := make(map[string]Notifier, len(notifiers))
+	for _, n := range notifiers {
+		byName[n.Name()] = n
+	}
+	return &Deliverer{db: db, notifiers: byName, maxAttempts: maxAttempts}
+}
+
+// Deliver sends every pending notification that is due. Each is claimed
+// before it is sent, so deliverers on several instances never send the
+// same one twice. A failed one is tried again after a delay that doubles
+// with each attempt, and given up on after maxAttempts.
+func (d *Deliverer) Deliver() error {
+	names := make([]string, 0, len(d.notifiers))
+	for name := range d.notifiers {
+		names = append(names, name)
+	}
+
+	for i := 0; i < deliverBatch; i++ {
+		var (
+			id, alertID uuid.UUID
+			notifier    string
+			attempts    int
+		)
+		err := d.db.QueryRow(`
+			UPDATE alert_notifications
+			SET next_attempt_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second'
+			WHERE id = (
+				SELECT id FROM alert_notifications
+				WHERE sent_at IS NULL AND attempts < $1 AND next_attempt_at <= CURRENT_TIMESTAMP
+				  AND notifier = ANY($2)
+				ORDER BY created_at
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, alert_id, notifier, attempts`,
+			d.maxAttempts, pq.Array(names), claimLease.Seconds(),
+		).Scan(&id, &alertID, &notifier, &attempts)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		alert, err := GetAlert(d.db, alertID)
+		if err != nil {
+			return err
+		}
+
+		if err := d.notifiers[notifier].Notify(alert); err != nil {
+			delay := time.Duration(1<<attempts) * time.Minute
+			if _, err := d.db.Exec(`
+				UPDATE alert_notifications
+				SET attempts = attempts + 1, last_error = $2, next_attempt_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second'
+				WHERE id = $1`,
+				id, err.Error(), delay.Seconds(),
+			); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := d.db.Exec(`
+			UPDATE alert_notifications
+			SET attempts = attempts + 1, last_error = NULL, sent_at = CURRENT_TIMESTAMP
+			WHERE id = $1`,
+			id,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// headerSafe keeps a value on one header line.
+func headerSafe(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,253 @@
+// Package alerts evaluates security rules against the audit log and
+// raises alerts, which are handed to notifiers.
+package alerts
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	// Time zones for off-hours rules, whether or not the host has them
+	_ "time/tzdata"
+
+	"github.com/google/uuid"
+)
+
+// Rule types.
+const (
+	// TypeMatch fires on every entry the rule matches.
+	TypeMatch = "match"
+	// TypeThreshold fires when Count matching entries with the same GroupBy
+	// value fall within WindowMinutes of each other.
+	TypeThreshold = "threshold"
+	// TypeOffHours fires on matching entries outside business hours.
+	TypeOffHours = "off_hours"
+)
+
+var severities = map[string]bool{"low": true, "medium": true, "high": true, "critical": true}
+
+// groupColumns are what a threshold rule may count by, as SQL over
+// audit_logs a joined to users u. An unknown user's failed logins only
+// carry the username in their details.
+var groupColumns = map[string]string{
+	"username":   "COALESCE(u.username, a.details->>'username')",
+	"user_id":    "a.user_id::text",
+	"ip_address": "host(a.ip_address)",
+}
+
+// Rule is one alerting rule. Action is an exact action or a prefix ending
+// in "*"; Match, when set, must be contained in the entry's details.
+type Rule struct {
+	ID          uuid.UUID              `json:"id"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Type        string                 `json:"type"`
+	Action      string                 `json:"action"`
+	Match       map[string]interface{} `json:"match,omitempty"`
+	Params      Params                 `json:"params"`
+	Severity    string                 `json:"severity"`
+	Notify      []string               `json:"notify"`
+	Enabled     bool                   `json:"enabled"`
+	CreatedAt   time.Time              `json:"created_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+
+	location *time.Location
+}
+
+// Params holds the settings of threshold and off-hours rules.
+type Params struct {
+	Count         int    `json:"count,omitempty"`
+	WindowMinutes int    `json:"window_minutes,omitempty"`
+	GroupBy       string `json:"group_by,omitempty"`
+
+	Timezone string `json:"timezone,omitempty"`
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	// Weekdays are business days, 0 for Sunday to 6 for Saturday
+	Weekdays []int `json:"weekdays,omitempty"`
+}
+
+// Validate checks r and fills in defaults.
+func (r *Rule) Validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" || len(r.Name) > 255 {
+		return errors.New("name is required")
+	}
+	r.Action = strings.TrimSpace(r.Action)
+	if r.Action == "" || strings.Contains(strings.TrimSuffix(r.Action, "*"), "*") {
+		return errors.New(`action must be an action name, optionally ending in "*"`)
+	}
+	if r.Severity == "" {
+		r.Severity = "medium"
+	}
+	if !severities[r.Severity] {
+		return errors.New("severity must be low, medium, high or critical")
+	}
+	if r.Notify == nil {
+		r.Notify = []string{}
+	}
+
+	p := &r.Params
+	switch r.Type {
+	case TypeMatch:
+		r.Params = Params{}
+	case TypeThreshold:
+		if p.Count < 2 {
+			return errors.New("threshold rules need a count of at least 2")
+		}
+		if p.WindowMinutes < 1 {
+			return errors.New("threshold rules need window_minutes of at least 1")
+		}
+		if _, ok := groupColumns[p.GroupBy]; !ok {
+			return errors.New("group_by must be username, user_id or ip_address")
+		}
+		*p = Params{Count: p.Count, WindowMinutes: p.WindowMinutes, GroupBy: p.GroupBy}
+	case TypeOffHours:
+		if p.Timezone == "" {
+			p.Timezone = "UTC"
+		}
+		if _, err := time.LoadLocation(p.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", p.Timezone)
+		}
+		start, err := clock(p.Start)
+		if err != nil {
+			return errors.New("start must be HH:MM")
+		}
+		end, err := clock(p.End)
+		if err != nil || end <= start {
+			return errors.New("end must be HH:MM and after start")
+		}
+		if p.Weekdays == nil {
+			p.Weekdays = []int{1, 2, 3, 4, 5}
+		}
+		for _, d := range p.Weekdays {
+			if d < 0 || d > 6 {
+				return errors.New("weekdays must be 0 (Sunday) to 6 (Saturday)")
+			}
+		}
+		*p = Params{Timezone: p.Timezone, Start: p.Start, End: p.End, Weekdays: p.Weekdays}
+	default:
+		return errors.New("type must be match, threshold or off_hours")
+	}
+	return nil
+}
+
+// matches reports whether the rule covers an entry with this action and
+// details.
+func (r *Rule) matches(action string, details json.RawMessage) bool {
+	if prefix, ok := strings.CutSuffix(r.Action, "*"); ok {
+		if !strings.HasPrefix(action, prefix) {
+			return false
+		}
+	} else if action != r.Action {
+		return false
+	}
+	if len(r.Match) == 0 {
+		return true
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(details, &got); err != nil {
+		return false
+	}
+	for key, want := range r.Match {
+		if !sameJSON(got[key], want) {
+			return false
+		}
+	}
+	return true
+}
+
+// offHours reports whether t falls outside the rule's business hours.
+func (r *Rule) offHours(t time.Time) bool {
+	local := t.In(r.location)
+	business := false
+	for _, d := range r.Params.Weekdays {
+		if int(local.Weekday()) == d {
+			business = true
+		}
+	}
+	if !business {
+		return true
+	}
+	start, _ := clock(r.Params.Start)
+	end, _ := clock(r.Params.End)
+	now := local.Hour()*60 + local.Minute()
+	return now < start || now >= end
+}
+
+// LoadRules returns every rule, or only enabled ones.
+func LoadRules(db *sql.DB, enabledOnly bool) ([]Rule, error) {
+	rows, err := db.Query(`
+		SELECT id, name, description, type, action, match, params, severity, notify, enabled, created_at, updated_at
+		FROM alert_rules
+		WHERE enabled OR NOT $1
+		ORDER BY name`,
+		enabledOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []Rule{}
+	for rows.Next() {
+		r, err := scanRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *r)
+	}
+	return rules, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRule(row scanner) (*Rule, error) {
+	var (
+		r                     Rule
+		match, params, notify []byte
+	)
+	if err := row.Scan(&r.ID, &r.Name, &r.Description, &r.Type, &r.Action, &match, &params, &r.Severity,
+		&notify, &r.Enabled, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if len(match) > 0 {
+		if err := json.Unmarshal(match, &r.Match); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(params, &r.Params); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(notify, &r.Notify); err != nil {
+		return nil, err
+	}
+	r.location = time.UTC
+	if r.Params.Timezone != "" {
+		if loc, err := time.LoadLocation(r.Params.Timezone); err == nil {
+			r.location = loc
+		}
+	}
+	return &r, nil
+}
+
+// clock parses HH:MM into minutes after midnight.
+func clock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func sameJSON(a, b interface{}) bool {
+	ea, _ := json.Marshal(a)
+	eb, _ := json.Marshal(b)
+	return string(ea) == string(eb)
+}
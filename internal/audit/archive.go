@@ -0,0 +1,419 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// timestampLayout is how created_at is hashed and archived.
+const timestampLayout = "2006-01-02T15:04:05.000000"
+
+// ArchivedEntry is an audit_logs row as written to an archive: every
+// column in the form it was hashed in, so the entry can be checked
+// against its hash after it has left the database.
+type ArchivedEntry struct {
+	Seq        int64      `json:"seq"`
+	ID         uuid.UUID  `json:"id"`
+	UserID     *uuid.UUID `json:"user_id"`
+	Action     string     `json:"action"`
+	Resource   string     `json:"resource"`
+	ResourceID *uuid.UUID `json:"resource_id"`
+	Details    *string    `json:"details"`
+	IPAddress  *string    `json:"ip_address"`
+	UserAgent  *string    `json:"user_agent"`
+	CreatedAt  string     `json:"created_at"`
+	PrevHash   string     `json:"prev_hash"`
+	Hash       string     `json:"hash"`
+}
+
+// Manifest is the last line of an archive. Its signature, by the
+// checkpoint key, covers the SHA-256 of every line before it.
+type Manifest struct {
+	ID        uuid.UUID `json:"id"`
+	FirstSeq  int64     `json:"first_seq"`
+	LastSeq   int64     `json:"last_seq"`
+	Entries   int       `json:"entries"`
+	SHA256    string    `json:"sha256"`
+	KeyID     uuid.UUID `json:"key_id"`
+	PublicKey string    `json:"public_key"`
+	Signature string    `json:"signature"`
+	CreatedAt time.Time `json:"created_at"`
+	Location  string    `json:"location,omitempty"`
+}
+
+// Archiver moves audit entries past their retention period into signed,
+// gzipped NDJSON files and then purges them. An entry is kept while no
+// retention rule matches its action, while a legal hold covers its user
+// or resource, and while it is the chain head. Each purged entry leaves a
+// tombstone with its seq and hashes, so the chain still verifies.
+type Archiver struct {
+	db           *sql.DB
+	store        ArchiveStore
+	checkpointer *Checkpointer
+	batchSize    int
+}
+
+func NewArchiver(db *sql.DB, store ArchiveStore, checkpointer *Checkpointer, batchSize int) *Archiver {
+	return &Archiver{
+		db:           db,
+		store:        store,
+		checkpointer: checkpointer,
+		batchSize:    batchSize,
+	}
+}
+
+// Archive writes one archive of up to batchSize expired entries and purges
+// them. It returns nil when nothing has expired.
+func (a *Archiver) Archive() (*Manifest, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Legal holds take this lock too, so a hold placed while an archive is
+	// being written waits for it rather than missing it
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('audit_archive'))`); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT a.seq, a.id, a.user_id, a.action, a.resource, a.resource_id, a.details::text, a.ip_address::text,
+		       a.user_agent, a.created_at, COALESCE(a.prev_hash, ''), COALESCE(a.hash, '')
+		FROM audit_logs a
+		CROSS JOIN LATERAL (
+			SELECT r.retention_days
+			FROM audit_retention_rules r
+			WHERE r.action = a.action
+			   OR (r.action LIKE '%*' AND starts_with(a.action, rtrim(r.action, '*')))
+			ORDER BY r.action = a.action DESC, length(r.action) DESC
+			LIMIT 1
+		) rule
+		WHERE a.created_at < CURRENT_TIMESTAMP - make_interval(days => (SELECT MIN(retention_days) FROM audit_retention_rules))
+		  AND a.created_at < CURRENT_TIMESTAMP - make_interval(days => rule.retention_days)
+		  AND a.seq < (SELECT MAX(seq) FROM audit_logs)
+		  AND NOT EXISTS (
+			SELECT 1 FROM audit_legal_holds h
+			WHERE h.released_at IS NULL
+			  AND (h.user_id = a.user_id OR h.resource_id = a.resource_id)
+		  )
+		ORDER BY a.seq
+		LIMIT $1`,
+		a.batchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ArchivedEntry
+	for rows.Next() {
+		var l link
+		if err := rows.Scan(&l.Seq, &l.ID, &l.UserID, &l.Action, &l.Resource, &l.ResourceID, &l.Details,
+			&l.IPAddress, &l.UserAgent, &l.CreatedAt, &l.PrevHash, &l.Hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, l.archived())
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	m := &Manifest{
+		ID:        uuid.New(),
+		FirstSeq:  entries[0].Seq,
+		LastSeq:   entries[len(entries)-1].Seq,
+		Entries:   len(entries),
+		KeyID:     a.checkpointer.keyID,
+		PublicKey: base64.StdEncoding.EncodeToString(a.checkpointer.signer.Public().(ed25519.PublicKey)),
+		CreatedAt: time.Now().UTC(),
+	}
+	data, err := writeArchive(entries, m, a.checkpointer.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("audit-%020d-%020d-%s.ndjson.gz", m.FirstSeq, m.LastSeq, m.ID)
+	if m.Location, err = a.store.Put(name, data); err != nil {
+		return nil, fmt.Errorf("failed to store audit archive: %v", err)
+	}
+
+	// Only once the archive is safely stored are the entries purged
+	if _, err := tx.Exec(`
+		INSERT INTO audit_archives (id, location, first_seq, last_seq, entries, sha256, key_id, signature, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		m.ID, m.Location, m.FirstSeq, m.LastSeq, m.Entries, m.SHA256, m.KeyID, m.Signature, m.CreatedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	var seqs []int64
+	var tombSeqs []int64
+	var prevHashes, hashes []string
+	for _, e := range entries {
+		seqs = append(seqs, e.Seq)
+		if e.Hash != "" {
+			tombSeqs = append(tombSeqs, e.Seq)
+			prevHashes = append(prevHashes, e.PrevHash)
+			hashes = append(hashes, e.Hash)
+		}
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO audit_tombstones (seq, prev_hash, hash, archive_id)
+		SELECT t.seq, t.prev_hash, t.hash, $4
+		FROM unnest($1::bigint[], $2::text[], $3::text[]) AS t(seq, prev_hash, hash)`,
+		pq.Array(tombSeqs), pq.Array(prevHashes), pq.Array(hashes), m.ID,
+	); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM audit_logs WHERE seq = ANY($1)`, pq.Array(seqs)); err != nil {
+		return nil, err
+	}
+
+	return m, tx.Commit()
+}
+
+// writeArchive renders entries as gzipped NDJSON with the signed manifest
+// as the final line, filling in the manifest's digest and signature.
+func writeArchive(entries []ArchivedEntry, m *Manifest, signer ed25519.PrivateKey) ([]byte, error) {
+	var body bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	digest := sha256.Sum256(body.Bytes())
+	m.SHA256 = hex.EncodeToString(digest[:])
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signer, archiveMessage(m)))
+
+	trailer, err := json.Marshal(map[string]*Manifest{"manifest": m})
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	gz := gzip.NewWriter(&out)
+	gz.Write(body.Bytes())
+	gz.Write(trailer)
+	gz.Write([]byte{'\n'})
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// ReadArchive checks an archive file and returns its entries. The
+// manifest signature must verify with the key it names, which must be
+// one of trusted when that is not empty, and every chained entry must
+// match its own hash.
+func ReadArchive(data []byte, keys map[uuid.UUID]ed25519.PublicKey, trusted []ed25519.PublicKey) (*Manifest, []ArchivedEntry, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("archive is not gzip: %v", err)
+	}
+	defer gz.Close()
+
+	var (
+		lines   [][]byte
+		scanner = bufio.NewScanner(gz)
+	)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil, errors.New("archive is empty")
+	}
+
+	var trailer struct {
+		Manifest *Manifest `json:"manifest"`
+	}
+	if err := json.Unmarshal(lines[len(lines)-1], &trailer); err != nil || trailer.Manifest == nil {
+		return nil, nil, errors.New("archive has no manifest")
+	}
+	m := trailer.Manifest
+	lines = lines[:len(lines)-1]
+
+	public, ok := keys[m.KeyID]
+	if !ok {
+		// Offline, the manifest's own key is only good enough if pinned
+		encoded, err := base64.StdEncoding.DecodeString(m.PublicKey)
+		if err != nil || len(encoded) != ed25519.PublicKeySize || len(trusted) == 0 {
+			return nil, nil, fmt.Errorf("archive is signed by unknown key %s", m.KeyID)
+		}
+		public = ed25519.PublicKey(encoded)
+	}
+	if len(trusted) > 0 && !isTrusted(public, trusted) {
+		return nil, nil, fmt.Errorf("archive is signed by untrusted key %s", m.KeyID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil || !ed25519.Verify(public, archiveMessage(m), signature) {
+		return nil, nil, errors.New("archive manifest has an invalid signature")
+	}
+
+	digest := sha256.New()
+	entries := make([]ArchivedEntry, 0, len(lines))
+	for _, line := range lines {
+		digest.Write(line)
+		digest.Write([]byte{'\n'})
+
+		var e ArchivedEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, nil, fmt.Errorf("invalid archive entry: %v", err)
+		}
+		if e.Hash != "" {
+			l, err := e.link()
+			if err != nil {
+				return nil, nil, err
+			}
+			if l.sum() != e.Hash {
+				return nil, nil, fmt.Errorf("archived entry %d was modified", e.Seq)
+			}
+		}
+		entries = append(entries, e)
+	}
+	if hex.EncodeToString(digest.Sum(nil)) != m.SHA256 {
+		return nil, nil, errors.New("archive contents do not match the manifest")
+	}
+	if len(entries) != m.Entries {
+		return nil, nil, errors.New("archive entry count does not match the manifest")
+	}
+	return m, entries, nil
+}
+
+// Restore loads a checked archive into audit_restored for investigation.
+// The live log is left alone. Where the purge left tombstones, chained
+// entries must match them, so an archive cannot stand in for other
+// entries. Restoring the same archive twice is harmless.
+func Restore(db *sql.DB, m *Manifest, entries []ArchivedEntry) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	restored := 0
+	for _, e := range entries {
+		if e.Hash != "" {
+			var hash string
+			err := tx.QueryRow(`SELECT hash FROM audit_tombstones WHERE seq = $1`, e.Seq).Scan(&hash)
+			if err != nil && err != sql.ErrNoRows {
+				return 0, err
+			}
+			if err == nil && hash != e.Hash {
+				return 0, fmt.Errorf("archived entry %d does not match its tombstone", e.Seq)
+			}
+		}
+
+		result, err := tx.Exec(`
+			INSERT INTO audit_restored (seq, id, user_id, action, resource, resource_id, details, ip_address,
+			                            user_agent, created_at, prev_hash, hash, archive_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), NULLIF($12, ''), $13)
+			ON CONFLICT (seq) DO NOTHING`,
+			e.Seq, e.ID, e.UserID, e.Action, e.Resource, e.ResourceID, e.Details, e.IPAddress,
+			e.UserAgent, e.CreatedAt, e.PrevHash, e.Hash, m.ID,
+		)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := result.RowsAffected()
+		restored += int(n)
+	}
+	return restored, tx.Commit()
+}
+
+// ArchiveLocation looks up where an archive was stored.
+func ArchiveLocation(db *sql.DB, id uuid.UUID) (string, error) {
+	var location string
+	err := db.QueryRow(`SELECT location FROM audit_archives WHERE id = $1`, id).Scan(&location)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return location, err
+}
+
+// ArchiveKeys returns the checkpoint public keys archives may be signed
+// with.
+func ArchiveKeys(db *sql.DB) (map[uuid.UUID]ed25519.PublicKey, error) {
+	return loadCheckpointKeys(db)
+}
+
+// archiveMessage is what an archive signature covers.
+func archiveMessage(m *Manifest) []byte {
+	return []byte(fmt.Sprintf("idam-pam audit archive %s %d %d %d %s", m.ID, m.FirstSeq, m.LastSeq, m.Entries, m.SHA256))
+}
+
+func (l *link) archived() ArchivedEntry {
+	return ArchivedEntry{
+		Seq:        l.Seq,
+		ID:         l.ID,
+		UserID:     l.UserID,
+		Action:     l.Action,
+		Resource:   l.Resource,
+		ResourceID: l.ResourceID,
+		Details:    nullString(l.Details),
+		IPAddress:  nullString(l.IPAddress),
+		UserAgent:  nullString(l.UserAgent),
+		CreatedAt:  l.CreatedAt.Format(timestampLayout),
+		PrevHash:   l.PrevHash,
+		Hash:       l.Hash,
+	}
+}
+
+func (e *ArchivedEntry) link() (*link, error) {
+	createdAt, err := time.Parse(timestampLayout, e.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("archived entry %d has an invalid timestamp", e.Seq)
+	}
+	return &link{
+		Seq:        e.Seq,
+		PrevHash:   e.PrevHash,
+		ID:         e.ID,
+		UserID:     e.UserID,
+		Action:     e.Action,
+		Resource:   e.Resource,
+		ResourceID: e.ResourceID,
+		Details:    fromPointer(e.Details),
+		IPAddress:  fromPointer(e.IPAddress),
+		UserAgent:  fromPointer(e.UserAgent),
+		CreatedAt:  createdAt,
+		Hash:       e.Hash,
+	}, nil
+}
+
+func nullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func fromPointer(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
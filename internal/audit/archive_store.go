@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ArchiveStore keeps archive files. Put returns the location the file can
+// be read back from, which is what audit_archives records.
+type ArchiveStore interface {
+	Put(name string, data []byte) (string, error)
+	Get(location string) ([]byte, error)
+}
+
+// ArchiveConfig picks where archives go: an S3 bucket when Bucket is set,
+// otherwise Dir on local disk.
+type ArchiveConfig struct {
+	Dir      string
+	Bucket   string
+	Prefix   string
+	Region   string
+	Endpoint string
+}
+
+// NewArchiveStore returns nil when no destination is configured, which
+// leaves archival and purging off.
+func NewArchiveStore(cfg ArchiveConfig) (ArchiveStore, error) {
+	if cfg.Bucket != "" {
+		return NewS3Store(cfg.Bucket, cfg.Prefix, cfg.Region, cfg.Endpoint)
+	}
+	if cfg.Dir != "" {
+		return NewLocalStore(cfg.Dir)
+	}
+	return nil, nil
+}
+
+// LocalStore writes archives to a directory only the platform can read.
+type LocalStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create audit archive directory: %v", err)
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+// Put writes the file under a temporary name first, so a crash never
+// leaves a partial archive behind under the real one.
+func (s *LocalStore) Put(name string, data []byte) (string, error) {
+	target := filepath.Join(s.dir, name)
+	tmp, err := os.CreateTemp(s.dir, ".tmp-"+name)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: target}).String(), nil
+}
+
+func (s *LocalStore) Get(location string) ([]byte, error) {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "file" && u.Scheme != "") {
+		return nil, fmt.Errorf("not a local archive: %s", location)
+	}
+	return os.ReadFile(u.Path)
+}
+
+// S3Store writes archives to an S3 bucket. Set endpoint to use an
+// S3-compatible store such as MinIO.
+type S3Store struct {
+	client *s3.S3
+	bucket string
+	prefix string
+}
+
+func NewS3Store(bucket, prefix, region, endpoint string) (*S3Store, error) {
+	awsConfig := &aws.Config{Region: aws.String(region)}
+	if endpoint != "" {
+		// Most S3-compatible stores do not support virtual-hosted buckets
+		awsConfig.Endpoint = aws.String(endpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{
+		client: s3.New(sess),
+		bucket: bucket,
+		prefix: strings.Trim(prefix, "/"),
+	}, nil
+}
+
+func (s *S3Store) Put(name string, data []byte) (string, error) {
+	key := path.Join(s.prefix, name)
+	_, err := s.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/gzip"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return "s3://" + s.bucket + "/" + key, nil
+}
+
+func (s *S3Store) Get(location string) ([]byte, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "s3" {
+		return nil, fmt.Errorf("not an S3 archive: %s", location)
+	}
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
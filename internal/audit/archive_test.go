@@ -0,0 +1,204 @@
+package audit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func testLink(seq int64, prevHash string) link {
+	userID := uuid.MustParse("6f1c2a4e-8d3b-4f5a-9c7e-1b2d3e4f5a6b")
+	resourceID := uuid.MustParse("0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d")
+	l := link{
+		Seq:        seq,
+		PrevHash:   prevHash,
+		ID:         uuid.MustParse("11111111-2222-4333-8444-555555555555"),
+		UserID:     &userID,
+		Action:     "secrets.read",
+		Resource:   "secrets",
+		ResourceID: &resourceID,
+		Details:    sql.NullString{String: `{"path": "prod/db"}`, Valid: true},
+		IPAddress:  sql.NullString{String: "192.0.2.10", Valid: true},
+		CreatedAt:  time.Date(2024, 3, 1, 12, 30, 45, 123456000, time.UTC),
+	}
+	l.Hash = l.sum()
+	return l
+}
+
+// The hash is stored with every entry and checked long after it was
+// written, so its encoding must never change.
+func TestLinkSumIsStable(t *testing.T) {
+	l := testLink(42, "")
+	const want = "efa530f7423df623f7bb35a70b7d1ef2acc5f2fb7da822f5f0c57237a3fb818e"
+	if got := l.sum(); got != want {
+		t.Fatalf("sum() = %s, want %s", got, want)
+	}
+
+	l.Hash = "ignored"
+	if got := l.sum(); got != want {
+		t.Errorf("sum() depends on Hash: got %s", got)
+	}
+
+	l.UserID, l.ResourceID = nil, nil
+	l.Details, l.IPAddress, l.UserAgent = sql.NullString{}, sql.NullString{}, sql.NullString{}
+	if l.sum() == want {
+		t.Error("sum() ignores nullable columns")
+	}
+}
+
+func TestLinkSumCoversEveryColumn(t *testing.T) {
+	base := testLink(7, strings.Repeat("a", 64))
+	for name, change := range map[string]func(l *link){
+		"seq":        func(l *link) { l.Seq++ },
+		"prev_hash":  func(l *link) { l.PrevHash = strings.Repeat("b", 64) },
+		"id":         func(l *link) { l.ID = uuid.New() },
+		"user_id":    func(l *link) { l.UserID = nil },
+		"action":     func(l *link) { l.Action = "secrets.write" },
+		"resource":   func(l *link) { l.Resource = "folders" },
+		"details":    func(l *link) { l.Details.String = `{"path": "prod/api"}` },
+		"ip_address": func(l *link) { l.IPAddress.Valid = false },
+		"user_agent": func(l *link) { l.UserAgent = sql.NullString{String: "curl", Valid: true} },
+		"created_at": func(l *link) { l.CreatedAt = l.CreatedAt.Add(time.Microsecond) },
+	} {
+		l := base
+		change(&l)
+		if l.sum() == base.Hash {
+			t.Errorf("changing %s does not change the hash", name)
+		}
+	}
+}
+
+func TestArchivedEntryKeepsHash(t *testing.T) {
+	l := testLink(3, strings.Repeat("c", 64))
+	e := l.archived()
+	back, err := e.link()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.sum() != l.Hash {
+		t.Errorf("entry hashes to %s after archiving, want %s", back.sum(), l.Hash)
+	}
+}
+
+func testArchive(t *testing.T) ([]byte, ed25519.PublicKey, *Manifest) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := testLink(1, "")
+	second := testLink(2, first.Hash)
+	entries := []ArchivedEntry{first.archived(), second.archived()}
+	m := &Manifest{
+		ID:        uuid.New(),
+		FirstSeq:  1,
+		LastSeq:   2,
+		Entries:   len(entries),
+		KeyID:     uuid.New(),
+		PublicKey: base64.StdEncoding.EncodeToString(public),
+		CreatedAt: time.Now().UTC(),
+	}
+	data, err := writeArchive(entries, m, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, public, m
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	data, public, written := testArchive(t)
+
+	m, entries, err := ReadArchive(data, map[uuid.UUID]ed25519.PublicKey{written.KeyID: public}, nil)
+	if err != nil {
+		t.Fatalf("ReadArchive: %v", err)
+	}
+	if m.ID != written.ID || m.SHA256 != written.SHA256 {
+		t.Errorf("manifest = %+v, want %+v", m, written)
+	}
+	if len(entries) != 2 || entries[0].Seq != 1 || entries[1].PrevHash != entries[0].Hash {
+		t.Errorf("entries = %+v", entries)
+	}
+
+	// Offline, a pinned key stands in for the database's
+	if _, _, err := ReadArchive(data, nil, []ed25519.PublicKey{public}); err != nil {
+		t.Errorf("ReadArchive with a pinned key: %v", err)
+	}
+}
+
+func TestArchiveRejectsTampering(t *testing.T) {
+	data, public, written := testArchive(t)
+	keys := map[uuid.UUID]ed25519.PublicKey{written.KeyID: public}
+
+	for name, tamper := range map[string]func(string) string{
+		"entry": func(s string) string {
+			return strings.Replace(s, `"action":"secrets.read"`, `"action":"secrets.list"`, 1)
+		},
+		"renumbered": func(s string) string {
+			lines := strings.SplitN(s, "\n", 2)
+			return strings.Replace(lines[0], `"seq":1`, `"seq":9`, 1) + "\n" + lines[1]
+		},
+		"dropped entry": func(s string) string {
+			return s[strings.Index(s, "\n")+1:]
+		},
+		"manifest": func(s string) string {
+			return strings.Replace(s, `"last_seq":2`, `"last_seq":3`, 1)
+		},
+	} {
+		tampered := regzip(t, tamper(gunzip(t, data)))
+		if _, _, err := ReadArchive(tampered, keys, nil); err == nil {
+			t.Errorf("%s: tampered archive was accepted", name)
+		}
+	}
+}
+
+func TestArchiveRejectsWrongKey(t *testing.T) {
+	data, _, written := testArchive(t)
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ReadArchive(data, map[uuid.UUID]ed25519.PublicKey{written.KeyID: other}, nil); err == nil {
+		t.Error("archive verified with the wrong key")
+	}
+	if _, _, err := ReadArchive(data, nil, []ed25519.PublicKey{other}); err == nil {
+		t.Error("archive accepted with a key that is not pinned")
+	}
+	if _, _, err := ReadArchive(data, nil, nil); err == nil {
+		t.Error("archive accepted its own unpinned key")
+	}
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+func regzip(t *testing.T, plain string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	gz := gzip.NewWriter(&out)
+	gz.Write([]byte(plain))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,187 @@
+// Package audit records audited actions. Events are queued and written in
+// batches by a Logger, as a hash chain: every entry stores the hash of the
+// entry before it, so editing or deleting a row breaks the chain from that
+// point on, and periodic checkpoints signed with a key only the platform
+// holds stop the chain from being rebuilt after an edit.
+package audit
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event is one audited action. UserID is the acting user and is nil for
+// actions taken by the platform itself.
+//
+// Critical marks events the action must not go ahead without, such as
+// handing out secret material: they are written before Log returns, and
+// Log reports when they could not be.
+type Event struct {
+	Time       time.Time   `json:"time"`
+	UserID     *uuid.UUID  `json:"user_id,omitempty"`
+	Action     string      `json:"action"`
+	Resource   string      `json:"resource"`
+	ResourceID *uuid.UUID  `json:"resource_id,omitempty"`
+	Details    interface{} `json:"details,omitempty"`
+	IPAddress  string      `json:"ip_address,omitempty"`
+	UserAgent  string      `json:"user_agent,omitempty"`
+	Critical   bool        `json:"critical,omitempty"`
+}
+
+// link is an audit_logs row as it is hashed: every column, in the text form
+// Postgres returns it in, so the writer and the verifier hash the same bytes.
+type link struct {
+	Seq        int64
+	PrevHash   string
+	ID         uuid.UUID
+	UserID     *uuid.UUID
+	Action     string
+	Resource   string
+	ResourceID *uuid.UUID
+	Details    sql.NullString
+	IPAddress  sql.NullString
+	UserAgent  sql.NullString
+	CreatedAt  time.Time
+	Hash       string
+}
+
+// sum hashes the row's contents together with the previous entry's hash.
+// The fields are encoded as a JSON array so no value can run into the next.
+func (l *link) sum() string {
+	encoded, _ := json.Marshal([]interface{}{
+		l.Seq,
+		l.PrevHash,
+		l.ID,
+		l.UserID,
+		l.Action,
+		l.Resource,
+		l.ResourceID,
+		nullable(l.Details),
+		nullable(l.IPAddress),
+		nullable(l.UserAgent),
+		l.CreatedAt.Format(timestampLayout),
+	})
+	digest := sha256.Sum256(encoded)
+	return hex.EncodeToString(digest[:])
+}
+
+// AppendTx adds e to the end of the chain as part of tx, so the entry is
+// only written if the audited change is. The chain head stays locked until
+// tx ends, so keep such transactions short.
+func AppendTx(tx *sql.Tx, e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	return appendBatch(tx, []Event{e})
+}
+
+// appendBatch chains events, in order, onto the end of the log.
+func appendBatch(tx *sql.Tx, events []Event) error {
+	// Entries are chained in the order they take this lock
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('audit_logs'))`); err != nil {
+		return err
+	}
+
+	var prevHash string
+	if err := tx.QueryRow(`
+		SELECT COALESCE((SELECT hash FROM audit_logs WHERE hash IS NOT NULL ORDER BY seq DESC LIMIT 1), '')`,
+	).Scan(&prevHash); err != nil {
+		return err
+	}
+
+	links := make([]link, len(events))
+	values := make([]string, len(events))
+	args := make([]interface{}, 0, len(events)*4)
+	for i, e := range events {
+		var details, ipAddress sql.NullString
+		if e.Details != nil {
+			encoded, err := json.Marshal(e.Details)
+			if err != nil {
+				return fmt.Errorf("audit details for %s: %v", e.Action, err)
+			}
+			details = sql.NullString{String: string(encoded), Valid: true}
+		}
+		if e.IPAddress != "" {
+			ipAddress = sql.NullString{String: e.IPAddress, Valid: true}
+		}
+
+		links[i] = link{
+			ID:         uuid.New(),
+			UserID:     e.UserID,
+			Action:     e.Action,
+			Resource:   e.Resource,
+			ResourceID: e.ResourceID,
+			UserAgent:  sql.NullString{String: e.UserAgent, Valid: e.UserAgent != ""},
+		}
+		n := len(args)
+		values[i] = fmt.Sprintf("($%d::int, $%d::text, $%d::text, $%d::timestamptz)", n+1, n+2, n+3, n+4)
+		args = append(args, i, details, ipAddress, e.Time)
+	}
+
+	// Let Postgres normalise the JSON, address and timestamp first, so the
+	// hash covers exactly what will be read back
+	rows, err := tx.Query(`
+		SELECT v.n, nextval(pg_get_serial_sequence('audit_logs', 'seq')),
+		       v.details::jsonb::text, v.ip::inet::text, v.t::timestamp
+		FROM (VALUES `+strings.Join(values, ", ")+`) AS v(n, details, ip, t)`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	var seqs []int64
+	for rows.Next() {
+		var (
+			n   int
+			seq int64
+		)
+		if err := rows.Scan(&n, &seq, &links[n].Details, &links[n].IPAddress, &links[n].CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		seqs = append(seqs, seq)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	args = make([]interface{}, 0, len(links)*12)
+	for i := range links {
+		l := &links[i]
+		l.Seq = seqs[i]
+		l.PrevHash = prevHash
+		l.Hash = l.sum()
+		prevHash = l.Hash
+
+		n := len(args)
+		values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+			n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10, n+11, n+12)
+		args = append(args, l.ID, l.Seq, l.UserID, l.Action, l.Resource, l.ResourceID, l.Details,
+			l.IPAddress, l.UserAgent, l.CreatedAt, l.PrevHash, l.Hash)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO audit_logs (id, seq, user_id, action, resource, resource_id, details, ip_address,
+		                        user_agent, created_at, prev_hash, hash)
+		VALUES `+strings.Join(values, ", "),
+		args...,
+	)
+	return err
+}
+
+func nullable(s sql.NullString) interface{} {
+	if !s.Valid {
+		return nil
+	}
+	return s.String
+}
@@ -0,0 +1,157 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"idam-pam-platform/internal/encryption"
+
+	"github.com/google/uuid"
+)
+
+// Checkpoint is a signed statement of the chain head at some point. An
+// entry at or before a checkpoint cannot be changed without the checkpoint
+// failing verification, even if every later hash is recomputed.
+type Checkpoint struct {
+	ID        uuid.UUID `json:"id"`
+	Seq       int64     `json:"seq"`
+	Hash      string    `json:"hash"`
+	KeyID     uuid.UUID `json:"key_id"`
+	Signature string    `json:"signature"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Checkpointer signs checkpoints with an Ed25519 key stored encrypted in
+// audit_checkpoint_keys. Only the public half is needed to verify them.
+type Checkpointer struct {
+	db     *sql.DB
+	keyID  uuid.UUID
+	signer ed25519.PrivateKey
+}
+
+// NewCheckpointer loads the checkpoint signing key, creating it on first
+// start.
+func NewCheckpointer(db *sql.DB, encryptionSvc *encryption.Service) (*Checkpointer, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Only one instance creates the key
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('audit_checkpoint_keys'))`); err != nil {
+		return nil, err
+	}
+
+	c := &Checkpointer{db: db}
+	var encryptedKey string
+	err = tx.QueryRow(`
+		SELECT id, private_key FROM audit_checkpoint_keys
+		ORDER BY created_at DESC LIMIT 1`,
+	).Scan(&c.keyID, &encryptedKey)
+	if err == sql.ErrNoRows {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		encryptedKey, err := encryptionSvc.Encrypt(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt audit checkpoint key: %v", err)
+		}
+		if err := tx.QueryRow(`
+			INSERT INTO audit_checkpoint_keys (public_key, private_key)
+			VALUES ($1, $2)
+			RETURNING id`,
+			base64.StdEncoding.EncodeToString(public), encryptedKey,
+		).Scan(&c.keyID); err != nil {
+			return nil, err
+		}
+		c.signer = private
+		return c, tx.Commit()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := encryptionSvc.Decrypt(encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt audit checkpoint key: %v", err)
+	}
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("invalid audit checkpoint key PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("audit checkpoint key is not Ed25519")
+	}
+	c.signer = private
+	return c, tx.Commit()
+}
+
+// Checkpoint signs the current chain head. It returns nil when nothing has
+// been appended since the last checkpoint.
+func (c *Checkpointer) Checkpoint() (*Checkpoint, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('audit_checkpoints'))`); err != nil {
+		return nil, err
+	}
+
+	cp := Checkpoint{KeyID: c.keyID}
+	err = tx.QueryRow(`
+		SELECT seq, hash FROM audit_logs
+		WHERE hash IS NOT NULL
+		ORDER BY seq DESC LIMIT 1`,
+	).Scan(&cp.Seq, &cp.Hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var covered bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM audit_checkpoints WHERE seq >= $1)`, cp.Seq).Scan(&covered); err != nil {
+		return nil, err
+	}
+	if covered {
+		return nil, nil
+	}
+
+	cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(c.signer, checkpointMessage(cp.Seq, cp.Hash)))
+	if err := tx.QueryRow(`
+		INSERT INTO audit_checkpoints (seq, hash, key_id, signature)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`,
+		cp.Seq, cp.Hash, cp.KeyID, cp.Signature,
+	).Scan(&cp.ID, &cp.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &cp, tx.Commit()
+}
+
+// checkpointMessage is what a checkpoint signature covers.
+func checkpointMessage(seq int64, hash string) []byte {
+	return []byte(fmt.Sprintf("idam-pam audit checkpoint %d %s", seq, hash))
+}
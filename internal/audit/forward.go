@@ -0,0 +1,335 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned for a dead letter that does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Sink delivers audit entries to a system outside the platform, such as a
+// SIEM. Send must deliver all of records or return an error; a batch that
+// fails is sent again, so receivers may see an entry more than once and
+// can tell by its seq. A sink whose destination refused the entries
+// themselves returns a *RejectedError.
+type Sink interface {
+	Name() string
+	Send(records []Record) error
+	Close() error
+}
+
+// RejectedError means the destination was reached but turned the entries
+// down, so sending them again as they are would fail the same way.
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return "rejected: " + e.Err.Error()
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// Forwarder feeds one sink from audit_logs. Its position is kept in
+// audit_sink_cursors, so every sink retries on its own without holding
+// the others up, and nothing is skipped across restarts. While the sink
+// cannot be reached its position stays put; only entries the sink rejects
+// one by one are moved to audit_dead_letters.
+type Forwarder struct {
+	db        *sql.DB
+	sink      Sink
+	batchSize int
+}
+
+func NewForwarder(db *sql.DB, sink Sink, batchSize int) *Forwarder {
+	return &Forwarder{
+		db:        db,
+		sink:      sink,
+		batchSize: batchSize,
+	}
+}
+
+// Sink returns the sink the forwarder feeds.
+func (f *Forwarder) Sink() Sink {
+	return f.sink
+}
+
+// Forward sends the next batch of entries. It returns how many entries it
+// got past, delivered or dead-lettered; zero with a nil error means the
+// sink is caught up or another instance is forwarding to it.
+func (f *Forwarder) Forward() (int, error) {
+	tx, err := f.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// One instance forwards to each sink
+	var locked bool
+	if err := tx.QueryRow(`SELECT pg_try_advisory_xact_lock(hashtext('audit_sink:' || $1))`, f.sink.Name()).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	var lastSeq int64
+	err = tx.QueryRow(`SELECT last_seq FROM audit_sink_cursors WHERE sink = $1`, f.sink.Name()).Scan(&lastSeq)
+	if err == sql.ErrNoRows {
+		// A new sink starts from now rather than replaying the whole log
+		if _, err := tx.Exec(`
+			INSERT INTO audit_sink_cursors (sink, last_seq)
+			SELECT $1, COALESCE(MAX(seq), 0) FROM audit_logs`,
+			f.sink.Name(),
+		); err != nil {
+			return 0, err
+		}
+		return 0, tx.Commit()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(recordSelect+`
+		WHERE a.seq > $1
+		ORDER BY a.seq
+		LIMIT $2`,
+		lastSeq, f.batchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var records []Record
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		records = append(records, *r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	n, rejected, sendErr := f.deliver(records)
+	for _, d := range rejected {
+		encoded, _ := json.Marshal(d.record)
+		if _, err := tx.Exec(`
+			INSERT INTO audit_dead_letters (sink, seq, record, error, attempts)
+			VALUES ($1, $2, $3, $4, 1)`,
+			f.sink.Name(), d.record.Seq, string(encoded), d.err.Error(),
+		); err != nil {
+			return 0, err
+		}
+	}
+
+	// The cursor moves past what was delivered or dead-lettered; the rest
+	// is tried again after the job's backoff
+	position := lastSeq
+	if n > 0 {
+		position = records[n-1].Seq
+	}
+	lastError := sql.NullString{}
+	if sendErr != nil {
+		lastError = sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+	if _, err := tx.Exec(`
+		UPDATE audit_sink_cursors
+		SET last_seq = $2, failures = CASE WHEN $3::text IS NULL THEN 0 ELSE failures + 1 END,
+		    last_error = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE sink = $1`,
+		f.sink.Name(), position, lastError,
+	); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, sendErr
+}
+
+// rejection is an entry the sink turned down.
+type rejection struct {
+	record Record
+	err    error
+}
+
+// deliver sends records. When the sink rejects a batch, it is sent again
+// one entry at a time to find the entries at fault. deliver returns how
+// many records it got past, the ones among them that were rejected, and
+// the error that stopped it short.
+func (f *Forwarder) deliver(records []Record) (int, []rejection, error) {
+	err := f.sink.Send(records)
+	var rejectedErr *RejectedError
+	if err == nil {
+		return len(records), nil, nil
+	}
+	if !errors.As(err, &rejectedErr) {
+		return 0, nil, err
+	}
+	if len(records) == 1 {
+		return 1, []rejection{{records[0], err}}, nil
+	}
+
+	var rejected []rejection
+	for i, r := range records {
+		err := f.sink.Send([]Record{r})
+		if err == nil {
+			continue
+		}
+		if !errors.As(err, &rejectedErr) {
+			return i, rejected, err
+		}
+		rejected = append(rejected, rejection{r, err})
+	}
+	return len(records), rejected, nil
+}
+
+// SinkStatus is a sink's position in the log.
+type SinkStatus struct {
+	Sink        string    `json:"sink"`
+	LastSeq     int64     `json:"last_seq"`
+	Lag         int64     `json:"lag"`
+	Failures    int       `json:"failures"`
+	LastError   *string   `json:"last_error,omitempty"`
+	DeadLetters int       `json:"dead_letters"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SinkStatuses reports every sink that has forwarded anything.
+func SinkStatuses(db *sql.DB) ([]SinkStatus, error) {
+	rows, err := db.Query(`
+		SELECT c.sink, c.last_seq,
+		       GREATEST((SELECT COALESCE(MAX(seq), 0) FROM audit_logs) - c.last_seq, 0),
+		       c.failures, c.last_error,
+		       (SELECT COUNT(*) FROM audit_dead_letters d WHERE d.sink = c.sink),
+		       c.updated_at
+		FROM audit_sink_cursors c
+		ORDER BY c.sink`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := []SinkStatus{}
+	for rows.Next() {
+		var s SinkStatus
+		if err := rows.Scan(&s.Sink, &s.LastSeq, &s.Lag, &s.Failures, &s.LastError, &s.DeadLetters, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
+
+// DeadLetter is an entry a sink rejected.
+type DeadLetter struct {
+	ID        uuid.UUID `json:"id"`
+	Sink      string    `json:"sink"`
+	Seq       int64     `json:"seq"`
+	Record    Record    `json:"record"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeadLetters lists dead letters, oldest first, optionally for one sink.
+func DeadLetters(db *sql.DB, sink string, limit int) ([]DeadLetter, error) {
+	rows, err := db.Query(`
+		SELECT id, sink, seq, record, error, attempts, created_at
+		FROM audit_dead_letters
+		WHERE $1 = '' OR sink = $1
+		ORDER BY created_at, seq
+		LIMIT $2`,
+		sink, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, *d)
+	}
+	return letters, rows.Err()
+}
+
+// Redeliver sends a dead letter to its sink again and removes it once the
+// sink accepts it.
+func Redeliver(db *sql.DB, id uuid.UUID, sinks map[string]Sink) (*DeadLetter, error) {
+	d, err := scanDeadLetter(db.QueryRow(`
+		SELECT id, sink, seq, record, error, attempts, created_at
+		FROM audit_dead_letters
+		WHERE id = $1`,
+		id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sink, ok := sinks[d.Sink]
+	if !ok {
+		return nil, fmt.Errorf("sink %q is not configured", d.Sink)
+	}
+	if err := sink.Send([]Record{d.Record}); err != nil {
+		db.Exec(`UPDATE audit_dead_letters SET error = $2, attempts = attempts + 1 WHERE id = $1`, id, err.Error())
+		return nil, err
+	}
+	if _, err := db.Exec(`DELETE FROM audit_dead_letters WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DiscardDeadLetter drops a dead letter for good.
+func DiscardDeadLetter(db *sql.DB, id uuid.UUID) (*DeadLetter, error) {
+	d, err := scanDeadLetter(db.QueryRow(`
+		DELETE FROM audit_dead_letters
+		WHERE id = $1
+		RETURNING id, sink, seq, record, error, attempts, created_at`,
+		id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return d, err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDeadLetter(row scanner) (*DeadLetter, error) {
+	var (
+		d      DeadLetter
+		record []byte
+	)
+	if err := row.Scan(&d.ID, &d.Sink, &d.Seq, &record, &d.Error, &d.Attempts, &d.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(record, &d.Record); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
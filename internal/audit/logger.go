@@ -0,0 +1,267 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	retryDelay    = 100 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+
+	// closeAttempts bounds how often a failing batch is retried once the
+	// logger is closing; after that its events go to the process log.
+	closeAttempts = 3
+
+	// criticalTimeout is how long a critical event may wait for the writer
+	// to take it up before the action it records is refused.
+	criticalTimeout = 5 * time.Second
+
+	// maxBatchSize keeps a batch insert under Postgres' 65535 parameters.
+	maxBatchSize = 5000
+)
+
+// ErrNotRecorded is returned for a critical event that could not be
+// written. The caller must not go ahead with the action.
+var ErrNotRecorded = errors.New("audit event could not be recorded")
+
+// Config sizes the Logger's queue. When BufferSize events are waiting,
+// Log blocks until the writer catches up.
+type Config struct {
+	BufferSize int
+	BatchSize  int
+}
+
+// Logger writes audit events from a single background goroutine. Whatever
+// has queued up while one batch is being written goes into the next, so
+// batches grow with load and a quiet system writes each event at once.
+type Logger struct {
+	db        *sql.DB
+	batchSize int
+	queue     chan request
+	done      chan struct{}
+
+	mu      sync.RWMutex
+	closed  bool
+	closing atomic.Bool
+}
+
+type request struct {
+	event  Event
+	result chan error
+	// state settles a critical event's race between the writer taking it
+	// and its caller giving up on it
+	state *atomic.Int32
+}
+
+// Critical request states.
+const (
+	waiting int32 = iota
+	taken
+	abandoned
+)
+
+func NewLogger(db *sql.DB, cfg Config) *Logger {
+	if cfg.BatchSize > maxBatchSize {
+		cfg.BatchSize = maxBatchSize
+	}
+	l := &Logger{
+		db:        db,
+		batchSize: cfg.BatchSize,
+		queue:     make(chan request, cfg.BufferSize),
+		done:      make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Log records e. Ordinary events are queued and Log returns at once unless
+// the queue is full, in which case it waits for room rather than lose the
+// event. Critical events are written before Log returns; ErrNotRecorded
+// means the action must be refused.
+func (l *Logger) Log(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	// Encode now: the caller may reuse its map, and a value that cannot be
+	// written must not hold up the queue
+	if e.Details != nil {
+		encoded, err := json.Marshal(e.Details)
+		if err != nil {
+			encoded, _ = json.Marshal(map[string]string{"encoding_error": err.Error()})
+		}
+		e.Details = json.RawMessage(encoded)
+	}
+	if net.ParseIP(e.IPAddress) == nil {
+		e.IPAddress = ""
+	}
+
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		// Stragglers after shutdown are written directly
+		if err := l.write([]Event{e}); err != nil {
+			log.Println("Failed to write audit event:", err)
+			if e.Critical {
+				return ErrNotRecorded
+			}
+			dump(e)
+		}
+		return nil
+	}
+
+	req := request{event: e}
+	if !e.Critical {
+		l.queue <- req
+		l.mu.RUnlock()
+		return nil
+	}
+
+	req.result = make(chan error, 1)
+	req.state = new(atomic.Int32)
+	timeout := time.NewTimer(criticalTimeout)
+	defer timeout.Stop()
+	select {
+	case l.queue <- req:
+		l.mu.RUnlock()
+	case <-timeout.C:
+		l.mu.RUnlock()
+		return ErrNotRecorded
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-timeout.C:
+		// An abandoned event is dropped by the writer, so the log never
+		// records an action that was refused. Once the writer has taken
+		// it, the outcome of its write stands and is waited for.
+		if req.state.CompareAndSwap(waiting, abandoned) {
+			return ErrNotRecorded
+		}
+		return <-req.result
+	}
+}
+
+// Close stops accepting queued events and returns once everything already
+// queued has been written.
+func (l *Logger) Close() {
+	l.closing.Store(true)
+
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mu.Unlock()
+
+	<-l.done
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+
+	batch := make([]request, 0, l.batchSize)
+	for req := range l.queue {
+		batch = append(batch[:0], req)
+	drain:
+		for len(batch) < l.batchSize {
+			select {
+			case req, ok := <-l.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		l.flush(batch)
+	}
+}
+
+// flush writes a batch, retrying with backoff until it goes through.
+// Critical events are not retried: their callers are told at once so the
+// request fails instead of hanging. Critical events their callers gave up
+// on are dropped.
+func (l *Logger) flush(batch []request) {
+	live := batch[:0]
+	for _, req := range batch {
+		if req.state != nil && !req.state.CompareAndSwap(waiting, taken) {
+			continue
+		}
+		live = append(live, req)
+	}
+	batch = live
+	if len(batch) == 0 {
+		return
+	}
+
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		events := make([]Event, len(batch))
+		for i, req := range batch {
+			events[i] = req.event
+		}
+
+		err := l.write(events)
+		if err == nil {
+			for _, req := range batch {
+				if req.result != nil {
+					req.result <- nil
+				}
+			}
+			return
+		}
+		log.Println("Failed to write audit events:", err)
+
+		pending := batch[:0]
+		for _, req := range batch {
+			if req.result != nil {
+				req.result <- ErrNotRecorded
+				continue
+			}
+			pending = append(pending, req)
+		}
+		batch = pending
+		if len(batch) == 0 {
+			return
+		}
+
+		if l.closing.Load() && attempt >= closeAttempts {
+			// Last resort on shutdown: keep the events in the process log
+			for _, req := range batch {
+				dump(req.event)
+			}
+			return
+		}
+
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func (l *Logger) write(events []Event) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := appendBatch(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func dump(e Event) {
+	encoded, _ := json.Marshal(e)
+	log.Printf("Unwritten audit event: %s", encoded)
+}
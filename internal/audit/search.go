@@ -0,0 +1,217 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Filter narrows a search of the audit log. Zero fields match everything.
+// An Action ending in "*" matches by prefix, so "secrets.*" finds every
+// secret event. IPAddress may be a single address or a CIDR range, and
+// Query is matched case-insensitively anywhere in the details.
+type Filter struct {
+	UserID     *uuid.UUID
+	Username   string
+	Action     string
+	Resource   string
+	ResourceID *uuid.UUID
+	IPAddress  string
+	Since      *time.Time
+	Until      *time.Time
+	Query      string
+}
+
+// Record is an audit_logs row as returned by searches and exports.
+type Record struct {
+	Seq        int64           `json:"seq"`
+	ID         uuid.UUID       `json:"id"`
+	UserID     *uuid.UUID      `json:"user_id"`
+	Username   string          `json:"username"`
+	Action     string          `json:"action"`
+	Resource   string          `json:"resource"`
+	ResourceID *uuid.UUID      `json:"resource_id"`
+	Details    json.RawMessage `json:"details"`
+	IPAddress  string          `json:"ip_address"`
+	UserAgent  string          `json:"user_agent"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+const recordSelect = `
+	SELECT a.seq, a.id, a.user_id, COALESCE(u.username, ''), a.action, a.resource, a.resource_id,
+	       COALESCE(a.details::text, 'null'), COALESCE(host(a.ip_address), ''), COALESCE(a.user_agent, ''),
+	       a.created_at
+	FROM audit_logs a
+	LEFT JOIN users u ON a.user_id = u.id`
+
+// where renders f as SQL conditions, appending its arguments to args.
+func (f *Filter) where(args *[]interface{}) []string {
+	var conds []string
+	arg := func(v interface{}) string {
+		*args = append(*args, v)
+		return fmt.Sprintf("$%d", len(*args))
+	}
+
+	if f.UserID != nil {
+		conds = append(conds, "a.user_id = "+arg(*f.UserID))
+	}
+	if f.Username != "" {
+		conds = append(conds, "u.username = "+arg(f.Username))
+	}
+	if prefix, ok := strings.CutSuffix(f.Action, "*"); ok {
+		conds = append(conds, "a.action LIKE "+arg(escapeLike(prefix)+"%"))
+	} else if f.Action != "" {
+		conds = append(conds, "a.action = "+arg(f.Action))
+	}
+	if f.Resource != "" {
+		conds = append(conds, "a.resource = "+arg(f.Resource))
+	}
+	if f.ResourceID != nil {
+		conds = append(conds, "a.resource_id = "+arg(*f.ResourceID))
+	}
+	if f.IPAddress != "" {
+		conds = append(conds, "a.ip_address <<= "+arg(f.IPAddress)+"::inet")
+	}
+	if f.Since != nil {
+		conds = append(conds, "a.created_at >= "+arg(*f.Since))
+	}
+	if f.Until != nil {
+		conds = append(conds, "a.created_at < "+arg(*f.Until))
+	}
+	if f.Query != "" {
+		conds = append(conds, "a.details::text ILIKE "+arg("%"+escapeLike(f.Query)+"%"))
+	}
+	return conds
+}
+
+// Search returns up to limit entries matching f, newest first. Pass the
+// Seq of the last entry of one page as before to get the next; zero starts
+// from the newest entry.
+func Search(db *sql.DB, f Filter, before int64, limit int) ([]Record, error) {
+	var args []interface{}
+	conds := f.where(&args)
+	if before > 0 {
+		args = append(args, before)
+		conds = append(conds, fmt.Sprintf("a.seq < $%d", len(args)))
+	}
+	args = append(args, limit)
+
+	rows, err := db.Query(recordSelect+whereClause(conds)+fmt.Sprintf(`
+		ORDER BY a.seq DESC
+		LIMIT $%d`, len(args)),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []Record{}
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *r)
+	}
+	return records, rows.Err()
+}
+
+// After returns up to limit entries matching f with a seq above after,
+// oldest first. Live streams poll it to pick up new entries in order.
+func After(db *sql.DB, f Filter, after int64, limit int) ([]Record, error) {
+	var args []interface{}
+	conds := f.where(&args)
+	args = append(args, after)
+	conds = append(conds, fmt.Sprintf("a.seq > $%d", len(args)))
+	args = append(args, limit)
+
+	rows, err := db.Query(recordSelect+whereClause(conds)+fmt.Sprintf(`
+		ORDER BY a.seq
+		LIMIT $%d`, len(args)),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []Record{}
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *r)
+	}
+	return records, rows.Err()
+}
+
+// Head returns the seq of the newest entry, or zero for an empty log.
+func Head(db *sql.DB) (int64, error) {
+	var seq int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM audit_logs`).Scan(&seq)
+	return seq, err
+}
+
+// Cursor walks the entries matching a filter oldest first without loading
+// them all at once.
+type Cursor struct {
+	rows *sql.Rows
+}
+
+// Export opens a cursor over every entry matching f, oldest first. The
+// caller must Close it.
+func Export(db *sql.DB, f Filter) (*Cursor, error) {
+	var args []interface{}
+	conds := f.where(&args)
+	rows, err := db.Query(recordSelect+whereClause(conds)+`
+		ORDER BY a.seq`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Cursor{rows: rows}, nil
+}
+
+// Next returns the next entry, or nil once there are none left.
+func (c *Cursor) Next() (*Record, error) {
+	if !c.rows.Next() {
+		return nil, c.rows.Err()
+	}
+	return scanRecord(c.rows)
+}
+
+func (c *Cursor) Close() error {
+	return c.rows.Close()
+}
+
+func scanRecord(rows *sql.Rows) (*Record, error) {
+	var (
+		r       Record
+		details string
+	)
+	if err := rows.Scan(&r.Seq, &r.ID, &r.UserID, &r.Username, &r.Action, &r.Resource, &r.ResourceID,
+		&details, &r.IPAddress, &r.UserAgent, &r.CreatedAt); err != nil {
+		return nil, err
+	}
+	r.Details = json.RawMessage(details)
+	return &r, nil
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return "\n\tWHERE " + strings.Join(conds, " AND ")
+}
+
+// escapeLike makes s match literally inside a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
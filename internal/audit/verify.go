@@ -0,0 +1,218 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Break is the first point at which the chain fails verification.
+type Break struct {
+	Seq    int64      `json:"seq"`
+	ID     *uuid.UUID `json:"id,omitempty"`
+	Reason string     `json:"reason"`
+}
+
+// Verification is the outcome of walking the chain.
+type Verification struct {
+	Valid bool `json:"valid"`
+	// Legacy counts entries written before the chain existed; they are not
+	// covered by it
+	Legacy  int64 `json:"legacy_entries"`
+	Entries int64 `json:"entries"`
+	// Purged counts entries archived and purged under a retention rule;
+	// their tombstones keep the chain linked
+	Purged      int64  `json:"purged_entries"`
+	Checkpoints int    `json:"checkpoints"`
+	HeadSeq     int64  `json:"head_seq"`
+	HeadHash    string `json:"head_hash"`
+	Break       *Break `json:"break,omitempty"`
+}
+
+// Verify walks the whole chain in order and reports the first entry whose
+// hash, link to the previous entry or signed checkpoint does not hold. If
+// trusted is not empty, checkpoints signed by any other key are rejected;
+// pin the key this way when the database itself is not trusted.
+func Verify(db *sql.DB, trusted []ed25519.PublicKey) (*Verification, error) {
+	checkpoints, err := loadCheckpoints(db)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadCheckpointKeys(db)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Verification{}
+	fail := func(seq int64, id *uuid.UUID, reason string, args ...interface{}) (*Verification, error) {
+		v.Break = &Break{Seq: seq, ID: id, Reason: fmt.Sprintf(reason, args...)}
+		return v, nil
+	}
+
+	for _, cp := range checkpoints {
+		public, ok := keys[cp.KeyID]
+		if !ok {
+			return fail(cp.Seq, nil, "checkpoint %s is signed by unknown key %s", cp.ID, cp.KeyID)
+		}
+		if len(trusted) > 0 && !isTrusted(public, trusted) {
+			return fail(cp.Seq, nil, "checkpoint %s is signed by untrusted key %s", cp.ID, cp.KeyID)
+		}
+		signature, err := base64.StdEncoding.DecodeString(cp.Signature)
+		if err != nil || !ed25519.Verify(public, checkpointMessage(cp.Seq, cp.Hash), signature) {
+			return fail(cp.Seq, nil, "checkpoint %s has an invalid signature", cp.ID)
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT seq, id, user_id, action, resource, resource_id, details::text, ip_address::text,
+		       user_agent, created_at, COALESCE(prev_hash, ''), COALESCE(hash, ''), false
+		FROM audit_logs
+		UNION ALL
+		SELECT seq, '00000000-0000-0000-0000-000000000000'::uuid, NULL, '', '', NULL, NULL, NULL,
+		       NULL, 'epoch'::timestamp, prev_hash, hash, true
+		FROM audit_tombstones
+		ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	next := 0
+	prevHash := ""
+	chained := false
+	for rows.Next() {
+		var (
+			l      link
+			purged bool
+		)
+		if err := rows.Scan(&l.Seq, &l.ID, &l.UserID, &l.Action, &l.Resource, &l.ResourceID, &l.Details,
+			&l.IPAddress, &l.UserAgent, &l.CreatedAt, &l.PrevHash, &l.Hash, &purged); err != nil {
+			return nil, err
+		}
+		id := &l.ID
+		if purged {
+			id = nil
+		}
+
+		// A checkpointed entry that never came up has been deleted
+		if next < len(checkpoints) && checkpoints[next].Seq < l.Seq {
+			return fail(checkpoints[next].Seq, nil, "entry covered by checkpoint %s is missing", checkpoints[next].ID)
+		}
+
+		if l.Hash == "" {
+			if chained {
+				return fail(l.Seq, &l.ID, "entry is not part of the chain")
+			}
+			v.Legacy++
+			continue
+		}
+		chained = true
+
+		if l.PrevHash != prevHash {
+			return fail(l.Seq, id, "previous hash does not match; an entry before it was changed or removed")
+		}
+		// A tombstone only carries the hashes; the entry itself is checked
+		// against them when its archive is read
+		if !purged && l.sum() != l.Hash {
+			return fail(l.Seq, &l.ID, "entry was modified after it was written")
+		}
+		if next < len(checkpoints) && checkpoints[next].Seq == l.Seq {
+			if checkpoints[next].Hash != l.Hash {
+				return fail(l.Seq, id, "entry does not match checkpoint %s", checkpoints[next].ID)
+			}
+			next++
+			v.Checkpoints++
+		}
+
+		prevHash = l.Hash
+		if purged {
+			v.Purged++
+		} else {
+			v.Entries++
+		}
+		v.HeadSeq = l.Seq
+		v.HeadHash = l.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if next < len(checkpoints) {
+		return fail(checkpoints[next].Seq, nil, "entry covered by checkpoint %s is missing", checkpoints[next].ID)
+	}
+
+	v.Valid = true
+	return v, nil
+}
+
+func loadCheckpoints(db *sql.DB) ([]Checkpoint, error) {
+	rows, err := db.Query(`
+		SELECT id, seq, hash, key_id, signature, created_at
+		FROM audit_checkpoints
+		ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkpoints []Checkpoint
+	for rows.Next() {
+		var cp Checkpoint
+		if err := rows.Scan(&cp.ID, &cp.Seq, &cp.Hash, &cp.KeyID, &cp.Signature, &cp.CreatedAt); err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+	return checkpoints, rows.Err()
+}
+
+func loadCheckpointKeys(db *sql.DB) (map[uuid.UUID]ed25519.PublicKey, error) {
+	rows, err := db.Query(`SELECT id, public_key FROM audit_checkpoint_keys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := map[uuid.UUID]ed25519.PublicKey{}
+	for rows.Next() {
+		var (
+			id      uuid.UUID
+			encoded string
+		)
+		if err := rows.Scan(&id, &encoded); err != nil {
+			return nil, err
+		}
+		public, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(public) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid audit checkpoint key %s", id)
+		}
+		keys[id] = ed25519.PublicKey(public)
+	}
+	return keys, rows.Err()
+}
+
+// CheckpointKeys returns the public checkpoint keys, base64-encoded, for
+// pinning outside the database.
+func CheckpointKeys(db *sql.DB) (map[uuid.UUID]string, error) {
+	keys, err := loadCheckpointKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	encoded := map[uuid.UUID]string{}
+	for id, key := range keys {
+		encoded[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	return encoded, nil
+}
+
+func isTrusted(key ed25519.PublicKey, trusted []ed25519.PublicKey) bool {
+	for _, t := range trusted {
+		if bytes.Equal(key, t) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,7 +2,10 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"strings"
 	"time"
@@ -15,31 +18,36 @@ import (
 )
 
 type Claims struct {
-	UserID   string `json:"user_id"`
-	Username string `json:"username"`
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid"`
+	// ClientID and Scope are only set on tokens issued to OIDC clients.
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateJWT(userID uuid.UUID, username, secret string) (string, error) {
+// GenerateJWT issues a short-lived access token bound to a server-side session,
+// signed with the active key of the key set.
+func GenerateJWT(keys *KeySet, userID uuid.UUID, username string, sessionID uuid.UUID, ttl time.Duration) (string, error) {
 	claims := &Claims{
-		UserID:   userID.String(),
-		Username: username,
+		UserID:    userID.String(),
+		Username:  username,
+		SessionID: sessionID.String(),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			Issuer:    keys.Issuer(),
+			Subject:   userID.String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	return keys.Sign(claims)
 }
 
-func ValidateJWT(tokenString, secret string) (*Claims, error) {
+func ValidateJWT(tokenString string, keys *KeySet) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
-
+	token, err := keys.Parse(tokenString, claims, jwt.WithIssuer(keys.Issuer()))
 	if err != nil {
 		return nil, err
 	}
@@ -51,6 +59,32 @@ func ValidateJWT(tokenString, secret string) (*Claims, error) {
 	return claims, nil
 }
 
+// GenerateRefreshToken returns an opaque refresh token for the given session and
+// the hash that should be stored server-side. The session ID prefix lets us find
+// the session even when a stale (already rotated) token is presented.
+func GenerateRefreshToken(sessionID uuid.UUID) (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := sessionID.String() + "." + base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashRefreshToken(token), nil
+}
+
+// ParseRefreshToken extracts the session ID from a refresh token.
+func ParseRefreshToken(token string) (uuid.UUID, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return uuid.Nil, fmt.Errorf("malformed refresh token")
+	}
+	return uuid.Parse(parts[0])
+}
+
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func HashPassword(password string) string {
 	salt := make([]byte, 16)
 	rand.Read(salt)
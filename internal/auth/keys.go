@@ -0,0 +1,415 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+
+	// reloadInterval bounds how stale our view of signing_keys may get when
+	// several instances share the table and one of them rotates.
+	reloadInterval = time.Minute
+)
+
+// Cipher protects private signing keys at rest.
+type Cipher interface {
+	Encrypt(plaintext string) (string, error)
+	Decrypt(ciphertext string) (string, error)
+}
+
+// SigningKey is one entry of the key set. Only the active key signs; retired
+// keys keep verifying until ExpiresAt so tokens issued before a rotation stay
+// valid for the rotation window.
+type SigningKey struct {
+	KID       string
+	Algorithm string
+	CreatedAt time.Time
+	RetiredAt *time.Time
+	ExpiresAt *time.Time
+
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// KeySetConfig controls key generation and rotation.
+type KeySetConfig struct {
+	Algorithm      string
+	Issuer         string
+	RotationWindow time.Duration
+}
+
+// KeySet holds the asymmetric keys used to sign and verify platform tokens.
+// Keys live in the signing_keys table with the private half encrypted, so
+// every instance of the platform signs with the same active key.
+type KeySet struct {
+	db     *sql.DB
+	cipher Cipher
+	cfg    KeySetConfig
+
+	mu         sync.RWMutex
+	active     *SigningKey
+	keys       map[string]*SigningKey
+	lastReload time.Time
+}
+
+func NewKeySet(db *sql.DB, cipher Cipher, cfg KeySetConfig) (*KeySet, error) {
+	if cfg.Algorithm != AlgRS256 && cfg.Algorithm != AlgEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", cfg.Algorithm)
+	}
+
+	ks := &KeySet{
+		db:     db,
+		cipher: cipher,
+		cfg:    cfg,
+		keys:   map[string]*SigningKey{},
+	}
+
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	if ks.activeKey() == nil {
+		if _, err := ks.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ks, nil
+}
+
+func (ks *KeySet) Issuer() string {
+	return ks.cfg.Issuer
+}
+
+// Algorithm is the JWS algorithm new keys are generated for.
+func (ks *KeySet) Algorithm() string {
+	return ks.cfg.Algorithm
+}
+
+// Reload refreshes the in-memory key set from the database.
+func (ks *KeySet) Reload() error {
+	rows, err := ks.db.Query(`
+		SELECT kid, algorithm, private_key, public_key, created_at, retired_at, expires_at
+		FROM signing_keys
+		WHERE expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP
+		ORDER BY created_at DESC`)
+	if err != nil {
+		return fmt.Errorf("failed to load signing keys: %v", err)
+	}
+	defer rows.Close()
+
+	keys := map[string]*SigningKey{}
+	var active *SigningKey
+	for rows.Next() {
+		var (
+			key                   SigningKey
+			privatePEM, publicPEM string
+			retiredAt, expiresAt  sql.NullTime
+		)
+		if err := rows.Scan(&key.KID, &key.Algorithm, &privatePEM, &publicPEM,
+			&key.CreatedAt, &retiredAt, &expiresAt); err != nil {
+			return err
+		}
+		if retiredAt.Valid {
+			key.RetiredAt = &retiredAt.Time
+		}
+		if expiresAt.Valid {
+			key.ExpiresAt = &expiresAt.Time
+		}
+
+		if err := ks.decodeKey(&key, privatePEM, publicPEM); err != nil {
+			return fmt.Errorf("failed to decode signing key %s: %v", key.KID, err)
+		}
+
+		keys[key.KID] = &key
+		if active == nil && key.RetiredAt == nil {
+			active = &key
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.active = active
+	ks.lastReload = time.Now()
+	ks.mu.Unlock()
+
+	return nil
+}
+
+// Rotate generates a new active key. Previously active keys are retired and
+// keep verifying for the configured rotation window.
+func (ks *KeySet) Rotate() (*SigningKey, error) {
+	signer, err := generateSigner(ks.cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedPrivate, err := ks.cipher.Encrypt(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt signing key: %v", err)
+	}
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+
+	kidBytes := make([]byte, 12)
+	if _, err := rand.Read(kidBytes); err != nil {
+		return nil, err
+	}
+	kid := base64.RawURLEncoding.EncodeToString(kidBytes)
+
+	tx, err := ks.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialize rotations across instances
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('signing_keys'))`); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE signing_keys
+		SET retired_at = CURRENT_TIMESTAMP,
+		    expires_at = CURRENT_TIMESTAMP + make_interval(secs => $1)
+		WHERE retired_at IS NULL`,
+		ks.cfg.RotationWindow.Seconds(),
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM signing_keys WHERE expires_at <= CURRENT_TIMESTAMP`); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO signing_keys (kid, algorithm, private_key, public_key)
+		VALUES ($1, $2, $3, $4)`,
+		kid, ks.cfg.Algorithm, encryptedPrivate, publicPEM,
+	); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[kid], nil
+}
+
+// Keys returns the keys that currently verify tokens, active key first.
+func (ks *KeySet) Keys() []*SigningKey {
+	ks.maybeReload()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keys := make([]*SigningKey, 0, len(ks.keys))
+	if ks.active != nil {
+		keys = append(keys, ks.active)
+	}
+	for _, key := range ks.keys {
+		if key != ks.active && key.usable() {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Sign signs the claims with the active key and stamps its kid header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.maybeReload()
+
+	key := ks.activeKey()
+	if key == nil {
+		return "", fmt.Errorf("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(signingMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.KID
+	return token.SignedString(key.private)
+}
+
+// Parse verifies a token against the key named by its kid header.
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	opts = append(opts, jwt.WithValidMethods([]string{AlgRS256, AlgEdDSA}))
+	return jwt.ParseWithClaims(tokenString, claims, ks.verificationKey, opts...)
+}
+
+func (ks *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, fmt.Errorf("token has no kid header")
+	}
+
+	key := ks.lookup(kid)
+	if key == nil {
+		// The key may have been created by another instance since our last load
+		ks.mu.RLock()
+		stale := time.Since(ks.lastReload) > 5*time.Second
+		ks.mu.RUnlock()
+		if stale {
+			if err := ks.Reload(); err != nil {
+				return nil, err
+			}
+			key = ks.lookup(kid)
+		}
+	}
+	if key == nil || !key.usable() {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("algorithm mismatch for key %q", kid)
+	}
+
+	return key.public, nil
+}
+
+func (ks *KeySet) lookup(kid string) *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[kid]
+}
+
+func (ks *KeySet) activeKey() *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.active
+}
+
+func (ks *KeySet) maybeReload() {
+	ks.mu.RLock()
+	stale := time.Since(ks.lastReload) > reloadInterval
+	ks.mu.RUnlock()
+	if stale {
+		if err := ks.Reload(); err != nil {
+			println("Failed to reload signing keys:", err.Error())
+		}
+	}
+}
+
+func (ks *KeySet) decodeKey(key *SigningKey, encryptedPrivate, publicPEM string) error {
+	privatePEM, err := ks.cipher.Decrypt(encryptedPrivate)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return fmt.Errorf("invalid private key PEM")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("private key cannot sign")
+	}
+
+	block, _ = pem.Decode([]byte(publicPEM))
+	if block == nil {
+		return fmt.Errorf("invalid public key PEM")
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	key.private = signer
+	key.public = public
+	return nil
+}
+
+func (k *SigningKey) usable() bool {
+	return k.ExpiresAt == nil || time.Now().Before(*k.ExpiresAt)
+}
+
+// Public returns the public half of the key.
+func (k *SigningKey) Public() crypto.PublicKey {
+	return k.public
+}
+
+// JWK is a public key in RFC 7517 form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys other services need to verify our tokens.
+func (ks *KeySet) JWKS() map[string][]JWK {
+	keys := []JWK{}
+	for _, key := range ks.Keys() {
+		jwk := JWK{Kid: key.KID, Use: "sig", Alg: key.Algorithm}
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string][]JWK{"keys": keys}
+}
+
+func generateSigner(alg string) (crypto.Signer, error) {
+	switch alg {
+	case AlgRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case AlgEdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+}
+
+func signingMethod(alg string) jwt.SigningMethod {
+	if alg == AlgEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
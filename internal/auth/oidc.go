@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// IDTokenClaims is the OpenID Connect ID token issued to relying parties.
+// Email and Roles are left out unless their scopes were granted.
+type IDTokenClaims struct {
+	Nonce             string   `json:"nonce,omitempty"`
+	AuthTime          int64    `json:"auth_time"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email,omitempty"`
+	Roles             []string `json:"roles,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// IDTokenSubject describes the authenticated user for an ID token.
+type IDTokenSubject struct {
+	UserID   uuid.UUID
+	Username string
+	Email    string
+	Roles    []string
+	AuthTime time.Time
+}
+
+func GenerateIDToken(keys *KeySet, subject IDTokenSubject, clientID, nonce string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := &IDTokenClaims{
+		Nonce:             nonce,
+		AuthTime:          subject.AuthTime.Unix(),
+		PreferredUsername: subject.Username,
+		Email:             subject.Email,
+		Roles:             subject.Roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    keys.Issuer(),
+			Subject:   subject.UserID.String(),
+			Audience:  jwt.ClaimStrings{clientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	return keys.Sign(claims)
+}
+
+// GenerateClientAccessToken issues an access token for an OIDC client. It is
+// bound to a session like platform tokens but scoped to the client audience.
+func GenerateClientAccessToken(keys *KeySet, userID uuid.UUID, username string, sessionID uuid.UUID, clientID, scope string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserID:    userID.String(),
+		Username:  username,
+		SessionID: sessionID.String(),
+		ClientID:  clientID,
+		Scope:     scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    keys.Issuer(),
+			Subject:   userID.String(),
+			Audience:  jwt.ClaimStrings{clientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	return keys.Sign(claims)
+}
+
+// VerifyPKCE checks an RFC 7636 code verifier against the S256 challenge
+// recorded with the authorization code.
+func VerifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
@@ -86,6 +86,58 @@ func RunMigrations(db *sql.DB) error {
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		);`,
 
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			refresh_token_hash VARCHAR(255) NOT NULL,
+			ip_address INET,
+			user_agent TEXT,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);`,
+
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS client_id VARCHAR(255);`,
+
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS scope TEXT;`,
+
+		`CREATE TABLE IF NOT EXISTS signing_keys (
+			kid VARCHAR(64) PRIMARY KEY,
+			algorithm VARCHAR(16) NOT NULL,
+			private_key TEXT NOT NULL,
+			public_key TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			retired_at TIMESTAMP,
+			expires_at TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS oidc_clients (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			client_id VARCHAR(255) UNIQUE NOT NULL,
+			client_secret_hash VARCHAR(255),
+			name VARCHAR(255) NOT NULL,
+			redirect_uris TEXT[] NOT NULL,
+			created_by UUID REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS oidc_authorization_codes (
+			code_hash VARCHAR(64) PRIMARY KEY,
+			client_id VARCHAR(255) NOT NULL REFERENCES oidc_clients(client_id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			redirect_uri TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			nonce TEXT,
+			code_challenge VARCHAR(255) NOT NULL,
+			code_challenge_method VARCHAR(16) NOT NULL,
+			auth_time TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP
+		);`,
+
 		`INSERT INTO roles (name, description) VALUES 
 			('admin', 'Full system administrator') 
 			ON CONFLICT (name) DO NOTHING;`,
@@ -103,6 +155,664 @@ func RunMigrations(db *sql.DB) error {
 			('secrets.write', 'secrets', 'write'),
 			('audit.read', 'audit', 'read')
 			ON CONFLICT (name) DO NOTHING;`,
+
+		// Built-in roles and permissions cannot be renamed or deleted through
+		// the API. Permissions seeded by migrations are built-in by default;
+		// the API creates custom ones with is_system = false.
+		`ALTER TABLE roles ADD COLUMN IF NOT EXISTS is_system BOOLEAN NOT NULL DEFAULT false;`,
+
+		`UPDATE roles SET is_system = true WHERE name IN ('admin', 'user');`,
+
+		`ALTER TABLE permissions ADD COLUMN IF NOT EXISTS is_system BOOLEAN NOT NULL DEFAULT true;`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES 
+			('audit.read_all', 'audit', 'read_all'),
+			('keys.read', 'signing_keys', 'read'),
+			('keys.write', 'signing_keys', 'write'),
+			('clients.read', 'oidc_clients', 'read'),
+			('clients.write', 'oidc_clients', 'write')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// role_permissions was never populated before permission checks were
+		// enforced. The first time we seed it, give every existing user without
+		// a role the default 'user' role so nobody is locked out.
+		`INSERT INTO user_roles (user_id, role_id)
+			SELECT u.id, r.id FROM users u, roles r
+			WHERE r.name = 'user'
+			  AND NOT EXISTS (SELECT 1 FROM role_permissions)
+			  AND NOT EXISTS (SELECT 1 FROM user_roles ur WHERE ur.user_id = u.id)
+			ON CONFLICT DO NOTHING;`,
+
+		`INSERT INTO role_permissions (role_id, permission_id)
+			SELECT r.id, p.id FROM roles r, permissions p
+			WHERE r.name = 'user'
+			  AND p.name IN ('users.read', 'secrets.read', 'secrets.write', 'audit.read')
+			  AND NOT EXISTS (SELECT 1 FROM role_permissions)
+			ON CONFLICT DO NOTHING;`,
+
+		// Envelope encryption: the per-secret data key, wrapped by the master
+		// key. NULL for secrets written before envelope encryption.
+		`ALTER TABLE secrets ADD COLUMN IF NOT EXISTS encrypted_data_key TEXT;`,
+
+		// Just-in-time access: time-bound role assignments granted through
+		// approved access requests
+		`ALTER TABLE user_roles ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;`,
+
+		`ALTER TABLE user_roles ADD COLUMN IF NOT EXISTS granted_by UUID REFERENCES users(id);`,
+
+		`ALTER TABLE user_roles ADD COLUMN IF NOT EXISTS request_id UUID;`,
+
+		`CREATE INDEX IF NOT EXISTS idx_user_roles_expires_at ON user_roles(expires_at) WHERE expires_at IS NOT NULL;`,
+
+		`CREATE TABLE IF NOT EXISTS access_requests (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			role_id UUID NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+			justification TEXT NOT NULL,
+			duration_seconds INTEGER NOT NULL,
+			status VARCHAR(20) NOT NULL DEFAULT 'pending',
+			decided_by UUID REFERENCES users(id),
+			decision_reason TEXT,
+			decided_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_access_requests_status ON access_requests(status);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES 
+			('access.approve', 'access_requests', 'approve')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// Permissions every user should have are granted to the 'user' role only
+		// when the permission is first created, so later edits stick.
+		`WITH created AS (
+			INSERT INTO permissions (name, resource, action) VALUES 
+				('access.request', 'access_requests', 'request')
+				ON CONFLICT (name) DO NOTHING
+				RETURNING id
+		)
+		INSERT INTO role_permissions (role_id, permission_id)
+			SELECT r.id, created.id FROM roles r, created
+			WHERE r.name = 'user'
+			ON CONFLICT DO NOTHING;`,
+
+		// Master key keyring. Each version is wrapped by the key provider;
+		// retired versions stay until nothing is encrypted under them.
+		`CREATE TABLE IF NOT EXISTS encryption_keys (
+			version INTEGER PRIMARY KEY,
+			wrapped_key TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			retired_at TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS encryption_rewrap_jobs (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			target_version INTEGER NOT NULL,
+			status VARCHAR(20) NOT NULL DEFAULT 'running',
+			total INTEGER NOT NULL DEFAULT 0,
+			processed INTEGER NOT NULL DEFAULT 0,
+			reencrypted INTEGER NOT NULL DEFAULT 0,
+			last_id UUID,
+			error TEXT,
+			started_by UUID REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			completed_at TIMESTAMP
+		);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES 
+			('encryption.read', 'encryption_keys', 'read'),
+			('encryption.write', 'encryption_keys', 'write')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// Secret versioning: secrets holds the current value, secret_versions
+		// the retained history including the current version
+		`ALTER TABLE secrets ADD COLUMN IF NOT EXISTS current_version INTEGER NOT NULL DEFAULT 1;`,
+
+		`ALTER TABLE secrets ADD COLUMN IF NOT EXISTS max_versions INTEGER;`,
+
+		`CREATE TABLE IF NOT EXISTS secret_versions (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			secret_id UUID NOT NULL REFERENCES secrets(id) ON DELETE CASCADE,
+			version INTEGER NOT NULL,
+			encrypted_data TEXT NOT NULL,
+			encrypted_data_key TEXT,
+			created_by UUID REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (secret_id, version)
+		);`,
+
+		`INSERT INTO secret_versions (secret_id, version, encrypted_data, encrypted_data_key, created_by, created_at)
+			SELECT s.id, s.current_version, s.encrypted_data, s.encrypted_data_key, s.created_by, s.updated_at
+			FROM secrets s
+			WHERE NOT EXISTS (SELECT 1 FROM secret_versions v WHERE v.secret_id = s.id);`,
+
+		// Secret sharing: read, write or manage granted to a user or a role
+		`CREATE TABLE IF NOT EXISTS secret_acls (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			secret_id UUID NOT NULL REFERENCES secrets(id) ON DELETE CASCADE,
+			principal_type VARCHAR(10) NOT NULL CHECK (principal_type IN ('user', 'role')),
+			principal_id UUID NOT NULL,
+			access VARCHAR(10) NOT NULL CHECK (access IN ('read', 'write', 'manage')),
+			granted_by UUID REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (secret_id, principal_type, principal_id)
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_secret_acls_principal ON secret_acls(principal_type, principal_id);`,
+
+		// Hierarchical secret paths: a secret lives at folder/name, unique per
+		// path rather than globally. Existing names containing '/' are split.
+		`ALTER TABLE secrets ADD COLUMN IF NOT EXISTS folder TEXT NOT NULL DEFAULT '';`,
+
+		`UPDATE secrets
+			SET folder = trim(both '/' from regexp_replace(name, '/[^/]*$', '')),
+			    name = regexp_replace(name, '^.*/', '')
+			WHERE folder = '' AND name LIKE '%/%';`,
+
+		`ALTER TABLE secrets DROP CONSTRAINT IF EXISTS secrets_name_key;`,
+
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_secrets_folder_name ON secrets(folder, name);`,
+
+		// Folder ACLs apply to the folder and everything beneath it
+		`CREATE TABLE IF NOT EXISTS folder_acls (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			path TEXT NOT NULL,
+			principal_type VARCHAR(10) NOT NULL CHECK (principal_type IN ('user', 'role')),
+			principal_id UUID NOT NULL,
+			access VARCHAR(10) NOT NULL CHECK (access IN ('read', 'write', 'manage')),
+			granted_by UUID REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (path, principal_type, principal_id)
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_folder_acls_principal ON folder_acls(principal_type, principal_id);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES 
+			('folders.manage', 'folders', 'manage')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// Exclusive check-out: secrets flagged checkout_required are readable
+		// only by the current holder and are rotated on check-in
+		`ALTER TABLE secrets ADD COLUMN IF NOT EXISTS checkout_required BOOLEAN NOT NULL DEFAULT false;`,
+
+		`CREATE TABLE IF NOT EXISTS secret_checkouts (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			secret_id UUID NOT NULL REFERENCES secrets(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id),
+			checked_out_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			checked_in_at TIMESTAMP,
+			checkin_reason VARCHAR(20)
+		);`,
+
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_secret_checkouts_active ON secret_checkouts(secret_id) WHERE checked_in_at IS NULL;`,
+
+		`CREATE TABLE IF NOT EXISTS secret_checkout_queue (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			secret_id UUID NOT NULL REFERENCES secrets(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id),
+			duration_seconds INTEGER NOT NULL,
+			requested_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (secret_id, user_id)
+		);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES 
+			('checkouts.force', 'secrets', 'force_checkin')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// Rotation policies: a secret is rotated every interval_seconds or
+		// once its current version is older than max_age_seconds. Failed
+		// rotations are retried at next_retry_at.
+		`CREATE TABLE IF NOT EXISTS secret_rotation_policies (
+			secret_id UUID PRIMARY KEY REFERENCES secrets(id) ON DELETE CASCADE,
+			rotator VARCHAR(50) NOT NULL,
+			config JSONB NOT NULL DEFAULT '{}',
+			interval_seconds INTEGER,
+			max_age_seconds INTEGER,
+			enabled BOOLEAN NOT NULL DEFAULT true,
+			last_rotated_at TIMESTAMP,
+			last_status VARCHAR(20),
+			last_error TEXT,
+			consecutive_failures INTEGER NOT NULL DEFAULT 0,
+			next_retry_at TIMESTAMP,
+			created_by UUID REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			CHECK ((interval_seconds IS NULL) <> (max_age_seconds IS NULL))
+		);`,
+
+		// Dynamic database credentials: each database role is a connection
+		// plus a grant template, and every issued login is a lease that is
+		// dropped from the target database when it expires
+		`CREATE TABLE IF NOT EXISTS database_roles (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			name VARCHAR(100) UNIQUE NOT NULL,
+			description TEXT,
+			connection_url TEXT NOT NULL,
+			connection_url_key TEXT,
+			grant_statements TEXT NOT NULL,
+			default_ttl_seconds INTEGER NOT NULL,
+			max_ttl_seconds INTEGER NOT NULL,
+			allowed_role_ids UUID[] NOT NULL DEFAULT '{}',
+			created_by UUID REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS database_leases (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			database_role_id UUID NOT NULL REFERENCES database_roles(id) ON DELETE CASCADE,
+			user_id UUID NOT NULL REFERENCES users(id),
+			username VARCHAR(63) NOT NULL,
+			status VARCHAR(20) NOT NULL DEFAULT 'active',
+			issued_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			max_expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			revoked_by UUID REFERENCES users(id),
+			revoke_reason VARCHAR(20),
+			last_error TEXT
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_database_leases_active ON database_leases(expires_at) WHERE status = 'active';`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES 
+			('database.manage', 'database', 'manage')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		`WITH created AS (
+			INSERT INTO permissions (name, resource, action) VALUES 
+				('database.request', 'database', 'request')
+				ON CONFLICT (name) DO NOTHING
+				RETURNING id
+		)
+		INSERT INTO role_permissions (role_id, permission_id)
+			SELECT r.id, created.id FROM roles r, created
+			WHERE r.name = 'user'
+			ON CONFLICT DO NOTHING;`,
+
+		`CREATE TABLE IF NOT EXISTS ssh_ca_keys (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			algorithm VARCHAR(50) NOT NULL,
+			private_key TEXT NOT NULL,
+			public_key TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			retired_at TIMESTAMP,
+			expires_at TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS ssh_role_policies (
+			role_id UUID PRIMARY KEY REFERENCES roles(id) ON DELETE CASCADE,
+			principals TEXT[] NOT NULL,
+			extensions TEXT[] NOT NULL DEFAULT '{permit-pty}',
+			max_ttl_seconds INTEGER NOT NULL,
+			updated_by UUID REFERENCES users(id),
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS ssh_certificates (
+			serial BIGINT PRIMARY KEY,
+			user_id UUID NOT NULL REFERENCES users(id),
+			key_id VARCHAR(255) NOT NULL,
+			principals TEXT[] NOT NULL,
+			public_key_fingerprint VARCHAR(100) NOT NULL,
+			ca_key_id UUID REFERENCES ssh_ca_keys(id) ON DELETE SET NULL,
+			valid_after TIMESTAMP NOT NULL,
+			valid_before TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_ssh_certificates_user ON ssh_certificates(user_id, created_at);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES 
+			('ssh.manage', 'ssh', 'manage')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		`WITH created AS (
+			INSERT INTO permissions (name, resource, action) VALUES 
+				('ssh.sign', 'ssh', 'sign')
+				ON CONFLICT (name) DO NOTHING
+				RETURNING id
+		)
+		INSERT INTO role_permissions (role_id, permission_id)
+			SELECT r.id, created.id FROM roles r, created
+			WHERE r.name = 'user'
+			ON CONFLICT DO NOTHING;`,
+
+		`CREATE TABLE IF NOT EXISTS pki_cas (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			kind VARCHAR(20) NOT NULL,
+			parent_id UUID REFERENCES pki_cas(id),
+			common_name VARCHAR(255) NOT NULL,
+			serial VARCHAR(64) NOT NULL UNIQUE,
+			certificate TEXT NOT NULL,
+			private_key TEXT NOT NULL,
+			not_before TIMESTAMP NOT NULL,
+			not_after TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS pki_roles (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			name VARCHAR(100) UNIQUE NOT NULL,
+			description TEXT,
+			allowed_domains TEXT[] NOT NULL,
+			allow_subdomains BOOLEAN NOT NULL DEFAULT false,
+			allow_ip_sans BOOLEAN NOT NULL DEFAULT false,
+			server_auth BOOLEAN NOT NULL DEFAULT true,
+			client_auth BOOLEAN NOT NULL DEFAULT false,
+			default_ttl_seconds INTEGER NOT NULL,
+			max_ttl_seconds INTEGER NOT NULL,
+			allowed_role_ids UUID[] NOT NULL DEFAULT '{}',
+			created_by UUID REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS pki_certificates (
+			serial VARCHAR(64) PRIMARY KEY,
+			pki_role_id UUID REFERENCES pki_roles(id) ON DELETE SET NULL,
+			ca_id UUID NOT NULL REFERENCES pki_cas(id),
+			common_name VARCHAR(255) NOT NULL,
+			dns_names TEXT[] NOT NULL DEFAULT '{}',
+			ip_addresses TEXT[] NOT NULL DEFAULT '{}',
+			certificate TEXT NOT NULL,
+			not_before TIMESTAMP NOT NULL,
+			not_after TIMESTAMP NOT NULL,
+			issued_by UUID NOT NULL REFERENCES users(id),
+			issued_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			renewed_from VARCHAR(64),
+			revoked_at TIMESTAMP,
+			revoked_by UUID REFERENCES users(id),
+			revoke_reason VARCHAR(30)
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_pki_certificates_issued_by ON pki_certificates(issued_by, issued_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_pki_certificates_revoked ON pki_certificates(not_after) WHERE revoked_at IS NOT NULL;`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES 
+			('pki.manage', 'pki', 'manage')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		`WITH created AS (
+			INSERT INTO permissions (name, resource, action) VALUES 
+				('pki.issue', 'pki', 'issue')
+				ON CONFLICT (name) DO NOTHING
+				RETURNING id
+		)
+		INSERT INTO role_permissions (role_id, permission_id)
+			SELECT r.id, created.id FROM roles r, created
+			WHERE r.name = 'user'
+			ON CONFLICT DO NOTHING;`,
+
+		`CREATE TABLE IF NOT EXISTS transit_keys (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			name VARCHAR(100) UNIQUE NOT NULL,
+			type VARCHAR(20) NOT NULL,
+			latest_version INTEGER NOT NULL DEFAULT 1,
+			min_decryption_version INTEGER NOT NULL DEFAULT 1,
+			allowed_role_ids UUID[] NOT NULL DEFAULT '{}',
+			created_by UUID REFERENCES users(id),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			rotated_at TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS transit_key_versions (
+			key_id UUID NOT NULL REFERENCES transit_keys(id) ON DELETE CASCADE,
+			version INTEGER NOT NULL,
+			key_material TEXT NOT NULL,
+			hmac_key TEXT NOT NULL,
+			public_key TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (key_id, version)
+		);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES 
+			('transit.manage', 'transit', 'manage'),
+			('transit.encrypt', 'transit', 'encrypt'),
+			('transit.decrypt', 'transit', 'decrypt'),
+			('transit.sign', 'transit', 'sign'),
+			('transit.verify', 'transit', 'verify'),
+			('transit.hmac', 'transit', 'hmac')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// Hash chain over audit_logs. Rows written before these columns
+		// existed keep a NULL hash and are reported as legacy entries.
+		`ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS seq BIGSERIAL;`,
+
+		`ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS prev_hash VARCHAR(64);`,
+
+		`ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS hash VARCHAR(64);`,
+
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_audit_logs_seq ON audit_logs(seq);`,
+
+		`CREATE TABLE IF NOT EXISTS audit_checkpoint_keys (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			public_key TEXT NOT NULL,
+			private_key TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS audit_checkpoints (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			seq BIGINT NOT NULL,
+			hash VARCHAR(64) NOT NULL,
+			key_id UUID NOT NULL REFERENCES audit_checkpoint_keys(id),
+			signature TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_audit_checkpoints_seq ON audit_checkpoints(seq);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES
+			('audit.verify', 'audit', 'verify')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// Audit search filters by user and resource, paging on seq
+		`CREATE INDEX IF NOT EXISTS idx_audit_logs_user_seq ON audit_logs(user_id, seq);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_audit_logs_resource_id ON audit_logs(resource_id);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES
+			('audit.export', 'audit', 'export')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// Each audit sink's position in the log, and what it gave up on
+		`CREATE TABLE IF NOT EXISTS audit_sink_cursors (
+			sink VARCHAR(100) PRIMARY KEY,
+			last_seq BIGINT NOT NULL DEFAULT 0,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS audit_dead_letters (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			sink VARCHAR(100) NOT NULL,
+			seq BIGINT NOT NULL,
+			record JSONB NOT NULL,
+			error TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_audit_dead_letters_sink ON audit_dead_letters(sink, created_at);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES
+			('audit.sinks', 'audit', 'sinks')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// Retention: archival picks expired entries by age
+		`CREATE INDEX IF NOT EXISTS idx_audit_logs_created_at ON audit_logs(created_at);`,
+
+		`CREATE TABLE IF NOT EXISTS audit_retention_rules (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			action VARCHAR(255) UNIQUE NOT NULL,
+			retention_days INTEGER NOT NULL CHECK (retention_days > 0),
+			created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS audit_legal_holds (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			user_id UUID,
+			resource_id UUID,
+			reason TEXT NOT NULL,
+			created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			released_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			released_at TIMESTAMP,
+			CHECK (user_id IS NOT NULL OR resource_id IS NOT NULL)
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_audit_legal_holds_active ON audit_legal_holds(user_id, resource_id) WHERE released_at IS NULL;`,
+
+		`CREATE TABLE IF NOT EXISTS audit_archives (
+			id UUID PRIMARY KEY,
+			location TEXT NOT NULL,
+			first_seq BIGINT NOT NULL,
+			last_seq BIGINT NOT NULL,
+			entries INTEGER NOT NULL,
+			sha256 VARCHAR(64) NOT NULL,
+			key_id UUID NOT NULL REFERENCES audit_checkpoint_keys(id),
+			signature TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		// What is left of a purged entry: enough to keep the chain linked
+		`CREATE TABLE IF NOT EXISTS audit_tombstones (
+			seq BIGINT PRIMARY KEY,
+			prev_hash VARCHAR(64) NOT NULL,
+			hash VARCHAR(64) NOT NULL,
+			archive_id UUID NOT NULL REFERENCES audit_archives(id)
+		);`,
+
+		// Archived entries loaded back for an investigation
+		`CREATE TABLE IF NOT EXISTS audit_restored (
+			seq BIGINT PRIMARY KEY,
+			id UUID NOT NULL,
+			user_id UUID,
+			action VARCHAR(255) NOT NULL,
+			resource VARCHAR(255) NOT NULL,
+			resource_id UUID,
+			details JSONB,
+			ip_address INET,
+			user_agent TEXT,
+			created_at TIMESTAMP NOT NULL,
+			prev_hash VARCHAR(64),
+			hash VARCHAR(64),
+			archive_id UUID NOT NULL,
+			restored_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES
+			('audit.retention', 'audit', 'retention'),
+			('audit.legal_hold', 'audit', 'legal_hold')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		`CREATE TABLE IF NOT EXISTS alert_rules (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			name VARCHAR(255) UNIQUE NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			type VARCHAR(50) NOT NULL,
+			action VARCHAR(255) NOT NULL,
+			match JSONB,
+			params JSONB NOT NULL DEFAULT '{}',
+			severity VARCHAR(20) NOT NULL DEFAULT 'medium',
+			notify JSONB NOT NULL DEFAULT '[]',
+			enabled BOOLEAN NOT NULL DEFAULT true,
+			created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE TABLE IF NOT EXISTS alerts (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			rule_id UUID REFERENCES alert_rules(id) ON DELETE SET NULL,
+			rule_name VARCHAR(255) NOT NULL,
+			severity VARCHAR(20) NOT NULL,
+			summary TEXT NOT NULL,
+			group_key TEXT,
+			seq BIGINT NOT NULL,
+			details JSONB,
+			status VARCHAR(20) NOT NULL DEFAULT 'open',
+			event_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			acknowledged_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			acknowledged_at TIMESTAMP,
+			resolved_by UUID REFERENCES users(id) ON DELETE SET NULL,
+			resolved_at TIMESTAMP,
+			UNIQUE (rule_id, seq)
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_alerts_status ON alerts(status, created_at);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_alerts_rule_group ON alerts(rule_id, group_key, event_at);`,
+
+		`CREATE TABLE IF NOT EXISTS alert_notifications (
+			id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+			alert_id UUID NOT NULL REFERENCES alerts(id) ON DELETE CASCADE,
+			notifier VARCHAR(50) NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			sent_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+
+		`CREATE INDEX IF NOT EXISTS idx_alert_notifications_pending ON alert_notifications(next_attempt_at) WHERE sent_at IS NULL;`,
+
+		// Starter rules; edit or disable them through the API
+		`INSERT INTO alert_rules (name, description, type, action, params, severity) VALUES
+			('Repeated login failures', 'Five failed logins for one username within ten minutes', 'threshold',
+			 'auth.login.failed', '{"count": 5, "window_minutes": 10, "group_by": "username"}', 'high'),
+			('Secret read outside business hours', 'Secret values read outside 08:00-18:00 UTC on weekdays', 'off_hours',
+			 'secrets.read', '{"timezone": "UTC", "start": "08:00", "end": "18:00", "weekdays": [1, 2, 3, 4, 5]}', 'medium')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// Matched on the admin role's ID, which survives a rename
+		`INSERT INTO alert_rules (name, description, type, action, match, severity)
+			SELECT 'Admin role granted', 'The admin role was assigned to a user', 'match',
+			       'users.assign_role', jsonb_build_object('role_id', id), 'critical'
+			FROM roles WHERE name = 'admin'
+			ON CONFLICT (name) DO NOTHING;`,
+
+		`INSERT INTO alert_rules (name, description, type, action, match, severity)
+			SELECT 'Admin role granted on request', 'An access request for the admin role was approved', 'match',
+			       'access.request.approve', jsonb_build_object('role_id', id), 'critical'
+			FROM roles WHERE name = 'admin'
+			ON CONFLICT (name) DO NOTHING;`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES
+			('alerts.read', 'alerts', 'read'),
+			('alerts.manage', 'alerts', 'manage'),
+			('alerts.rules', 'alerts', 'rules')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		`CREATE TABLE IF NOT EXISTS login_attempts (
+			scope VARCHAR(10) NOT NULL,
+			key VARCHAR(255) NOT NULL,
+			failures INTEGER NOT NULL DEFAULT 0,
+			lockouts INTEGER NOT NULL DEFAULT 0,
+			last_failure_at TIMESTAMP,
+			next_attempt_at TIMESTAMP,
+			locked_until TIMESTAMP,
+			PRIMARY KEY (scope, key)
+		);`,
+
+		`INSERT INTO permissions (name, resource, action) VALUES
+			('users.unlock', 'users', 'unlock')
+			ON CONFLICT (name) DO NOTHING;`,
+
+		// The admin role always holds every permission, including ones added
+		// by later migrations.
+		`INSERT INTO role_permissions (role_id, permission_id)
+			SELECT r.id, p.id FROM roles r, permissions p
+			WHERE r.name = 'admin'
+			ON CONFLICT DO NOTHING;`,
 	}
 
 	for _, migration := range migrations {
@@ -0,0 +1,334 @@
+package dynamic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrNotAllowed is returned when the user holds none of the database
+	// role's allowed roles.
+	ErrNotAllowed = errors.New("not allowed to request credentials for this database role")
+	// ErrTTLTooLong is returned when a lease would outlive the role's max TTL.
+	ErrTTLTooLong = errors.New("ttl exceeds the database role's max_ttl")
+)
+
+// TargetError wraps a failure reported by the target database, as opposed
+// to a failure in the platform's own database.
+type TargetError struct {
+	Err error
+}
+
+func (e *TargetError) Error() string { return "target database: " + e.Err.Error() }
+
+func (e *TargetError) Unwrap() error { return e.Err }
+
+// revokeStatement drops a login along with anything it created.
+const revokeStatement = `REASSIGN OWNED BY {{name}} TO CURRENT_USER;
+DROP OWNED BY {{name}};
+DROP ROLE {{name}};`
+
+type Lease struct {
+	ID             uuid.UUID       `json:"id"`
+	DatabaseRoleID uuid.UUID       `json:"database_role_id"`
+	DatabaseRole   string          `json:"database_role"`
+	UserID         uuid.UUID       `json:"user_id"`
+	Username       string          `json:"username"`
+	LoginName      string          `json:"login_name"`
+	Status         string          `json:"status"`
+	IssuedAt       time.Time       `json:"issued_at"`
+	ExpiresAt      time.Time       `json:"expires_at"`
+	MaxExpiresAt   time.Time       `json:"max_expires_at"`
+	RevokedAt      *time.Time      `json:"revoked_at,omitempty"`
+	RevokedBy      *uuid.UUID      `json:"revoked_by,omitempty"`
+	RevokeReason   *string         `json:"revoke_reason,omitempty"`
+	LastError      *string         `json:"last_error,omitempty"`
+	Connection     *ConnectionInfo `json:"connection,omitempty"`
+}
+
+// Credentials is what an issued lease hands back once; the password is
+// never stored.
+type Credentials struct {
+	Lease    *Lease `json:"lease"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+const leaseSelect = `
+	SELECT l.id, l.database_role_id, d.name, l.user_id, u.username, l.username, l.status,
+	       l.issued_at, l.expires_at, l.max_expires_at, l.revoked_at, l.revoked_by,
+	       l.revoke_reason, l.last_error
+	FROM database_leases l
+	JOIN database_roles d ON d.id = l.database_role_id
+	JOIN users u ON u.id = l.user_id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanLease(row rowScanner) (*Lease, error) {
+	var l Lease
+	if err := row.Scan(&l.ID, &l.DatabaseRoleID, &l.DatabaseRole, &l.UserID, &l.Username,
+		&l.LoginName, &l.Status, &l.IssuedAt, &l.ExpiresAt, &l.MaxExpiresAt, &l.RevokedAt,
+		&l.RevokedBy, &l.RevokeReason, &l.LastError); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// Issue creates a login on the role's target database for ttl, or the
+// role's default TTL when ttl is zero. The lease row is written before the
+// login is created, so a crash in between still gets the login dropped on
+// expiry.
+func (m *Manager) Issue(ctx context.Context, roleID, userID uuid.UUID, username string, ttl time.Duration) (*Credentials, error) {
+	role, err := m.loadRole(m.db, roleID)
+	if err != nil {
+		return nil, err
+	}
+	if ttl == 0 {
+		ttl = role.defaultTTL
+	}
+	if ttl > role.maxTTL {
+		return nil, ErrTTLTooLong
+	}
+
+	allowed, err := m.resolver.HoldsAnyRole(userID.String(), role.allowedRoleIDs)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrNotAllowed
+	}
+
+	name, err := loginName(username, role.name)
+	if err != nil {
+		return nil, err
+	}
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+
+	var leaseID uuid.UUID
+	if err := m.db.QueryRow(`
+		INSERT INTO database_leases (database_role_id, user_id, username, expires_at, max_expires_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP + make_interval(secs => $4), CURRENT_TIMESTAMP + make_interval(secs => $5))
+		RETURNING id`,
+		roleID, userID, name, ttl.Seconds(), role.maxTTL.Seconds(),
+	).Scan(&leaseID); err != nil {
+		return nil, err
+	}
+	lease, err := scanLease(m.db.QueryRow(leaseSelect+` WHERE l.id = $1`, leaseID))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	statements := expand(createStatement+"\n"+role.grants, name, password, lease.ExpiresAt)
+	if err := execTarget(ctx, role.connectionURL, statements); err != nil {
+		// Nothing was created on the target, so the lease can go
+		m.db.Exec(`DELETE FROM database_leases WHERE id = $1`, leaseID)
+		return nil, &TargetError{Err: err}
+	}
+
+	info := connectionInfo(role.connectionURL)
+	lease.Connection = &info
+	return &Credentials{Lease: lease, Username: name, Password: password}, nil
+}
+
+// Renew extends an active lease by increment, or the role's default TTL
+// when increment is zero, but never past the lease's max_expires_at.
+func (m *Manager) Renew(ctx context.Context, leaseID uuid.UUID, increment time.Duration) (*Lease, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	lease, err := lockLease(tx, leaseID)
+	if err != nil {
+		return nil, err
+	}
+	role, err := m.loadRole(tx, lease.DatabaseRoleID)
+	if err != nil {
+		return nil, err
+	}
+	if increment == 0 {
+		increment = role.defaultTTL
+	}
+
+	var expiresAt time.Time
+	if err := tx.QueryRow(`
+		SELECT LEAST(CURRENT_TIMESTAMP + make_interval(secs => $2), max_expires_at)
+		FROM database_leases WHERE id = $1`,
+		leaseID, increment.Seconds(),
+	).Scan(&expiresAt); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	statement := expand(`ALTER ROLE {{name}} VALID UNTIL {{expiration}};`, lease.LoginName, "", expiresAt)
+	if err := execTarget(ctx, role.connectionURL, statement); err != nil {
+		return nil, &TargetError{Err: err}
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE database_leases SET expires_at = $2, last_error = NULL WHERE id = $1`,
+		leaseID, expiresAt,
+	); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return m.Lease(leaseID)
+}
+
+// Revoke drops an active lease's login, ending its open sessions. reason is
+// "expired" for leases that ran out and is recorded on the lease. If the
+// target database refuses, the lease stays active with last_error set so
+// the expirer tries again.
+func (m *Manager) Revoke(ctx context.Context, leaseID uuid.UUID, revokedBy *uuid.UUID, reason string) (*Lease, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	lease, err := lockLease(tx, leaseID)
+	if err != nil {
+		return nil, err
+	}
+	role, err := m.loadRole(tx, lease.DatabaseRoleID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	if err := dropLogin(ctx, role.connectionURL, lease.LoginName); err != nil {
+		tx.Exec(`UPDATE database_leases SET last_error = $2 WHERE id = $1`, leaseID, err.Error())
+		tx.Commit()
+		return nil, &TargetError{Err: err}
+	}
+
+	status := "revoked"
+	if reason == "expired" {
+		status = "expired"
+	}
+	if _, err := tx.Exec(`
+		UPDATE database_leases
+		SET status = $2, revoked_at = CURRENT_TIMESTAMP, revoked_by = $3, revoke_reason = $4, last_error = NULL
+		WHERE id = $1`,
+		leaseID, status, revokedBy, reason,
+	); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return m.Lease(leaseID)
+}
+
+// Lease returns a lease by ID.
+func (m *Manager) Lease(leaseID uuid.UUID) (*Lease, error) {
+	lease, err := scanLease(m.db.QueryRow(leaseSelect+` WHERE l.id = $1`, leaseID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return lease, err
+}
+
+// Leases lists leases, newest first. A nil userID lists everyone's; an
+// empty status lists every status.
+func (m *Manager) Leases(userID *uuid.UUID, status string) ([]Lease, error) {
+	rows, err := m.db.Query(leaseSelect+`
+		WHERE ($1::uuid IS NULL OR l.user_id = $1) AND ($2::text = '' OR l.status = $2)
+		ORDER BY l.issued_at DESC`,
+		userID, status,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leases := []Lease{}
+	for rows.Next() {
+		lease, err := scanLease(rows)
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, *lease)
+	}
+	return leases, rows.Err()
+}
+
+// ExpiredLeases lists active leases whose TTL has run out.
+func (m *Manager) ExpiredLeases() ([]uuid.UUID, error) {
+	rows, err := m.db.Query(`
+		SELECT id FROM database_leases
+		WHERE status = 'active' AND expires_at <= CURRENT_TIMESTAMP
+		ORDER BY expires_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leaseIDs []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		leaseIDs = append(leaseIDs, id)
+	}
+	return leaseIDs, rows.Err()
+}
+
+// lockLease loads an active lease and holds its row until tx ends.
+func lockLease(tx *sql.Tx, leaseID uuid.UUID) (*Lease, error) {
+	var status string
+	err := tx.QueryRow(`SELECT status FROM database_leases WHERE id = $1 FOR UPDATE`, leaseID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status != "active" {
+		return nil, ErrLeaseClosed
+	}
+	return scanLease(tx.QueryRow(leaseSelect+` WHERE l.id = $1`, leaseID))
+}
+
+// dropLogin removes a login from the target database. A login that is
+// already gone counts as dropped.
+func dropLogin(ctx context.Context, connectionURL, name string) error {
+	target, err := sql.Open("postgres", connectionURL)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	var exists bool
+	if err := target.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)`, name,
+	).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	// Cut off sessions still using the login. This needs pg_signal_backend,
+	// so it is best effort; VALID UNTIL already blocks new logins.
+	target.ExecContext(ctx, `SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE usename = $1`, name)
+
+	return execTarget(ctx, connectionURL, expand(revokeStatement, name, "", time.Time{}))
+}
@@ -4,96 +4,231 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"database/sql"
 	"encoding/base64"
 	"fmt"
 	"io"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/kms"
+	"strings"
+	"sync"
+	"time"
 )
 
+// legacyKey is the static key secrets were encrypted with before envelope
+// encryption. It is only ever used to read those old values.
+var legacyKey = []byte("0123456789abcdef0123456789abcdef")
+
+// Service encrypts data with envelope encryption: every value gets its own
+// data key, wrapped by the active master key in the keyring. Master keys are
+// in turn wrapped by the key provider and stored in encryption_keys.
+//
+// Encrypted data carries a "v<version>:" header naming the master key that
+// wrapped its data key.
 type Service struct {
-	kmsClient *kms.KMS
-	keyID     string
+	db       *sql.DB
+	provider KeyProvider
+
+	mu         sync.RWMutex
+	keys       map[int][]byte
+	versions   []MasterKey
+	active     int
+	lastReload time.Time
 }
 
-func NewService(region, keyID string) *Service {
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	}))
+func NewService(db *sql.DB, provider KeyProvider) (*Service, error) {
+	s := &Service{
+		db:       db,
+		provider: provider,
+		keys:     map[int][]byte{},
+	}
 
-	return &Service{
-		kmsClient: kms.New(sess),
-		keyID:     keyID,
+	if err := s.Reload(); err != nil {
+		return nil, err
 	}
+	if s.ActiveVersion() == 0 {
+		if _, err := s.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
 }
 
-// For demo purposes, using a mock encryption key
-// In production, this would fetch from AWS KMS
-func (s *Service) getEncryptionKey() ([]byte, error) {
-	// In real implementation, this would call AWS KMS
-	// For demo, using a static key (DO NOT use in production)
-	// Must be a valid AES key size: 16, 24, or 32 bytes. Using 32 bytes here.
-	return []byte("0123456789abcdef0123456789abcdef"), nil
+// EncryptEnvelope encrypts plaintext under a fresh data key and returns the
+// ciphertext and the wrapped data key, both base64-encoded, to be stored
+// side by side.
+func (s *Service) EncryptEnvelope(plaintext string) (string, string, error) {
+	version, masterKey, err := s.activeKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", "", err
+	}
+	defer zero(dataKey)
+
+	wrappedKey, err := seal(masterKey, dataKey)
+	if err != nil {
+		return "", "", err
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", "", err
+	}
+
+	return VersionPrefix(version) + base64.StdEncoding.EncodeToString(ciphertext),
+		base64.StdEncoding.EncodeToString(wrappedKey), nil
 }
 
-func (s *Service) Encrypt(plaintext string) (string, error) {
-	key, err := s.getEncryptionKey()
+// DecryptEnvelope reverses EncryptEnvelope. It also reads values written
+// before the keyring, whose data key was wrapped by the key provider
+// directly, and before envelope encryption, which have no data key at all.
+func (s *Service) DecryptEnvelope(encryptedData, encryptedKey string) (string, error) {
+	version, encoded := splitVersion(encryptedData)
+	data, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
 		return "", err
 	}
 
-	block, err := aes.NewCipher(key)
+	if encryptedKey == "" {
+		plaintext, err := open(legacyKey, data)
+		if err != nil {
+			return "", err
+		}
+		return string(plaintext), nil
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(encryptedKey)
 	if err != nil {
 		return "", err
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	var dataKey []byte
+	if version == 0 {
+		dataKey, err = s.provider.DecryptDataKey(wrappedKey)
+	} else {
+		var masterKey []byte
+		if masterKey, err = s.masterKey(version); err == nil {
+			dataKey, err = open(masterKey, wrappedKey)
+		}
+	}
 	if err != nil {
 		return "", err
 	}
+	defer zero(dataKey)
 
-	nonce := make([]byte, aesGCM.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	plaintext, err := open(dataKey, data)
+	if err != nil {
 		return "", err
 	}
+	return string(plaintext), nil
+}
+
+// Reencrypt moves a value onto the active master key. It reports false when
+// the value already uses it.
+func (s *Service) Reencrypt(encryptedData, encryptedKey string) (string, string, bool, error) {
+	if encryptedKey != "" && KeyVersion(encryptedData) == s.ActiveVersion() {
+		return encryptedData, encryptedKey, false, nil
+	}
 
-	ciphertext := aesGCM.Seal(nonce, nonce, []byte(plaintext), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	plaintext, err := s.DecryptEnvelope(encryptedData, encryptedKey)
+	if err != nil {
+		return "", "", false, err
+	}
+	newData, newKey, err := s.EncryptEnvelope(plaintext)
+	if err != nil {
+		return "", "", false, err
+	}
+	return newData, newKey, true, nil
 }
 
-func (s *Service) Decrypt(encryptedData string) (string, error) {
-	key, err := s.getEncryptionKey()
+// Encrypt is EncryptEnvelope for callers that store a single value: the
+// wrapped key and ciphertext are joined as "<key>.<data>".
+func (s *Service) Encrypt(plaintext string) (string, error) {
+	encryptedData, encryptedKey, err := s.EncryptEnvelope(plaintext)
 	if err != nil {
 		return "", err
 	}
+	return encryptedKey + "." + encryptedData, nil
+}
+
+func (s *Service) Decrypt(encrypted string) (string, error) {
+	encryptedKey, encryptedData, found := strings.Cut(encrypted, ".")
+	if !found {
+		// Standard base64 has no '.', so this predates envelope encryption
+		return s.DecryptEnvelope(encrypted, "")
+	}
+	return s.DecryptEnvelope(encryptedData, encryptedKey)
+}
+
+// ReencryptValue is Reencrypt for values stored by Encrypt.
+func (s *Service) ReencryptValue(encrypted string) (string, bool, error) {
+	encryptedKey, encryptedData, found := strings.Cut(encrypted, ".")
+	if !found {
+		encryptedKey, encryptedData = "", encrypted
+	}
+	newData, newKey, changed, err := s.Reencrypt(encryptedData, encryptedKey)
+	if err != nil || !changed {
+		return encrypted, false, err
+	}
+	return newKey + "." + newData, true, nil
+}
 
-	data, err := base64.StdEncoding.DecodeString(encryptedData)
+// Seal encrypts plaintext under a caller-held 32-byte key with the same
+// AES-256-GCM construction the service uses for its own data. The nonce is
+// prepended to the result.
+func Seal(key, plaintext []byte) ([]byte, error) {
+	return seal(key, plaintext)
+}
+
+// Open reverses Seal.
+func Open(key, data []byte) ([]byte, error) {
+	return open(key, data)
+}
+
+// seal encrypts with AES-256-GCM and prepends the nonce.
+func seal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aesGCM.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
 	}
 
+	return aesGCM.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, data []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	nonceSize := aesGCM.NonceSize()
 	if len(data) < nonceSize {
-		return "", fmt.Errorf("ciphertext too short")
+		return nil, fmt.Errorf("ciphertext too short")
 	}
 
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return "", err
-	}
+	return aesGCM.Open(nil, nonce, ciphertext, nil)
+}
 
-	return string(plaintext), nil
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
 }
@@ -0,0 +1,214 @@
+package encryption
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyringReloadInterval bounds how long an instance keeps encrypting under a
+// master key that another instance has already rotated out.
+const keyringReloadInterval = time.Minute
+
+// MasterKey describes one version in the keyring. The key material itself is
+// only held in memory, unwrapped by the key provider.
+type MasterKey struct {
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+	Active    bool       `json:"active"`
+}
+
+// Reload refreshes the keyring from the database.
+func (s *Service) Reload() error {
+	rows, err := s.db.Query(`
+		SELECT version, wrapped_key, created_at, retired_at
+		FROM encryption_keys
+		ORDER BY version DESC`)
+	if err != nil {
+		return fmt.Errorf("failed to load encryption keys: %v", err)
+	}
+	defer rows.Close()
+
+	keys := map[int][]byte{}
+	var versions []MasterKey
+	active := 0
+	for rows.Next() {
+		var (
+			key        MasterKey
+			wrappedKey string
+			retiredAt  sql.NullTime
+		)
+		if err := rows.Scan(&key.Version, &wrappedKey, &key.CreatedAt, &retiredAt); err != nil {
+			return err
+		}
+		if retiredAt.Valid {
+			key.RetiredAt = &retiredAt.Time
+		} else if active == 0 {
+			active = key.Version
+			key.Active = true
+		}
+
+		wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+		if err != nil {
+			return fmt.Errorf("failed to decode master key v%d: %v", key.Version, err)
+		}
+		material, err := s.provider.DecryptDataKey(wrapped)
+		if err != nil {
+			return fmt.Errorf("failed to unwrap master key v%d: %v", key.Version, err)
+		}
+
+		keys[key.Version] = material
+		versions = append(versions, key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.versions = versions
+	s.active = active
+	s.lastReload = time.Now()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Rotate adds a new master key version and makes it active. Retired versions
+// stay in the keyring so existing ciphertext keeps decrypting until it has
+// been re-encrypted.
+func (s *Service) Rotate() (int, error) {
+	material, wrapped, err := s.provider.GenerateDataKey()
+	if err != nil {
+		return 0, err
+	}
+	// The material is loaded back through Reload like every other version
+	zero(material)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Serialize rotations across instances
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('encryption_keys'))`); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE encryption_keys SET retired_at = CURRENT_TIMESTAMP
+		WHERE retired_at IS NULL`,
+	); err != nil {
+		return 0, err
+	}
+
+	var version int
+	if err := tx.QueryRow(`
+		INSERT INTO encryption_keys (version, wrapped_key)
+		SELECT COALESCE(MAX(version), 0) + 1, $1 FROM encryption_keys
+		RETURNING version`,
+		base64.StdEncoding.EncodeToString(wrapped),
+	).Scan(&version); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if err := s.Reload(); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Keys returns the keyring, newest version first.
+func (s *Service) Keys() []MasterKey {
+	s.maybeReload()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]MasterKey(nil), s.versions...)
+}
+
+// ActiveVersion is the master key version new values are encrypted under.
+func (s *Service) ActiveVersion() int {
+	s.maybeReload()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active
+}
+
+// KeyVersion reports the master key version encryptedData was written under.
+// Zero means it predates the keyring.
+func KeyVersion(encryptedData string) int {
+	version, _ := splitVersion(encryptedData)
+	return version
+}
+
+// VersionPrefix is the header every value encrypted under version carries.
+func VersionPrefix(version int) string {
+	return "v" + strconv.Itoa(version) + ":"
+}
+
+func splitVersion(encryptedData string) (int, string) {
+	header, rest, found := strings.Cut(encryptedData, ":")
+	if !found || !strings.HasPrefix(header, "v") {
+		return 0, encryptedData
+	}
+	version, err := strconv.Atoi(header[1:])
+	if err != nil {
+		return 0, encryptedData
+	}
+	return version, rest
+}
+
+func (s *Service) activeKey() (int, []byte, error) {
+	s.maybeReload()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.active == 0 {
+		return 0, nil, fmt.Errorf("no active master key")
+	}
+	return s.active, s.keys[s.active], nil
+}
+
+// masterKey looks up a version, reloading once if another instance may have
+// rotated since the last load.
+func (s *Service) masterKey(version int) ([]byte, error) {
+	s.mu.RLock()
+	key := s.keys[version]
+	stale := time.Since(s.lastReload) > 5*time.Second
+	s.mu.RUnlock()
+
+	if key == nil && stale {
+		if err := s.Reload(); err != nil {
+			return nil, err
+		}
+		s.mu.RLock()
+		key = s.keys[version]
+		s.mu.RUnlock()
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown master key version %d", version)
+	}
+	return key, nil
+}
+
+func (s *Service) maybeReload() {
+	s.mu.RLock()
+	stale := time.Since(s.lastReload) > keyringReloadInterval
+	s.mu.RUnlock()
+	if stale {
+		if err := s.Reload(); err != nil {
+			println("Failed to reload encryption keys:", err.Error())
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ProviderLocal      = "local"
+	ProviderKMS        = "kms"
+	ProviderPassphrase = "passphrase"
+)
+
+// dataKeySize is the size of every data and master key: AES-256.
+const dataKeySize = 32
+
+// KeyProvider issues data keys and unwraps them again. The master key that
+// wraps data keys never leaves the provider.
+type KeyProvider interface {
+	// GenerateDataKey returns a fresh data key in plaintext together with
+	// the same key wrapped by the master key.
+	GenerateDataKey() (plaintext, wrapped []byte, err error)
+	// DecryptDataKey unwraps a key previously returned by GenerateDataKey.
+	DecryptDataKey(wrapped []byte) ([]byte, error)
+}
+
+type ProviderConfig struct {
+	// Type is one of ProviderLocal, ProviderKMS or ProviderPassphrase
+	Type string
+
+	// Local: base64-encoded 32-byte key, or a file holding one
+	MasterKey     string
+	MasterKeyFile string
+
+	// Passphrase: master key derived with scrypt
+	Passphrase     string
+	PassphraseSalt string
+
+	// KMS: Endpoint overrides the AWS endpoint, e.g. a local KMS stand-in
+	AWSRegion   string
+	KMSKeyID    string
+	KMSEndpoint string
+}
+
+// NewProvider builds the key provider selected by cfg.Type.
+func NewProvider(cfg ProviderConfig) (KeyProvider, error) {
+	switch cfg.Type {
+	case ProviderLocal:
+		encoded := cfg.MasterKey
+		if cfg.MasterKeyFile != "" {
+			contents, err := os.ReadFile(cfg.MasterKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("read master key file: %w", err)
+			}
+			encoded = strings.TrimSpace(string(contents))
+		}
+		if encoded == "" {
+			return nil, fmt.Errorf("local key provider requires ENCRYPTION_MASTER_KEY or ENCRYPTION_MASTER_KEY_FILE")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("master key must be base64: %w", err)
+		}
+		return NewLocalKeyProvider(key)
+	case ProviderPassphrase:
+		return NewPassphraseKeyProvider(cfg.Passphrase, cfg.PassphraseSalt)
+	case ProviderKMS:
+		return NewKMSKeyProvider(cfg.AWSRegion, cfg.KMSKeyID, cfg.KMSEndpoint)
+	default:
+		return nil, fmt.Errorf("unknown key provider %q", cfg.Type)
+	}
+}
+
+// LocalKeyProvider wraps data keys with a master key held in process memory,
+// loaded from the environment or a file.
+type LocalKeyProvider struct {
+	masterKey []byte
+}
+
+func NewLocalKeyProvider(masterKey []byte) (*LocalKeyProvider, error) {
+	if len(masterKey) != dataKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", dataKeySize, len(masterKey))
+	}
+	return &LocalKeyProvider{masterKey: masterKey}, nil
+}
+
+func (p *LocalKeyProvider) GenerateDataKey() ([]byte, []byte, error) {
+	plaintext := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := seal(p.masterKey, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, wrapped, nil
+}
+
+func (p *LocalKeyProvider) DecryptDataKey(wrapped []byte) ([]byte, error) {
+	return open(p.masterKey, wrapped)
+}
+
+// PassphraseKeyProvider derives the master key from an operator-supplied
+// passphrase. The salt must stay the same for the lifetime of the data.
+type PassphraseKeyProvider struct {
+	*LocalKeyProvider
+}
+
+func NewPassphraseKeyProvider(passphrase, salt string) (*PassphraseKeyProvider, error) {
+	if passphrase == "" || salt == "" {
+		return nil, fmt.Errorf("passphrase key provider requires ENCRYPTION_PASSPHRASE and ENCRYPTION_PASSPHRASE_SALT")
+	}
+	key, err := scrypt.Key([]byte(passphrase), []byte(salt), 1<<15, 8, 1, dataKeySize)
+	if err != nil {
+		return nil, err
+	}
+	local, err := NewLocalKeyProvider(key)
+	if err != nil {
+		return nil, err
+	}
+	return &PassphraseKeyProvider{LocalKeyProvider: local}, nil
+}
+
+// KMSKeyProvider asks AWS KMS for data keys, so the master key never leaves
+// KMS. Set endpoint to point at a KMS-compatible stand-in such as local-kms
+// or LocalStack.
+type KMSKeyProvider struct {
+	client *kms.KMS
+	keyID  string
+}
+
+func NewKMSKeyProvider(region, keyID, endpoint string) (*KMSKeyProvider, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("kms key provider requires KMS_KEY_ID")
+	}
+	awsConfig := &aws.Config{Region: aws.String(region)}
+	if endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &KMSKeyProvider{
+		client: kms.New(sess),
+		keyID:  keyID,
+	}, nil
+}
+
+func (p *KMSKeyProvider) GenerateDataKey() ([]byte, []byte, error) {
+	out, err := p.client.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(p.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("kms generate data key: %w", err)
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+func (p *KMSKeyProvider) DecryptDataKey(wrapped []byte) ([]byte, error) {
+	out, err := p.client.Decrypt(&kms.DecryptInput{
+		KeyId:          aws.String(p.keyID),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms decrypt data key: %w", err)
+	}
+	return out.Plaintext, nil
+}
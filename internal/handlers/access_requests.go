@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/models"
+	"idam-pam-platform/internal/rbac"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// AccessRequestHandler implements just-in-time privileged access: users ask
+// for a role for a bounded time with a justification, an approver with
+// access.approve decides, and the resulting grant lapses on its own.
+type AccessRequestHandler struct {
+	db          *sql.DB
+	resolver    *rbac.Resolver
+	maxDuration time.Duration
+	auditor
+}
+
+func NewAccessRequestHandler(db *sql.DB, resolver *rbac.Resolver, maxDuration time.Duration, auditLog *audit.Logger) *AccessRequestHandler {
+	return &AccessRequestHandler{
+		db:          db,
+		resolver:    resolver,
+		maxDuration: maxDuration,
+		auditor:     auditor{auditLog},
+	}
+}
+
+func (h *AccessRequestHandler) CreateRequest(c *fiber.Ctx) error {
+	var req struct {
+		RoleID        uuid.UUID `json:"role_id"`
+		Duration      string    `json:"duration"`
+		Justification string    `json:"justification"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Duration must be a positive duration such as 2h or 30m"})
+	}
+	if duration > h.maxDuration {
+		return c.Status(400).JSON(fiber.Map{"error": "Duration exceeds the maximum of " + h.maxDuration.String()})
+	}
+	req.Justification = strings.TrimSpace(req.Justification)
+	if req.Justification == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Justification is required"})
+	}
+
+	var roleName string
+	if err := h.db.QueryRow(`SELECT name FROM roles WHERE id = $1`, req.RoleID).Scan(&roleName); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Role not found"})
+	}
+
+	uid := currentUserID(c)
+
+	var pending bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM access_requests
+			WHERE user_id = $1 AND role_id = $2 AND status = 'pending'
+		)`,
+		uid, req.RoleID,
+	).Scan(&pending)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create access request"})
+	}
+	if pending {
+		return c.Status(409).JSON(fiber.Map{"error": "You already have a pending request for this role"})
+	}
+
+	var requestID uuid.UUID
+	err = h.db.QueryRow(`
+		INSERT INTO access_requests (user_id, role_id, justification, duration_seconds)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`,
+		uid, req.RoleID, req.Justification, int(duration.Seconds()),
+	).Scan(&requestID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create access request"})
+	}
+
+	h.logAudit(c, &uid, "access.request.create", "access_requests", &requestID, map[string]interface{}{
+		"role_id":       req.RoleID,
+		"role_name":     roleName,
+		"duration":      duration.String(),
+		"justification": req.Justification,
+	})
+
+	return c.JSON(fiber.Map{
+		"id":      requestID,
+		"message": "Access request submitted",
+	})
+}
+
+// GetRequests lists the caller's own requests. Approvers see everyone's.
+// Filter with ?status=pending.
+func (h *AccessRequestHandler) GetRequests(c *fiber.Ctx) error {
+	uid := currentUserID(c)
+	canApprove, err := h.resolver.HasPermission(uid.String(), "access.approve")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve permissions"})
+	}
+
+	query := accessRequestSelect + ` WHERE ($1::text = '' OR ar.status = $1)`
+	args := []interface{}{c.Query("status")}
+	if !canApprove {
+		query += ` AND ar.user_id = $2`
+		args = append(args, uid)
+	}
+	query += ` ORDER BY ar.created_at DESC`
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch access requests"})
+	}
+	defer rows.Close()
+
+	var requests []models.AccessRequest
+	for rows.Next() {
+		request, err := scanAccessRequest(rows)
+		if err != nil {
+			continue
+		}
+		requests = append(requests, *request)
+	}
+
+	return c.JSON(requests)
+}
+
+func (h *AccessRequestHandler) GetRequest(c *fiber.Ctx) error {
+	requestID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request ID"})
+	}
+
+	request, err := scanAccessRequest(h.db.QueryRow(accessRequestSelect+` WHERE ar.id = $1`, requestID))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Access request not found"})
+	}
+
+	uid := currentUserID(c)
+	if request.UserID != uid {
+		canApprove, err := h.resolver.HasPermission(uid.String(), "access.approve")
+		if err != nil || !canApprove {
+			return c.Status(404).JSON(fiber.Map{"error": "Access request not found"})
+		}
+	}
+
+	return c.JSON(request)
+}
+
+// Approve grants the requested role until now + the requested duration.
+func (h *AccessRequestHandler) Approve(c *fiber.Ctx) error {
+	return h.decide(c, "approved")
+}
+
+func (h *AccessRequestHandler) Deny(c *fiber.Ctx) error {
+	return h.decide(c, "denied")
+}
+
+func (h *AccessRequestHandler) decide(c *fiber.Ctx, status string) error {
+	requestID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request ID"})
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+
+	uid := currentUserID(c)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update access request"})
+	}
+	defer tx.Rollback()
+
+	var (
+		requesterID     uuid.UUID
+		roleID          uuid.UUID
+		roleName        string
+		currentStatus   string
+		durationSeconds int
+	)
+	err = tx.QueryRow(`
+		SELECT ar.user_id, ar.role_id, r.name, ar.status, ar.duration_seconds
+		FROM access_requests ar
+		JOIN roles r ON r.id = ar.role_id
+		WHERE ar.id = $1
+		FOR UPDATE OF ar`,
+		requestID,
+	).Scan(&requesterID, &roleID, &roleName, &currentStatus, &durationSeconds)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Access request not found"})
+	}
+
+	if requesterID == uid {
+		return c.Status(403).JSON(fiber.Map{"error": "You cannot decide on your own access request"})
+	}
+	if currentStatus != "pending" {
+		return c.Status(409).JSON(fiber.Map{"error": "Access request is already " + currentStatus})
+	}
+
+	var expiresAt *time.Time
+	if status == "approved" {
+		t := time.Now().Add(time.Duration(durationSeconds) * time.Second)
+		expiresAt = &t
+
+		// A permanent assignment is never shortened, and an existing
+		// time-bound one is only ever extended
+		_, err = tx.Exec(`
+			INSERT INTO user_roles (user_id, role_id, expires_at, granted_by, request_id)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (user_id, role_id) DO UPDATE
+			SET expires_at = EXCLUDED.expires_at, granted_by = EXCLUDED.granted_by, request_id = EXCLUDED.request_id
+			WHERE user_roles.expires_at IS NOT NULL AND user_roles.expires_at < EXCLUDED.expires_at`,
+			requesterID, roleID, expiresAt, uid, requestID,
+		)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to grant role"})
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE access_requests
+		SET status = $2, decided_by = $3, decision_reason = NULLIF($4, ''),
+		    decided_at = CURRENT_TIMESTAMP, expires_at = $5
+		WHERE id = $1`,
+		requestID, status, uid, req.Reason, expiresAt,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update access request"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update access request"})
+	}
+	h.resolver.Invalidate(requesterID.String())
+
+	action := "access.request.deny"
+	if status == "approved" {
+		action = "access.request.approve"
+	}
+	h.logAudit(c, &uid, action, "access_requests", &requestID, map[string]interface{}{
+		"requester_id": requesterID,
+		"role_id":      roleID,
+		"role_name":    roleName,
+		"reason":       req.Reason,
+		"expires_at":   expiresAt,
+	})
+
+	return c.JSON(fiber.Map{
+		"message":    "Access request " + status,
+		"expires_at": expiresAt,
+	})
+}
+
+// Cancel withdraws the caller's own pending request.
+func (h *AccessRequestHandler) Cancel(c *fiber.Ctx) error {
+	requestID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request ID"})
+	}
+
+	uid := currentUserID(c)
+	result, err := h.db.Exec(`
+		UPDATE access_requests
+		SET status = 'cancelled', decided_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND user_id = $2 AND status = 'pending'`,
+		requestID, uid,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to cancel access request"})
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "No pending access request found"})
+	}
+
+	h.logAudit(c, &uid, "access.request.cancel", "access_requests", &requestID, nil)
+
+	return c.JSON(fiber.Map{"message": "Access request cancelled"})
+}
+
+const accessRequestSelect = `
+	SELECT ar.id, ar.user_id, u.username, ar.role_id, r.name, ar.justification,
+	       ar.duration_seconds, ar.status, ar.decided_by, ar.decision_reason,
+	       ar.decided_at, ar.expires_at, ar.created_at
+	FROM access_requests ar
+	JOIN users u ON u.id = ar.user_id
+	JOIN roles r ON r.id = ar.role_id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAccessRequest(row rowScanner) (*models.AccessRequest, error) {
+	var r models.AccessRequest
+	err := row.Scan(&r.ID, &r.UserID, &r.Username, &r.RoleID, &r.RoleName, &r.Justification,
+		&r.DurationSeconds, &r.Status, &r.DecidedBy, &r.DecisionReason,
+		&r.DecidedAt, &r.ExpiresAt, &r.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"idam-pam-platform/internal/alerts"
+	"idam-pam-platform/internal/audit"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type AlertHandler struct {
+	db *sql.DB
+	auditor
+}
+
+func NewAlertHandler(db *sql.DB, auditLog *audit.Logger) *AlertHandler {
+	return &AlertHandler{db: db, auditor: auditor{auditLog}}
+}
+
+// GetAlerts lists alerts newest first, optionally ?status=open,
+// acknowledged or resolved.
+func (h *AlertHandler) GetAlerts(c *fiber.Ctx) error {
+	status := c.Query("status")
+	if status != "" && status != "open" && status != "acknowledged" && status != "resolved" {
+		return c.Status(400).JSON(fiber.Map{"error": "status must be open, acknowledged or resolved"})
+	}
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+
+	list, err := alerts.ListAlerts(h.db, status, limit)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch alerts"})
+	}
+	return c.JSON(list)
+}
+
+func (h *AlertHandler) GetAlert(c *fiber.Ctx) error {
+	alertID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid alert ID"})
+	}
+
+	alert, err := alerts.GetAlert(h.db, alertID)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Alert not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch alert"})
+	}
+	return c.JSON(alert)
+}
+
+// AcknowledgeAlert marks an open alert as being looked at.
+func (h *AlertHandler) AcknowledgeAlert(c *fiber.Ctx) error {
+	return h.setStatus(c, "acknowledged", `
+		UPDATE alerts SET status = 'acknowledged', acknowledged_by = $2, acknowledged_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'open'`)
+}
+
+// ResolveAlert closes an open or acknowledged alert.
+func (h *AlertHandler) ResolveAlert(c *fiber.Ctx) error {
+	return h.setStatus(c, "resolved", `
+		UPDATE alerts SET status = 'resolved', resolved_by = $2, resolved_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status <> 'resolved'`)
+}
+
+func (h *AlertHandler) setStatus(c *fiber.Ctx, status, query string) error {
+	alertID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid alert ID"})
+	}
+
+	uid := currentUserID(c)
+	result, err := h.db.Exec(query, alertID, uid)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update alert"})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		if _, err := alerts.GetAlert(h.db, alertID); err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Alert not found"})
+		}
+		return c.Status(409).JSON(fiber.Map{"error": "Alert cannot be " + status})
+	}
+
+	h.logAudit(c, &uid, "alerts."+status, "alerts", &alertID, nil)
+
+	return c.JSON(fiber.Map{"message": "Alert " + status})
+}
+
+// GetRules lists every alert rule, enabled or not.
+func (h *AlertHandler) GetRules(c *fiber.Ctx) error {
+	rules, err := alerts.LoadRules(h.db, false)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch alert rules"})
+	}
+	return c.JSON(rules)
+}
+
+// CreateRule adds a rule. It applies from the next batch of audit entries
+// the engine evaluates.
+func (h *AlertHandler) CreateRule(c *fiber.Ctx) error {
+	rule := alerts.Rule{Enabled: true}
+	if err := c.BodyParser(&rule); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if err := rule.Validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	uid := currentUserID(c)
+	match, params, notify := ruleJSON(&rule)
+	err := h.db.QueryRow(`
+		INSERT INTO alert_rules (name, description, type, action, match, params, severity, notify, enabled, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, created_at, updated_at`,
+		rule.Name, rule.Description, rule.Type, rule.Action, match, params, rule.Severity, notify, rule.Enabled, uid,
+	).Scan(&rule.ID, &rule.CreatedAt, &rule.UpdatedAt)
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "An alert rule with this name already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create alert rule"})
+	}
+
+	h.logAudit(c, &uid, "alerts.rule.create", "alerts", &rule.ID, rule)
+
+	return c.Status(201).JSON(rule)
+}
+
+// UpdateRule replaces a rule's definition.
+func (h *AlertHandler) UpdateRule(c *fiber.Ctx) error {
+	ruleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid rule ID"})
+	}
+
+	rule := alerts.Rule{Enabled: true}
+	if err := c.BodyParser(&rule); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if err := rule.Validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	match, params, notify := ruleJSON(&rule)
+	rule.ID = ruleID
+	err = h.db.QueryRow(`
+		UPDATE alert_rules
+		SET name = $2, description = $3, type = $4, action = $5, match = $6, params = $7, severity = $8,
+		    notify = $9, enabled = $10, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING created_at, updated_at`,
+		ruleID, rule.Name, rule.Description, rule.Type, rule.Action, match, params, rule.Severity, notify, rule.Enabled,
+	).Scan(&rule.CreatedAt, &rule.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Alert rule not found"})
+	}
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "An alert rule with this name already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update alert rule"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "alerts.rule.update", "alerts", &ruleID, rule)
+
+	return c.JSON(rule)
+}
+
+// DeleteRule removes a rule. Alerts it raised are kept.
+func (h *AlertHandler) DeleteRule(c *fiber.Ctx) error {
+	ruleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid rule ID"})
+	}
+
+	var name string
+	err = h.db.QueryRow(`DELETE FROM alert_rules WHERE id = $1 RETURNING name`, ruleID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Alert rule not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete alert rule"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "alerts.rule.delete", "alerts", &ruleID, map[string]interface{}{
+		"name": name,
+	})
+
+	return c.JSON(fiber.Map{"message": "Alert rule deleted"})
+}
+
+// ruleJSON encodes a rule's JSONB columns as text for lib/pq.
+func ruleJSON(rule *alerts.Rule) (sql.NullString, string, string) {
+	var match sql.NullString
+	if len(rule.Match) > 0 {
+		encoded, _ := json.Marshal(rule.Match)
+		match = sql.NullString{String: string(encoded), Valid: true}
+	}
+	params, _ := json.Marshal(rule.Params)
+	notify, _ := json.Marshal(rule.Notify)
+	return match, string(params), string(notify)
+}
@@ -1,106 +1,307 @@
 package handlers
 
 import (
+	"bufio"
 	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 
-	"idam-pam-platform/internal/models"
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/rbac"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
+// maxAuditPage is the most entries one GetAuditLogs page returns.
+const maxAuditPage = 1000
+
 type AuditHandler struct {
-	db *sql.DB
+	db       *sql.DB
+	resolver *rbac.Resolver
+	done     <-chan struct{}
+	auditor
 }
 
-func NewAuditHandler(db *sql.DB) *AuditHandler {
-	return &AuditHandler{db: db}
+// NewAuditHandler takes a channel that is closed when the server shuts
+// down, which ends open streams.
+func NewAuditHandler(db *sql.DB, resolver *rbac.Resolver, done <-chan struct{}, auditLog *audit.Logger) *AuditHandler {
+	return &AuditHandler{db: db, resolver: resolver, done: done, auditor: auditor{auditLog}}
 }
 
+// GetAuditLogs searches the audit log, newest first. Filters: user_id,
+// username, action (a trailing * matches by prefix), resource, resource_id,
+// ip (address or CIDR), since and until (RFC 3339) and q, free text in the
+// details. When more entries remain, X-Next-Cursor holds the cursor for the
+// next page.
 func (h *AuditHandler) GetAuditLogs(c *fiber.Ctx) error {
 	limit := c.QueryInt("limit", 100)
-	offset := c.QueryInt("offset", 0)
-
-	userID := c.Locals("userID").(string)
-	uid, _ := uuid.Parse(userID)
+	if limit < 1 || limit > maxAuditPage {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("limit must be between 1 and %d", maxAuditPage)})
+	}
+	var before int64
+	if cursor := c.Query("cursor"); cursor != "" {
+		var err error
+		if before, err = strconv.ParseInt(cursor, 10, 64); err != nil || before < 1 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid cursor"})
+		}
+	}
 
-	// If user is admin, return all logs; else, return self logs
-	var rows *sql.Rows
-	var err error
-	var isAdmin int
-	_ = h.db.QueryRow(`
-		SELECT 1 FROM user_roles ur
-		JOIN roles r ON r.id = ur.role_id
-		WHERE ur.user_id = $1 AND r.name = 'admin'
-		LIMIT 1
-	`, uid).Scan(&isAdmin)
-
-	if isAdmin == 1 {
-		rows, err = h.db.Query(`
-			SELECT a.id, a.user_id, a.action, a.resource, a.resource_id, a.details,
-			       a.ip_address, a.user_agent, a.created_at, u.username
-			FROM audit_logs a
-			LEFT JOIN users u ON a.user_id = u.id
-			ORDER BY a.created_at DESC
-			LIMIT $1 OFFSET $2`,
-			limit, offset,
-		)
-	} else {
-		rows, err = h.db.Query(`
-			SELECT a.id, a.user_id, a.action, a.resource, a.resource_id, a.details,
-			       a.ip_address, a.user_agent, a.created_at, u.username
-			FROM audit_logs a
-			LEFT JOIN users u ON a.user_id = u.id
-			WHERE a.user_id = $1
-			ORDER BY a.created_at DESC
-			LIMIT $2 OFFSET $3`,
-			uid, limit, offset,
-		)
+	uid := currentUserID(c)
+	filter, err := h.auditFilter(c)
+	if err != nil {
+		return err
 	}
+
+	records, err := audit.Search(h.db, filter, before, limit)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch audit logs"})
 	}
-	defer rows.Close()
+	if len(records) == limit {
+		c.Set("X-Next-Cursor", strconv.FormatInt(records[len(records)-1].Seq, 10))
+	}
+
+	h.logAudit(c, &uid, "audit.list", "audit", nil, map[string]interface{}{
+		"query": c.Queries(),
+	})
+
+	return c.JSON(records)
+}
+
+// ExportAuditLogs streams every entry matching the GetAuditLogs filters,
+// oldest first, as ?format=ndjson (the default) or csv.
+func (h *AuditHandler) ExportAuditLogs(c *fiber.Ctx) error {
+	format := c.Query("format", "ndjson")
+	if format != "ndjson" && format != "csv" {
+		return c.Status(400).JSON(fiber.Map{"error": "format must be ndjson or csv"})
+	}
 
-	var logs []map[string]interface{}
-	for rows.Next() {
-		var log models.AuditLog
-		var username sql.NullString
-		if err := rows.Scan(&log.ID, &log.UserID, &log.Action, &log.Resource, &log.ResourceID,
-			&log.Details, &log.IPAddress, &log.UserAgent, &log.CreatedAt, &username); err != nil {
-			continue
+	uid := currentUserID(c)
+	filter, err := h.auditFilter(c)
+	if err != nil {
+		return err
+	}
+
+	// Evidence only leaves once the export itself is on record
+	if err := h.logCritical(c, &uid, "audit.export", "audit", nil, map[string]interface{}{
+		"format": format,
+		"query":  c.Queries(),
+	}); err != nil {
+		return auditUnavailable(c)
+	}
+
+	cursor, err := audit.Export(h.db, filter)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to export audit logs"})
+	}
+
+	filename := fmt.Sprintf("audit-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	if format == "csv" {
+		c.Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Set("Content-Type", "application/x-ndjson")
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cursor.Close()
+		if err := writeExport(w, cursor, format); err != nil {
+			log.Println("Audit export failed:", err)
 		}
+	})
+	return nil
+}
 
-		logs = append(logs, map[string]interface{}{
-			"id":          log.ID,
-			"user_id":     log.UserID,
-			"username":    username.String,
-			"action":      log.Action,
-			"resource":    log.Resource,
-			"resource_id": log.ResourceID,
-			"details":     log.Details,
-			"ip_address":  log.IPAddress,
-			"user_agent":  log.UserAgent,
-			"created_at":  log.CreatedAt,
-		})
+// auditFilter reads the search filters from the query string. Callers
+// without audit.read_all only ever see their own entries.
+func (h *AuditHandler) auditFilter(c *fiber.Ctx) (audit.Filter, error) {
+	filter := audit.Filter{
+		Username: c.Query("username"),
+		Action:   c.Query("action"),
+		Resource: c.Query("resource"),
+		Query:    c.Query("q"),
 	}
 
-	h.logAudit(c, &uid, "audit.list", "audit", nil, map[string]interface{}{
-		"limit":  limit,
-		"offset": offset,
+	for param, dest := range map[string]**uuid.UUID{"user_id": &filter.UserID, "resource_id": &filter.ResourceID} {
+		if value := c.Query(param); value != "" {
+			id, err := uuid.Parse(value)
+			if err != nil {
+				return filter, fiber.NewError(400, "Invalid "+param)
+			}
+			*dest = &id
+		}
+	}
+	for param, dest := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fiber.NewError(400, param+" must be an RFC 3339 time")
+			}
+			*dest = &t
+		}
+	}
+	if ip := c.Query("ip"); ip != "" {
+		if net.ParseIP(ip) == nil {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				return filter, fiber.NewError(400, "ip must be an address or CIDR range")
+			}
+		}
+		filter.IPAddress = ip
+	}
+
+	// Users with audit.read_all (admins) see all logs; everyone else sees their own
+	userID := c.Locals("userID").(string)
+	if readAll, _ := h.resolver.HasPermission(userID, "audit.read_all"); !readAll {
+		uid := currentUserID(c)
+		filter.UserID = &uid
+	}
+	return filter, nil
+}
+
+// VerifyChain walks the audit hash chain and reports the first break, along
+// with the checkpoint public keys so they can be pinned for offline checks.
+func (h *AuditHandler) VerifyChain(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(userID)
+
+	result, err := audit.Verify(h.db, nil)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to verify audit log"})
+	}
+	keys, err := audit.CheckpointKeys(h.db)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load checkpoint keys"})
+	}
+
+	h.logAudit(c, &uid, "audit.verify", "audit", nil, map[string]interface{}{
+		"valid":    result.Valid,
+		"head_seq": result.HeadSeq,
+		"break":    result.Break,
 	})
 
-	return c.JSON(logs)
+	return c.JSON(fiber.Map{
+		"verification":    result,
+		"checkpoint_keys": keys,
+	})
+}
+
+// auditor records audit events for the handler that embeds it, stamped
+// with the client address and user agent of the request.
+type auditor struct {
+	auditLog *audit.Logger
 }
 
-func (h *AuditHandler) logAudit(c *fiber.Ctx, userID *uuid.UUID, action, resource string, resourceID *uuid.UUID, details interface{}) {
-	if action == "audit.list" {
-		return
+func (a auditor) logAudit(c *fiber.Ctx, userID *uuid.UUID, action, resource string, resourceID *uuid.UUID, details interface{}) {
+	a.auditLog.Log(audit.Event{
+		UserID:     userID,
+		Action:     action,
+		Resource:   resource,
+		ResourceID: resourceID,
+		Details:    details,
+		IPAddress:  c.IP(),
+		UserAgent:  c.Get("User-Agent"),
+	})
+}
+
+// logCritical records an event the action must not go ahead without and
+// waits for it to be written. On error the caller refuses the request with
+// auditUnavailable.
+func (a auditor) logCritical(c *fiber.Ctx, userID *uuid.UUID, action, resource string, resourceID *uuid.UUID, details interface{}) error {
+	return a.auditLog.Log(audit.Event{
+		UserID:     userID,
+		Action:     action,
+		Resource:   resource,
+		ResourceID: resourceID,
+		Details:    details,
+		IPAddress:  c.IP(),
+		UserAgent:  c.Get("User-Agent"),
+		Critical:   true,
+	})
+}
+
+func auditUnavailable(c *fiber.Ctx) error {
+	return c.Status(503).JSON(fiber.Map{"error": "Audit log unavailable; request refused"})
+}
+
+// writeExport writes every entry of cursor to w, flushing as it goes so the
+// client receives the export while it is being read.
+func writeExport(w *bufio.Writer, cursor *audit.Cursor, format string) error {
+	var csvWriter *csv.Writer
+	if format == "csv" {
+		csvWriter = csv.NewWriter(w)
+		csvWriter.Write([]string{"seq", "id", "created_at", "user_id", "username", "action", "resource",
+			"resource_id", "ip_address", "user_agent", "details"})
 	}
 
-	h.db.Exec(`
-		INSERT INTO audit_logs (user_id, action, resource, resource_id, details, ip_address, user_agent)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-		userID, action, resource, resourceID, details, c.IP(), c.Get("User-Agent"),
-	)
+	for n := 1; ; n++ {
+		record, err := cursor.Next()
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			break
+		}
+
+		if csvWriter != nil {
+			csvWriter.Write([]string{
+				strconv.FormatInt(record.Seq, 10),
+				record.ID.String(),
+				record.CreatedAt.Format(time.RFC3339Nano),
+				uuidString(record.UserID),
+				csvCell(record.Username),
+				csvCell(record.Action),
+				csvCell(record.Resource),
+				uuidString(record.ResourceID),
+				record.IPAddress,
+				csvCell(record.UserAgent),
+				csvCell(string(record.Details)),
+			})
+		} else {
+			line, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			w.Write(append(line, '\n'))
+		}
+
+		if n%100 == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			if err := w.Flush(); err != nil {
+				// The client went away
+				return err
+			}
+		}
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func uuidString(id *uuid.UUID) string {
+	if id == nil {
+		return ""
+	}
+	return id.String()
+}
+
+// csvCell stops spreadsheet programs from running a value that starts like
+// a formula; user agents and usernames are caller-controlled.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsAny(value[:1], "=+-@\t\r") {
+		return "'" + value
+	}
+	return value
 }
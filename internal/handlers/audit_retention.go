@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// RetentionHandler manages how long audit entries are kept and the legal
+// holds that keep them regardless.
+type RetentionHandler struct {
+	db *sql.DB
+	auditor
+}
+
+func NewRetentionHandler(db *sql.DB, auditLog *audit.Logger) *RetentionHandler {
+	return &RetentionHandler{db: db, auditor: auditor{auditLog}}
+}
+
+type retentionRule struct {
+	ID            uuid.UUID  `json:"id"`
+	Action        string     `json:"action"`
+	RetentionDays int        `json:"retention_days"`
+	CreatedBy     *uuid.UUID `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+type legalHold struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     *uuid.UUID `json:"user_id"`
+	ResourceID *uuid.UUID `json:"resource_id"`
+	Reason     string     `json:"reason"`
+	CreatedBy  *uuid.UUID `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReleasedBy *uuid.UUID `json:"released_by"`
+	ReleasedAt *time.Time `json:"released_at"`
+}
+
+// GetRules lists the retention rules. Entries whose action no rule matches
+// are kept forever.
+func (h *RetentionHandler) GetRules(c *fiber.Ctx) error {
+	rows, err := h.db.Query(`
+		SELECT id, action, retention_days, created_by, created_at, updated_at
+		FROM audit_retention_rules
+		ORDER BY action`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch retention rules"})
+	}
+	defer rows.Close()
+
+	rules := []retentionRule{}
+	for rows.Next() {
+		var r retentionRule
+		if err := rows.Scan(&r.ID, &r.Action, &r.RetentionDays, &r.CreatedBy, &r.CreatedAt, &r.UpdatedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch retention rules"})
+		}
+		rules = append(rules, r)
+	}
+	return c.JSON(rules)
+}
+
+// SetRule creates or replaces the rule for an action. The action is exact
+// or ends in "*" to match by prefix; "*" alone covers every action. An
+// exact rule beats a prefix rule, and a longer prefix a shorter one.
+func (h *RetentionHandler) SetRule(c *fiber.Ctx) error {
+	var req struct {
+		Action        string `json:"action"`
+		RetentionDays int    `json:"retention_days"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	req.Action = strings.TrimSpace(req.Action)
+	if req.Action == "" || len(req.Action) > 255 || strings.Contains(strings.TrimSuffix(req.Action, "*"), "*") {
+		return c.Status(400).JSON(fiber.Map{"error": `action must be an action name, optionally ending in "*"`})
+	}
+	if req.RetentionDays < 1 {
+		return c.Status(400).JSON(fiber.Map{"error": "retention_days must be at least 1"})
+	}
+
+	uid := currentUserID(c)
+	var r retentionRule
+	err := h.db.QueryRow(`
+		INSERT INTO audit_retention_rules (action, retention_days, created_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (action) DO UPDATE
+		SET retention_days = EXCLUDED.retention_days, created_by = EXCLUDED.created_by, updated_at = CURRENT_TIMESTAMP
+		RETURNING id, action, retention_days, created_by, created_at, updated_at`,
+		req.Action, req.RetentionDays, uid,
+	).Scan(&r.ID, &r.Action, &r.RetentionDays, &r.CreatedBy, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save retention rule"})
+	}
+
+	h.logAudit(c, &uid, "audit.retention.set", "audit", &r.ID, map[string]interface{}{
+		"action":         r.Action,
+		"retention_days": r.RetentionDays,
+	})
+
+	return c.JSON(r)
+}
+
+func (h *RetentionHandler) DeleteRule(c *fiber.Ctx) error {
+	ruleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid rule ID"})
+	}
+
+	var action string
+	err = h.db.QueryRow(`DELETE FROM audit_retention_rules WHERE id = $1 RETURNING action`, ruleID).Scan(&action)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Retention rule not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete retention rule"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "audit.retention.delete", "audit", &ruleID, map[string]interface{}{
+		"action": action,
+	})
+
+	return c.JSON(fiber.Map{"message": "Retention rule deleted"})
+}
+
+// GetArchives lists the archives written, newest first.
+func (h *RetentionHandler) GetArchives(c *fiber.Ctx) error {
+	rows, err := h.db.Query(`
+		SELECT id, location, first_seq, last_seq, entries, sha256, key_id, signature, created_at
+		FROM audit_archives
+		ORDER BY created_at DESC
+		LIMIT 1000`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch audit archives"})
+	}
+	defer rows.Close()
+
+	archives := []audit.Manifest{}
+	for rows.Next() {
+		var m audit.Manifest
+		if err := rows.Scan(&m.ID, &m.Location, &m.FirstSeq, &m.LastSeq, &m.Entries, &m.SHA256, &m.KeyID,
+			&m.Signature, &m.CreatedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch audit archives"})
+		}
+		archives = append(archives, m)
+	}
+	return c.JSON(archives)
+}
+
+// GetLegalHolds lists legal holds; ?all=true includes released ones.
+func (h *RetentionHandler) GetLegalHolds(c *fiber.Ctx) error {
+	rows, err := h.db.Query(`
+		SELECT id, user_id, resource_id, reason, created_by, created_at, released_by, released_at
+		FROM audit_legal_holds
+		WHERE $1 OR released_at IS NULL
+		ORDER BY created_at DESC`,
+		c.QueryBool("all"),
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch legal holds"})
+	}
+	defer rows.Close()
+
+	holds := []legalHold{}
+	for rows.Next() {
+		var l legalHold
+		if err := rows.Scan(&l.ID, &l.UserID, &l.ResourceID, &l.Reason, &l.CreatedBy, &l.CreatedAt,
+			&l.ReleasedBy, &l.ReleasedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch legal holds"})
+		}
+		holds = append(holds, l)
+	}
+	return c.JSON(holds)
+}
+
+// CreateLegalHold stops entries for a user, a resource, or both from being
+// purged until the hold is released. Once it returns, no archive run can
+// purge a covered entry.
+func (h *RetentionHandler) CreateLegalHold(c *fiber.Ctx) error {
+	var req struct {
+		UserID     *uuid.UUID `json:"user_id"`
+		ResourceID *uuid.UUID `json:"resource_id"`
+		Reason     string     `json:"reason"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.UserID == nil && req.ResourceID == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "user_id or resource_id is required"})
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "reason is required"})
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create legal hold"})
+	}
+	defer tx.Rollback()
+
+	// Wait out an archive run in progress so it cannot purge what the hold
+	// covers after we return
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('audit_archive'))`); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create legal hold"})
+	}
+
+	uid := currentUserID(c)
+	var l legalHold
+	err = tx.QueryRow(`
+		INSERT INTO audit_legal_holds (user_id, resource_id, reason, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, user_id, resource_id, reason, created_by, created_at`,
+		req.UserID, req.ResourceID, req.Reason, uid,
+	).Scan(&l.ID, &l.UserID, &l.ResourceID, &l.Reason, &l.CreatedBy, &l.CreatedAt)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create legal hold"})
+	}
+	if err := tx.Commit(); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create legal hold"})
+	}
+
+	h.logAudit(c, &uid, "audit.legal_hold.create", "audit", &l.ID, map[string]interface{}{
+		"user_id":     uuidString(l.UserID),
+		"resource_id": uuidString(l.ResourceID),
+		"reason":      l.Reason,
+	})
+
+	return c.Status(201).JSON(l)
+}
+
+// ReleaseLegalHold lets the entries it covered be purged again once no
+// other hold covers them.
+func (h *RetentionHandler) ReleaseLegalHold(c *fiber.Ctx) error {
+	holdID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid legal hold ID"})
+	}
+
+	uid := currentUserID(c)
+	var l legalHold
+	err = h.db.QueryRow(`
+		UPDATE audit_legal_holds
+		SET released_by = $2, released_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND released_at IS NULL
+		RETURNING id, user_id, resource_id, reason`,
+		holdID, uid,
+	).Scan(&l.ID, &l.UserID, &l.ResourceID, &l.Reason)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Active legal hold not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to release legal hold"})
+	}
+
+	h.logAudit(c, &uid, "audit.legal_hold.release", "audit", &holdID, map[string]interface{}{
+		"user_id":     uuidString(l.UserID),
+		"resource_id": uuidString(l.ResourceID),
+		"reason":      l.Reason,
+	})
+
+	return c.JSON(fiber.Map{"message": "Legal hold released"})
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"idam-pam-platform/internal/audit"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// AuditSinkHandler reports on audit forwarding and lets operators retry or
+// drop the entries a sink gave up on.
+type AuditSinkHandler struct {
+	db    *sql.DB
+	sinks map[string]audit.Sink
+	auditor
+}
+
+func NewAuditSinkHandler(db *sql.DB, sinks []audit.Sink, auditLog *audit.Logger) *AuditSinkHandler {
+	byName := make(map[string]audit.Sink, len(sinks))
+	for _, s := range sinks {
+		byName[s.Name()] = s
+	}
+	return &AuditSinkHandler{db: db, sinks: byName, auditor: auditor{auditLog}}
+}
+
+// GetSinks lists each sink with its position, lag behind the head of the
+// log, consecutive failures and dead letters.
+func (h *AuditSinkHandler) GetSinks(c *fiber.Ctx) error {
+	statuses, err := audit.SinkStatuses(h.db)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch audit sinks"})
+	}
+
+	configured := make([]string, 0, len(h.sinks))
+	for name := range h.sinks {
+		configured = append(configured, name)
+	}
+	return c.JSON(fiber.Map{
+		"configured": configured,
+		"sinks":      statuses,
+	})
+}
+
+// GetDeadLetters lists dead letters, oldest first, optionally ?sink=name.
+func (h *AuditSinkHandler) GetDeadLetters(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 || limit > maxAuditPage {
+		limit = 100
+	}
+
+	letters, err := audit.DeadLetters(h.db, c.Query("sink"), limit)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch dead letters"})
+	}
+	return c.JSON(letters)
+}
+
+// RetryDeadLetter sends a dead letter to its sink again.
+func (h *AuditSinkHandler) RetryDeadLetter(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid dead letter ID"})
+	}
+
+	letter, err := audit.Redeliver(h.db, id, h.sinks)
+	if err == audit.ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "Dead letter not found"})
+	}
+	if err != nil {
+		return c.Status(502).JSON(fiber.Map{"error": "Redelivery failed: " + err.Error()})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "audit.dead_letter.retry", "audit", &id, map[string]interface{}{
+		"sink": letter.Sink,
+		"seq":  letter.Seq,
+	})
+
+	return c.JSON(fiber.Map{"message": "Dead letter delivered"})
+}
+
+// DiscardDeadLetter drops a dead letter without delivering it.
+func (h *AuditSinkHandler) DiscardDeadLetter(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid dead letter ID"})
+	}
+
+	letter, err := audit.DiscardDeadLetter(h.db, id)
+	if err == audit.ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "Dead letter not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to discard dead letter"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "audit.dead_letter.discard", "audit", &id, map[string]interface{}{
+		"sink": letter.Sink,
+		"seq":  letter.Seq,
+	})
+
+	return c.JSON(fiber.Map{"message": "Dead letter discarded"})
+}
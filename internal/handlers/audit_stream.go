@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// streamPoll is how often a live stream looks for new entries.
+	streamPoll = time.Second
+
+	// streamRecheck is how often a live stream sends a keep-alive and
+	// checks that its caller's session and audit.read still hold.
+	streamRecheck = 15 * time.Second
+
+	// streamBatch is the most entries one poll sends; a stream that falls
+	// behind catches up a batch per poll.
+	streamBatch = 500
+)
+
+// StreamAuditLogs pushes new audit entries as Server-Sent Events, oldest
+// first, each with its seq as the event ID. It takes the GetAuditLogs
+// filters and visibility rule. A reconnecting client sends the last ID
+// it saw as the Last-Event-ID header (or ?last_event_id=) and resumes
+// right after it; a new stream starts at the current head. The stream
+// ends when the caller's session is revoked or they lose the permissions
+// it was opened with, and is dropped without an end event when the server
+// shuts down, so clients reconnect.
+func (h *AuditHandler) StreamAuditLogs(c *fiber.Ctx) error {
+	uid := currentUserID(c)
+	filter, err := h.auditFilter(c)
+	if err != nil {
+		return err
+	}
+
+	var after int64
+	lastID := c.Get("Last-Event-ID", c.Query("last_event_id"))
+	if lastID != "" {
+		if after, err = strconv.ParseInt(lastID, 10, 64); err != nil || after < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid last event ID"})
+		}
+	} else if after, err = audit.Head(h.db); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to open audit stream"})
+	}
+
+	h.logAudit(c, &uid, "audit.stream", "audit", nil, map[string]interface{}{
+		"query":         c.Queries(),
+		"last_event_id": lastID,
+	})
+
+	// The request context is recycled once the handler returns, so the
+	// stream only keeps what it copied out of it
+	userID := uid.String()
+	sessionID, _ := c.Locals("sessionID").(string)
+	readAll, _ := h.resolver.HasPermission(userID, "audit.read_all")
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		poll := time.NewTicker(streamPoll)
+		defer poll.Stop()
+		recheck := time.NewTicker(streamRecheck)
+		defer recheck.Stop()
+
+		// Tell EventSource clients how soon to reconnect
+		fmt.Fprintf(w, "retry: %d\n\n", streamPoll.Milliseconds())
+		if w.Flush() != nil {
+			return
+		}
+
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-recheck.C:
+				if !h.streamAllowed(userID, sessionID, readAll) {
+					fmt.Fprint(w, "event: end\ndata: {}\n\n")
+					w.Flush()
+					return
+				}
+				// Comment lines keep proxies from timing the stream out
+				fmt.Fprint(w, ": keep-alive\n\n")
+				if w.Flush() != nil {
+					return
+				}
+			case <-poll.C:
+				records, err := audit.After(h.db, filter, after, streamBatch)
+				if err != nil {
+					log.Println("Audit stream failed:", err)
+					continue
+				}
+				for _, r := range records {
+					data, _ := json.Marshal(r)
+					fmt.Fprintf(w, "id: %d\nevent: audit\ndata: %s\n\n", r.Seq, data)
+					after = r.Seq
+				}
+				if len(records) > 0 && w.Flush() != nil {
+					return
+				}
+			}
+		}
+	})
+	return nil
+}
+
+// streamAllowed reports whether an open stream may go on sending. A stream
+// opened with audit.read_all needs to keep it, as its filter shows other
+// users' entries.
+func (h *AuditHandler) streamAllowed(userID, sessionID string, readAll bool) bool {
+	var active bool
+	err := h.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM sessions s
+			JOIN users u ON u.id = s.user_id
+			WHERE s.id = $1 AND s.revoked_at IS NULL
+			  AND s.expires_at > CURRENT_TIMESTAMP AND u.is_active
+		)`,
+		sessionID,
+	).Scan(&active)
+	if err != nil || !active {
+		return false
+	}
+	for _, permission := range []string{"audit.read", "audit.read_all"} {
+		if permission == "audit.read_all" && !readAll {
+			break
+		}
+		if allowed, err := h.resolver.HasPermission(userID, permission); err != nil || !allowed {
+			return false
+		}
+	}
+	return true
+}
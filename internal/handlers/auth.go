@@ -1,10 +1,17 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"database/sql"
-	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"time"
 
+	"idam-pam-platform/internal/audit"
 	"idam-pam-platform/internal/auth"
+	"idam-pam-platform/internal/lockout"
 	"idam-pam-platform/internal/models"
 
 	"github.com/gofiber/fiber/v2"
@@ -12,14 +19,22 @@ import (
 )
 
 type AuthHandler struct {
-	db        *sql.DB
-	jwtSecret string
+	db         *sql.DB
+	keys       *auth.KeySet
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	limiter    *lockout.Limiter
+	auditor
 }
 
-func NewAuthHandler(db *sql.DB, jwtSecret string) *AuthHandler {
+func NewAuthHandler(db *sql.DB, keys *auth.KeySet, accessTTL, refreshTTL time.Duration, limiter *lockout.Limiter, auditLog *audit.Logger) *AuthHandler {
 	return &AuthHandler{
-		db:        db,
-		jwtSecret: jwtSecret,
+		db:         db,
+		keys:       keys,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		limiter:    limiter,
+		auditor:    auditor{auditLog},
 	}
 }
 
@@ -45,6 +60,17 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Username or email already exists"})
 	}
 
+	// New accounts start with the default 'user' role
+	_, err = h.db.Exec(`
+		INSERT INTO user_roles (user_id, role_id)
+		SELECT $1, id FROM roles WHERE name = 'user'
+		ON CONFLICT DO NOTHING`,
+		userID,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to assign default role"})
+	}
+
 	// Log the registration
 	h.logAudit(c, &userID, "user.register", "users", &userID, nil)
 
@@ -60,71 +86,362 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
+	user, err := h.authenticate(c, req)
+	if err == errTOTPRequired {
+		return c.JSON(fiber.Map{
+			"requires_totp": true,
+			"message":       "TOTP code required",
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	// Start a session and issue the token pair
+	sessionID, refreshToken, err := h.createSession(c, user.ID, "", "")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create session"})
+	}
+
+	token, err := auth.GenerateJWT(h.keys, user.ID, user.Username, sessionID, h.accessTTL)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to generate token"})
+	}
+
+	// Log successful login
+	h.logAudit(c, &user.ID, "auth.login.success", "auth", nil, map[string]interface{}{
+		"session_id": sessionID,
+	})
+
+	return c.JSON(fiber.Map{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(h.accessTTL.Seconds()),
+		"user": fiber.Map{
+			"id":       user.ID,
+			"username": user.Username,
+			"email":    user.Email,
+		},
+	})
+}
+
+var errTOTPRequired = errors.New("TOTP code required")
+
+// authenticate verifies username, password and TOTP and records failures in
+// the audit log. It is shared by the API login and the OIDC authorization
+// endpoint. Rejections are returned as *fiber.Error; errTOTPRequired means
+// the password was correct but a TOTP code still has to be supplied.
+// Failures are counted per username and IP, and attempts made too soon
+// after them are refused with 429 before anything is checked.
+func (h *AuthHandler) authenticate(c *fiber.Ctx, req models.LoginRequest) (*models.User, error) {
+	attempt, err := h.limiter.Begin(req.Username, c.IP())
+	if err != nil {
+		return nil, fiber.NewError(500, "Failed to check login attempts")
+	}
+
+	if wait, locked := attempt.Blocked(); wait > 0 {
+		reason := "throttled"
+		if locked {
+			reason = "locked_out"
+		}
+		h.logAudit(c, nil, "auth.login.failed", "auth", nil, map[string]string{
+			"username": req.Username,
+			"reason":   reason,
+		})
+		c.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return nil, fiber.NewError(429, "Too many failed login attempts, try again later")
+	}
+
 	// Get user from database
 	var user models.User
-	err := h.db.QueryRow(`
+	err = h.db.QueryRow(`
 		SELECT id, username, email, password_hash, totp_secret, is_active 
 		FROM users WHERE username = $1`,
 		req.Username,
 	).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.TOTPSecret, &user.IsActive)
 
 	if err != nil {
-		h.logAudit(c, nil, "auth.login.failed", "auth", nil, map[string]string{
+		h.loginFailed(c, attempt, nil, map[string]string{
 			"username": req.Username,
 			"reason":   "user_not_found",
 		})
-		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+		return nil, fiber.NewError(401, "Invalid credentials")
 	}
 
 	// Check if user is active
 	if !user.IsActive {
-		h.logAudit(c, &user.ID, "auth.login.failed", "auth", nil, map[string]string{
+		h.loginFailed(c, attempt, &user.ID, map[string]string{
 			"reason": "user_inactive",
 		})
-		return c.Status(401).JSON(fiber.Map{"error": "Account is deactivated"})
+		return nil, fiber.NewError(401, "Account is deactivated")
 	}
 
 	// Verify password
 	if !auth.VerifyPassword(req.Password, user.PasswordHash) {
-		h.logAudit(c, &user.ID, "auth.login.failed", "auth", nil, map[string]string{
+		h.loginFailed(c, attempt, &user.ID, map[string]string{
 			"reason": "invalid_password",
 		})
-		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+		return nil, fiber.NewError(401, "Invalid credentials")
 	}
 
 	// Check TOTP if enabled
 	if user.TOTPSecret != nil && *user.TOTPSecret != "" {
 		if req.TOTPCode == "" {
-			return c.JSON(fiber.Map{
-				"requires_totp": true,
-				"message":       "TOTP code required",
-			})
+			return nil, errTOTPRequired
 		}
 
 		if !auth.ValidateTOTP(req.TOTPCode, *user.TOTPSecret) {
-			h.logAudit(c, &user.ID, "auth.login.failed", "auth", nil, map[string]string{
+			h.loginFailed(c, attempt, &user.ID, map[string]string{
 				"reason": "invalid_totp",
 			})
-			return c.Status(401).JSON(fiber.Map{"error": "Invalid TOTP code"})
+			return nil, fiber.NewError(401, "Invalid TOTP code")
+		}
+	}
+
+	if err := attempt.Succeed(); err != nil {
+		log.Println("Failed to clear login failures:", err)
+	}
+	return &user, nil
+}
+
+// loginFailed audits a failed login and counts it, auditing any lockout it
+// sets off.
+func (h *AuthHandler) loginFailed(c *fiber.Ctx, attempt *lockout.Attempt, userID *uuid.UUID, details map[string]string) {
+	h.logAudit(c, userID, "auth.login.failed", "auth", nil, details)
+
+	locks, err := attempt.Fail()
+	if err != nil {
+		log.Println("Failed to record login failure:", err)
+		return
+	}
+	for _, lock := range locks {
+		var lockedID *uuid.UUID
+		if lock.Scope == lockout.ScopeUser {
+			lockedID = userID
 		}
+		h.logAudit(c, lockedID, "auth.lockout", "auth", lockedID, lock)
+	}
+}
+
+// createSession stores a new session and returns its ID together with the
+// first refresh token. clientID and scope are set for sessions started
+// through the OIDC provider.
+func (h *AuthHandler) createSession(c *fiber.Ctx, userID uuid.UUID, clientID, scope string) (uuid.UUID, string, error) {
+	sessionID := uuid.New()
+	refreshToken, refreshHash, err := auth.GenerateRefreshToken(sessionID)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO sessions (id, user_id, client_id, scope, refresh_token_hash, ip_address, user_agent, expires_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7, $8)`,
+		sessionID, userID, clientID, scope, refreshHash, c.IP(), c.Get("User-Agent"), time.Now().Add(h.refreshTTL),
+	)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+
+	return sessionID, refreshToken, nil
+}
+
+// rotatedSession is the result of exchanging a refresh token.
+type rotatedSession struct {
+	SessionID    uuid.UUID
+	UserID       uuid.UUID
+	Username     string
+	Scope        string
+	RefreshToken string
+}
+
+// rotateSession validates a refresh token issued to clientID ("" for the
+// platform itself) and replaces it with a new one. Presenting a refresh token
+// that has already been rotated is treated as theft and revokes the session.
+func (h *AuthHandler) rotateSession(c *fiber.Ctx, refreshToken, clientID string) (*rotatedSession, error) {
+	sessionID, err := auth.ParseRefreshToken(refreshToken)
+	if err != nil {
+		return nil, fiber.NewError(401, "Invalid refresh token")
 	}
 
-	// Generate JWT
-	token, err := auth.GenerateJWT(user.ID, user.Username, h.jwtSecret)
+	tx, err := h.db.Begin()
+	if err != nil {
+		return nil, fiber.NewError(500, "Failed to refresh session")
+	}
+	defer tx.Rollback()
+
+	var (
+		sess           = rotatedSession{SessionID: sessionID}
+		storedHash     string
+		storedClientID sql.NullString
+		scope          sql.NullString
+		expiresAt      time.Time
+		revokedAt      sql.NullTime
+		isActive       bool
+	)
+	err = tx.QueryRow(`
+		SELECT s.user_id, s.client_id, s.scope, s.refresh_token_hash, s.expires_at, s.revoked_at,
+		       u.username, u.is_active
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = $1
+		FOR UPDATE OF s`,
+		sessionID,
+	).Scan(&sess.UserID, &storedClientID, &scope, &storedHash, &expiresAt, &revokedAt, &sess.Username, &isActive)
+	if err != nil || storedClientID.String != clientID {
+		return nil, fiber.NewError(401, "Invalid refresh token")
+	}
+	sess.Scope = scope.String
+
+	if revokedAt.Valid {
+		return nil, fiber.NewError(401, "Session has been revoked")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(auth.HashRefreshToken(refreshToken)), []byte(storedHash)) != 1 {
+		// An old refresh token was replayed; assume it leaked and kill the session.
+		if _, err := tx.Exec(`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1`, sessionID); err == nil {
+			tx.Commit()
+		}
+		h.logAudit(c, &sess.UserID, "auth.refresh.reuse_detected", "sessions", &sessionID, nil)
+		return nil, fiber.NewError(401, "Invalid refresh token")
+	}
+
+	if !isActive || time.Now().After(expiresAt) {
+		return nil, fiber.NewError(401, "Session has expired")
+	}
+
+	newToken, refreshHash, err := auth.GenerateRefreshToken(sessionID)
+	if err != nil {
+		return nil, fiber.NewError(500, "Failed to generate token")
+	}
+
+	_, err = tx.Exec(`
+		UPDATE sessions
+		SET refresh_token_hash = $2, last_used_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		sessionID, refreshHash,
+	)
+	if err != nil {
+		return nil, fiber.NewError(500, "Failed to refresh session")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fiber.NewError(500, "Failed to refresh session")
+	}
+
+	sess.RefreshToken = newToken
+	return &sess, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and rotates the
+// refresh token.
+func (h *AuthHandler) Refresh(c *fiber.Ctx) error {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	sess, err := h.rotateSession(c, req.RefreshToken, "")
+	if err != nil {
+		return err
+	}
+
+	token, err := auth.GenerateJWT(h.keys, sess.UserID, sess.Username, sess.SessionID, h.accessTTL)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to generate token"})
 	}
 
-	// Log successful login
-	h.logAudit(c, &user.ID, "auth.login.success", "auth", nil, nil)
+	h.logAudit(c, &sess.UserID, "auth.refresh", "sessions", &sess.SessionID, nil)
 
 	return c.JSON(fiber.Map{
-		"token": token,
-		"user": fiber.Map{
-			"id":       user.ID,
-			"username": user.Username,
-			"email":    user.Email,
-		},
+		"token":         token,
+		"refresh_token": sess.RefreshToken,
+		"expires_in":    int(h.accessTTL.Seconds()),
+	})
+}
+
+// Logout revokes the session behind the current access token. With
+// {"all": true} every session of the user is revoked.
+func (h *AuthHandler) Logout(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(userID)
+	sessionID, _ := uuid.Parse(c.Locals("sessionID").(string))
+
+	var req struct {
+		All bool `json:"all"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+
+	var err error
+	if req.All {
+		_, err = h.db.Exec(`
+			UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+			WHERE user_id = $1 AND revoked_at IS NULL`,
+			uid,
+		)
+	} else {
+		_, err = h.db.Exec(`
+			UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+			sessionID, uid,
+		)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke session"})
+	}
+
+	h.logAudit(c, &uid, "auth.logout", "sessions", &sessionID, map[string]interface{}{
+		"all": req.All,
+	})
+
+	return c.JSON(fiber.Map{"message": "Logged out successfully"})
+}
+
+// JWKS publishes the public signing keys so other services can verify
+// platform tokens offline.
+func (h *AuthHandler) JWKS(c *fiber.Ctx) error {
+	c.Set("Cache-Control", "public, max-age=300")
+	return c.JSON(h.keys.JWKS())
+}
+
+func (h *AuthHandler) GetSigningKeys(c *fiber.Ctx) error {
+	var keys []fiber.Map
+	for _, key := range h.keys.Keys() {
+		keys = append(keys, fiber.Map{
+			"kid":        key.KID,
+			"algorithm":  key.Algorithm,
+			"created_at": key.CreatedAt,
+			"retired_at": key.RetiredAt,
+			"expires_at": key.ExpiresAt,
+		})
+	}
+
+	return c.JSON(keys)
+}
+
+// RotateSigningKey makes a fresh key active. The previous key keeps verifying
+// until the rotation window elapses.
+func (h *AuthHandler) RotateSigningKey(c *fiber.Ctx) error {
+	key, err := h.keys.Rotate()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to rotate signing key"})
+	}
+
+	userID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(userID)
+	h.logAudit(c, &uid, "keys.rotate", "signing_keys", nil, map[string]interface{}{
+		"kid":       key.KID,
+		"algorithm": key.Algorithm,
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "Signing key rotated successfully",
+		"kid":     key.KID,
 	})
 }
 
@@ -161,18 +478,4 @@ func (h *AuthHandler) EnableTOTP(c *fiber.Ctx) error {
 		"secret": secret,
 		"qr_url": qrCode.URL(),
 	})
-}
-
-func (h *AuthHandler) logAudit(c *fiber.Ctx, userID *uuid.UUID, action, resource string, resourceID *uuid.UUID, details interface{}) {
-	detailsJSON, _ := json.Marshal(details)
-	
-	_, err := h.db.Exec(`
-		INSERT INTO audit_logs (user_id, action, resource, resource_id, details, ip_address, user_agent)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-		userID, action, resource, resourceID, detailsJSON, c.IP(), c.Get("User-Agent"),
-	)
-	if err != nil {
-		// Log error but don't fail the request
-		println("Failed to log audit:", err.Error())
-	}
 }
\ No newline at end of file
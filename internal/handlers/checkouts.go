@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"time"
+
+	"idam-pam-platform/internal/vault"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// GetCheckout shows who holds a secret and who is waiting for it. Holders
+// of checkouts.force see it for any secret, so they know whom to release.
+func (h *SecretHandler) GetCheckout(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	uid := currentUserID(c)
+	canForce, err := h.resolver.HasPermission(uid.String(), "checkouts.force")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve permissions"})
+	}
+	if _, err := h.checkoutPath(secretID, uid, canForce); err != nil {
+		return err
+	}
+
+	holder, err := h.store.ActiveCheckout(secretID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch checkout"})
+	}
+	queue, err := h.store.Queue(secretID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch checkout queue"})
+	}
+
+	return c.JSON(fiber.Map{
+		"holder": holder,
+		"queue":  queue,
+	})
+}
+
+// CheckOut takes exclusive hold of a secret for a bounded time. If someone
+// else holds it, {"queue": true} joins the queue instead; the secret is
+// handed over automatically when it is checked in.
+func (h *SecretHandler) CheckOut(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	var req struct {
+		Duration string `json:"duration"`
+		Queue    bool   `json:"queue"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+
+	duration := time.Hour
+	if req.Duration != "" {
+		if duration, err = time.ParseDuration(req.Duration); err != nil || duration <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Duration must be a positive duration such as 2h or 30m"})
+		}
+	}
+	if duration > h.maxCheckout {
+		return c.Status(400).JSON(fiber.Map{"error": "Duration exceeds the maximum of " + h.maxCheckout.String()})
+	}
+
+	uid := currentUserID(c)
+	secretPath, err := h.authorize(secretID, uid, vault.AccessRead)
+	if err != nil {
+		return err
+	}
+
+	checkout, err := h.store.CheckOut(secretID, uid, duration)
+	switch {
+	case err == vault.ErrCheckoutNotRequired:
+		return c.Status(409).JSON(fiber.Map{"error": "This secret does not use check-out"})
+	case err == vault.ErrCheckedOut && req.Queue:
+		position, err := h.store.Enqueue(secretID, uid, duration)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to join the queue"})
+		}
+		h.logAudit(c, &uid, "secrets.checkout.queue", "secrets", &secretID, map[string]interface{}{
+			"path":     secretPath,
+			"position": position,
+			"duration": duration.String(),
+		})
+		return c.Status(202).JSON(fiber.Map{
+			"message":  "Secret is checked out; you are in the queue",
+			"position": position,
+		})
+	case err == vault.ErrCheckedOut:
+		holder, _ := h.store.ActiveCheckout(secretID)
+		resp := fiber.Map{"error": "Secret is checked out by another user"}
+		if holder != nil {
+			resp["holder"] = holder.Username
+			resp["expires_at"] = holder.ExpiresAt
+		}
+		return c.Status(409).JSON(resp)
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to check out secret"})
+	}
+
+	h.logAudit(c, &uid, "secrets.checkout", "secrets", &secretID, map[string]interface{}{
+		"path":        secretPath,
+		"checkout_id": checkout.ID,
+		"expires_at":  checkout.ExpiresAt,
+	})
+
+	return c.JSON(checkout)
+}
+
+// CheckIn releases the caller's checkout. The value is rotated straight away.
+func (h *SecretHandler) CheckIn(c *fiber.Ctx) error {
+	return h.checkIn(c, false)
+}
+
+// ForceCheckIn releases whoever holds the secret. Requires checkouts.force.
+func (h *SecretHandler) ForceCheckIn(c *fiber.Ctx) error {
+	return h.checkIn(c, true)
+}
+
+func (h *SecretHandler) checkIn(c *fiber.Ctx, force bool) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	uid := currentUserID(c)
+	secretPath, err := h.checkoutPath(secretID, uid, force)
+	if err != nil {
+		return err
+	}
+
+	holder, reason := &uid, "returned"
+	if force {
+		holder, reason = nil, "forced"
+	}
+
+	result, err := h.store.CheckIn(secretID, holder, reason)
+	switch {
+	case err == vault.ErrCheckoutNotRequired:
+		return c.Status(409).JSON(fiber.Map{"error": "This secret does not use check-out"})
+	case err == vault.ErrNotCheckedOut:
+		return c.Status(409).JSON(fiber.Map{"error": "Secret is not checked out"})
+	case err == vault.ErrCheckedOut:
+		return c.Status(403).JSON(fiber.Map{"error": "You do not hold this secret"})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to check in secret"})
+	}
+
+	h.logCheckin(c, &uid, secretID, secretPath, result)
+
+	if result.RotationError != nil {
+		return c.JSON(fiber.Map{
+			"message":        "Secret checked in; rotation failed and will be retried",
+			"rotation_error": result.RotationError.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Secret checked in and rotated",
+		"version": result.Version,
+	})
+}
+
+// GetMyCheckouts lists the secrets the caller holds or is queued for.
+func (h *SecretHandler) GetMyCheckouts(c *fiber.Ctx) error {
+	uid := currentUserID(c)
+
+	rows, err := h.db.Query(`
+		SELECT s.id, `+vault.PathSQL+`, c.checked_out_at, c.expires_at
+		FROM secret_checkouts c
+		JOIN secrets s ON s.id = c.secret_id
+		WHERE c.user_id = $1 AND c.checked_in_at IS NULL
+		ORDER BY c.expires_at`,
+		uid,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch checkouts"})
+	}
+	defer rows.Close()
+
+	held := []fiber.Map{}
+	for rows.Next() {
+		var (
+			secretID              uuid.UUID
+			path                  string
+			checkedOut, expiresAt time.Time
+		)
+		if err := rows.Scan(&secretID, &path, &checkedOut, &expiresAt); err != nil {
+			continue
+		}
+		held = append(held, fiber.Map{
+			"secret_id":      secretID,
+			"path":           path,
+			"checked_out_at": checkedOut,
+			"expires_at":     expiresAt,
+		})
+	}
+
+	queueRows, err := h.db.Query(`
+		SELECT s.id, `+vault.PathSQL+`, q.requested_at,
+		       (SELECT COUNT(*) FROM secret_checkout_queue o
+		        WHERE o.secret_id = q.secret_id AND o.requested_at <= q.requested_at)
+		FROM secret_checkout_queue q
+		JOIN secrets s ON s.id = q.secret_id
+		WHERE q.user_id = $1
+		ORDER BY q.requested_at`,
+		uid,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch checkouts"})
+	}
+	defer queueRows.Close()
+
+	queued := []fiber.Map{}
+	for queueRows.Next() {
+		var (
+			secretID    uuid.UUID
+			path        string
+			requestedAt time.Time
+			position    int
+		)
+		if err := queueRows.Scan(&secretID, &path, &requestedAt, &position); err != nil {
+			continue
+		}
+		queued = append(queued, fiber.Map{
+			"secret_id":    secretID,
+			"path":         path,
+			"requested_at": requestedAt,
+			"position":     position,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"held":   held,
+		"queued": queued,
+	})
+}
+
+// LeaveQueue removes the caller from a secret's checkout queue.
+func (h *SecretHandler) LeaveQueue(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	uid := currentUserID(c)
+	removed, err := h.store.Dequeue(secretID, uid)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to leave the queue"})
+	}
+	if !removed {
+		return c.Status(404).JSON(fiber.Map{"error": "You are not queued for this secret"})
+	}
+
+	h.logAudit(c, &uid, "secrets.checkout.dequeue", "secrets", &secretID, nil)
+
+	return c.JSON(fiber.Map{"message": "Left the queue"})
+}
+
+// checkoutPath returns the path of a secret whose checkout the caller
+// wants to see or release. Forcing is gated by checkouts.force on the
+// route, so it does not also need the secret's ACL.
+func (h *SecretHandler) checkoutPath(secretID, uid uuid.UUID, force bool) (string, error) {
+	if !force {
+		return h.authorize(secretID, uid, vault.AccessRead)
+	}
+	_, path, err := h.store.AccessFor(secretID, uid)
+	if err == vault.ErrNotFound {
+		return "", fiber.NewError(404, "Secret not found")
+	}
+	if err != nil {
+		return "", fiber.NewError(500, "Failed to check secret access")
+	}
+	return path, nil
+}
+
+func (h *SecretHandler) logCheckin(c *fiber.Ctx, uid *uuid.UUID, secretID uuid.UUID, secretPath string, result *vault.CheckinResult) {
+	h.logAudit(c, uid, "secrets.checkin", "secrets", &secretID, map[string]interface{}{
+		"path":        secretPath,
+		"checkout_id": result.Checkout.ID,
+		"holder_id":   result.Checkout.UserID,
+		"reason":      *result.Checkout.Reason,
+	})
+	if result.RotationError != nil {
+		h.logAudit(c, uid, "secrets.rotate.failed", "secrets", &secretID, map[string]interface{}{
+			"path":    secretPath,
+			"trigger": "checkin",
+			"error":   result.RotationError.Error(),
+		})
+	} else {
+		h.logAudit(c, uid, "secrets.rotate", "secrets", &secretID, map[string]interface{}{
+			"path":    secretPath,
+			"version": result.Version,
+			"trigger": "checkin",
+		})
+	}
+	for _, dropped := range result.Dropped {
+		dropped := dropped
+		h.logAudit(c, &dropped, "secrets.checkout.dequeue", "secrets", &secretID, map[string]interface{}{
+			"path":   secretPath,
+			"reason": "no_access",
+		})
+	}
+	if result.Handoff != nil {
+		h.logAudit(c, &result.Handoff.UserID, "secrets.checkout", "secrets", &secretID, map[string]interface{}{
+			"path":        secretPath,
+			"checkout_id": result.Handoff.ID,
+			"expires_at":  result.Handoff.ExpiresAt,
+			"from_queue":  true,
+		})
+	}
+}
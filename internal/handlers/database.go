@@ -0,0 +1,509 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/dynamic"
+	"idam-pam-platform/internal/models"
+	"idam-pam-platform/internal/rbac"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// DatabaseHandler issues short-lived PostgreSQL logins. Holders of
+// database.manage configure database roles; anyone with database.request
+// who holds one of a role's allowed roles can lease a login from it.
+type DatabaseHandler struct {
+	db       *sql.DB
+	manager  *dynamic.Manager
+	resolver *rbac.Resolver
+	auditor
+}
+
+func NewDatabaseHandler(db *sql.DB, manager *dynamic.Manager, resolver *rbac.Resolver, auditLog *audit.Logger) *DatabaseHandler {
+	return &DatabaseHandler{
+		db:       db,
+		manager:  manager,
+		resolver: resolver,
+		auditor:  auditor{auditLog},
+	}
+}
+
+const databaseRoleSelect = `
+	SELECT d.id, d.name, COALESCE(d.description, ''), d.grant_statements, d.default_ttl_seconds,
+	       d.max_ttl_seconds, d.allowed_role_ids,
+	       (SELECT COUNT(*) FROM database_leases l WHERE l.database_role_id = d.id AND l.status = 'active'),
+	       d.created_by, d.created_at, d.updated_at
+	FROM database_roles d`
+
+func scanDatabaseRole(row rowScanner) (*models.DatabaseRole, error) {
+	var r models.DatabaseRole
+	err := row.Scan(&r.ID, &r.Name, &r.Description, &r.GrantStatements, &r.DefaultTTLSeconds,
+		&r.MaxTTLSeconds, pq.Array(&r.AllowedRoleIDs), &r.ActiveLeases,
+		&r.CreatedBy, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (h *DatabaseHandler) GetRoles(c *fiber.Ctx) error {
+	rows, err := h.db.Query(databaseRoleSelect + ` ORDER BY d.name`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch database roles"})
+	}
+	defer rows.Close()
+
+	roles := []models.DatabaseRole{}
+	for rows.Next() {
+		role, err := scanDatabaseRole(rows)
+		if err != nil {
+			continue
+		}
+		roles = append(roles, *role)
+	}
+
+	return c.JSON(roles)
+}
+
+func (h *DatabaseHandler) GetRole(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid database role ID"})
+	}
+
+	role, err := scanDatabaseRole(h.db.QueryRow(databaseRoleSelect+` WHERE d.id = $1`, roleID))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Database role not found"})
+	}
+
+	return c.JSON(role)
+}
+
+type databaseRoleRequest struct {
+	Name            *string   `json:"name"`
+	Description     *string   `json:"description"`
+	ConnectionURL   *string   `json:"connection_url"`
+	GrantStatements *string   `json:"grant_statements"`
+	DefaultTTL      *string   `json:"default_ttl"`
+	MaxTTL          *string   `json:"max_ttl"`
+	AllowedRoleIDs  *[]string `json:"allowed_role_ids"`
+}
+
+// CreateRole registers a database role: an administrative connection URL,
+// which is stored encrypted, and the grant statements run for every login
+// issued from it. {{name}} in the template is the generated login.
+func (h *DatabaseHandler) CreateRole(c *fiber.Ctx) error {
+	var req databaseRoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.Name == nil || strings.TrimSpace(*req.Name) == "" || req.ConnectionURL == nil ||
+		req.GrantStatements == nil || req.AllowedRoleIDs == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "name, connection_url, grant_statements and allowed_role_ids are required"})
+	}
+	if req.DefaultTTL == nil {
+		req.DefaultTTL = strPtr("1h")
+	}
+	if req.MaxTTL == nil {
+		req.MaxTTL = strPtr("24h")
+	}
+
+	settings, err := h.validateRole(&req)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	encryptedURL, encryptedKey, err := h.manager.EncryptConnection(*req.ConnectionURL)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	uid := currentUserID(c)
+	var roleID uuid.UUID
+	err = h.db.QueryRow(`
+		INSERT INTO database_roles (name, description, connection_url, connection_url_key, grant_statements,
+		                            default_ttl_seconds, max_ttl_seconds, allowed_role_ids, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id`,
+		strings.TrimSpace(*req.Name), req.Description, encryptedURL, encryptedKey, *req.GrantStatements,
+		settings.defaultSeconds, settings.maxSeconds, pq.Array(*req.AllowedRoleIDs), uid,
+	).Scan(&roleID)
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "A database role with this name already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create database role"})
+	}
+
+	h.logAudit(c, &uid, "database.role.create", "database_roles", &roleID, map[string]interface{}{
+		"name":             strings.TrimSpace(*req.Name),
+		"default_ttl":      *req.DefaultTTL,
+		"max_ttl":          *req.MaxTTL,
+		"allowed_role_ids": *req.AllowedRoleIDs,
+	})
+
+	role, err := scanDatabaseRole(h.db.QueryRow(databaseRoleSelect+` WHERE d.id = $1`, roleID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch database role"})
+	}
+	return c.Status(201).JSON(role)
+}
+
+// UpdateRole changes any of a database role's settings. Leases already
+// issued keep their grants and expiry.
+func (h *DatabaseHandler) UpdateRole(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid database role ID"})
+	}
+
+	var req databaseRoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	current, err := scanDatabaseRole(h.db.QueryRow(databaseRoleSelect+` WHERE d.id = $1`, roleID))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Database role not found"})
+	}
+	if req.Name == nil {
+		req.Name = &current.Name
+	}
+	if req.Description == nil {
+		req.Description = &current.Description
+	}
+	if req.GrantStatements == nil {
+		req.GrantStatements = &current.GrantStatements
+	}
+	if req.DefaultTTL == nil {
+		req.DefaultTTL = strPtr((time.Duration(current.DefaultTTLSeconds) * time.Second).String())
+	}
+	if req.MaxTTL == nil {
+		req.MaxTTL = strPtr((time.Duration(current.MaxTTLSeconds) * time.Second).String())
+	}
+	if req.AllowedRoleIDs == nil {
+		req.AllowedRoleIDs = &current.AllowedRoleIDs
+	}
+
+	settings, err := h.validateRole(&req)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var encryptedURL, encryptedKey *string
+	if req.ConnectionURL != nil {
+		data, key, err := h.manager.EncryptConnection(*req.ConnectionURL)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		encryptedURL, encryptedKey = &data, &key
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE database_roles
+		SET name = $2, description = $3, grant_statements = $4, default_ttl_seconds = $5,
+		    max_ttl_seconds = $6, allowed_role_ids = $7,
+		    connection_url = COALESCE($8, connection_url),
+		    connection_url_key = CASE WHEN $8::text IS NULL THEN connection_url_key ELSE $9 END,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		roleID, strings.TrimSpace(*req.Name), *req.Description, *req.GrantStatements, settings.defaultSeconds,
+		settings.maxSeconds, pq.Array(*req.AllowedRoleIDs), encryptedURL, encryptedKey,
+	)
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "A database role with this name already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update database role"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "database.role.update", "database_roles", &roleID, map[string]interface{}{
+		"name":               strings.TrimSpace(*req.Name),
+		"default_ttl":        *req.DefaultTTL,
+		"max_ttl":            *req.MaxTTL,
+		"allowed_role_ids":   *req.AllowedRoleIDs,
+		"connection_changed": req.ConnectionURL != nil,
+	})
+
+	role, err := scanDatabaseRole(h.db.QueryRow(databaseRoleSelect+` WHERE d.id = $1`, roleID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch database role"})
+	}
+	return c.JSON(role)
+}
+
+// DeleteRole removes a database role and its lease history. Roles with
+// active leases must have them revoked first.
+func (h *DatabaseHandler) DeleteRole(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid database role ID"})
+	}
+
+	var name string
+	err = h.db.QueryRow(`
+		DELETE FROM database_roles d
+		WHERE d.id = $1
+		  AND NOT EXISTS (SELECT 1 FROM database_leases l WHERE l.database_role_id = d.id AND l.status = 'active')
+		RETURNING name`,
+		roleID,
+	).Scan(&name)
+	if err == sql.ErrNoRows {
+		var exists bool
+		h.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM database_roles WHERE id = $1)`, roleID).Scan(&exists)
+		if exists {
+			return c.Status(409).JSON(fiber.Map{"error": "Revoke the role's active leases first"})
+		}
+		return c.Status(404).JSON(fiber.Map{"error": "Database role not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete database role"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "database.role.delete", "database_roles", &roleID, map[string]interface{}{
+		"name": name,
+	})
+
+	return c.JSON(fiber.Map{"message": "Database role deleted"})
+}
+
+// IssueCredentials creates a login for the caller from a database role.
+// The password is returned once and never stored.
+func (h *DatabaseHandler) IssueCredentials(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid database role ID"})
+	}
+
+	var req struct {
+		TTL string `json:"ttl"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "TTL must be a positive duration such as 1h or 30m"})
+		}
+	}
+
+	uid := currentUserID(c)
+	var username string
+	if err := h.db.QueryRow(`SELECT username FROM users WHERE id = $1`, uid).Scan(&username); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to issue credentials"})
+	}
+
+	creds, err := h.manager.Issue(c.Context(), roleID, uid, username, ttl)
+	var targetErr *dynamic.TargetError
+	switch {
+	case err == dynamic.ErrNotFound:
+		return c.Status(404).JSON(fiber.Map{"error": "Database role not found"})
+	case err == dynamic.ErrNotAllowed:
+		return c.Status(403).JSON(fiber.Map{"error": "You do not hold a role allowed to use this database role"})
+	case err == dynamic.ErrTTLTooLong:
+		return c.Status(400).JSON(fiber.Map{"error": "TTL exceeds the database role's maximum"})
+	case errors.As(err, &targetErr):
+		h.logAudit(c, &uid, "database.credentials.failed", "database_roles", &roleID, map[string]interface{}{
+			"error": targetErr.Err.Error(),
+		})
+		return c.Status(502).JSON(fiber.Map{"error": "Failed to create the login on the target database"})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to issue credentials"})
+	}
+
+	if err := h.logCritical(c, &uid, "database.credentials.issue", "database_leases", &creds.Lease.ID, map[string]interface{}{
+		"database_role_id": roleID,
+		"database_role":    creds.Lease.DatabaseRole,
+		"login_name":       creds.Username,
+		"expires_at":       creds.Lease.ExpiresAt,
+	}); err != nil {
+		// A login nobody can trace back must not outlive the request. If
+		// the drop fails the lease stays active and the expirer retries it.
+		h.manager.Revoke(c.Context(), creds.Lease.ID, nil, "audit unavailable")
+		return auditUnavailable(c)
+	}
+
+	return c.Status(201).JSON(creds)
+}
+
+// GetLeases lists the caller's leases; holders of database.manage see
+// everyone's. Filter with ?status=active.
+func (h *DatabaseHandler) GetLeases(c *fiber.Ctx) error {
+	uid := currentUserID(c)
+	canManage, err := h.resolver.HasPermission(uid.String(), "database.manage")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve permissions"})
+	}
+
+	var owner *uuid.UUID
+	if !canManage {
+		owner = &uid
+	}
+	leases, err := h.manager.Leases(owner, c.Query("status"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch leases"})
+	}
+
+	return c.JSON(leases)
+}
+
+func (h *DatabaseHandler) GetLease(c *fiber.Ctx) error {
+	lease, err := h.ownLease(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(lease)
+}
+
+// RenewLease extends a lease by {"increment": "1h"}, or the database
+// role's default TTL, up to the role's max TTL from issuance.
+func (h *DatabaseHandler) RenewLease(c *fiber.Ctx) error {
+	lease, err := h.ownLease(c)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Increment string `json:"increment"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+	var increment time.Duration
+	if req.Increment != "" {
+		if increment, err = time.ParseDuration(req.Increment); err != nil || increment <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Increment must be a positive duration such as 1h or 30m"})
+		}
+	}
+
+	renewed, err := h.manager.Renew(c.Context(), lease.ID, increment)
+	var targetErr *dynamic.TargetError
+	switch {
+	case err == dynamic.ErrLeaseClosed:
+		return c.Status(409).JSON(fiber.Map{"error": "Lease is no longer active"})
+	case errors.As(err, &targetErr):
+		return c.Status(502).JSON(fiber.Map{"error": "Failed to extend the login on the target database"})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to renew lease"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "database.lease.renew", "database_leases", &lease.ID, map[string]interface{}{
+		"login_name":          lease.LoginName,
+		"previous_expires_at": lease.ExpiresAt,
+		"expires_at":          renewed.ExpiresAt,
+	})
+
+	return c.JSON(renewed)
+}
+
+// RevokeLease drops a lease's login straight away.
+func (h *DatabaseHandler) RevokeLease(c *fiber.Ctx) error {
+	lease, err := h.ownLease(c)
+	if err != nil {
+		return err
+	}
+
+	uid := currentUserID(c)
+	revoked, err := h.manager.Revoke(c.Context(), lease.ID, &uid, "revoked")
+	var targetErr *dynamic.TargetError
+	switch {
+	case err == dynamic.ErrLeaseClosed:
+		return c.Status(409).JSON(fiber.Map{"error": "Lease is no longer active"})
+	case errors.As(err, &targetErr):
+		return c.Status(502).JSON(fiber.Map{"error": "Failed to drop the login on the target database; it will be retried on expiry"})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke lease"})
+	}
+
+	h.logAudit(c, &uid, "database.lease.revoke", "database_leases", &lease.ID, map[string]interface{}{
+		"login_name": lease.LoginName,
+		"holder_id":  lease.UserID,
+	})
+
+	return c.JSON(revoked)
+}
+
+// ownLease loads the lease in the URL if the caller owns it or holds
+// database.manage. Other callers get a 404.
+func (h *DatabaseHandler) ownLease(c *fiber.Ctx) (*dynamic.Lease, error) {
+	leaseID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return nil, fiber.NewError(400, "Invalid lease ID")
+	}
+
+	lease, err := h.manager.Lease(leaseID)
+	if err == dynamic.ErrNotFound {
+		return nil, fiber.NewError(404, "Lease not found")
+	}
+	if err != nil {
+		return nil, fiber.NewError(500, "Failed to fetch lease")
+	}
+
+	uid := currentUserID(c)
+	if lease.UserID != uid {
+		canManage, err := h.resolver.HasPermission(uid.String(), "database.manage")
+		if err != nil || !canManage {
+			return nil, fiber.NewError(404, "Lease not found")
+		}
+	}
+	return lease, nil
+}
+
+type databaseRoleSettings struct {
+	defaultSeconds int
+	maxSeconds     int
+}
+
+func (h *DatabaseHandler) validateRole(req *databaseRoleRequest) (*databaseRoleSettings, error) {
+	if err := dynamic.ValidateTemplate(*req.GrantStatements); err != nil {
+		return nil, err
+	}
+
+	defaultTTL, err := time.ParseDuration(*req.DefaultTTL)
+	if err != nil || defaultTTL < time.Minute {
+		return nil, errors.New("default_ttl must be a duration of at least 1m")
+	}
+	maxTTL, err := time.ParseDuration(*req.MaxTTL)
+	if err != nil || maxTTL < defaultTTL {
+		return nil, errors.New("max_ttl must be a duration no shorter than default_ttl")
+	}
+
+	// An empty list would lock everyone out; name the 'user' role to open
+	// a database role to all requesters
+	if len(*req.AllowedRoleIDs) == 0 {
+		return nil, errors.New("allowed_role_ids must name at least one role")
+	}
+	for _, id := range *req.AllowedRoleIDs {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, errors.New("allowed_role_ids must be role IDs")
+		}
+	}
+	var found int
+	if err := h.db.QueryRow(`SELECT COUNT(*) FROM roles WHERE id = ANY($1::uuid[])`,
+		pq.Array(*req.AllowedRoleIDs)).Scan(&found); err != nil || found != len(*req.AllowedRoleIDs) {
+		return nil, errors.New("allowed_role_ids contains an unknown role")
+	}
+
+	return &databaseRoleSettings{
+		defaultSeconds: int(defaultTTL.Seconds()),
+		maxSeconds:     int(maxTTL.Seconds()),
+	}, nil
+}
+
+func strPtr(s string) *string {
+	return &s
+}
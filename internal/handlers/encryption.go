@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"database/sql"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/encryption"
+	"idam-pam-platform/internal/jobs"
+	"idam-pam-platform/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// EncryptionHandler manages the master key keyring and the re-encryption
+// jobs that follow a rotation.
+type EncryptionHandler struct {
+	db            *sql.DB
+	encryptionSvc *encryption.Service
+	rewrapper     *jobs.Rewrapper
+	auditor
+}
+
+func NewEncryptionHandler(db *sql.DB, encryptionSvc *encryption.Service, rewrapper *jobs.Rewrapper, auditLog *audit.Logger) *EncryptionHandler {
+	return &EncryptionHandler{
+		db:            db,
+		encryptionSvc: encryptionSvc,
+		rewrapper:     rewrapper,
+		auditor:       auditor{auditLog},
+	}
+}
+
+func (h *EncryptionHandler) GetKeys(c *fiber.Ctx) error {
+	var counts = map[int]int{}
+	rows, err := h.db.Query(`
+		SELECT substring(encrypted_data FROM '^v([0-9]+):'), COUNT(*)
+		FROM secrets GROUP BY 1`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch encryption keys"})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			version sql.NullInt64
+			count   int
+		)
+		if err := rows.Scan(&version, &count); err != nil {
+			continue
+		}
+		counts[int(version.Int64)] += count
+	}
+
+	var keys []fiber.Map
+	for _, key := range h.encryptionSvc.Keys() {
+		keys = append(keys, fiber.Map{
+			"version":    key.Version,
+			"active":     key.Active,
+			"created_at": key.CreatedAt,
+			"retired_at": key.RetiredAt,
+			"secrets":    counts[key.Version],
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"keys": keys,
+		// Secrets still encrypted without a keyring version
+		"legacy_secrets": counts[0],
+	})
+}
+
+// RotateKey makes a new master key version active and starts re-encrypting
+// every secret under it. Retired versions keep decrypting in the meantime.
+func (h *EncryptionHandler) RotateKey(c *fiber.Ctx) error {
+	version, err := h.encryptionSvc.Rotate()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to rotate master key"})
+	}
+
+	uid := currentUserID(c)
+
+	// Older jobs are now pointless; the new one covers everything
+	_, err = h.db.Exec(`
+		UPDATE encryption_rewrap_jobs
+		SET status = 'superseded', updated_at = CURRENT_TIMESTAMP
+		WHERE status IN ('running', 'failed')`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to start re-encryption"})
+	}
+
+	var jobID uuid.UUID
+	err = h.db.QueryRow(`
+		INSERT INTO encryption_rewrap_jobs (target_version, total, started_by)
+		SELECT $1, COUNT(*), $2 FROM secrets
+		RETURNING id`,
+		version, uid,
+	).Scan(&jobID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to start re-encryption"})
+	}
+	h.rewrapper.Start(jobID)
+
+	h.logAudit(c, &uid, "encryption.rotate", "encryption_keys", &jobID, map[string]interface{}{
+		"version": version,
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "Master key rotated; re-encryption started",
+		"version": version,
+		"job_id":  jobID,
+	})
+}
+
+func (h *EncryptionHandler) GetRewrapJobs(c *fiber.Ctx) error {
+	rows, err := h.db.Query(rewrapJobSelect + ` ORDER BY created_at DESC LIMIT 50`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch re-encryption jobs"})
+	}
+	defer rows.Close()
+
+	var jobs []models.RewrapJob
+	for rows.Next() {
+		job, err := scanRewrapJob(rows)
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, *job)
+	}
+
+	return c.JSON(jobs)
+}
+
+func (h *EncryptionHandler) GetRewrapJob(c *fiber.Ctx) error {
+	jobID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid job ID"})
+	}
+
+	job, err := scanRewrapJob(h.db.QueryRow(rewrapJobSelect+` WHERE id = $1`, jobID))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Re-encryption job not found"})
+	}
+
+	return c.JSON(job)
+}
+
+// ResumeRewrapJob restarts a failed job from where it stopped, e.g. once a
+// missing key is available again.
+func (h *EncryptionHandler) ResumeRewrapJob(c *fiber.Ctx) error {
+	jobID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid job ID"})
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE encryption_rewrap_jobs
+		SET status = 'running', error = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'failed'`,
+		jobID,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to resume re-encryption job"})
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Only failed jobs can be resumed"})
+	}
+	h.rewrapper.Start(jobID)
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "encryption.rewrap.resume", "encryption_keys", &jobID, nil)
+
+	return c.JSON(fiber.Map{"message": "Re-encryption job resumed"})
+}
+
+const rewrapJobSelect = `
+	SELECT id, target_version, status, total, processed, reencrypted, error,
+	       started_by, created_at, updated_at, completed_at
+	FROM encryption_rewrap_jobs`
+
+func scanRewrapJob(row rowScanner) (*models.RewrapJob, error) {
+	var j models.RewrapJob
+	err := row.Scan(&j.ID, &j.TargetVersion, &j.Status, &j.Total, &j.Processed, &j.Reencrypted,
+		&j.Error, &j.StartedBy, &j.CreatedAt, &j.UpdatedAt, &j.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"idam-pam-platform/internal/models"
+	"idam-pam-platform/internal/vault"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// GetFolderACL lists the entries that apply to a folder (?path=...),
+// including those inherited from folders above it.
+func (h *SecretHandler) GetFolderACL(c *fiber.Ctx) error {
+	folder, err := vault.CleanFolder(c.Query("path"))
+	if err != nil || folder == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "A folder path is required"})
+	}
+
+	uid := currentUserID(c)
+	if err := h.authorizeFolder(uid, folder); err != nil {
+		return err
+	}
+
+	rows, err := h.db.Query(`
+		SELECT a.id, a.path, a.principal_type, a.principal_id,
+		       COALESCE(u.username, r.name, ''), a.access, a.granted_by, a.created_at
+		FROM folder_acls a
+		LEFT JOIN users u ON a.principal_type = 'user' AND u.id = a.principal_id
+		LEFT JOIN roles r ON a.principal_type = 'role' AND r.id = a.principal_id
+		WHERE $1 = a.path OR left($1, length(a.path) + 1) = a.path || '/'
+		ORDER BY length(a.path), a.created_at`,
+		folder,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch folder ACL"})
+	}
+	defer rows.Close()
+
+	var entries []models.FolderACL
+	for rows.Next() {
+		var e models.FolderACL
+		if err := rows.Scan(&e.ID, &e.Path, &e.PrincipalType, &e.PrincipalID,
+			&e.PrincipalName, &e.Access, &e.GrantedBy, &e.CreatedAt); err != nil {
+			continue
+		}
+		e.Inherited = e.Path != folder
+		entries = append(entries, e)
+	}
+
+	return c.JSON(entries)
+}
+
+// GrantFolderAccess grants access on a folder and everything beneath it.
+func (h *SecretHandler) GrantFolderAccess(c *fiber.Ctx) error {
+	var req struct {
+		Path          string    `json:"path"`
+		PrincipalType string    `json:"principal_type"`
+		PrincipalID   uuid.UUID `json:"principal_id"`
+		Access        string    `json:"access"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	folder, err := vault.CleanFolder(req.Path)
+	if err != nil || folder == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "A folder path is required"})
+	}
+	if _, ok := vault.ParseAccess(req.Access); !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "access must be read, write or manage"})
+	}
+
+	var principalQuery string
+	switch req.PrincipalType {
+	case "user":
+		principalQuery = `SELECT username FROM users WHERE id = $1`
+	case "role":
+		principalQuery = `SELECT name FROM roles WHERE id = $1`
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "principal_type must be user or role"})
+	}
+
+	uid := currentUserID(c)
+	if err := h.authorizeFolder(uid, folder); err != nil {
+		return err
+	}
+
+	var principalName string
+	if err := h.db.QueryRow(principalQuery, req.PrincipalID).Scan(&principalName); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Principal not found"})
+	}
+
+	var entryID uuid.UUID
+	err = h.db.QueryRow(`
+		INSERT INTO folder_acls (path, principal_type, principal_id, access, granted_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (path, principal_type, principal_id) DO UPDATE
+		SET access = EXCLUDED.access, granted_by = EXCLUDED.granted_by, created_at = CURRENT_TIMESTAMP
+		RETURNING id`,
+		folder, req.PrincipalType, req.PrincipalID, req.Access, uid,
+	).Scan(&entryID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to grant access"})
+	}
+
+	h.logAudit(c, &uid, "folders.acl.grant", "folders", &entryID, map[string]interface{}{
+		"path":           folder,
+		"principal_type": req.PrincipalType,
+		"principal_id":   req.PrincipalID,
+		"principal_name": principalName,
+		"access":         req.Access,
+	})
+
+	return c.JSON(fiber.Map{
+		"id":      entryID,
+		"message": "Access granted successfully",
+	})
+}
+
+func (h *SecretHandler) RevokeFolderAccess(c *fiber.Ctx) error {
+	entryID, err := uuid.Parse(c.Params("aclId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ACL entry ID"})
+	}
+
+	var folder string
+	if err := h.db.QueryRow(`SELECT path FROM folder_acls WHERE id = $1`, entryID).Scan(&folder); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "ACL entry not found"})
+	}
+
+	uid := currentUserID(c)
+	if err := h.authorizeFolder(uid, folder); err != nil {
+		return err
+	}
+
+	var principalType, access string
+	var principalID uuid.UUID
+	err = h.db.QueryRow(`
+		DELETE FROM folder_acls WHERE id = $1
+		RETURNING principal_type, principal_id, access`,
+		entryID,
+	).Scan(&principalType, &principalID, &access)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "ACL entry not found"})
+	}
+
+	h.logAudit(c, &uid, "folders.acl.revoke", "folders", &entryID, map[string]interface{}{
+		"path":           folder,
+		"principal_type": principalType,
+		"principal_id":   principalID,
+		"access":         access,
+	})
+
+	return c.JSON(fiber.Map{"message": "Access revoked successfully"})
+}
+
+// authorizeFolder allows folder ACL changes to holders of folders.manage and
+// to anyone with manage access inherited on the folder.
+func (h *SecretHandler) authorizeFolder(uid uuid.UUID, folder string) error {
+	canManage, err := h.resolver.HasPermission(uid.String(), "folders.manage")
+	if err != nil {
+		return fiber.NewError(500, "Failed to resolve permissions")
+	}
+	if canManage {
+		return nil
+	}
+
+	access, _, err := h.store.FolderAccessFor(folder, uid)
+	if err != nil {
+		return fiber.NewError(500, "Failed to check folder access")
+	}
+	if access < vault.AccessManage {
+		return fiber.NewError(403, "This requires manage access to folder "+folder)
+	}
+	return nil
+}
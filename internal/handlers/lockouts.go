@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"database/sql"
+	"net"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/lockout"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type LockoutHandler struct {
+	db      *sql.DB
+	limiter *lockout.Limiter
+	auditor
+}
+
+func NewLockoutHandler(db *sql.DB, limiter *lockout.Limiter, auditLog *audit.Logger) *LockoutHandler {
+	return &LockoutHandler{db: db, limiter: limiter, auditor: auditor{auditLog}}
+}
+
+// GetLockouts lists the usernames and IPs locked out now.
+func (h *LockoutHandler) GetLockouts(c *fiber.Ctx) error {
+	entries, err := h.limiter.Locked()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch lockouts"})
+	}
+	return c.JSON(entries)
+}
+
+// UnlockUser clears a user's failed logins, lifting a lockout or backoff.
+func (h *LockoutHandler) UnlockUser(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	var username string
+	err = h.db.QueryRow(`SELECT username FROM users WHERE id = $1`, userID).Scan(&username)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch user"})
+	}
+
+	return h.unlock(c, lockout.ScopeUser, username, &userID)
+}
+
+// UnlockIP clears an IP's failed logins; the address is given as ?ip=.
+func (h *LockoutHandler) UnlockIP(c *fiber.Ctx) error {
+	ip := net.ParseIP(c.Query("ip"))
+	if ip == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "ip must be an IP address"})
+	}
+	return h.unlock(c, lockout.ScopeIP, ip.String(), nil)
+}
+
+func (h *LockoutHandler) unlock(c *fiber.Ctx, scope, key string, userID *uuid.UUID) error {
+	entry, err := h.limiter.Unlock(scope, key)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to unlock"})
+	}
+	if entry == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "No failed logins recorded"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "auth.unlock", "auth", userID, entry)
+
+	return c.JSON(fiber.Map{"message": "Unlocked", "cleared": entry})
+}
@@ -0,0 +1,655 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/auth"
+	"idam-pam-platform/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const authorizationCodeTTL = 5 * time.Minute
+
+// OIDCHandler implements an OpenID Connect provider on top of the platform's
+// own users, so internal tools can delegate login instead of re-implementing
+// password and TOTP checks. Credentials are verified by AuthHandler.
+type OIDCHandler struct {
+	db          *sql.DB
+	keys        *auth.KeySet
+	authHandler *AuthHandler
+	accessTTL   time.Duration
+}
+
+func NewOIDCHandler(db *sql.DB, keys *auth.KeySet, authHandler *AuthHandler, accessTTL time.Duration) *OIDCHandler {
+	return &OIDCHandler{
+		db:          db,
+		keys:        keys,
+		authHandler: authHandler,
+		accessTTL:   accessTTL,
+	}
+}
+
+type authorizeRequest struct {
+	ClientID            string `query:"client_id" form:"client_id"`
+	RedirectURI         string `query:"redirect_uri" form:"redirect_uri"`
+	ResponseType        string `query:"response_type" form:"response_type"`
+	Scope               string `query:"scope" form:"scope"`
+	State               string `query:"state" form:"state"`
+	Nonce               string `query:"nonce" form:"nonce"`
+	CodeChallenge       string `query:"code_challenge" form:"code_challenge"`
+	CodeChallengeMethod string `query:"code_challenge_method" form:"code_challenge_method"`
+}
+
+func (h *OIDCHandler) Discovery(c *fiber.Ctx) error {
+	issuer := h.keys.Issuer()
+	return c.JSON(fiber.Map{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth2/authorize",
+		"token_endpoint":                        issuer + "/oauth2/token",
+		"userinfo_endpoint":                     issuer + "/oauth2/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{h.keys.Algorithm()},
+		"scopes_supported":                      []string{"openid", "profile", "email", "roles", "offline_access"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce",
+			"preferred_username", "email", "roles",
+		},
+	})
+}
+
+// Authorize validates the authorization request and shows the login form.
+func (h *OIDCHandler) Authorize(c *fiber.Ctx) error {
+	var req authorizeRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	clientName, authErr := h.validateAuthorize(&req)
+	if authErr != nil {
+		return h.authorizeFailure(c, &req, authErr)
+	}
+
+	return h.renderLogin(c, 200, clientName, &req, "", "")
+}
+
+// AuthorizeLogin checks the credentials posted from the login form and
+// redirects back to the client with an authorization code.
+func (h *OIDCHandler) AuthorizeLogin(c *fiber.Ctx) error {
+	var req authorizeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	clientName, authErr := h.validateAuthorize(&req)
+	if authErr != nil {
+		return h.authorizeFailure(c, &req, authErr)
+	}
+
+	login := models.LoginRequest{
+		Username: c.FormValue("username"),
+		Password: c.FormValue("password"),
+		TOTPCode: c.FormValue("totp_code"),
+	}
+	user, err := h.authHandler.authenticate(c, login)
+	if err == errTOTPRequired {
+		return h.renderLogin(c, 401, clientName, &req, login.Username, "TOTP code required")
+	}
+	if e, ok := err.(*fiber.Error); ok {
+		return h.renderLogin(c, e.Code, clientName, &req, login.Username, e.Message)
+	}
+	if err != nil {
+		return err
+	}
+
+	code, err := randomToken(32)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to generate authorization code"})
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO oidc_authorization_codes
+			(code_hash, client_id, user_id, redirect_uri, scope, nonce,
+			 code_challenge, code_challenge_method, auth_time, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP, $9)`,
+		hashToken(code), req.ClientID, user.ID, req.RedirectURI, req.Scope, req.Nonce,
+		req.CodeChallenge, req.CodeChallengeMethod, time.Now().Add(authorizationCodeTTL),
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store authorization code"})
+	}
+
+	h.authHandler.logAudit(c, &user.ID, "oidc.authorize", "oidc_clients", nil, map[string]interface{}{
+		"client_id": req.ClientID,
+		"scope":     req.Scope,
+	})
+
+	return c.Redirect(redirectWith(req.RedirectURI, map[string]string{
+		"code":  code,
+		"state": req.State,
+	}), 302)
+}
+
+// authorizeError is a rejected authorization request. Problems with the
+// client or redirect URI are shown to the user agent directly; anything else
+// is reported to the client through the redirect URI, per RFC 6749.
+type authorizeError struct {
+	redirect    bool
+	code        string
+	description string
+}
+
+func (h *OIDCHandler) validateAuthorize(req *authorizeRequest) (string, *authorizeError) {
+	var (
+		clientName   string
+		redirectURIs []string
+	)
+	err := h.db.QueryRow(`
+		SELECT name, redirect_uris FROM oidc_clients WHERE client_id = $1`,
+		req.ClientID,
+	).Scan(&clientName, pq.Array(&redirectURIs))
+	if err != nil {
+		return "", &authorizeError{description: "Unknown client"}
+	}
+
+	registered := false
+	for _, uri := range redirectURIs {
+		if uri == req.RedirectURI {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return "", &authorizeError{description: "Redirect URI is not registered for this client"}
+	}
+
+	if req.ResponseType != "code" {
+		return "", &authorizeError{true, "unsupported_response_type", "Only the authorization code flow is supported"}
+	}
+	if !hasScope(req.Scope, "openid") {
+		return "", &authorizeError{true, "invalid_scope", "The openid scope is required"}
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return "", &authorizeError{true, "invalid_request", "PKCE with code_challenge_method=S256 is required"}
+	}
+
+	return clientName, nil
+}
+
+func (h *OIDCHandler) authorizeFailure(c *fiber.Ctx, req *authorizeRequest, e *authorizeError) error {
+	if !e.redirect {
+		return c.Status(400).JSON(fiber.Map{"error": e.description})
+	}
+	return c.Redirect(redirectWith(req.RedirectURI, map[string]string{
+		"error":             e.code,
+		"error_description": e.description,
+		"state":             req.State,
+	}), 302)
+}
+
+// Token implements the token endpoint for the authorization_code and
+// refresh_token grants.
+func (h *OIDCHandler) Token(c *fiber.Ctx) error {
+	c.Set("Cache-Control", "no-store")
+
+	clientID, clientSecret := clientCredentials(c)
+	if !h.authenticateClient(clientID, clientSecret) {
+		return oauthError(c, 401, "invalid_client", "Client authentication failed")
+	}
+
+	switch c.FormValue("grant_type") {
+	case "authorization_code":
+		return h.exchangeCode(c, clientID)
+	case "refresh_token":
+		return h.refreshGrant(c, clientID)
+	default:
+		return oauthError(c, 400, "unsupported_grant_type", "Unsupported grant type")
+	}
+}
+
+func (h *OIDCHandler) exchangeCode(c *fiber.Ctx, clientID string) error {
+	var (
+		codeClientID, redirectURI, scope, challenge string
+		nonce                                       sql.NullString
+		userID                                      uuid.UUID
+		authTime                                    time.Time
+	)
+	// Codes are single use: claim it atomically before doing anything else
+	err := h.db.QueryRow(`
+		UPDATE oidc_authorization_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE code_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING client_id, user_id, redirect_uri, scope, nonce, code_challenge, auth_time`,
+		hashToken(c.FormValue("code")),
+	).Scan(&codeClientID, &userID, &redirectURI, &scope, &nonce, &challenge, &authTime)
+	if err != nil {
+		return oauthError(c, 400, "invalid_grant", "Invalid or expired authorization code")
+	}
+
+	if codeClientID != clientID || redirectURI != c.FormValue("redirect_uri") {
+		return oauthError(c, 400, "invalid_grant", "Authorization code was not issued to this client")
+	}
+	if !auth.VerifyPKCE(c.FormValue("code_verifier"), challenge) {
+		return oauthError(c, 400, "invalid_grant", "PKCE verification failed")
+	}
+
+	subject, err := h.loadSubject(userID)
+	if err != nil {
+		return oauthError(c, 400, "invalid_grant", "User is not available")
+	}
+	subject.AuthTime = authTime
+
+	sessionID, refreshToken, err := h.authHandler.createSession(c, userID, clientID, scope)
+	if err != nil {
+		return oauthError(c, 500, "server_error", "Failed to create session")
+	}
+
+	accessToken, err := auth.GenerateClientAccessToken(h.keys, userID, subject.Username, sessionID, clientID, scope, h.accessTTL)
+	if err != nil {
+		return oauthError(c, 500, "server_error", "Failed to generate token")
+	}
+	idToken, err := auth.GenerateIDToken(h.keys, scopedSubject(*subject, scope), clientID, nonce.String, h.accessTTL)
+	if err != nil {
+		return oauthError(c, 500, "server_error", "Failed to generate token")
+	}
+
+	h.authHandler.logAudit(c, &userID, "oidc.token", "sessions", &sessionID, map[string]interface{}{
+		"client_id":  clientID,
+		"grant_type": "authorization_code",
+	})
+
+	resp := fiber.Map{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(h.accessTTL.Seconds()),
+		"id_token":     idToken,
+		"scope":        scope,
+	}
+	if hasScope(scope, "offline_access") {
+		resp["refresh_token"] = refreshToken
+	}
+	return c.JSON(resp)
+}
+
+func (h *OIDCHandler) refreshGrant(c *fiber.Ctx, clientID string) error {
+	sess, err := h.authHandler.rotateSession(c, c.FormValue("refresh_token"), clientID)
+	if err != nil || !hasScope(sess.Scope, "offline_access") {
+		return oauthError(c, 400, "invalid_grant", "Invalid refresh token")
+	}
+
+	accessToken, err := auth.GenerateClientAccessToken(h.keys, sess.UserID, sess.Username, sess.SessionID, clientID, sess.Scope, h.accessTTL)
+	if err != nil {
+		return oauthError(c, 500, "server_error", "Failed to generate token")
+	}
+
+	h.authHandler.logAudit(c, &sess.UserID, "oidc.token", "sessions", &sess.SessionID, map[string]interface{}{
+		"client_id":  clientID,
+		"grant_type": "refresh_token",
+	})
+
+	return c.JSON(fiber.Map{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(h.accessTTL.Seconds()),
+		"refresh_token": sess.RefreshToken,
+		"scope":         sess.Scope,
+	})
+}
+
+func (h *OIDCHandler) UserInfo(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Locals("userID").(string))
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid token"})
+	}
+
+	subject, err := h.loadSubject(userID)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Invalid token"})
+	}
+
+	scope, _ := c.Locals("scope").(string)
+	info := fiber.Map{
+		"sub":                subject.UserID,
+		"preferred_username": subject.Username,
+	}
+	if hasScope(scope, "email") {
+		info["email"] = subject.Email
+	}
+	if hasScope(scope, "roles") {
+		info["roles"] = subject.Roles
+	}
+	return c.JSON(info)
+}
+
+// scopedSubject drops the claims whose scopes the client was not granted.
+func scopedSubject(subject auth.IDTokenSubject, scope string) auth.IDTokenSubject {
+	if !hasScope(scope, "email") {
+		subject.Email = ""
+	}
+	if !hasScope(scope, "roles") {
+		subject.Roles = nil
+	}
+	return subject
+}
+
+func (h *OIDCHandler) loadSubject(userID uuid.UUID) (*auth.IDTokenSubject, error) {
+	subject := auth.IDTokenSubject{UserID: userID, Roles: []string{}}
+	var isActive bool
+	err := h.db.QueryRow(`
+		SELECT username, email, is_active FROM users WHERE id = $1`,
+		userID,
+	).Scan(&subject.Username, &subject.Email, &isActive)
+	if err != nil {
+		return nil, err
+	}
+	if !isActive {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := h.db.Query(`
+		SELECT r.name
+		FROM roles r
+		JOIN user_roles ur ON r.id = ur.role_id
+		WHERE ur.user_id = $1
+		  AND (ur.expires_at IS NULL OR ur.expires_at > CURRENT_TIMESTAMP)
+		ORDER BY r.name`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		subject.Roles = append(subject.Roles, name)
+	}
+
+	return &subject, rows.Err()
+}
+
+func (h *OIDCHandler) authenticateClient(clientID, clientSecret string) bool {
+	var secretHash sql.NullString
+	err := h.db.QueryRow(`
+		SELECT client_secret_hash FROM oidc_clients WHERE client_id = $1`,
+		clientID,
+	).Scan(&secretHash)
+	if err != nil {
+		return false
+	}
+
+	// Public clients have no secret and rely on PKCE alone
+	if !secretHash.Valid {
+		return clientSecret == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(clientSecret)), []byte(secretHash.String)) == 1
+}
+
+func (h *OIDCHandler) GetClients(c *fiber.Ctx) error {
+	rows, err := h.db.Query(`
+		SELECT client_id, name, redirect_uris, client_secret_hash IS NULL, created_by, created_at
+		FROM oidc_clients
+		ORDER BY created_at DESC`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch clients"})
+	}
+	defer rows.Close()
+
+	var clients []map[string]interface{}
+	for rows.Next() {
+		var (
+			clientID, name string
+			redirectURIs   []string
+			public         bool
+			createdBy      *uuid.UUID
+			createdAt      time.Time
+		)
+		if err := rows.Scan(&clientID, &name, pq.Array(&redirectURIs), &public, &createdBy, &createdAt); err != nil {
+			continue
+		}
+
+		clients = append(clients, map[string]interface{}{
+			"client_id":     clientID,
+			"name":          name,
+			"redirect_uris": redirectURIs,
+			"public":        public,
+			"created_by":    createdBy,
+			"created_at":    createdAt,
+		})
+	}
+
+	return c.JSON(clients)
+}
+
+// CreateClient registers a relying party. The client secret is only returned
+// once; public clients (SPAs, CLIs) get none and must use PKCE.
+func (h *OIDCHandler) CreateClient(c *fiber.Ctx) error {
+	var req struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Public       bool     `json:"public"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if req.Name == "" || len(req.RedirectURIs) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Name and at least one redirect URI are required"})
+	}
+	for _, uri := range req.RedirectURIs {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid redirect URI: " + uri})
+		}
+	}
+
+	clientID, err := randomToken(16)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to generate client ID"})
+	}
+
+	var clientSecret string
+	var secretHash *string
+	if !req.Public {
+		clientSecret, err = randomToken(32)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to generate client secret"})
+		}
+		hash := hashToken(clientSecret)
+		secretHash = &hash
+	}
+
+	userID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(userID)
+
+	var id uuid.UUID
+	err = h.db.QueryRow(`
+		INSERT INTO oidc_clients (client_id, client_secret_hash, name, redirect_uris, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`,
+		clientID, secretHash, req.Name, pq.Array(req.RedirectURIs), uid,
+	).Scan(&id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create client"})
+	}
+
+	h.authHandler.logAudit(c, &uid, "oidc.clients.create", "oidc_clients", &id, map[string]interface{}{
+		"client_id":     clientID,
+		"name":          req.Name,
+		"redirect_uris": req.RedirectURIs,
+		"public":        req.Public,
+	})
+
+	resp := fiber.Map{
+		"client_id": clientID,
+		"message":   "Client registered successfully",
+	}
+	if clientSecret != "" {
+		resp["client_secret"] = clientSecret
+	}
+	return c.JSON(resp)
+}
+
+func (h *OIDCHandler) DeleteClient(c *fiber.Ctx) error {
+	clientID := c.Params("clientId")
+
+	var id uuid.UUID
+	err := h.db.QueryRow(`DELETE FROM oidc_clients WHERE client_id = $1 RETURNING id`, clientID).Scan(&id)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Client not found"})
+	}
+
+	// Tokens already issued to the client stop working with their sessions
+	_, err = h.db.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE client_id = $1 AND revoked_at IS NULL`,
+		clientID,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke client sessions"})
+	}
+
+	userID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(userID)
+	h.authHandler.logAudit(c, &uid, "oidc.clients.delete", "oidc_clients", &id, map[string]interface{}{
+		"client_id": clientID,
+	})
+
+	return c.JSON(fiber.Map{"message": "Client deleted successfully"})
+}
+
+func (h *OIDCHandler) renderLogin(c *fiber.Ctx, status int, clientName string, req *authorizeRequest, username, errMsg string) error {
+	var buf bytes.Buffer
+	err := loginTemplate.Execute(&buf, map[string]interface{}{
+		"ClientName": clientName,
+		"Request":    req,
+		"Username":   username,
+		"Error":      errMsg,
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to render login page"})
+	}
+
+	c.Set("Cache-Control", "no-store")
+	c.Set("X-Frame-Options", "DENY")
+	c.Type("html")
+	return c.Status(status).Send(buf.Bytes())
+}
+
+// clientCredentials reads client_secret_basic credentials, falling back to
+// client_secret_post form fields.
+func clientCredentials(c *fiber.Ctx) (string, string) {
+	if header := c.Get("Authorization"); strings.HasPrefix(header, "Basic ") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+		if err == nil {
+			if id, secret, ok := strings.Cut(string(decoded), ":"); ok {
+				id, _ = url.QueryUnescape(id)
+				secret, _ = url.QueryUnescape(secret)
+				return id, secret
+			}
+		}
+	}
+	return c.FormValue("client_id"), c.FormValue("client_secret")
+}
+
+func oauthError(c *fiber.Ctx, status int, code, description string) error {
+	return c.Status(status).JSON(fiber.Map{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func redirectWith(redirectURI string, params map[string]string) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	q := u.Query()
+	for k, v := range params {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in - IDAM-PAM Platform</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #f9fafb; display: flex; justify-content: center; padding-top: 10vh; }
+form { background: #fff; padding: 2rem; border-radius: 8px; box-shadow: 0 1px 3px rgba(0,0,0,.1); width: 320px; }
+h1 { font-size: 1.25rem; margin: 0 0 .25rem; }
+p { color: #6b7280; margin: 0 0 1.5rem; font-size: .875rem; }
+label { display: block; font-size: .875rem; margin-bottom: 1rem; }
+input[type=text], input[type=password] { width: 100%; box-sizing: border-box; padding: .5rem; margin-top: .25rem; border: 1px solid #d1d5db; border-radius: 4px; }
+button { width: 100%; padding: .6rem; background: #2563eb; color: #fff; border: 0; border-radius: 4px; cursor: pointer; }
+.error { color: #b91c1c; }
+</style>
+</head>
+<body>
+<form method="post" action="/oauth2/authorize">
+<h1>Sign in</h1>
+<p>to continue to <strong>{{.ClientName}}</strong></p>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<label>Username <input type="text" name="username" value="{{.Username}}" autocomplete="username" required autofocus></label>
+<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+<label>TOTP code <input type="text" name="totp_code" inputmode="numeric" autocomplete="one-time-code" placeholder="Only if MFA is enabled"></label>
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
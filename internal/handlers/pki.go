@@ -0,0 +1,554 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/models"
+	"idam-pam-platform/internal/pki"
+	"idam-pam-platform/internal/rbac"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// PKIHandler issues TLS certificates from the internal CA. Holders of
+// pki.manage configure PKI roles; anyone with pki.issue who holds one of a
+// role's allowed roles can issue certificates from it.
+type PKIHandler struct {
+	db       *sql.DB
+	ca       *pki.CA
+	resolver *rbac.Resolver
+	auditor
+}
+
+func NewPKIHandler(db *sql.DB, ca *pki.CA, resolver *rbac.Resolver, auditLog *audit.Logger) *PKIHandler {
+	return &PKIHandler{
+		db:       db,
+		ca:       ca,
+		resolver: resolver,
+		auditor:  auditor{auditLog},
+	}
+}
+
+// CAChain publishes the intermediate and root certificates as PEM for
+// clients' trust stores.
+func (h *PKIHandler) CAChain(c *fiber.Ctx) error {
+	chain, err := h.ca.Chain()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch CA chain"})
+	}
+	c.Set("Cache-Control", "public, max-age=3600")
+	c.Set(fiber.HeaderContentType, "application/pem-certificate-chain")
+	return c.SendString(chain)
+}
+
+// CRL publishes the current certificate revocation list, DER encoded, or
+// PEM with ?format=pem.
+func (h *PKIHandler) CRL(c *fiber.Ctx) error {
+	crl, err := h.ca.CRL()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to build CRL"})
+	}
+	c.Set("Cache-Control", "public, max-age=300")
+	if c.Query("format") == "pem" {
+		c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+		return c.Send(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}))
+	}
+	c.Set(fiber.HeaderContentType, "application/pkix-crl")
+	return c.Send(crl)
+}
+
+func (h *PKIHandler) GetAuthorities(c *fiber.Ctx) error {
+	cas, err := h.ca.Authorities()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch CAs"})
+	}
+	return c.JSON(cas)
+}
+
+const pkiRoleSelect = `
+	SELECT id, name, COALESCE(description, ''), allowed_domains, allow_subdomains, allow_ip_sans,
+	       server_auth, client_auth, default_ttl_seconds, max_ttl_seconds, allowed_role_ids,
+	       created_by, created_at, updated_at
+	FROM pki_roles`
+
+func scanPKIRole(row rowScanner) (*models.PKIRole, error) {
+	var r models.PKIRole
+	err := row.Scan(&r.ID, &r.Name, &r.Description, pq.Array(&r.AllowedDomains), &r.AllowSubdomains,
+		&r.AllowIPSANs, &r.ServerAuth, &r.ClientAuth, &r.DefaultTTLSeconds, &r.MaxTTLSeconds,
+		pq.Array(&r.AllowedRoleIDs), &r.CreatedBy, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (h *PKIHandler) GetRoles(c *fiber.Ctx) error {
+	rows, err := h.db.Query(pkiRoleSelect + ` ORDER BY name`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch PKI roles"})
+	}
+	defer rows.Close()
+
+	roles := []models.PKIRole{}
+	for rows.Next() {
+		role, err := scanPKIRole(rows)
+		if err != nil {
+			continue
+		}
+		roles = append(roles, *role)
+	}
+
+	return c.JSON(roles)
+}
+
+func (h *PKIHandler) GetRole(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid PKI role ID"})
+	}
+
+	role, err := scanPKIRole(h.db.QueryRow(pkiRoleSelect+` WHERE id = $1`, roleID))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "PKI role not found"})
+	}
+
+	return c.JSON(role)
+}
+
+type pkiRoleRequest struct {
+	Name            *string   `json:"name"`
+	Description     *string   `json:"description"`
+	AllowedDomains  *[]string `json:"allowed_domains"`
+	AllowSubdomains *bool     `json:"allow_subdomains"`
+	AllowIPSANs     *bool     `json:"allow_ip_sans"`
+	ServerAuth      *bool     `json:"server_auth"`
+	ClientAuth      *bool     `json:"client_auth"`
+	DefaultTTL      *string   `json:"default_ttl"`
+	MaxTTL          *string   `json:"max_ttl"`
+	AllowedRoleIDs  *[]string `json:"allowed_role_ids"`
+}
+
+// CreateRole registers a certificate template: the domains certificates
+// may name, their lifetime and usages, and the platform roles that may
+// issue from it.
+func (h *PKIHandler) CreateRole(c *fiber.Ctx) error {
+	var req pkiRoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.Name == nil || strings.TrimSpace(*req.Name) == "" || req.AllowedDomains == nil || req.AllowedRoleIDs == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "name, allowed_domains and allowed_role_ids are required"})
+	}
+	if req.Description == nil {
+		req.Description = strPtr("")
+	}
+	if req.AllowSubdomains == nil {
+		req.AllowSubdomains = boolPtr(false)
+	}
+	if req.AllowIPSANs == nil {
+		req.AllowIPSANs = boolPtr(false)
+	}
+	if req.ServerAuth == nil {
+		req.ServerAuth = boolPtr(true)
+	}
+	if req.ClientAuth == nil {
+		req.ClientAuth = boolPtr(false)
+	}
+	if req.DefaultTTL == nil {
+		req.DefaultTTL = strPtr("720h")
+	}
+	if req.MaxTTL == nil {
+		req.MaxTTL = strPtr("2160h")
+	}
+
+	settings, err := h.validateRole(&req)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	uid := currentUserID(c)
+	var roleID uuid.UUID
+	err = h.db.QueryRow(`
+		INSERT INTO pki_roles (name, description, allowed_domains, allow_subdomains, allow_ip_sans, server_auth,
+		                       client_auth, default_ttl_seconds, max_ttl_seconds, allowed_role_ids, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id`,
+		strings.TrimSpace(*req.Name), *req.Description, pq.Array(*req.AllowedDomains), *req.AllowSubdomains,
+		*req.AllowIPSANs, *req.ServerAuth, *req.ClientAuth, settings.defaultSeconds, settings.maxSeconds,
+		pq.Array(*req.AllowedRoleIDs), uid,
+	).Scan(&roleID)
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "A PKI role with this name already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create PKI role"})
+	}
+
+	h.logAudit(c, &uid, "pki.role.create", "pki_roles", &roleID, pkiRoleAuditDetails(&req))
+
+	role, err := scanPKIRole(h.db.QueryRow(pkiRoleSelect+` WHERE id = $1`, roleID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch PKI role"})
+	}
+	return c.Status(201).JSON(role)
+}
+
+// UpdateRole changes any of a PKI role's settings. Certificates already
+// issued are unaffected; renewals follow the new settings.
+func (h *PKIHandler) UpdateRole(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid PKI role ID"})
+	}
+
+	var req pkiRoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	current, err := scanPKIRole(h.db.QueryRow(pkiRoleSelect+` WHERE id = $1`, roleID))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "PKI role not found"})
+	}
+	if req.Name == nil {
+		req.Name = &current.Name
+	}
+	if req.Description == nil {
+		req.Description = &current.Description
+	}
+	if req.AllowedDomains == nil {
+		req.AllowedDomains = &current.AllowedDomains
+	}
+	if req.AllowSubdomains == nil {
+		req.AllowSubdomains = &current.AllowSubdomains
+	}
+	if req.AllowIPSANs == nil {
+		req.AllowIPSANs = &current.AllowIPSANs
+	}
+	if req.ServerAuth == nil {
+		req.ServerAuth = &current.ServerAuth
+	}
+	if req.ClientAuth == nil {
+		req.ClientAuth = &current.ClientAuth
+	}
+	if req.DefaultTTL == nil {
+		req.DefaultTTL = strPtr((time.Duration(current.DefaultTTLSeconds) * time.Second).String())
+	}
+	if req.MaxTTL == nil {
+		req.MaxTTL = strPtr((time.Duration(current.MaxTTLSeconds) * time.Second).String())
+	}
+	if req.AllowedRoleIDs == nil {
+		req.AllowedRoleIDs = &current.AllowedRoleIDs
+	}
+
+	settings, err := h.validateRole(&req)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE pki_roles
+		SET name = $2, description = $3, allowed_domains = $4, allow_subdomains = $5, allow_ip_sans = $6,
+		    server_auth = $7, client_auth = $8, default_ttl_seconds = $9, max_ttl_seconds = $10,
+		    allowed_role_ids = $11, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		roleID, strings.TrimSpace(*req.Name), *req.Description, pq.Array(*req.AllowedDomains), *req.AllowSubdomains,
+		*req.AllowIPSANs, *req.ServerAuth, *req.ClientAuth, settings.defaultSeconds, settings.maxSeconds,
+		pq.Array(*req.AllowedRoleIDs),
+	)
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "A PKI role with this name already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update PKI role"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "pki.role.update", "pki_roles", &roleID, pkiRoleAuditDetails(&req))
+
+	role, err := scanPKIRole(h.db.QueryRow(pkiRoleSelect+` WHERE id = $1`, roleID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch PKI role"})
+	}
+	return c.JSON(role)
+}
+
+// DeleteRole removes a PKI role. Its certificates stay in the inventory and
+// can still be revoked, but can no longer be renewed.
+func (h *PKIHandler) DeleteRole(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid PKI role ID"})
+	}
+
+	var name string
+	err = h.db.QueryRow(`DELETE FROM pki_roles WHERE id = $1 RETURNING name`, roleID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "PKI role not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete PKI role"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "pki.role.delete", "pki_roles", &roleID, map[string]interface{}{
+		"name": name,
+	})
+
+	return c.JSON(fiber.Map{"message": "PKI role deleted"})
+}
+
+// IssueCertificate signs a certificate from a PKI role. Send a CSR to keep
+// the private key on your side; without one a key is generated and
+// returned once.
+func (h *PKIHandler) IssueCertificate(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid PKI role ID"})
+	}
+
+	var req struct {
+		CommonName  string   `json:"common_name"`
+		AltNames    []string `json:"alt_names"`
+		IPAddresses []string `json:"ip_addresses"`
+		CSR         string   `json:"csr"`
+		TTL         string   `json:"ttl"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "TTL must be a positive duration such as 720h"})
+		}
+	}
+
+	keySource := "generated"
+	if req.CSR != "" {
+		keySource = "csr"
+	}
+
+	uid := currentUserID(c)
+	issued, err := h.ca.Issue(roleID, uid, pki.IssueRequest{
+		CommonName:  strings.TrimSpace(req.CommonName),
+		AltNames:    req.AltNames,
+		IPAddresses: req.IPAddresses,
+		CSR:         req.CSR,
+		TTL:         ttl,
+	})
+	if err != nil {
+		return pkiError(c, err, "Failed to issue certificate")
+	}
+
+	if err := h.logCritical(c, &uid, "pki.certificate.issue", "pki_roles", &roleID, map[string]interface{}{
+		"serial":       issued.Serial,
+		"pki_role":     issued.PKIRole,
+		"common_name":  issued.CommonName,
+		"dns_names":    issued.DNSNames,
+		"ip_addresses": issued.IPAddresses,
+		"not_after":    issued.NotAfter,
+		"key_source":   keySource,
+	}); err != nil {
+		return auditUnavailable(c)
+	}
+
+	return c.Status(201).JSON(issued)
+}
+
+// GetCertificates lists certificates the caller issued; holders of
+// pki.manage see everyone's. Filter with ?status=valid, expired or revoked.
+func (h *PKIHandler) GetCertificates(c *fiber.Ctx) error {
+	uid := currentUserID(c)
+	canManage, err := h.resolver.HasPermission(uid.String(), "pki.manage")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve permissions"})
+	}
+
+	var owner *uuid.UUID
+	if !canManage {
+		owner = &uid
+	}
+	certs, err := h.ca.Certificates(owner, c.Query("status"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch certificates"})
+	}
+
+	return c.JSON(certs)
+}
+
+func (h *PKIHandler) GetCertificate(c *fiber.Ctx) error {
+	cert, err := h.ownCertificate(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(cert)
+}
+
+// RenewCertificate issues a new certificate for the same key and names,
+// valid for the PKI role's default TTL.
+func (h *PKIHandler) RenewCertificate(c *fiber.Ctx) error {
+	cert, err := h.ownCertificate(c)
+	if err != nil {
+		return err
+	}
+
+	uid := currentUserID(c)
+	renewed, err := h.ca.Renew(cert.Serial, uid)
+	if err != nil {
+		return pkiError(c, err, "Failed to renew certificate")
+	}
+
+	if err := h.logCritical(c, &uid, "pki.certificate.renew", "pki_roles", renewed.PKIRoleID, map[string]interface{}{
+		"serial":       renewed.Serial,
+		"renewed_from": cert.Serial,
+		"common_name":  renewed.CommonName,
+		"not_after":    renewed.NotAfter,
+	}); err != nil {
+		return auditUnavailable(c)
+	}
+
+	return c.Status(201).JSON(renewed)
+}
+
+// RevokeCertificate puts a certificate on the CRL: {"reason":
+// "key_compromise"}. The reason defaults to unspecified.
+func (h *PKIHandler) RevokeCertificate(c *fiber.Ctx) error {
+	cert, err := h.ownCertificate(c)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "unspecified"
+	}
+	if _, ok := pki.RevocationReasons[req.Reason]; !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "reason must be unspecified, key_compromise, affiliation_changed, superseded or cessation_of_operation"})
+	}
+
+	uid := currentUserID(c)
+	revoked, err := h.ca.Revoke(cert.Serial, uid, req.Reason)
+	if err != nil {
+		return pkiError(c, err, "Failed to revoke certificate")
+	}
+
+	h.logAudit(c, &uid, "pki.certificate.revoke", "pki_roles", cert.PKIRoleID, map[string]interface{}{
+		"serial":      cert.Serial,
+		"common_name": cert.CommonName,
+		"issued_by":   cert.IssuedBy,
+		"reason":      req.Reason,
+	})
+
+	return c.JSON(revoked)
+}
+
+// ownCertificate loads the certificate in the URL if the caller issued it
+// or holds pki.manage. Other callers get a 404.
+func (h *PKIHandler) ownCertificate(c *fiber.Ctx) (*pki.Certificate, error) {
+	cert, err := h.ca.Certificate(c.Params("serial"))
+	if err == pki.ErrNotFound {
+		return nil, fiber.NewError(404, "Certificate not found")
+	}
+	if err != nil {
+		return nil, fiber.NewError(500, "Failed to fetch certificate")
+	}
+
+	uid := currentUserID(c)
+	if cert.IssuedBy != uid {
+		canManage, err := h.resolver.HasPermission(uid.String(), "pki.manage")
+		if err != nil || !canManage {
+			return nil, fiber.NewError(404, "Certificate not found")
+		}
+	}
+	return cert, nil
+}
+
+func pkiError(c *fiber.Ctx, err error, fallback string) error {
+	switch {
+	case err == pki.ErrNotFound:
+		return c.Status(404).JSON(fiber.Map{"error": "PKI role not found"})
+	case err == pki.ErrNotAllowed:
+		return c.Status(403).JSON(fiber.Map{"error": "You do not hold a role allowed to use this PKI role"})
+	case err == pki.ErrTTLTooLong:
+		return c.Status(400).JSON(fiber.Map{"error": "TTL exceeds the PKI role's maximum"})
+	case err == pki.ErrRevoked:
+		return c.Status(409).JSON(fiber.Map{"error": "Certificate is revoked"})
+	case errors.Is(err, pki.ErrNameNotAllowed), errors.Is(err, pki.ErrInvalidCSR), err == pki.ErrCommonNameRequired:
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": fallback})
+	}
+}
+
+type pkiRoleSettings struct {
+	defaultSeconds int
+	maxSeconds     int
+}
+
+func (h *PKIHandler) validateRole(req *pkiRoleRequest) (*pkiRoleSettings, error) {
+	if err := pki.ValidateDomains(*req.AllowedDomains); err != nil {
+		return nil, err
+	}
+	if !*req.ServerAuth && !*req.ClientAuth {
+		return nil, errors.New("at least one of server_auth and client_auth must be set")
+	}
+
+	defaultTTL, err := time.ParseDuration(*req.DefaultTTL)
+	if err != nil || defaultTTL < time.Hour {
+		return nil, errors.New("default_ttl must be a duration of at least 1h")
+	}
+	maxTTL, err := time.ParseDuration(*req.MaxTTL)
+	if err != nil || maxTTL < defaultTTL {
+		return nil, errors.New("max_ttl must be a duration no shorter than default_ttl")
+	}
+
+	if len(*req.AllowedRoleIDs) == 0 {
+		return nil, errors.New("allowed_role_ids must name at least one role")
+	}
+	for _, id := range *req.AllowedRoleIDs {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, errors.New("allowed_role_ids must be role IDs")
+		}
+	}
+	var found int
+	if err := h.db.QueryRow(`SELECT COUNT(*) FROM roles WHERE id = ANY($1::uuid[])`,
+		pq.Array(*req.AllowedRoleIDs)).Scan(&found); err != nil || found != len(*req.AllowedRoleIDs) {
+		return nil, errors.New("allowed_role_ids contains an unknown role")
+	}
+
+	return &pkiRoleSettings{
+		defaultSeconds: int(defaultTTL.Seconds()),
+		maxSeconds:     int(maxTTL.Seconds()),
+	}, nil
+}
+
+func pkiRoleAuditDetails(req *pkiRoleRequest) map[string]interface{} {
+	return map[string]interface{}{
+		"name":             strings.TrimSpace(*req.Name),
+		"allowed_domains":  *req.AllowedDomains,
+		"allow_subdomains": *req.AllowSubdomains,
+		"allow_ip_sans":    *req.AllowIPSANs,
+		"default_ttl":      *req.DefaultTTL,
+		"max_ttl":          *req.MaxTTL,
+		"allowed_role_ids": *req.AllowedRoleIDs,
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,524 @@
+package handlers
+
+import (
+	"database/sql"
+	"strings"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/models"
+	"idam-pam-platform/internal/rbac"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// RoleHandler manages roles, permissions and the bindings between them.
+// Built-in (is_system) roles and permissions cannot be renamed or deleted,
+// and the admin role always keeps every permission.
+type RoleHandler struct {
+	db       *sql.DB
+	resolver *rbac.Resolver
+	auditor
+}
+
+func NewRoleHandler(db *sql.DB, resolver *rbac.Resolver, auditLog *audit.Logger) *RoleHandler {
+	return &RoleHandler{db: db, resolver: resolver, auditor: auditor{auditLog}}
+}
+
+func (h *RoleHandler) GetRoles(c *fiber.Ctx) error {
+	rows, err := h.db.Query(`
+		SELECT id, name, COALESCE(description, ''), is_system, created_at
+		FROM roles
+		ORDER BY name
+	`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch roles"})
+	}
+	defer rows.Close()
+
+	var roles []models.Role
+	for rows.Next() {
+		var role models.Role
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.IsSystem, &role.CreatedAt); err != nil {
+			continue
+		}
+		roles = append(roles, role)
+	}
+
+	return c.JSON(roles)
+}
+
+func (h *RoleHandler) GetRole(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
+	}
+
+	var role models.Role
+	err = h.db.QueryRow(`
+		SELECT id, name, COALESCE(description, ''), is_system, created_at
+		FROM roles WHERE id = $1`,
+		roleID,
+	).Scan(&role.ID, &role.Name, &role.Description, &role.IsSystem, &role.CreatedAt)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Role not found"})
+	}
+
+	role.Permissions, err = h.rolePermissions(roleID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch role permissions"})
+	}
+
+	return c.JSON(role)
+}
+
+func (h *RoleHandler) CreateRole(c *fiber.Ctx) error {
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Role name is required"})
+	}
+
+	var roleID uuid.UUID
+	err := h.db.QueryRow(`
+		INSERT INTO roles (name, description) VALUES ($1, $2)
+		RETURNING id`,
+		req.Name, req.Description,
+	).Scan(&roleID)
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "Role already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create role"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "roles.create", "roles", &roleID, map[string]interface{}{
+		"name": req.Name,
+	})
+
+	return c.JSON(fiber.Map{
+		"id":      roleID,
+		"message": "Role created successfully",
+	})
+}
+
+func (h *RoleHandler) UpdateRole(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
+	}
+
+	var req struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	var name string
+	var isSystem bool
+	err = h.db.QueryRow(`SELECT name, is_system FROM roles WHERE id = $1`, roleID).Scan(&name, &isSystem)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Role not found"})
+	}
+
+	if req.Name != nil {
+		*req.Name = strings.TrimSpace(*req.Name)
+		if *req.Name == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "Role name is required"})
+		}
+		if isSystem && *req.Name != name {
+			return c.Status(409).JSON(fiber.Map{"error": "Built-in roles cannot be renamed"})
+		}
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE roles
+		SET name = COALESCE($2, name), description = COALESCE($3, description)
+		WHERE id = $1`,
+		roleID, req.Name, req.Description,
+	)
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "Role already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update role"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "roles.update", "roles", &roleID, map[string]interface{}{
+		"name":        req.Name,
+		"description": req.Description,
+	})
+
+	return c.JSON(fiber.Map{"message": "Role updated successfully"})
+}
+
+func (h *RoleHandler) DeleteRole(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete role"})
+	}
+	defer tx.Rollback()
+
+	var name string
+	var isSystem bool
+	err = tx.QueryRow(`SELECT name, is_system FROM roles WHERE id = $1 FOR UPDATE`, roleID).Scan(&name, &isSystem)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Role not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete role"})
+	}
+	if isSystem {
+		return c.Status(409).JSON(fiber.Map{"error": "Built-in roles cannot be deleted"})
+	}
+
+	// Secret shares and database, certificate and transit key access
+	// granted to the role go with it
+	for _, query := range []string{
+		`DELETE FROM roles WHERE id = $1`,
+		`DELETE FROM secret_acls WHERE principal_type = 'role' AND principal_id = $1`,
+		`DELETE FROM folder_acls WHERE principal_type = 'role' AND principal_id = $1`,
+		`UPDATE database_roles SET allowed_role_ids = array_remove(allowed_role_ids, $1) WHERE $1 = ANY(allowed_role_ids)`,
+		`UPDATE pki_roles SET allowed_role_ids = array_remove(allowed_role_ids, $1) WHERE $1 = ANY(allowed_role_ids)`,
+		`UPDATE transit_keys SET allowed_role_ids = array_remove(allowed_role_ids, $1) WHERE $1 = ANY(allowed_role_ids)`,
+	} {
+		if _, err := tx.Exec(query, roleID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete role"})
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete role"})
+	}
+	h.resolver.InvalidateAll()
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "roles.delete", "roles", &roleID, map[string]interface{}{
+		"name": name,
+	})
+
+	return c.JSON(fiber.Map{"message": "Role deleted successfully"})
+}
+
+func (h *RoleHandler) GetRolePermissions(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
+	}
+
+	permissions, err := h.rolePermissions(roleID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch role permissions"})
+	}
+
+	return c.JSON(permissions)
+}
+
+func (h *RoleHandler) GrantPermission(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
+	}
+
+	var req struct {
+		PermissionID uuid.UUID `json:"permission_id"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	roleName, status, msg := h.checkMutableRole(roleID)
+	if status != 0 {
+		return c.Status(status).JSON(fiber.Map{"error": msg})
+	}
+
+	var permissionName string
+	err = h.db.QueryRow(`SELECT name FROM permissions WHERE id = $1`, req.PermissionID).Scan(&permissionName)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Permission not found"})
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO role_permissions (role_id, permission_id) VALUES ($1, $2)
+		ON CONFLICT (role_id, permission_id) DO NOTHING`,
+		roleID, req.PermissionID,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to grant permission"})
+	}
+	h.resolver.InvalidateAll()
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "roles.grant_permission", "roles", &roleID, map[string]interface{}{
+		"role":          roleName,
+		"permission_id": req.PermissionID,
+		"permission":    permissionName,
+	})
+
+	return c.JSON(fiber.Map{"message": "Permission granted successfully"})
+}
+
+func (h *RoleHandler) RevokePermission(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
+	}
+	permissionID, err := uuid.Parse(c.Params("permissionId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid permission ID"})
+	}
+
+	roleName, status, msg := h.checkMutableRole(roleID)
+	if status != 0 {
+		return c.Status(status).JSON(fiber.Map{"error": msg})
+	}
+
+	var permissionName string
+	err = h.db.QueryRow(`
+		DELETE FROM role_permissions rp
+		USING permissions p
+		WHERE rp.permission_id = p.id AND rp.role_id = $1 AND rp.permission_id = $2
+		RETURNING p.name`,
+		roleID, permissionID,
+	).Scan(&permissionName)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Permission is not granted to this role"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke permission"})
+	}
+	h.resolver.InvalidateAll()
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "roles.revoke_permission", "roles", &roleID, map[string]interface{}{
+		"role":          roleName,
+		"permission_id": permissionID,
+		"permission":    permissionName,
+	})
+
+	return c.JSON(fiber.Map{"message": "Permission revoked successfully"})
+}
+
+func (h *RoleHandler) GetPermissions(c *fiber.Ctx) error {
+	rows, err := h.db.Query(`
+		SELECT id, name, resource, action, is_system
+		FROM permissions
+		ORDER BY name
+	`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch permissions"})
+	}
+	defer rows.Close()
+
+	var permissions []models.Permission
+	for rows.Next() {
+		var p models.Permission
+		if err := rows.Scan(&p.ID, &p.Name, &p.Resource, &p.Action, &p.IsSystem); err != nil {
+			continue
+		}
+		permissions = append(permissions, p)
+	}
+
+	return c.JSON(permissions)
+}
+
+func (h *RoleHandler) CreatePermission(c *fiber.Ctx) error {
+	var req struct {
+		Name     string `json:"name"`
+		Resource string `json:"resource"`
+		Action   string `json:"action"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	req.Resource = strings.TrimSpace(req.Resource)
+	req.Action = strings.TrimSpace(req.Action)
+	if req.Resource == "" || req.Action == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Resource and action are required"})
+	}
+	if req.Name == "" {
+		req.Name = req.Resource + "." + req.Action
+	}
+
+	var permissionID uuid.UUID
+	err := h.db.QueryRow(`
+		INSERT INTO permissions (name, resource, action, is_system) VALUES ($1, $2, $3, false)
+		RETURNING id`,
+		req.Name, req.Resource, req.Action,
+	).Scan(&permissionID)
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "Permission already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create permission"})
+	}
+
+	// Keep the admin role complete
+	_, err = h.db.Exec(`
+		INSERT INTO role_permissions (role_id, permission_id)
+		SELECT id, $1 FROM roles WHERE name = 'admin'
+		ON CONFLICT DO NOTHING`,
+		permissionID,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to grant permission to admin role"})
+	}
+	h.resolver.InvalidateAll()
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "permissions.create", "permissions", &permissionID, map[string]interface{}{
+		"name":     req.Name,
+		"resource": req.Resource,
+		"action":   req.Action,
+	})
+
+	return c.JSON(fiber.Map{
+		"id":      permissionID,
+		"message": "Permission created successfully",
+	})
+}
+
+func (h *RoleHandler) UpdatePermission(c *fiber.Ctx) error {
+	permissionID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid permission ID"})
+	}
+
+	var req struct {
+		Name     *string `json:"name"`
+		Resource *string `json:"resource"`
+		Action   *string `json:"action"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	var isSystem bool
+	err = h.db.QueryRow(`SELECT is_system FROM permissions WHERE id = $1`, permissionID).Scan(&isSystem)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Permission not found"})
+	}
+	if isSystem {
+		// Routes refer to built-in permissions by name
+		return c.Status(409).JSON(fiber.Map{"error": "Built-in permissions cannot be modified"})
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE permissions
+		SET name = COALESCE($2, name), resource = COALESCE($3, resource), action = COALESCE($4, action)
+		WHERE id = $1`,
+		permissionID, req.Name, req.Resource, req.Action,
+	)
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "Permission already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update permission"})
+	}
+	h.resolver.InvalidateAll()
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "permissions.update", "permissions", &permissionID, map[string]interface{}{
+		"name":     req.Name,
+		"resource": req.Resource,
+		"action":   req.Action,
+	})
+
+	return c.JSON(fiber.Map{"message": "Permission updated successfully"})
+}
+
+func (h *RoleHandler) DeletePermission(c *fiber.Ctx) error {
+	permissionID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid permission ID"})
+	}
+
+	var name string
+	var isSystem bool
+	err = h.db.QueryRow(`SELECT name, is_system FROM permissions WHERE id = $1`, permissionID).Scan(&name, &isSystem)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Permission not found"})
+	}
+	if isSystem {
+		return c.Status(409).JSON(fiber.Map{"error": "Built-in permissions cannot be deleted"})
+	}
+
+	if _, err := h.db.Exec(`DELETE FROM permissions WHERE id = $1`, permissionID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete permission"})
+	}
+	h.resolver.InvalidateAll()
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "permissions.delete", "permissions", &permissionID, map[string]interface{}{
+		"name": name,
+	})
+
+	return c.JSON(fiber.Map{"message": "Permission deleted successfully"})
+}
+
+func (h *RoleHandler) rolePermissions(roleID uuid.UUID) ([]models.Permission, error) {
+	rows, err := h.db.Query(`
+		SELECT p.id, p.name, p.resource, p.action, p.is_system
+		FROM permissions p
+		JOIN role_permissions rp ON rp.permission_id = p.id
+		WHERE rp.role_id = $1
+		ORDER BY p.name`,
+		roleID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []models.Permission{}
+	for rows.Next() {
+		var p models.Permission
+		if err := rows.Scan(&p.ID, &p.Name, &p.Resource, &p.Action, &p.IsSystem); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, rows.Err()
+}
+
+// checkMutableRole returns the role name, or an HTTP status and message if
+// the role's permission bindings may not be changed.
+func (h *RoleHandler) checkMutableRole(roleID uuid.UUID) (string, int, string) {
+	var name string
+	err := h.db.QueryRow(`SELECT name FROM roles WHERE id = $1`, roleID).Scan(&name)
+	if err != nil {
+		return "", 404, "Role not found"
+	}
+	if name == "admin" {
+		return "", 409, "The admin role always holds every permission"
+	}
+	return name, 0, ""
+}
+
+func currentUserID(c *fiber.Ctx) uuid.UUID {
+	userID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(userID)
+	return uid
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
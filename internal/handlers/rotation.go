@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"idam-pam-platform/internal/vault"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// GetRotationPolicy shows how and when a secret is rotated.
+func (h *SecretHandler) GetRotationPolicy(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	uid := currentUserID(c)
+	if _, err := h.authorize(secretID, uid, vault.AccessRead); err != nil {
+		return err
+	}
+
+	policy, err := h.store.RotationPolicy(secretID)
+	if err == vault.ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "Secret has no rotation policy"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch rotation policy"})
+	}
+
+	return c.JSON(policy)
+}
+
+// SetRotationPolicy creates or replaces a secret's rotation policy. Exactly
+// one of interval (rotate every N) or max_age (rotate once the current
+// value is older than N) must be given. Requires manage access.
+func (h *SecretHandler) SetRotationPolicy(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	var req struct {
+		Rotator  string          `json:"rotator"`
+		Config   json.RawMessage `json:"config"`
+		Interval string          `json:"interval"`
+		MaxAge   string          `json:"max_age"`
+		Enabled  *bool           `json:"enabled"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	uid := currentUserID(c)
+	secretPath, err := h.authorize(secretID, uid, vault.AccessManage)
+	if err != nil {
+		return err
+	}
+
+	policy := &vault.RotationPolicy{
+		SecretID: secretID,
+		Rotator:  req.Rotator,
+		Config:   req.Config,
+		Enabled:  req.Enabled == nil || *req.Enabled,
+	}
+	if req.Interval != "" {
+		if policy.IntervalSeconds, err = policySeconds(req.Interval); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Interval " + err.Error()})
+		}
+	}
+	if req.MaxAge != "" {
+		if policy.MaxAgeSeconds, err = policySeconds(req.MaxAge); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Max age " + err.Error()})
+		}
+	}
+
+	saved, err := h.store.SetRotationPolicy(policy, uid)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	h.logAudit(c, &uid, "secrets.rotation.set", "secrets", &secretID, map[string]interface{}{
+		"path":     secretPath,
+		"rotator":  saved.Rotator,
+		"interval": req.Interval,
+		"max_age":  req.MaxAge,
+		"enabled":  saved.Enabled,
+	})
+
+	return c.JSON(saved)
+}
+
+// DeleteRotationPolicy stops scheduled rotation of a secret.
+func (h *SecretHandler) DeleteRotationPolicy(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	uid := currentUserID(c)
+	secretPath, err := h.authorize(secretID, uid, vault.AccessManage)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := h.store.DeleteRotationPolicy(secretID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete rotation policy"})
+	}
+	if !deleted {
+		return c.Status(404).JSON(fiber.Map{"error": "Secret has no rotation policy"})
+	}
+
+	h.logAudit(c, &uid, "secrets.rotation.delete", "secrets", &secretID, map[string]interface{}{
+		"path": secretPath,
+	})
+
+	return c.JSON(fiber.Map{"message": "Rotation policy deleted"})
+}
+
+// RotateSecret rotates a secret now with its configured rotator. A
+// checked-out secret can only be rotated by its holder.
+func (h *SecretHandler) RotateSecret(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	uid := currentUserID(c)
+	secretPath, err := h.authorize(secretID, uid, vault.AccessWrite)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), 30*time.Second)
+	defer cancel()
+
+	version, err := h.store.Rotate(ctx, secretID, &uid)
+	var rotationErr *vault.RotationError
+	switch {
+	case err == vault.ErrCheckedOut:
+		return c.Status(423).JSON(fiber.Map{"error": "Secret is checked out by another user"})
+	case errors.As(err, &rotationErr):
+		h.logAudit(c, &uid, "secrets.rotate.failed", "secrets", &secretID, map[string]interface{}{
+			"path":    secretPath,
+			"trigger": "manual",
+			"error":   rotationErr.Err.Error(),
+		})
+		return c.Status(502).JSON(fiber.Map{"error": rotationErr.Error()})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to rotate secret"})
+	}
+
+	h.logAudit(c, &uid, "secrets.rotate", "secrets", &secretID, map[string]interface{}{
+		"path":    secretPath,
+		"version": version,
+		"trigger": "manual",
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "Secret rotated",
+		"version": version,
+	})
+}
+
+// policySeconds parses a rotation period of at least a minute.
+func policySeconds(value string) (*int, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < time.Minute {
+		return nil, errors.New("must be a duration of at least 1m, such as 720h")
+	}
+	seconds := int(d.Seconds())
+	return &seconds, nil
+}
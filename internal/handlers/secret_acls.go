@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"idam-pam-platform/internal/models"
+	"idam-pam-platform/internal/vault"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// GetSecretACL lists who the secret is shared with. Requires manage.
+func (h *SecretHandler) GetSecretACL(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	uid := currentUserID(c)
+	if _, err := h.authorize(secretID, uid, vault.AccessManage); err != nil {
+		return err
+	}
+
+	rows, err := h.db.Query(`
+		SELECT a.id, a.secret_id, a.principal_type, a.principal_id,
+		       COALESCE(u.username, r.name, ''), a.access, a.granted_by, a.created_at
+		FROM secret_acls a
+		LEFT JOIN users u ON a.principal_type = 'user' AND u.id = a.principal_id
+		LEFT JOIN roles r ON a.principal_type = 'role' AND r.id = a.principal_id
+		WHERE a.secret_id = $1
+		ORDER BY a.created_at`,
+		secretID,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch secret ACL"})
+	}
+	defer rows.Close()
+
+	var entries []models.SecretACL
+	for rows.Next() {
+		var e models.SecretACL
+		if err := rows.Scan(&e.ID, &e.SecretID, &e.PrincipalType, &e.PrincipalID,
+			&e.PrincipalName, &e.Access, &e.GrantedBy, &e.CreatedAt); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return c.JSON(entries)
+}
+
+// GrantSecretAccess shares the secret with a user or role, replacing any
+// existing entry for that principal. Requires manage.
+func (h *SecretHandler) GrantSecretAccess(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	var req struct {
+		PrincipalType string    `json:"principal_type"`
+		PrincipalID   uuid.UUID `json:"principal_id"`
+		Access        string    `json:"access"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if _, ok := vault.ParseAccess(req.Access); !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "access must be read, write or manage"})
+	}
+
+	var principalQuery string
+	switch req.PrincipalType {
+	case "user":
+		principalQuery = `SELECT username FROM users WHERE id = $1`
+	case "role":
+		principalQuery = `SELECT name FROM roles WHERE id = $1`
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "principal_type must be user or role"})
+	}
+
+	uid := currentUserID(c)
+	secretPath, err := h.authorize(secretID, uid, vault.AccessManage)
+	if err != nil {
+		return err
+	}
+
+	var principalName string
+	if err := h.db.QueryRow(principalQuery, req.PrincipalID).Scan(&principalName); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Principal not found"})
+	}
+
+	var entryID uuid.UUID
+	err = h.db.QueryRow(`
+		INSERT INTO secret_acls (secret_id, principal_type, principal_id, access, granted_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (secret_id, principal_type, principal_id) DO UPDATE
+		SET access = EXCLUDED.access, granted_by = EXCLUDED.granted_by, created_at = CURRENT_TIMESTAMP
+		RETURNING id`,
+		secretID, req.PrincipalType, req.PrincipalID, req.Access, uid,
+	).Scan(&entryID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to grant access"})
+	}
+
+	h.logAudit(c, &uid, "secrets.acl.grant", "secrets", &secretID, map[string]interface{}{
+		"path":           secretPath,
+		"acl_id":         entryID,
+		"principal_type": req.PrincipalType,
+		"principal_id":   req.PrincipalID,
+		"principal_name": principalName,
+		"access":         req.Access,
+	})
+
+	return c.JSON(fiber.Map{
+		"id":      entryID,
+		"message": "Access granted successfully",
+	})
+}
+
+// RevokeSecretAccess removes an ACL entry. Requires manage.
+func (h *SecretHandler) RevokeSecretAccess(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+	entryID, err := uuid.Parse(c.Params("aclId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ACL entry ID"})
+	}
+
+	uid := currentUserID(c)
+	secretPath, err := h.authorize(secretID, uid, vault.AccessManage)
+	if err != nil {
+		return err
+	}
+
+	var principalType, access string
+	var principalID uuid.UUID
+	err = h.db.QueryRow(`
+		DELETE FROM secret_acls WHERE id = $1 AND secret_id = $2
+		RETURNING principal_type, principal_id, access`,
+		entryID, secretID,
+	).Scan(&principalType, &principalID, &access)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "ACL entry not found"})
+	}
+
+	h.logAudit(c, &uid, "secrets.acl.revoke", "secrets", &secretID, map[string]interface{}{
+		"path":           secretPath,
+		"acl_id":         entryID,
+		"principal_type": principalType,
+		"principal_id":   principalID,
+		"access":         access,
+	})
+
+	return c.JSON(fiber.Map{"message": "Access revoked successfully"})
+}
@@ -2,24 +2,33 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/json"
+	"strconv"
+	"time"
 
-	"idam-pam-platform/internal/encryption"
+	"idam-pam-platform/internal/audit"
 	"idam-pam-platform/internal/models"
+	"idam-pam-platform/internal/rbac"
+	"idam-pam-platform/internal/vault"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
 type SecretHandler struct {
-	db            *sql.DB
-	encryptionSvc *encryption.Service
+	db          *sql.DB
+	store       *vault.Store
+	resolver    *rbac.Resolver
+	maxCheckout time.Duration
+	auditor
 }
 
-func NewSecretHandler(db *sql.DB, encryptionSvc *encryption.Service) *SecretHandler {
+func NewSecretHandler(db *sql.DB, store *vault.Store, resolver *rbac.Resolver, maxCheckout time.Duration, auditLog *audit.Logger) *SecretHandler {
 	return &SecretHandler{
-		db:            db,
-		encryptionSvc: encryptionSvc,
+		db:          db,
+		store:       store,
+		resolver:    resolver,
+		maxCheckout: maxCheckout,
+		auditor:     auditor{auditLog},
 	}
 }
 
@@ -28,33 +37,66 @@ func (h *SecretHandler) CreateSecret(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
+	if req.MaxVersions != nil && *req.MaxVersions < 1 {
+		return c.Status(400).JSON(fiber.Map{"error": "max_versions must be at least 1"})
+	}
+
+	// A path such as teams/payments/prod/db places the secret in a folder
+	path := req.Path
+	if path == "" {
+		path = req.Name
+	}
+	folder, name, err := vault.SplitPath(path)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	userID := c.Locals("userID").(string)
 	uid, _ := uuid.Parse(userID)
 
-	encryptedData, err := h.encryptionSvc.Encrypt(req.Data)
+	// Folders covered by an ACL only accept secrets from their writers
+	access, claimed, err := h.store.FolderAccessFor(folder, uid)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to encrypt secret"})
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to check folder access"})
+	}
+	if claimed && access < vault.AccessWrite {
+		return c.Status(403).JSON(fiber.Map{"error": "This requires write access to folder " + folder})
 	}
 
-	var secretID uuid.UUID
-	err = h.db.QueryRow(`
-		INSERT INTO secrets (name, description, encrypted_data, created_by)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id`,
-		req.Name, req.Description, encryptedData, uid,
-	).Scan(&secretID)
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create secret"})
+	}
+	defer tx.Rollback()
 
+	secretID, err := h.store.Create(tx, folder, name, req.Description, req.Data, req.MaxVersions, uid)
 	if err != nil {
+		if isUniqueViolation(err) {
+			return c.Status(409).JSON(fiber.Map{"error": "A secret already exists at this path"})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create secret"})
+	}
+	if req.CheckoutRequired {
+		if _, err := tx.Exec(`UPDATE secrets SET checkout_required = true WHERE id = $1`, secretID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create secret"})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create secret"})
 	}
 
+	path = vault.JoinPath(folder, name)
 	h.logAudit(c, &uid, "secrets.create", "secrets", &secretID, map[string]interface{}{
-		"name": req.Name,
+		"path":              path,
+		"version":           1,
+		"checkout_required": req.CheckoutRequired,
 	})
 
 	return c.JSON(fiber.Map{
 		"id":      secretID,
+		"path":    path,
+		"version": 1,
 		"message": "Secret created successfully",
 	})
 }
@@ -63,14 +105,28 @@ func (h *SecretHandler) GetSecrets(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(string)
 	uid, _ := uuid.Parse(userID)
 
+	prefix, err := vault.CleanFolder(c.Query("prefix"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	// By default everything beneath the prefix is listed; recursive=false
+	// lists only the folder itself
+	recursive := c.Query("recursive") != "false"
+
+	// Secrets the caller created or has been granted access to
 	rows, err := h.db.Query(`
-		SELECT s.id, s.name, s.description, s.created_by, s.created_at, s.updated_at,
-		       u.username as created_by_username
-		FROM secrets s
-		JOIN users u ON s.created_by = u.id
-		WHERE s.created_by = $1
-		ORDER BY s.created_at DESC
-	`, uid)
+		SELECT * FROM (
+			SELECT s.id, s.folder, s.name, COALESCE(s.description, ''), s.current_version, s.max_versions,
+			       s.checkout_required, s.created_by, s.created_at, s.updated_at,
+			       u.username as created_by_username, `+vault.AccessLevelSQL+` AS access
+			FROM secrets s
+			JOIN users u ON s.created_by = u.id
+			WHERE s.folder = $2
+			   OR ($3 AND ($2 = '' OR left(s.folder, length($2) + 1) = $2 || '/'))
+		) visible
+		WHERE access > 0
+		ORDER BY folder, name
+	`, uid, prefix, recursive)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch secrets"})
 	}
@@ -78,25 +134,38 @@ func (h *SecretHandler) GetSecrets(c *fiber.Ctx) error {
 
 	var secrets []map[string]interface{}
 	for rows.Next() {
-		var secret models.Secret
-		var createdByUsername string
-		if err := rows.Scan(&secret.ID, &secret.Name, &secret.Description, &secret.CreatedBy,
-			&secret.CreatedAt, &secret.UpdatedAt, &createdByUsername); err != nil {
+		var (
+			secret            models.Secret
+			createdByUsername string
+			access            vault.Access
+		)
+		if err := rows.Scan(&secret.ID, &secret.Folder, &secret.Name, &secret.Description, &secret.CurrentVersion,
+			&secret.MaxVersions, &secret.CheckoutRequired, &secret.CreatedBy, &secret.CreatedAt, &secret.UpdatedAt,
+			&createdByUsername, &access); err != nil {
 			continue
 		}
 
 		secrets = append(secrets, map[string]interface{}{
 			"id":                  secret.ID,
+			"path":                vault.JoinPath(secret.Folder, secret.Name),
+			"folder":              secret.Folder,
 			"name":                secret.Name,
 			"description":         secret.Description,
+			"version":             secret.CurrentVersion,
+			"max_versions":        secret.MaxVersions,
+			"checkout_required":   secret.CheckoutRequired,
 			"created_by":          secret.CreatedBy,
 			"created_by_username": createdByUsername,
 			"created_at":          secret.CreatedAt,
 			"updated_at":          secret.UpdatedAt,
+			"access":              access.String(),
 		})
 	}
 
-	h.logAudit(c, &uid, "secrets.list", "secrets", nil, nil)
+	h.logAudit(c, &uid, "secrets.list", "secrets", nil, map[string]interface{}{
+		"prefix":    prefix,
+		"recursive": recursive,
+	})
 
 	return c.JSON(secrets)
 }
@@ -111,36 +180,296 @@ func (h *SecretHandler) GetSecret(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(string)
 	uid, _ := uuid.Parse(userID)
 
+	if _, err := h.authorize(secretID, uid, vault.AccessRead); err != nil {
+		return err
+	}
+	if err := h.requireCheckout(secretID, uid); err != nil {
+		return err
+	}
+
 	var secret models.Secret
 	err = h.db.QueryRow(`
-		SELECT id, name, description, encrypted_data, created_by, created_at, updated_at
-		FROM secrets 
-		WHERE id = $1 AND created_by = $2`,
-		secretID, uid,
-	).Scan(&secret.ID, &secret.Name, &secret.Description, &secret.EncryptedData,
-		&secret.CreatedBy, &secret.CreatedAt, &secret.UpdatedAt)
+		SELECT id, folder, name, COALESCE(description, ''), encrypted_data, COALESCE(encrypted_data_key, ''),
+		       current_version, max_versions, checkout_required, created_by, created_at, updated_at
+		FROM secrets
+		WHERE id = $1`,
+		secretID,
+	).Scan(&secret.ID, &secret.Folder, &secret.Name, &secret.Description, &secret.EncryptedData, &secret.EncryptedKey,
+		&secret.CurrentVersion, &secret.MaxVersions, &secret.CheckoutRequired, &secret.CreatedBy, &secret.CreatedAt, &secret.UpdatedAt)
 
 	if err != nil {
 		return c.Status(404).JSON(fiber.Map{"error": "Secret not found"})
 	}
 
-	decryptedData, err := h.encryptionSvc.Decrypt(secret.EncryptedData)
+	decryptedData, err := h.store.Decrypt(secret.EncryptedData, secret.EncryptedKey)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to decrypt secret"})
 	}
 
-	h.logAudit(c, &uid, "secrets.read", "secrets", &secretID, map[string]interface{}{
-		"name": secret.Name,
-	})
+	path := vault.JoinPath(secret.Folder, secret.Name)
+	if err := h.logCritical(c, &uid, "secrets.read", "secrets", &secretID, map[string]interface{}{
+		"path":    path,
+		"version": secret.CurrentVersion,
+	}); err != nil {
+		return auditUnavailable(c)
+	}
 
 	return c.JSON(map[string]interface{}{
-		"id":          secret.ID,
-		"name":        secret.Name,
-		"description": secret.Description,
-		"data":        decryptedData,
-		"created_by":  secret.CreatedBy,
-		"created_at":  secret.CreatedAt,
-		"updated_at":  secret.UpdatedAt,
+		"id":                secret.ID,
+		"path":              path,
+		"folder":            secret.Folder,
+		"name":              secret.Name,
+		"description":       secret.Description,
+		"data":              decryptedData,
+		"version":           secret.CurrentVersion,
+		"max_versions":      secret.MaxVersions,
+		"checkout_required": secret.CheckoutRequired,
+		"created_by":        secret.CreatedBy,
+		"created_at":        secret.CreatedAt,
+		"updated_at":        secret.UpdatedAt,
+	})
+}
+
+// UpdateSecret stores new data as the next version. Description and
+// max_versions can change without creating a version.
+func (h *SecretHandler) UpdateSecret(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	var req models.UpdateSecretRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.Data == nil && req.Description == nil && req.MaxVersions == nil && req.CheckoutRequired == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Nothing to update"})
+	}
+	if req.MaxVersions != nil && *req.MaxVersions < 1 {
+		return c.Status(400).JSON(fiber.Map{"error": "max_versions must be at least 1"})
+	}
+
+	userID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(userID)
+
+	need := vault.AccessWrite
+	if req.MaxVersions != nil || req.CheckoutRequired != nil {
+		// Shrinking retention destroys history; checkout changes who can read
+		need = vault.AccessManage
+	}
+	secretPath, err := h.authorize(secretID, uid, need)
+	if err != nil {
+		return err
+	}
+
+	holder, err := h.store.ActiveCheckout(secretID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update secret"})
+	}
+	if holder != nil {
+		if req.Data != nil && holder.UserID != uid {
+			return c.Status(423).JSON(fiber.Map{"error": "Secret is checked out by " + holder.Username})
+		}
+		if req.CheckoutRequired != nil && !*req.CheckoutRequired {
+			return c.Status(409).JSON(fiber.Map{"error": "Check the secret in before disabling check-out"})
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update secret"})
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow(`
+		UPDATE secrets
+		SET description = COALESCE($2, description),
+		    max_versions = COALESCE($3, max_versions),
+		    checkout_required = COALESCE($4, checkout_required),
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING current_version`,
+		secretID, req.Description, req.MaxVersions, req.CheckoutRequired,
+	).Scan(&version)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Secret not found"})
+	}
+
+	if req.Data != nil {
+		version, err = h.store.WriteVersion(tx, secretID, *req.Data, &uid)
+	} else if req.MaxVersions != nil {
+		err = h.store.Prune(tx, secretID)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update secret"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update secret"})
+	}
+
+	h.logAudit(c, &uid, "secrets.update", "secrets", &secretID, map[string]interface{}{
+		"path":                secretPath,
+		"version":             version,
+		"new_version":         req.Data != nil,
+		"description_changed": req.Description != nil,
+		"max_versions":        req.MaxVersions,
+		"checkout_required":   req.CheckoutRequired,
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "Secret updated successfully",
+		"version": version,
+	})
+}
+
+// GetSecretVersions lists retained versions, newest first, without their data.
+func (h *SecretHandler) GetSecretVersions(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+
+	userID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(userID)
+
+	if _, err := h.authorize(secretID, uid, vault.AccessRead); err != nil {
+		return err
+	}
+
+	var currentVersion int
+	err = h.db.QueryRow(`SELECT current_version FROM secrets WHERE id = $1`, secretID).Scan(&currentVersion)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Secret not found"})
+	}
+
+	rows, err := h.db.Query(`
+		SELECT v.version, v.created_by, u.username, v.created_at
+		FROM secret_versions v
+		LEFT JOIN users u ON u.id = v.created_by
+		WHERE v.secret_id = $1
+		ORDER BY v.version DESC`,
+		secretID,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch secret versions"})
+	}
+	defer rows.Close()
+
+	var versions []models.SecretVersion
+	for rows.Next() {
+		var v models.SecretVersion
+		if err := rows.Scan(&v.Version, &v.CreatedBy, &v.CreatedByUsername, &v.CreatedAt); err != nil {
+			continue
+		}
+		v.Current = v.Version == currentVersion
+		versions = append(versions, v)
+	}
+
+	h.logAudit(c, &uid, "secrets.list_versions", "secrets", &secretID, nil)
+
+	return c.JSON(versions)
+}
+
+func (h *SecretHandler) GetSecretVersion(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+	version, err := strconv.Atoi(c.Params("version"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid version"})
+	}
+
+	userID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(userID)
+
+	secretPath, err := h.authorize(secretID, uid, vault.AccessRead)
+	if err != nil {
+		return err
+	}
+	if err := h.requireCheckout(secretID, uid); err != nil {
+		return err
+	}
+
+	data, err := h.store.ReadVersion(secretID, version)
+	if err == vault.ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "Version not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to decrypt secret"})
+	}
+
+	if err := h.logCritical(c, &uid, "secrets.read", "secrets", &secretID, map[string]interface{}{
+		"path":    secretPath,
+		"version": version,
+	}); err != nil {
+		return auditUnavailable(c)
+	}
+
+	return c.JSON(fiber.Map{
+		"id":      secretID,
+		"path":    secretPath,
+		"version": version,
+		"data":    data,
+	})
+}
+
+// RollbackSecret restores an earlier version by writing its data as a new
+// version, so history is never rewritten.
+func (h *SecretHandler) RollbackSecret(c *fiber.Ctx) error {
+	secretID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid secret ID"})
+	}
+	restored, err := strconv.Atoi(c.Params("version"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid version"})
+	}
+
+	userID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(userID)
+
+	secretPath, err := h.authorize(secretID, uid, vault.AccessWrite)
+	if err != nil {
+		return err
+	}
+	if err := h.requireCheckout(secretID, uid); err != nil {
+		return err
+	}
+
+	data, err := h.store.ReadVersion(secretID, restored)
+	if err == vault.ErrNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "Version not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to decrypt secret"})
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to roll back secret"})
+	}
+	defer tx.Rollback()
+
+	version, err := h.store.WriteVersion(tx, secretID, data, &uid)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to roll back secret"})
+	}
+	if err := tx.Commit(); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to roll back secret"})
+	}
+
+	h.logAudit(c, &uid, "secrets.rollback", "secrets", &secretID, map[string]interface{}{
+		"path":             secretPath,
+		"restored_version": restored,
+		"version":          version,
+	})
+
+	return c.JSON(fiber.Map{
+		"message": "Secret rolled back successfully",
+		"version": version,
 	})
 }
 
@@ -154,16 +483,12 @@ func (h *SecretHandler) DeleteSecret(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(string)
 	uid, _ := uuid.Parse(userID)
 
-	var secretName string
-	err = h.db.QueryRow(`
-		SELECT name FROM secrets WHERE id = $1 AND created_by = $2`,
-		secretID, uid,
-	).Scan(&secretName)
+	secretPath, err := h.authorize(secretID, uid, vault.AccessManage)
 	if err != nil {
-		return c.Status(404).JSON(fiber.Map{"error": "Secret not found"})
+		return err
 	}
 
-	result, err := h.db.Exec(`DELETE FROM secrets WHERE id = $1 AND created_by = $2`, secretID, uid)
+	result, err := h.db.Exec(`DELETE FROM secrets WHERE id = $1`, secretID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete secret"})
 	}
@@ -174,18 +499,37 @@ func (h *SecretHandler) DeleteSecret(c *fiber.Ctx) error {
 	}
 
 	h.logAudit(c, &uid, "secrets.delete", "secrets", &secretID, map[string]interface{}{
-		"name": secretName,
+		"path": secretPath,
 	})
 
 	return c.JSON(fiber.Map{"message": "Secret deleted successfully"})
 }
 
-func (h *SecretHandler) logAudit(c *fiber.Ctx, userID *uuid.UUID, action, resource string, resourceID *uuid.UUID, details interface{}) {
-	detailsJSON, _ := json.Marshal(details)
+// authorize checks the caller's access to a secret and returns its path.
+// Callers with no access at all get a 404, so secret IDs do not leak.
+func (h *SecretHandler) authorize(secretID, uid uuid.UUID, need vault.Access) (string, error) {
+	access, name, err := h.store.AccessFor(secretID, uid)
+	if err != nil && err != vault.ErrNotFound {
+		return "", fiber.NewError(500, "Failed to check secret access")
+	}
+	if access == vault.AccessNone {
+		return "", fiber.NewError(404, "Secret not found")
+	}
+	if access < need {
+		return "", fiber.NewError(403, "This requires "+need.String()+" access to the secret")
+	}
+	return name, nil
+}
 
-	h.db.Exec(`
-		INSERT INTO audit_logs (user_id, action, resource, resource_id, details, ip_address, user_agent)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-		userID, action, resource, resourceID, detailsJSON, c.IP(), c.Get("User-Agent"),
-	)
+// requireCheckout rejects reads of a check-out secret unless the caller
+// currently holds it.
+func (h *SecretHandler) requireCheckout(secretID, uid uuid.UUID) error {
+	allowed, err := h.store.CanRead(secretID, uid)
+	if err != nil {
+		return fiber.NewError(500, "Failed to check secret checkout")
+	}
+	if !allowed {
+		return fiber.NewError(423, "Check the secret out before using it")
+	}
+	return nil
 }
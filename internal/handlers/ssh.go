@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/models"
+	"idam-pam-platform/internal/rbac"
+	"idam-pam-platform/internal/sshca"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// SSHHandler signs SSH user certificates. Holders of ssh.manage attach SSH
+// policies to roles; anyone with ssh.sign gets certificates for the
+// principals their roles allow.
+type SSHHandler struct {
+	db       *sql.DB
+	ca       *sshca.CA
+	resolver *rbac.Resolver
+	auditor
+}
+
+func NewSSHHandler(db *sql.DB, ca *sshca.CA, resolver *rbac.Resolver, auditLog *audit.Logger) *SSHHandler {
+	return &SSHHandler{
+		db:       db,
+		ca:       ca,
+		resolver: resolver,
+		auditor:  auditor{auditLog},
+	}
+}
+
+// CAPublicKeys publishes the trusted CA keys in authorized_keys format, one
+// per line, for hosts' TrustedUserCAKeys file.
+func (h *SSHHandler) CAPublicKeys(c *fiber.Ctx) error {
+	keys, err := h.ca.TrustedKeys()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch CA keys"})
+	}
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key.PublicKey)
+		b.WriteString("\n")
+	}
+	c.Set("Cache-Control", "public, max-age=300")
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	return c.SendString(b.String())
+}
+
+func (h *SSHHandler) GetCAKeys(c *fiber.Ctx) error {
+	keys, err := h.ca.TrustedKeys()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch CA keys"})
+	}
+	return c.JSON(keys)
+}
+
+// RotateCA makes a fresh CA key active. The previous key stays trusted
+// until certificates it signed have expired.
+func (h *SSHHandler) RotateCA(c *fiber.Ctx) error {
+	key, err := h.ca.Rotate()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to rotate SSH CA key"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "ssh.ca.rotate", "ssh_ca_keys", &key.ID, map[string]interface{}{
+		"fingerprint": key.Fingerprint,
+	})
+
+	return c.JSON(key)
+}
+
+// GetProfile shows the principals, extensions and max TTL the caller's
+// roles allow.
+func (h *SSHHandler) GetProfile(c *fiber.Ctx) error {
+	uid := currentUserID(c)
+	username, err := h.username(uid)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch SSH profile"})
+	}
+
+	profile, err := h.ca.Profile(uid, username)
+	if err == sshca.ErrNoPolicy {
+		return c.Status(403).JSON(fiber.Map{"error": "No SSH policy applies to your roles"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch SSH profile"})
+	}
+
+	return c.JSON(profile)
+}
+
+// SignKey returns a certificate for {"public_key": "ssh-ed25519 AAAA..."}.
+// principals narrows the certificate to some of the caller's principals and
+// ttl shortens it; by default it carries them all for the max TTL.
+func (h *SSHHandler) SignKey(c *fiber.Ctx) error {
+	var req struct {
+		PublicKey  string   `json:"public_key"`
+		Principals []string `json:"principals"`
+		TTL        string   `json:"ttl"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if strings.TrimSpace(req.PublicKey) == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "public_key is required"})
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "TTL must be a positive duration such as 1h or 30m"})
+		}
+	}
+
+	uid := currentUserID(c)
+	username, err := h.username(uid)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to sign certificate"})
+	}
+
+	cert, err := h.ca.Sign(uid, username, req.PublicKey, req.Principals, ttl)
+	switch {
+	case err == sshca.ErrNoPolicy:
+		return c.Status(403).JSON(fiber.Map{"error": "No SSH policy applies to your roles"})
+	case errors.Is(err, sshca.ErrPrincipalNotAllowed):
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	case err == sshca.ErrTTLTooLong:
+		return c.Status(400).JSON(fiber.Map{"error": "TTL exceeds the maximum allowed by your roles"})
+	case errors.Is(err, sshca.ErrInvalidKey):
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to sign certificate"})
+	}
+
+	if err := h.logCritical(c, &uid, "ssh.certificate.issue", "ssh_certificates", nil, map[string]interface{}{
+		"serial":       cert.Serial,
+		"principals":   cert.Principals,
+		"fingerprint":  cert.Fingerprint,
+		"ca_key_id":    cert.CAKeyID,
+		"valid_before": cert.ValidBefore,
+	}); err != nil {
+		return auditUnavailable(c)
+	}
+
+	return c.Status(201).JSON(cert)
+}
+
+// GetCertificates lists the caller's issued certificates; holders of
+// ssh.manage see everyone's.
+func (h *SSHHandler) GetCertificates(c *fiber.Ctx) error {
+	uid := currentUserID(c)
+	canManage, err := h.resolver.HasPermission(uid.String(), "ssh.manage")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve permissions"})
+	}
+
+	var owner *uuid.UUID
+	if !canManage {
+		owner = &uid
+	}
+	certs, err := h.ca.Certificates(owner)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch certificates"})
+	}
+
+	return c.JSON(certs)
+}
+
+const sshPolicySelect = `
+	SELECT p.role_id, r.name, p.principals, p.extensions, p.max_ttl_seconds, p.updated_by, p.updated_at
+	FROM ssh_role_policies p
+	JOIN roles r ON r.id = p.role_id`
+
+func scanSSHPolicy(row rowScanner) (*models.SSHRolePolicy, error) {
+	var p models.SSHRolePolicy
+	err := row.Scan(&p.RoleID, &p.RoleName, pq.Array(&p.Principals), pq.Array(&p.Extensions),
+		&p.MaxTTLSeconds, &p.UpdatedBy, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (h *SSHHandler) GetPolicies(c *fiber.Ctx) error {
+	rows, err := h.db.Query(sshPolicySelect + ` ORDER BY r.name`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch SSH policies"})
+	}
+	defer rows.Close()
+
+	policies := []models.SSHRolePolicy{}
+	for rows.Next() {
+		policy, err := scanSSHPolicy(rows)
+		if err != nil {
+			continue
+		}
+		policies = append(policies, *policy)
+	}
+
+	return c.JSON(policies)
+}
+
+func (h *SSHHandler) GetPolicy(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("roleId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
+	}
+
+	policy, err := scanSSHPolicy(h.db.QueryRow(sshPolicySelect+` WHERE p.role_id = $1`, roleID))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "SSH policy not found"})
+	}
+
+	return c.JSON(policy)
+}
+
+// SetPolicy attaches an SSH policy to a role, replacing any it had:
+// {"principals": ["{{username}}", "deploy"], "extensions": ["permit-pty"],
+// "max_ttl": "8h"}.
+func (h *SSHHandler) SetPolicy(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("roleId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
+	}
+
+	var req struct {
+		Principals []string  `json:"principals"`
+		Extensions *[]string `json:"extensions"`
+		MaxTTL     string    `json:"max_ttl"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.Extensions == nil {
+		req.Extensions = &[]string{"permit-pty"}
+	}
+	if err := sshca.ValidatePolicy(req.Principals, *req.Extensions); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	maxTTL, err := time.ParseDuration(req.MaxTTL)
+	if err != nil || maxTTL < time.Minute {
+		return c.Status(400).JSON(fiber.Map{"error": "max_ttl must be a duration of at least 1m"})
+	}
+
+	var exists bool
+	if err := h.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM roles WHERE id = $1)`, roleID).Scan(&exists); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to set SSH policy"})
+	}
+	if !exists {
+		return c.Status(404).JSON(fiber.Map{"error": "Role not found"})
+	}
+
+	uid := currentUserID(c)
+	_, err = h.db.Exec(`
+		INSERT INTO ssh_role_policies (role_id, principals, extensions, max_ttl_seconds, updated_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (role_id) DO UPDATE
+		SET principals = EXCLUDED.principals, extensions = EXCLUDED.extensions,
+		    max_ttl_seconds = EXCLUDED.max_ttl_seconds, updated_by = EXCLUDED.updated_by,
+		    updated_at = CURRENT_TIMESTAMP`,
+		roleID, pq.Array(req.Principals), pq.Array(*req.Extensions), int(maxTTL.Seconds()), uid,
+	)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to set SSH policy"})
+	}
+
+	h.logAudit(c, &uid, "ssh.policy.set", "roles", &roleID, map[string]interface{}{
+		"principals": req.Principals,
+		"extensions": *req.Extensions,
+		"max_ttl":    req.MaxTTL,
+	})
+
+	policy, err := scanSSHPolicy(h.db.QueryRow(sshPolicySelect+` WHERE p.role_id = $1`, roleID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch SSH policy"})
+	}
+	return c.JSON(policy)
+}
+
+// DeletePolicy removes a role's SSH policy. Certificates already issued
+// stay valid until they expire.
+func (h *SSHHandler) DeletePolicy(c *fiber.Ctx) error {
+	roleID, err := uuid.Parse(c.Params("roleId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
+	}
+
+	result, err := h.db.Exec(`DELETE FROM ssh_role_policies WHERE role_id = $1`, roleID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete SSH policy"})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "SSH policy not found"})
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "ssh.policy.delete", "roles", &roleID, nil)
+
+	return c.JSON(fiber.Map{"message": "SSH policy deleted"})
+}
+
+func (h *SSHHandler) username(userID uuid.UUID) (string, error) {
+	var username string
+	err := h.db.QueryRow(`SELECT username FROM users WHERE id = $1`, userID).Scan(&username)
+	return username, err
+}
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/transit"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// TransitHandler exposes encryption as a service. Holders of transit.manage
+// create and rotate named keys; each operation has its own permission, and
+// the caller must also hold one of the key's allowed roles. Plaintext and
+// inputs travel base64-encoded so any bytes can be processed.
+type TransitHandler struct {
+	db     *sql.DB
+	engine *transit.Engine
+	auditor
+}
+
+func NewTransitHandler(db *sql.DB, engine *transit.Engine, auditLog *audit.Logger) *TransitHandler {
+	return &TransitHandler{
+		db:      db,
+		engine:  engine,
+		auditor: auditor{auditLog},
+	}
+}
+
+func (h *TransitHandler) GetKeys(c *fiber.Ctx) error {
+	keys, err := h.engine.Keys()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch transit keys"})
+	}
+	return c.JSON(keys)
+}
+
+func (h *TransitHandler) GetKey(c *fiber.Ctx) error {
+	key, err := h.engine.Key(c.Params("name"))
+	if err != nil {
+		return transitError(c, err, "Failed to fetch transit key")
+	}
+	return c.JSON(key)
+}
+
+// CreateKey generates a key: {"name": "orders", "type": "aes256-gcm",
+// "allowed_role_ids": ["..."]}. Types are aes256-gcm for encryption and
+// ed25519 or ecdsa-p256 for signing; every type can compute HMACs.
+func (h *TransitHandler) CreateKey(c *fiber.Ctx) error {
+	var req struct {
+		Name           string   `json:"name"`
+		Type           string   `json:"type"`
+		AllowedRoleIDs []string `json:"allowed_role_ids"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.Type == "" {
+		req.Type = transit.TypeAES256GCM
+	}
+	if err := transit.ValidateKey(req.Name, req.Type); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.validateRoles(req.AllowedRoleIDs); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	uid := currentUserID(c)
+	key, err := h.engine.Create(req.Name, req.Type, req.AllowedRoleIDs, uid)
+	if isUniqueViolation(err) {
+		return c.Status(409).JSON(fiber.Map{"error": "A transit key with this name already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create transit key"})
+	}
+
+	h.logAudit(c, &uid, "transit.key.create", "transit_keys", &key.ID, map[string]interface{}{
+		"name":             key.Name,
+		"type":             key.Type,
+		"allowed_role_ids": key.AllowedRoleIDs,
+	})
+
+	return c.Status(201).JSON(key)
+}
+
+// UpdateKey changes a key's allowed roles or min_decryption_version.
+func (h *TransitHandler) UpdateKey(c *fiber.Ctx) error {
+	name := c.Params("name")
+	var req struct {
+		MinDecryptionVersion *int      `json:"min_decryption_version"`
+		AllowedRoleIDs       *[]string `json:"allowed_role_ids"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	key, err := h.engine.Key(name)
+	if err != nil {
+		return transitError(c, err, "Failed to update transit key")
+	}
+	if req.AllowedRoleIDs != nil {
+		if err := h.validateRoles(*req.AllowedRoleIDs); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if key, err = h.engine.SetAllowedRoles(name, *req.AllowedRoleIDs); err != nil {
+			return transitError(c, err, "Failed to update transit key")
+		}
+	}
+	if req.MinDecryptionVersion != nil {
+		if key, err = h.engine.SetMinDecryptionVersion(name, *req.MinDecryptionVersion); err != nil {
+			return transitError(c, err, "Failed to update transit key")
+		}
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "transit.key.update", "transit_keys", &key.ID, map[string]interface{}{
+		"name":                   key.Name,
+		"min_decryption_version": key.MinDecryptionVersion,
+		"allowed_role_ids":       key.AllowedRoleIDs,
+	})
+
+	return c.JSON(key)
+}
+
+// RotateKey adds a new version that all new operations use.
+func (h *TransitHandler) RotateKey(c *fiber.Ctx) error {
+	key, err := h.engine.Rotate(c.Params("name"))
+	if err != nil {
+		return transitError(c, err, "Failed to rotate transit key")
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "transit.key.rotate", "transit_keys", &key.ID, map[string]interface{}{
+		"name":    key.Name,
+		"version": key.LatestVersion,
+	})
+
+	return c.JSON(key)
+}
+
+// DeleteKey destroys a key. Data still encrypted under it is lost.
+func (h *TransitHandler) DeleteKey(c *fiber.Ctx) error {
+	key, err := h.engine.Key(c.Params("name"))
+	if err != nil {
+		return transitError(c, err, "Failed to delete transit key")
+	}
+	if err := h.engine.Delete(key.Name); err != nil {
+		return transitError(c, err, "Failed to delete transit key")
+	}
+
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, "transit.key.delete", "transit_keys", &key.ID, map[string]interface{}{
+		"name": key.Name,
+	})
+
+	return c.JSON(fiber.Map{"message": "Transit key deleted"})
+}
+
+type transitRequest struct {
+	Plaintext  string `json:"plaintext"`
+	Ciphertext string `json:"ciphertext"`
+	Input      string `json:"input"`
+	Signature  string `json:"signature"`
+	HMAC       string `json:"hmac"`
+	Algorithm  string `json:"algorithm"`
+}
+
+// Encrypt encrypts {"plaintext": "<base64>"} under the key's latest version.
+func (h *TransitHandler) Encrypt(c *fiber.Ctx) error {
+	key, req, err := h.prepare(c)
+	if err != nil {
+		return err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(req.Plaintext)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "plaintext must be base64"})
+	}
+
+	ciphertext, err := h.engine.Encrypt(key, plaintext)
+	if err != nil {
+		return transitError(c, err, "Failed to encrypt")
+	}
+
+	h.logOperation(c, "transit.encrypt", key)
+	return c.JSON(fiber.Map{"ciphertext": ciphertext, "key_version": key.LatestVersion})
+}
+
+// Decrypt returns the base64 plaintext of {"ciphertext": "transit:v1:..."}.
+func (h *TransitHandler) Decrypt(c *fiber.Ctx) error {
+	key, req, err := h.prepare(c)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := h.engine.Decrypt(key, req.Ciphertext)
+	if err != nil {
+		return transitError(c, err, "Failed to decrypt")
+	}
+
+	// Plaintext only leaves once the decryption is on record
+	uid := currentUserID(c)
+	if err := h.logCritical(c, &uid, "transit.decrypt", "transit_keys", &key.ID, map[string]interface{}{
+		"name": key.Name,
+	}); err != nil {
+		return auditUnavailable(c)
+	}
+	return c.JSON(fiber.Map{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+}
+
+// Rewrap re-encrypts {"ciphertext": ...} under the latest version without
+// returning the plaintext.
+func (h *TransitHandler) Rewrap(c *fiber.Ctx) error {
+	key, req, err := h.prepare(c)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := h.engine.Rewrap(key, req.Ciphertext)
+	if err != nil {
+		return transitError(c, err, "Failed to rewrap")
+	}
+
+	h.logOperation(c, "transit.rewrap", key)
+	return c.JSON(fiber.Map{"ciphertext": ciphertext, "key_version": key.LatestVersion})
+}
+
+// Sign signs {"input": "<base64>"} with the key's latest version.
+func (h *TransitHandler) Sign(c *fiber.Ctx) error {
+	key, req, err := h.prepare(c)
+	if err != nil {
+		return err
+	}
+	input, err := base64.StdEncoding.DecodeString(req.Input)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "input must be base64"})
+	}
+
+	signature, err := h.engine.Sign(key, input)
+	if err != nil {
+		return transitError(c, err, "Failed to sign")
+	}
+
+	h.logOperation(c, "transit.sign", key)
+	return c.JSON(fiber.Map{"signature": signature, "key_version": key.LatestVersion})
+}
+
+// Verify checks {"input": "<base64>"} against either a "signature" from
+// Sign or an "hmac" from HMAC.
+func (h *TransitHandler) Verify(c *fiber.Ctx) error {
+	key, req, err := h.prepare(c)
+	if err != nil {
+		return err
+	}
+	input, err := base64.StdEncoding.DecodeString(req.Input)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "input must be base64"})
+	}
+	if (req.Signature == "") == (req.HMAC == "") {
+		return c.Status(400).JSON(fiber.Map{"error": "Provide exactly one of signature and hmac"})
+	}
+
+	var valid bool
+	if req.Signature != "" {
+		valid, err = h.engine.Verify(key, input, req.Signature)
+	} else {
+		valid, err = h.engine.VerifyHMAC(key, input, req.Algorithm, req.HMAC)
+	}
+	if err != nil {
+		return transitError(c, err, "Failed to verify")
+	}
+
+	return c.JSON(fiber.Map{"valid": valid})
+}
+
+// HMAC computes an HMAC of {"input": "<base64>", "algorithm": "sha256"}.
+func (h *TransitHandler) HMAC(c *fiber.Ctx) error {
+	key, req, err := h.prepare(c)
+	if err != nil {
+		return err
+	}
+	input, err := base64.StdEncoding.DecodeString(req.Input)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "input must be base64"})
+	}
+
+	sum, err := h.engine.HMAC(key, input, req.Algorithm)
+	if err != nil {
+		return transitError(c, err, "Failed to compute HMAC")
+	}
+
+	return c.JSON(fiber.Map{"hmac": sum, "key_version": key.LatestVersion})
+}
+
+// prepare parses the body and loads the key in the URL if the caller may
+// use it.
+func (h *TransitHandler) prepare(c *fiber.Ctx) (*transit.Key, *transitRequest, error) {
+	var req transitRequest
+	if err := c.BodyParser(&req); err != nil {
+		return nil, nil, fiber.NewError(400, "Invalid request")
+	}
+
+	key, err := h.engine.Authorize(c.Params("name"), currentUserID(c))
+	switch {
+	case err == transit.ErrNotFound, err == transit.ErrNotAllowed:
+		// Keys the caller cannot use are not revealed
+		return nil, nil, fiber.NewError(404, "Transit key not found")
+	case err != nil:
+		return nil, nil, fiber.NewError(500, "Failed to load transit key")
+	}
+	return key, &req, nil
+}
+
+func transitError(c *fiber.Ctx, err error, fallback string) error {
+	switch {
+	case err == transit.ErrNotFound:
+		return c.Status(404).JSON(fiber.Map{"error": "Transit key not found"})
+	case err == transit.ErrUnsupported:
+		return c.Status(400).JSON(fiber.Map{"error": "This key type does not support the operation"})
+	case err == transit.ErrVersionRetired, errors.Is(err, transit.ErrInvalidInput):
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	default:
+		return c.Status(500).JSON(fiber.Map{"error": fallback})
+	}
+}
+
+func (h *TransitHandler) validateRoles(ids []string) error {
+	if len(ids) == 0 {
+		return errors.New("allowed_role_ids must name at least one role")
+	}
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return errors.New("allowed_role_ids must be role IDs")
+		}
+	}
+	var found int
+	if err := h.db.QueryRow(`SELECT COUNT(*) FROM roles WHERE id = ANY($1::uuid[])`,
+		pq.Array(ids)).Scan(&found); err != nil || found != len(ids) {
+		return errors.New("allowed_role_ids contains an unknown role")
+	}
+	return nil
+}
+
+// logOperation records which key was used, never the data.
+func (h *TransitHandler) logOperation(c *fiber.Ctx, action string, key *transit.Key) {
+	uid := currentUserID(c)
+	h.logAudit(c, &uid, action, "transit_keys", &key.ID, map[string]interface{}{
+		"name": key.Name,
+	})
+}
@@ -2,20 +2,24 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/json"
+	"time"
 
+	"idam-pam-platform/internal/audit"
 	"idam-pam-platform/internal/models"
+	"idam-pam-platform/internal/rbac"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
 type UserHandler struct {
-	db *sql.DB
+	db       *sql.DB
+	resolver *rbac.Resolver
+	auditor
 }
 
-func NewUserHandler(db *sql.DB) *UserHandler {
-	return &UserHandler{db: db}
+func NewUserHandler(db *sql.DB, resolver *rbac.Resolver, auditLog *audit.Logger) *UserHandler {
+	return &UserHandler{db: db, resolver: resolver, auditor: auditor{auditLog}}
 }
 
 func (h *UserHandler) GetUsers(c *fiber.Ctx) error {
@@ -67,17 +71,18 @@ func (h *UserHandler) GetUser(c *fiber.Ctx) error {
 
 	// Get user roles
 	roleRows, err := h.db.Query(`
-		SELECT r.id, r.name, r.description
+		SELECT r.id, r.name, COALESCE(r.description, ''), ur.expires_at
 		FROM roles r
 		JOIN user_roles ur ON r.id = ur.role_id
-		WHERE ur.user_id = $1`,
+		WHERE ur.user_id = $1
+		  AND (ur.expires_at IS NULL OR ur.expires_at > CURRENT_TIMESTAMP)`,
 		userID,
 	)
 	if err == nil {
 		defer roleRows.Close()
 		for roleRows.Next() {
 			var role models.Role
-			roleRows.Scan(&role.ID, &role.Name, &role.Description)
+			roleRows.Scan(&role.ID, &role.Name, &role.Description, &role.ExpiresAt)
 			user.Roles = append(user.Roles, role)
 		}
 	}
@@ -113,6 +118,18 @@ func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to update user"})
 	}
 
+	// Deactivated users must not keep working sessions
+	if active, ok := updates["is_active"].(bool); ok && !active {
+		_, err = h.db.Exec(`
+			UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+			WHERE user_id = $1 AND revoked_at IS NULL`,
+			userID,
+		)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke user sessions"})
+		}
+	}
+
 	// Log the action
 	currentUserID := c.Locals("userID").(string)
 	uid, _ := uuid.Parse(currentUserID)
@@ -125,36 +142,113 @@ func (h *UserHandler) AssignRole(c *fiber.Ctx) error {
 	userID, _ := uuid.Parse(c.Params("id"))
 	var req struct {
 		RoleID uuid.UUID `json:"role_id"`
+		// ExpiresAt makes the assignment time-bound; omit for a permanent role
+		ExpiresAt *time.Time `json:"expires_at"`
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return c.Status(400).JSON(fiber.Map{"error": "expires_at must be in the future"})
+	}
+
+	var roleName string
+	if err := h.db.QueryRow(`SELECT name FROM roles WHERE id = $1`, req.RoleID).Scan(&roleName); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Role not found"})
+	}
+
+	currentUserID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(currentUserID)
 
 	_, err := h.db.Exec(`
-		INSERT INTO user_roles (user_id, role_id) VALUES ($1, $2)
-		ON CONFLICT (user_id, role_id) DO NOTHING`,
-		userID, req.RoleID,
+		INSERT INTO user_roles (user_id, role_id, expires_at, granted_by) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, role_id) DO UPDATE
+		SET expires_at = EXCLUDED.expires_at, granted_by = EXCLUDED.granted_by, request_id = NULL`,
+		userID, req.RoleID, req.ExpiresAt, uid,
 	)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to assign role"})
 	}
+	h.resolver.Invalidate(userID.String())
 
 	// Log the action
-	currentUserID := c.Locals("userID").(string)
-	uid, _ := uuid.Parse(currentUserID)
 	h.logAudit(c, &uid, "users.assign_role", "users", &userID, map[string]interface{}{
-		"role_id": req.RoleID,
+		"role_id":    req.RoleID,
+		"role_name":  roleName,
+		"expires_at": req.ExpiresAt,
 	})
 
 	return c.JSON(fiber.Map{"message": "Role assigned successfully"})
 }
 
-func (h *UserHandler) logAudit(c *fiber.Ctx, userID *uuid.UUID, action, resource string, resourceID *uuid.UUID, details interface{}) {
-	detailsJSON, _ := json.Marshal(details)
-	
-	h.db.Exec(`
-		INSERT INTO audit_logs (user_id, action, resource, resource_id, details, ip_address, user_agent)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-		userID, action, resource, resourceID, detailsJSON, c.IP(), c.Get("User-Agent"),
-	)
+// RemoveRole unassigns a role from a user. An admin cannot drop their own
+// admin role, and the last remaining admin cannot be demoted.
+func (h *UserHandler) RemoveRole(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+	roleID, err := uuid.Parse(c.Params("roleId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
+	}
+
+	currentUserID := c.Locals("userID").(string)
+	uid, _ := uuid.Parse(currentUserID)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to remove role"})
+	}
+	defer tx.Rollback()
+
+	var roleName string
+	err = tx.QueryRow(`SELECT name FROM roles WHERE id = $1`, roleID).Scan(&roleName)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Role not found"})
+	}
+
+	if roleName == "admin" {
+		if userID == uid {
+			return c.Status(409).JSON(fiber.Map{"error": "You cannot remove your own admin role"})
+		}
+
+		// Lock the admin assignments so two concurrent removals cannot both
+		// see a second admin
+		var admins int
+		err = tx.QueryRow(`
+			SELECT COUNT(*) FROM (
+				SELECT 1 FROM user_roles
+				WHERE role_id = $1 AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+				FOR UPDATE
+			) a`,
+			roleID,
+		).Scan(&admins)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to remove role"})
+		}
+		if admins <= 1 {
+			return c.Status(409).JSON(fiber.Map{"error": "Cannot remove the last admin"})
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM user_roles WHERE user_id = $1 AND role_id = $2`, userID, roleID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to remove role"})
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "User does not have this role"})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to remove role"})
+	}
+	h.resolver.Invalidate(userID.String())
+
+	h.logAudit(c, &uid, "users.remove_role", "users", &userID, map[string]interface{}{
+		"role_id":   roleID,
+		"role_name": roleName,
+	})
+
+	return c.JSON(fiber.Map{"message": "Role removed successfully"})
 }
\ No newline at end of file
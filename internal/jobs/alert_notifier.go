@@ -0,0 +1,40 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"idam-pam-platform/internal/alerts"
+)
+
+// AlertNotifier sends queued alert notifications every interval.
+type AlertNotifier struct {
+	deliverer *alerts.Deliverer
+	interval  time.Duration
+}
+
+func NewAlertNotifier(deliverer *alerts.Deliverer, interval time.Duration) *AlertNotifier {
+	return &AlertNotifier{
+		deliverer: deliverer,
+		interval:  interval,
+	}
+}
+
+// Run delivers notifications until ctx is cancelled.
+func (n *AlertNotifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := n.deliverer.Deliver(); err != nil {
+			log.Println("Failed to deliver alert notifications:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+)
+
+// AuditArchiver archives and purges audit entries past their retention
+// period every interval.
+type AuditArchiver struct {
+	archiver *audit.Archiver
+	interval time.Duration
+}
+
+func NewAuditArchiver(archiver *audit.Archiver, interval time.Duration) *AuditArchiver {
+	return &AuditArchiver{
+		archiver: archiver,
+		interval: interval,
+	}
+}
+
+// Run archives until ctx is cancelled. Each pass writes archives until
+// nothing more has expired.
+func (a *AuditArchiver) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			m, err := a.archiver.Archive()
+			if err != nil {
+				log.Println("Failed to archive audit logs:", err)
+				break
+			}
+			if m == nil {
+				break
+			}
+			log.Printf("Archived audit entries %d-%d (%d) to %s", m.FirstSeq, m.LastSeq, m.Entries, m.Location)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
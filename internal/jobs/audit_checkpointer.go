@@ -0,0 +1,47 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+)
+
+// AuditCheckpointer signs the head of the audit chain every interval, so
+// rewriting the chain after an edit is limited to entries newer than the
+// last checkpoint.
+type AuditCheckpointer struct {
+	checkpointer *audit.Checkpointer
+	interval     time.Duration
+}
+
+func NewAuditCheckpointer(checkpointer *audit.Checkpointer, interval time.Duration) *AuditCheckpointer {
+	return &AuditCheckpointer{
+		checkpointer: checkpointer,
+		interval:     interval,
+	}
+}
+
+// Run writes checkpoints every interval until ctx is cancelled, and once
+// more on the way out.
+func (a *AuditCheckpointer) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			a.checkpoint()
+			return
+		case <-ticker.C:
+			a.checkpoint()
+		}
+	}
+}
+
+func (a *AuditCheckpointer) checkpoint() {
+	if _, err := a.checkpointer.Checkpoint(); err != nil {
+		log.Println("Failed to write audit checkpoint:", err)
+	}
+}
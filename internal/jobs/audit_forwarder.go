@@ -0,0 +1,60 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+)
+
+// maxForwardDelay caps the backoff of a sink that keeps failing.
+const maxForwardDelay = 5 * time.Minute
+
+// AuditForwarder feeds one audit sink. Each sink gets its own forwarder,
+// so an unreachable collector only backs off its own deliveries.
+type AuditForwarder struct {
+	forwarder *audit.Forwarder
+	batchSize int
+	interval  time.Duration
+}
+
+func NewAuditForwarder(forwarder *audit.Forwarder, batchSize int, interval time.Duration) *AuditForwarder {
+	return &AuditForwarder{
+		forwarder: forwarder,
+		batchSize: batchSize,
+		interval:  interval,
+	}
+}
+
+// Run forwards new entries every interval until ctx is cancelled. A full
+// batch is followed by the next one straight away; a failed one by a
+// delay that doubles up to maxForwardDelay.
+func (a *AuditForwarder) Run(ctx context.Context) {
+	defer a.forwarder.Sink().Close()
+
+	delay := a.interval
+	for {
+		wait := a.interval
+		n, err := a.forwarder.Forward()
+		switch {
+		case err != nil:
+			log.Printf("Failed to forward audit events to %s: %v", a.forwarder.Sink().Name(), err)
+			wait = delay
+			if delay *= 2; delay > maxForwardDelay {
+				delay = maxForwardDelay
+			}
+		case n >= a.batchSize:
+			delay = a.interval
+			wait = 0
+		default:
+			delay = a.interval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/vault"
+
+	"github.com/google/uuid"
+)
+
+// CheckoutExpirer checks in secrets whose checkout has run out. Like a
+// manual check-in, this rotates the value and hands the secret to the next
+// queued user.
+type CheckoutExpirer struct {
+	db       *sql.DB
+	store    *vault.Store
+	interval time.Duration
+	auditLog *audit.Logger
+}
+
+func NewCheckoutExpirer(db *sql.DB, store *vault.Store, interval time.Duration, auditLog *audit.Logger) *CheckoutExpirer {
+	return &CheckoutExpirer{
+		db:       db,
+		store:    store,
+		interval: interval,
+		auditLog: auditLog,
+	}
+}
+
+// Run expires checkouts every interval until ctx is cancelled.
+func (e *CheckoutExpirer) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.expire(); err != nil {
+			log.Println("Failed to expire checkouts:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *CheckoutExpirer) expire() error {
+	secretIDs, err := e.store.ExpiredCheckouts()
+	if err != nil {
+		return err
+	}
+
+	for _, secretID := range secretIDs {
+		result, err := e.store.CheckIn(secretID, nil, "expired")
+		if err == vault.ErrNotCheckedOut {
+			// Checked in since we looked
+			continue
+		}
+		if err != nil {
+			log.Println("Failed to check in expired secret:", secretID, err)
+			continue
+		}
+
+		e.audit(nil, "secrets.checkin", secretID, map[string]interface{}{
+			"checkout_id": result.Checkout.ID,
+			"holder_id":   result.Checkout.UserID,
+			"reason":      "expired",
+		})
+		if result.RotationError != nil {
+			e.audit(nil, "secrets.rotate.failed", secretID, map[string]interface{}{
+				"trigger": "checkout_expired",
+				"error":   result.RotationError.Error(),
+			})
+		} else {
+			e.audit(nil, "secrets.rotate", secretID, map[string]interface{}{
+				"version": result.Version,
+				"trigger": "checkout_expired",
+			})
+		}
+		for _, dropped := range result.Dropped {
+			dropped := dropped
+			e.audit(&dropped, "secrets.checkout.dequeue", secretID, map[string]interface{}{
+				"reason": "no_access",
+			})
+		}
+		if result.Handoff != nil {
+			e.audit(&result.Handoff.UserID, "secrets.checkout", secretID, map[string]interface{}{
+				"checkout_id": result.Handoff.ID,
+				"expires_at":  result.Handoff.ExpiresAt,
+				"from_queue":  true,
+			})
+		}
+	}
+	return nil
+}
+
+func (e *CheckoutExpirer) audit(userID *uuid.UUID, action string, secretID uuid.UUID, details map[string]interface{}) {
+	e.auditLog.Log(audit.Event{
+		UserID:     userID,
+		Action:     action,
+		Resource:   "secrets",
+		ResourceID: &secretID,
+		Details:    details,
+	})
+}
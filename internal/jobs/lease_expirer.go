@@ -0,0 +1,105 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/dynamic"
+
+	"github.com/google/uuid"
+)
+
+// LeaseExpirer drops the logins of database leases whose TTL has run out.
+// A lease whose target database cannot be reached stays active and is
+// tried again on the next pass; the failure is audited when it first
+// happens and again only if the error changes.
+type LeaseExpirer struct {
+	db       *sql.DB
+	manager  *dynamic.Manager
+	interval time.Duration
+	auditLog *audit.Logger
+}
+
+func NewLeaseExpirer(db *sql.DB, manager *dynamic.Manager, interval time.Duration, auditLog *audit.Logger) *LeaseExpirer {
+	return &LeaseExpirer{
+		db:       db,
+		manager:  manager,
+		interval: interval,
+		auditLog: auditLog,
+	}
+}
+
+// Run expires leases every interval until ctx is cancelled.
+func (e *LeaseExpirer) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.expire(ctx); err != nil {
+			log.Println("Failed to expire database leases:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *LeaseExpirer) expire(ctx context.Context) error {
+	leaseIDs, err := e.manager.ExpiredLeases()
+	if err != nil {
+		return err
+	}
+
+	for _, leaseID := range leaseIDs {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		before, err := e.manager.Lease(leaseID)
+		if err == dynamic.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			log.Println("Failed to expire database lease:", leaseID, err)
+			continue
+		}
+
+		lease, err := e.manager.Revoke(ctx, leaseID, nil, "expired")
+		var targetErr *dynamic.TargetError
+		switch {
+		case err == nil:
+			e.audit("database.lease.expire", leaseID, map[string]interface{}{
+				"login_name": lease.LoginName,
+				"holder_id":  lease.UserID,
+			})
+		case err == dynamic.ErrLeaseClosed, err == dynamic.ErrNotFound:
+			// Revoked since we looked
+		case errors.As(err, &targetErr):
+			if before.LastError != nil && *before.LastError == targetErr.Err.Error() {
+				continue
+			}
+			e.audit("database.lease.expire.failed", leaseID, map[string]interface{}{
+				"error": targetErr.Err.Error(),
+			})
+		default:
+			log.Println("Failed to expire database lease:", leaseID, err)
+		}
+	}
+	return nil
+}
+
+func (e *LeaseExpirer) audit(action string, leaseID uuid.UUID, details map[string]interface{}) {
+	e.auditLog.Log(audit.Event{
+		Action:     action,
+		Resource:   "database_leases",
+		ResourceID: &leaseID,
+		Details:    details,
+	})
+}
@@ -0,0 +1,41 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"idam-pam-platform/internal/lockout"
+)
+
+// LoginAttemptPruner drops failed-login records that have run out, so
+// guessed usernames do not pile up.
+type LoginAttemptPruner struct {
+	limiter  *lockout.Limiter
+	interval time.Duration
+}
+
+func NewLoginAttemptPruner(limiter *lockout.Limiter, interval time.Duration) *LoginAttemptPruner {
+	return &LoginAttemptPruner{
+		limiter:  limiter,
+		interval: interval,
+	}
+}
+
+// Run prunes every interval until ctx is cancelled.
+func (p *LoginAttemptPruner) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.limiter.Prune(); err != nil {
+			log.Println("Failed to prune login attempts:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
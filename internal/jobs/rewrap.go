@@ -0,0 +1,425 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/encryption"
+
+	"github.com/google/uuid"
+)
+
+// Rewrapper re-encrypts everything under the active master key after a
+// rotation: every secret with its retained versions, then the platform's
+// signing, CA and transit keys and dynamic database connection URLs. A job
+// only completes once nothing is left on an older version, so the older
+// ones can be retired. Progress is committed with each batch, so a job
+// interrupted by a crash or shutdown picks up where it left off on the
+// next start.
+type Rewrapper struct {
+	db        *sql.DB
+	svc       *encryption.Service
+	batchSize int
+	jobs      chan uuid.UUID
+}
+
+func NewRewrapper(db *sql.DB, svc *encryption.Service, batchSize int) *Rewrapper {
+	return &Rewrapper{
+		db:        db,
+		svc:       svc,
+		batchSize: batchSize,
+		jobs:      make(chan uuid.UUID, 16),
+	}
+}
+
+// Start queues a job for processing.
+func (r *Rewrapper) Start(jobID uuid.UUID) {
+	select {
+	case r.jobs <- jobID:
+	default:
+		log.Println("Re-encryption queue full; job will resume on next start:", jobID)
+	}
+}
+
+// Run resumes unfinished jobs, then processes queued ones until ctx is
+// cancelled.
+func (r *Rewrapper) Run(ctx context.Context) {
+	rows, err := r.db.Query(`SELECT id FROM encryption_rewrap_jobs WHERE status = 'running' ORDER BY created_at`)
+	if err != nil {
+		log.Println("Failed to load re-encryption jobs:", err)
+	} else {
+		var pending []uuid.UUID
+		for rows.Next() {
+			var id uuid.UUID
+			if err := rows.Scan(&id); err == nil {
+				pending = append(pending, id)
+			}
+		}
+		rows.Close()
+		for _, id := range pending {
+			r.process(ctx, id)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-r.jobs:
+			r.process(ctx, id)
+		}
+	}
+}
+
+func (r *Rewrapper) process(ctx context.Context, jobID uuid.UUID) {
+	for ctx.Err() == nil {
+		done, err := r.batch(jobID)
+		if err != nil {
+			log.Println("Re-encryption job failed:", jobID, err)
+			r.db.Exec(`
+				UPDATE encryption_rewrap_jobs
+				SET status = 'failed', error = $2, updated_at = CURRENT_TIMESTAMP
+				WHERE id = $1 AND status = 'running'`,
+				jobID, err.Error(),
+			)
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// batch re-encrypts the next batch of secrets. The job row is locked for the
+// duration, so instances sharing the database never work the same job at
+// once.
+func (r *Rewrapper) batch(jobID uuid.UUID) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var (
+		targetVersion int
+		status        string
+		lastID        *uuid.UUID
+	)
+	err = tx.QueryRow(`
+		SELECT target_version, status, last_id
+		FROM encryption_rewrap_jobs WHERE id = $1
+		FOR UPDATE`,
+		jobID,
+	).Scan(&targetVersion, &status, &lastID)
+	if err != nil {
+		return false, err
+	}
+	if status != "running" {
+		return true, nil
+	}
+
+	active := r.svc.ActiveVersion()
+	if active < targetVersion {
+		// Rotated on another instance since our last keyring load
+		if err := r.svc.Reload(); err != nil {
+			return false, err
+		}
+		active = r.svc.ActiveVersion()
+	}
+	if active != targetVersion {
+		// A newer rotation has its own job covering everything
+		_, err = tx.Exec(`
+			UPDATE encryption_rewrap_jobs
+			SET status = 'superseded', updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1`,
+			jobID,
+		)
+		if err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+
+	prefix := encryption.VersionPrefix(targetVersion)
+	rows, err := tx.Query(`
+		SELECT id, encrypted_data, COALESCE(encrypted_data_key, '')
+		FROM secrets
+		WHERE ($1::uuid IS NULL OR id > $1)
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE`,
+		lastID, r.batchSize,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	type row struct {
+		id            uuid.UUID
+		encryptedData string
+		encryptedKey  string
+	}
+	var batch []row
+	for rows.Next() {
+		var s row
+		if err := rows.Scan(&s.id, &s.encryptedData, &s.encryptedKey); err != nil {
+			rows.Close()
+			return false, err
+		}
+		batch = append(batch, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	reencrypted := 0
+	for _, s := range batch {
+		newData, newKey, changed, err := r.svc.Reencrypt(s.encryptedData, s.encryptedKey)
+		if err != nil {
+			return false, fmt.Errorf("secret %s: %v", s.id, err)
+		}
+		if changed {
+			if _, err := tx.Exec(`
+				UPDATE secrets SET encrypted_data = $2, encrypted_data_key = $3
+				WHERE id = $1`,
+				s.id, newData, newKey,
+			); err != nil {
+				return false, err
+			}
+			reencrypted++
+		}
+
+		if err := r.reencryptVersions(tx, s.id); err != nil {
+			return false, fmt.Errorf("secret %s: %v", s.id, err)
+		}
+	}
+
+	if len(batch) > 0 {
+		lastID = &batch[len(batch)-1].id
+	}
+
+	done := len(batch) < r.batchSize
+	if done {
+		// The platform's own keys are few, so they go in the last batch
+		n, err := r.reencryptKeys(tx)
+		if err != nil {
+			return false, err
+		}
+		reencrypted += n
+
+		// Values written by an instance that had not yet loaded the new
+		// key can land behind the cursor; sweep again until none remain
+		var remaining int
+		err = tx.QueryRow(`
+			SELECT
+				(SELECT COUNT(*) FROM secrets
+				 WHERE encrypted_data NOT LIKE $1 || '%' OR encrypted_data_key IS NULL) +
+				(SELECT COUNT(*) FROM secret_versions
+				 WHERE encrypted_data NOT LIKE $1 || '%' OR encrypted_data_key IS NULL) +
+				(SELECT COUNT(*) FROM database_roles
+				 WHERE connection_url NOT LIKE $1 || '%' OR connection_url_key IS NULL)`,
+			prefix,
+		).Scan(&remaining)
+		if err != nil {
+			return false, err
+		}
+		for _, c := range keyColumns {
+			var n int
+			if err := tx.QueryRow(`
+				SELECT COUNT(*) FROM `+c.table+`
+				WHERE split_part(`+c.column+`, '.', 2) NOT LIKE $1 || '%'`,
+				prefix,
+			).Scan(&n); err != nil {
+				return false, err
+			}
+			remaining += n
+		}
+		if remaining > 0 {
+			done = false
+			lastID = nil
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE encryption_rewrap_jobs
+		SET processed = processed + $2, reencrypted = reencrypted + $3, last_id = $4,
+		    status = CASE WHEN $5 THEN 'completed' ELSE status END,
+		    completed_at = CASE WHEN $5 THEN CURRENT_TIMESTAMP END,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		jobID, len(batch), reencrypted, lastID, done,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	if done {
+		if err := audit.AppendTx(tx, audit.Event{
+			Action:     "encryption.rewrap.complete",
+			Resource:   "encryption_keys",
+			ResourceID: &jobID,
+			Details: map[string]interface{}{
+				"target_version": targetVersion,
+			},
+		}); err != nil {
+			return false, err
+		}
+	}
+
+	return done, tx.Commit()
+}
+
+// keyColumns hold values stored with Encrypt: the private keys the
+// platform signs and encrypts with. id is an expression naming one row.
+var keyColumns = []struct {
+	table, id, column string
+}{
+	{"signing_keys", "kid", "private_key"},
+	{"audit_checkpoint_keys", "id::text", "private_key"},
+	{"pki_cas", "id::text", "private_key"},
+	{"ssh_ca_keys", "id::text", "private_key"},
+	{"transit_key_versions", "key_id::text || '/' || version", "key_material"},
+	{"transit_key_versions", "key_id::text || '/' || version", "hmac_key"},
+}
+
+// reencryptKeys moves the platform's keys and dynamic database connection
+// URLs onto the active key, returning how many values it changed.
+func (r *Rewrapper) reencryptKeys(tx *sql.Tx) (int, error) {
+	reencrypted := 0
+	for _, c := range keyColumns {
+		rows, err := tx.Query(`
+			SELECT ` + c.id + `, ` + c.column + ` FROM ` + c.table + `
+			FOR UPDATE`)
+		if err != nil {
+			return 0, err
+		}
+		values := map[string]string{}
+		for rows.Next() {
+			var id, value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			values[id] = value
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+
+		for id, value := range values {
+			newValue, changed, err := r.svc.ReencryptValue(value)
+			if err != nil {
+				return 0, fmt.Errorf("%s %s: %v", c.table, id, err)
+			}
+			if !changed {
+				continue
+			}
+			if _, err := tx.Exec(`
+				UPDATE `+c.table+` SET `+c.column+` = $2
+				WHERE `+c.id+` = $1`,
+				id, newValue,
+			); err != nil {
+				return 0, err
+			}
+			reencrypted++
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, connection_url, COALESCE(connection_url_key, '')
+		FROM database_roles
+		FOR UPDATE`)
+	if err != nil {
+		return 0, err
+	}
+	type role struct {
+		id                uuid.UUID
+		encryptedURL, key string
+	}
+	var roles []role
+	for rows.Next() {
+		var d role
+		if err := rows.Scan(&d.id, &d.encryptedURL, &d.key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		roles = append(roles, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, d := range roles {
+		newURL, newKey, changed, err := r.svc.Reencrypt(d.encryptedURL, d.key)
+		if err != nil {
+			return 0, fmt.Errorf("database role %s: %v", d.id, err)
+		}
+		if !changed {
+			continue
+		}
+		if _, err := tx.Exec(`
+			UPDATE database_roles SET connection_url = $2, connection_url_key = $3
+			WHERE id = $1`,
+			d.id, newURL, newKey,
+		); err != nil {
+			return 0, err
+		}
+		reencrypted++
+	}
+	return reencrypted, nil
+}
+
+// reencryptVersions moves a secret's retained versions onto the active key.
+func (r *Rewrapper) reencryptVersions(tx *sql.Tx, secretID uuid.UUID) error {
+	rows, err := tx.Query(`
+		SELECT id, encrypted_data, COALESCE(encrypted_data_key, '')
+		FROM secret_versions WHERE secret_id = $1
+		FOR UPDATE`,
+		secretID,
+	)
+	if err != nil {
+		return err
+	}
+
+	type version struct {
+		id            uuid.UUID
+		encryptedData string
+		encryptedKey  string
+	}
+	var versions []version
+	for rows.Next() {
+		var v version
+		if err := rows.Scan(&v.id, &v.encryptedData, &v.encryptedKey); err != nil {
+			rows.Close()
+			return err
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		newData, newKey, changed, err := r.svc.Reencrypt(v.encryptedData, v.encryptedKey)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		if _, err := tx.Exec(`
+			UPDATE secret_versions SET encrypted_data = $2, encrypted_data_key = $3
+			WHERE id = $1`,
+			v.id, newData, newKey,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/rbac"
+
+	"github.com/google/uuid"
+)
+
+// RoleExpirer removes time-bound role assignments once they lapse and records
+// each removal in audit_logs. Permission checks already ignore expired rows;
+// this job makes the removal explicit and auditable.
+type RoleExpirer struct {
+	db       *sql.DB
+	resolver *rbac.Resolver
+	interval time.Duration
+}
+
+func NewRoleExpirer(db *sql.DB, resolver *rbac.Resolver, interval time.Duration) *RoleExpirer {
+	return &RoleExpirer{
+		db:       db,
+		resolver: resolver,
+		interval: interval,
+	}
+}
+
+// Run expires grants every interval until ctx is cancelled.
+func (e *RoleExpirer) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.expire(); err != nil {
+			log.Println("Failed to expire role assignments:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *RoleExpirer) expire() error {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		DELETE FROM user_roles ur
+		USING roles r
+		WHERE r.id = ur.role_id
+		  AND ur.expires_at IS NOT NULL AND ur.expires_at <= CURRENT_TIMESTAMP
+		RETURNING ur.user_id, ur.role_id, r.name, ur.expires_at, ur.request_id`)
+	if err != nil {
+		return err
+	}
+
+	type expiredGrant struct {
+		userID    uuid.UUID
+		roleID    uuid.UUID
+		roleName  string
+		expiresAt time.Time
+		requestID *uuid.UUID
+	}
+	var expired []expiredGrant
+	for rows.Next() {
+		var g expiredGrant
+		if err := rows.Scan(&g.userID, &g.roleID, &g.roleName, &g.expiresAt, &g.requestID); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, g := range expired {
+		if g.requestID != nil {
+			if _, err := tx.Exec(`
+				UPDATE access_requests SET status = 'expired'
+				WHERE id = $1 AND status = 'approved'`,
+				*g.requestID,
+			); err != nil {
+				return err
+			}
+		}
+
+		// System action: no acting user, the affected user is the resource
+		if err := audit.AppendTx(tx, audit.Event{
+			Action:     "access.grant.expire",
+			Resource:   "users",
+			ResourceID: &g.userID,
+			Details: map[string]interface{}{
+				"role_id":    g.roleID,
+				"role_name":  g.roleName,
+				"expired_at": g.expiresAt,
+				"request_id": g.requestID,
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, g := range expired {
+		e.resolver.Invalidate(g.userID.String())
+	}
+	return nil
+}
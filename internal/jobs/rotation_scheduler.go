@@ -0,0 +1,128 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/vault"
+
+	"github.com/google/uuid"
+)
+
+// rotationBatch caps how many rotations one pass attempts.
+const rotationBatch = 50
+
+// RotationScheduler rotates secrets whose rotation policy is due. A failed
+// rotation is retried after retryDelay, doubling on each consecutive
+// failure up to maxDelay.
+type RotationScheduler struct {
+	db         *sql.DB
+	store      *vault.Store
+	interval   time.Duration
+	retryDelay time.Duration
+	maxDelay   time.Duration
+	auditLog   *audit.Logger
+}
+
+func NewRotationScheduler(db *sql.DB, store *vault.Store, interval, retryDelay, maxDelay time.Duration, auditLog *audit.Logger) *RotationScheduler {
+	return &RotationScheduler{
+		db:         db,
+		store:      store,
+		interval:   interval,
+		retryDelay: retryDelay,
+		maxDelay:   maxDelay,
+		auditLog:   auditLog,
+	}
+}
+
+// Run rotates due secrets every interval until ctx is cancelled.
+func (r *RotationScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.rotateDue(ctx); err != nil {
+			log.Println("Failed to run scheduled rotations:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *RotationScheduler) rotateDue(ctx context.Context) error {
+	secretIDs, err := r.store.DueRotations(rotationBatch)
+	if err != nil {
+		return err
+	}
+
+	for _, secretID := range secretIDs {
+		if ctx.Err() != nil {
+			return nil
+		}
+		r.rotate(ctx, secretID)
+	}
+	return nil
+}
+
+func (r *RotationScheduler) rotate(ctx context.Context, secretID uuid.UUID) {
+	rotateCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	version, err := r.store.RotateDue(rotateCtx, secretID)
+	switch {
+	case err == nil:
+		r.audit("secrets.rotate", secretID, map[string]interface{}{
+			"version": version,
+			"trigger": "scheduled",
+		})
+	case err == vault.ErrNotDue, err == vault.ErrNotFound:
+		// Rotated elsewhere or deleted since we looked
+	case err == vault.ErrCheckedOut:
+		// Check-in rotates it; nothing to retry until then
+	default:
+		var rotationErr *vault.RotationError
+		if errors.As(err, &rotationErr) {
+			err = rotationErr.Err
+		}
+
+		// The retry after n consecutive failures waits retryDelay * 2^(n-1)
+		policy, _ := r.store.RotationPolicy(secretID)
+		delay := r.retryDelay
+		if policy != nil {
+			for i := 0; i < policy.ConsecutiveFailures && delay < r.maxDelay; i++ {
+				delay *= 2
+			}
+		}
+		if delay > r.maxDelay {
+			delay = r.maxDelay
+		}
+
+		failures, recordErr := r.store.RecordRotationFailure(secretID, err, delay)
+		if recordErr != nil {
+			log.Println("Failed to record rotation failure:", secretID, recordErr)
+		}
+		r.audit("secrets.rotate.failed", secretID, map[string]interface{}{
+			"trigger":  "scheduled",
+			"error":    err.Error(),
+			"attempt":  failures,
+			"retry_in": delay.String(),
+		})
+	}
+}
+
+func (r *RotationScheduler) audit(action string, secretID uuid.UUID, details map[string]interface{}) {
+	r.auditLog.Log(audit.Event{
+		Action:     action,
+		Resource:   "secrets",
+		ResourceID: &secretID,
+		Details:    details,
+	})
+}
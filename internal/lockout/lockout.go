@@ -0,0 +1,280 @@
+// Package lockout throttles password and TOTP guessing. Failed logins are
+// counted per username and per client IP; each failure makes the next
+// attempt wait twice as long, and reaching a threshold locks the username
+// or IP out for a while. Unknown usernames are counted like real ones, so
+// a lockout does not reveal which accounts exist.
+package lockout
+
+import (
+	"database/sql"
+	"time"
+	"unicode/utf8"
+)
+
+// Scopes an attempt is counted under.
+const (
+	ScopeUser = "user"
+	ScopeIP   = "ip"
+)
+
+// maxKeyLength bounds what is stored for an attacker-chosen username.
+const maxKeyLength = 255
+
+// Policy says how hard to push back on failed logins.
+type Policy struct {
+	// UserThreshold and IPThreshold are the consecutive failures that lock
+	// a username or an IP out
+	UserThreshold int
+	IPThreshold   int
+	// LockDuration is the first lockout; each further one doubles, up to
+	// MaxLockDuration
+	LockDuration    time.Duration
+	MaxLockDuration time.Duration
+	// BackoffBase is the wait after the first failure; it doubles with
+	// each further one, up to BackoffMax
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// ResetAfter is how long without failures before counting starts over
+	ResetAfter time.Duration
+}
+
+// Limiter records failed logins and decides when to refuse new attempts.
+type Limiter struct {
+	db     *sql.DB
+	policy Policy
+}
+
+func NewLimiter(db *sql.DB, policy Policy) *Limiter {
+	return &Limiter{db: db, policy: policy}
+}
+
+// Lock is a lockout that a failure has just set off.
+type Lock struct {
+	Scope    string    `json:"scope"`
+	Key      string    `json:"key"`
+	Failures int       `json:"failures"`
+	Lockouts int       `json:"lockouts"`
+	Until    time.Time `json:"locked_until"`
+}
+
+// Attempt is one login attempt in progress. Nothing is held open while
+// the password is checked: Begin reads the counters and Fail or Succeed
+// update them in a single statement each. Attempts in flight together are
+// all checked before any of them is counted, but every failure is counted,
+// so the lockout still lands once the threshold is passed.
+type Attempt struct {
+	limiter  *Limiter
+	username string
+	ip       string
+	wait     time.Duration
+	locked   bool
+}
+
+// Begin starts an attempt to log in as username from ip and works out
+// whether it has to be refused.
+func (l *Limiter) Begin(username, ip string) (*Attempt, error) {
+	username = truncateKey(username)
+
+	a := &Attempt{limiter: l, username: username, ip: ip}
+	var wait sql.NullFloat64
+	err := l.db.QueryRow(`
+		SELECT COALESCE(bool_or(locked_until > CURRENT_TIMESTAMP), false),
+		       MAX(EXTRACT(EPOCH FROM GREATEST(locked_until, next_attempt_at) - CURRENT_TIMESTAMP))
+		FROM login_attempts
+		WHERE (scope = $1 AND key = $2) OR (scope = $3 AND key = $4)`,
+		ScopeUser, username, ScopeIP, ip,
+	).Scan(&a.locked, &wait)
+	if err != nil {
+		return nil, err
+	}
+	if wait.Float64 > 0 {
+		a.wait = time.Duration(wait.Float64 * float64(time.Second))
+	}
+	return a, nil
+}
+
+// Blocked returns how long the caller has to wait before trying again, and
+// whether that is because of a lockout rather than backoff. A zero wait
+// means the attempt may go ahead.
+func (a *Attempt) Blocked() (time.Duration, bool) {
+	return a.wait, a.locked
+}
+
+// Fail counts a failed attempt against the username and the IP and returns
+// the lockouts it set off.
+func (a *Attempt) Fail() ([]Lock, error) {
+	p := a.limiter.policy
+	var locks []Lock
+	for _, target := range []struct {
+		scope, key string
+		threshold  int
+	}{
+		{ScopeUser, a.username, p.UserThreshold},
+		{ScopeIP, a.ip, p.IPThreshold},
+	} {
+		if target.key == "" {
+			continue
+		}
+		lock, err := a.limiter.fail(target.scope, target.key, target.threshold)
+		if err != nil {
+			return nil, err
+		}
+		if lock != nil {
+			locks = append(locks, *lock)
+		}
+	}
+	return locks, nil
+}
+
+// failQuery counts one failure in a single statement, so concurrent
+// failures cannot lose counts or lock twice. A record that has gone
+// ResetAfter ($3) without a failure or lockout counts from zero. Reaching
+// the threshold ($4) locks for $5 seconds doubled per earlier lockout, up
+// to $6; short of it, the next attempt waits $7 seconds doubled per
+// earlier failure, up to $8.
+var failQuery = func() string {
+	stale := `COALESCE(GREATEST(last_failure_at, locked_until) < CURRENT_TIMESTAMP - $3 * INTERVAL '1 second', false)`
+	failures := `(CASE WHEN ` + stale + ` THEN 0 ELSE failures END + 1)`
+	lockouts := `(CASE WHEN ` + stale + ` THEN 0 ELSE lockouts END)`
+	locking := `($4 > 0 AND ` + failures + ` >= $4)`
+	return `
+		UPDATE login_attempts SET
+			failures = CASE WHEN ` + locking + ` THEN 0 ELSE ` + failures + ` END,
+			lockouts = ` + lockouts + ` + CASE WHEN ` + locking + ` THEN 1 ELSE 0 END,
+			locked_until = CASE WHEN ` + locking + `
+				THEN CURRENT_TIMESTAMP + LEAST($6::float8, $5::float8 * power(2, LEAST(` + lockouts + `, 62))) * INTERVAL '1 second'
+				ELSE locked_until END,
+			next_attempt_at = CASE WHEN ` + locking + ` THEN NULL
+				ELSE CURRENT_TIMESTAMP + LEAST($8::float8, $7::float8 * power(2, LEAST(` + failures + ` - 1, 62))) * INTERVAL '1 second' END,
+			last_failure_at = CURRENT_TIMESTAMP
+		WHERE scope = $1 AND key = $2
+		RETURNING lockouts, locked_until, next_attempt_at IS NULL`
+}()
+
+func (l *Limiter) fail(scope, key string, threshold int) (*Lock, error) {
+	if _, err := l.db.Exec(`
+		INSERT INTO login_attempts (scope, key, last_failure_at) VALUES ($1, $2, CURRENT_TIMESTAMP)
+		ON CONFLICT (scope, key) DO NOTHING`,
+		scope, key,
+	); err != nil {
+		return nil, err
+	}
+
+	p := l.policy
+	lock := Lock{Scope: scope, Key: key, Failures: threshold}
+	var (
+		until     sql.NullTime
+		lockedNow bool
+	)
+	if err := l.db.QueryRow(failQuery,
+		scope, key, p.ResetAfter.Seconds(), threshold,
+		p.LockDuration.Seconds(), ceiling(p.MaxLockDuration),
+		p.BackoffBase.Seconds(), ceiling(p.BackoffMax),
+	).Scan(&lock.Lockouts, &until, &lockedNow); err != nil {
+		return nil, err
+	}
+	if !lockedNow {
+		return nil, nil
+	}
+	lock.Until = until.Time
+	return &lock, nil
+}
+
+// Succeed clears the username's failures. The IP's are left to expire, so
+// that logging in to one account does not buy more guesses at others.
+func (a *Attempt) Succeed() error {
+	_, err := a.limiter.db.Exec(`
+		DELETE FROM login_attempts WHERE scope = $1 AND key = $2`,
+		ScopeUser, a.username,
+	)
+	return err
+}
+
+// Entry is the failure record of a username or IP.
+type Entry struct {
+	Scope         string     `json:"scope"`
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	Lockouts      int        `json:"lockouts"`
+	LastFailureAt *time.Time `json:"last_failure_at"`
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// Locked returns the usernames and IPs that are locked out now.
+func (l *Limiter) Locked() ([]Entry, error) {
+	rows, err := l.db.Query(`
+		SELECT scope, key, failures, lockouts, last_failure_at, next_attempt_at, locked_until
+		FROM login_attempts
+		WHERE locked_until > CURRENT_TIMESTAMP
+		ORDER BY locked_until DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.Scope, &e.Key, &e.Failures, &e.Lockouts, &e.LastFailureAt, &e.NextAttemptAt, &e.LockedUntil); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Unlock forgets the failures of a username or IP, lifting any lockout or
+// backoff. It returns the record it removed, or nil if there was none.
+func (l *Limiter) Unlock(scope, key string) (*Entry, error) {
+	e := Entry{Scope: scope, Key: key}
+	err := l.db.QueryRow(`
+		DELETE FROM login_attempts
+		WHERE scope = $1 AND key = $2
+		RETURNING failures, lockouts, last_failure_at, next_attempt_at, locked_until`,
+		scope, key,
+	).Scan(&e.Failures, &e.Lockouts, &e.LastFailureAt, &e.NextAttemptAt, &e.LockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Prune removes records that have gone ResetAfter without a failure or a
+// lockout, which would be counted from zero anyway.
+func (l *Limiter) Prune() (int64, error) {
+	result, err := l.db.Exec(`
+		DELETE FROM login_attempts
+		WHERE GREATEST(last_failure_at, locked_until) < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'`,
+		l.policy.ResetAfter.Seconds(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ceiling is a cap in seconds. No cap is taken as ten years, which keeps
+// the interval arithmetic in range.
+func ceiling(max time.Duration) float64 {
+	if max <= 0 {
+		return (10 * 365 * 24 * time.Hour).Seconds()
+	}
+	return max.Seconds()
+}
+
+// truncateKey cuts key to maxKeyLength bytes without splitting a UTF-8
+// sequence, which Postgres would refuse.
+func truncateKey(key string) string {
+	if len(key) <= maxKeyLength {
+		return key
+	}
+	cut := maxKeyLength
+	for cut > 0 && !utf8.RuneStart(key[cut]) {
+		cut--
+	}
+	return key[:cut]
+}
@@ -0,0 +1,35 @@
+package lockout
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateKey(t *testing.T) {
+	for name, key := range map[string]string{
+		"short":      "alice",
+		"ascii":      strings.Repeat("a", 300),
+		"two byte":   strings.Repeat("é", 200),
+		"three byte": strings.Repeat("名", 100),
+		"four byte":  strings.Repeat("😀", 80),
+		"offset":     "a" + strings.Repeat("名", 100),
+	} {
+		got := truncateKey(key)
+		if !utf8.ValidString(got) {
+			t.Errorf("%s: truncated to invalid UTF-8 %q", name, got)
+		}
+		if len(got) > maxKeyLength {
+			t.Errorf("%s: truncated to %d bytes, want at most %d", name, len(got), maxKeyLength)
+		}
+		if !strings.HasPrefix(key, got) {
+			t.Errorf("%s: %q is not a prefix of the key", name, got)
+		}
+		if len(key) > maxKeyLength && len(got) <= maxKeyLength-utf8.UTFMax {
+			t.Errorf("%s: truncated to %d bytes, more than a character short", name, len(got))
+		}
+		if len(key) <= maxKeyLength && got != key {
+			t.Errorf("%s: short key changed to %q", name, got)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"database/sql"
 	"strings"
 
 	"idam-pam-platform/internal/auth"
@@ -8,7 +9,20 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
-func JWTAuth(secret string) fiber.Handler {
+// JWTAuth validates the bearer token and rejects it if the session it was
+// issued for has been revoked, has expired, or belongs to a deactivated user.
+// Tokens issued to OIDC clients are not accepted by the platform API.
+func JWTAuth(keys *auth.KeySet, db *sql.DB) fiber.Handler {
+	return bearerAuth(keys, db, false)
+}
+
+// ClientTokenAuth is JWTAuth for endpoints that OIDC clients call, such as
+// userinfo. It accepts both platform and client access tokens.
+func ClientTokenAuth(keys *auth.KeySet, db *sql.DB) fiber.Handler {
+	return bearerAuth(keys, db, true)
+}
+
+func bearerAuth(keys *auth.KeySet, db *sql.DB, allowClientTokens bool) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		authHeader := c.Get("Authorization")
 		if authHeader == "" {
@@ -16,13 +30,31 @@ func JWTAuth(secret string) fiber.Handler {
 		}
 
 		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
-		claims, err := auth.ValidateJWT(tokenString, secret)
-		if err != nil {
+		claims, err := auth.ValidateJWT(tokenString, keys)
+		if err != nil || claims.SessionID == "" || (claims.ClientID != "" && !allowClientTokens) {
 			return c.Status(401).JSON(fiber.Map{"error": "Invalid token"})
 		}
 
+		var active bool
+		err = db.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1
+				FROM sessions s
+				JOIN users u ON u.id = s.user_id
+				WHERE s.id = $1 AND s.revoked_at IS NULL
+				  AND s.expires_at > CURRENT_TIMESTAMP AND u.is_active
+			)`,
+			claims.SessionID,
+		).Scan(&active)
+		if err != nil || !active {
+			return c.Status(401).JSON(fiber.Map{"error": "Session has been revoked"})
+		}
+
 		c.Locals("userID", claims.UserID)
 		c.Locals("username", claims.Username)
+		c.Locals("sessionID", claims.SessionID)
+		c.Locals("clientID", claims.ClientID)
+		c.Locals("scope", claims.Scope)
 		return c.Next()
 	}
-}
\ No newline at end of file
+}
@@ -7,21 +7,23 @@ import (
 )
 
 type User struct {
-	ID           uuid.UUID  `json:"id" db:"id"`
-	Username     string     `json:"username" db:"username"`
-	Email        string     `json:"email" db:"email"`
-	PasswordHash string     `json:"-" db:"password_hash"`
-	TOTPSecret   *string    `json:"-" db:"totp_secret"`
-	IsActive     bool       `json:"is_active" db:"is_active"`
-	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
-	Roles        []Role     `json:"roles,omitempty"`
+	ID           uuid.UUID `json:"id" db:"id"`
+	Username     string    `json:"username" db:"username"`
+	Email        string    `json:"email" db:"email"`
+	PasswordHash string    `json:"-" db:"password_hash"`
+	TOTPSecret   *string   `json:"-" db:"totp_secret"`
+	IsActive     bool      `json:"is_active" db:"is_active"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	Roles        []Role    `json:"roles,omitempty"`
 }
 
 type Role struct {
 	ID          uuid.UUID    `json:"id" db:"id"`
 	Name        string       `json:"name" db:"name"`
 	Description string       `json:"description" db:"description"`
+	IsSystem    bool         `json:"is_system" db:"is_system"`
+	ExpiresAt   *time.Time   `json:"expires_at,omitempty" db:"expires_at"`
 	CreatedAt   time.Time    `json:"created_at" db:"created_at"`
 	Permissions []Permission `json:"permissions,omitempty"`
 }
@@ -31,16 +33,53 @@ type Permission struct {
 	Name     string    `json:"name" db:"name"`
 	Resource string    `json:"resource" db:"resource"`
 	Action   string    `json:"action" db:"action"`
+	IsSystem bool      `json:"is_system" db:"is_system"`
 }
 
 type Secret struct {
-	ID            uuid.UUID `json:"id" db:"id"`
-	Name          string    `json:"name" db:"name"`
-	Description   string    `json:"description" db:"description"`
-	EncryptedData string    `json:"-" db:"encrypted_data"`
-	CreatedBy     uuid.UUID `json:"created_by" db:"created_by"`
-	CreatedAt     time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+	ID               uuid.UUID `json:"id" db:"id"`
+	Folder           string    `json:"folder" db:"folder"`
+	Name             string    `json:"name" db:"name"`
+	Description      string    `json:"description" db:"description"`
+	EncryptedData    string    `json:"-" db:"encrypted_data"`
+	EncryptedKey     string    `json:"-" db:"encrypted_data_key"`
+	CurrentVersion   int       `json:"version" db:"current_version"`
+	MaxVersions      *int      `json:"max_versions" db:"max_versions"`
+	CheckoutRequired bool      `json:"checkout_required" db:"checkout_required"`
+	CreatedBy        uuid.UUID `json:"created_by" db:"created_by"`
+	CreatedAt        time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type SecretVersion struct {
+	Version           int        `json:"version" db:"version"`
+	Current           bool       `json:"current"`
+	CreatedBy         *uuid.UUID `json:"created_by" db:"created_by"`
+	CreatedByUsername *string    `json:"created_by_username"`
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+}
+
+type SecretACL struct {
+	ID            uuid.UUID  `json:"id" db:"id"`
+	SecretID      uuid.UUID  `json:"secret_id" db:"secret_id"`
+	PrincipalType string     `json:"principal_type" db:"principal_type"`
+	PrincipalID   uuid.UUID  `json:"principal_id" db:"principal_id"`
+	PrincipalName string     `json:"principal_name"`
+	Access        string     `json:"access" db:"access"`
+	GrantedBy     *uuid.UUID `json:"granted_by" db:"granted_by"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+}
+
+type FolderACL struct {
+	ID            uuid.UUID  `json:"id" db:"id"`
+	Path          string     `json:"path" db:"path"`
+	Inherited     bool       `json:"inherited"`
+	PrincipalType string     `json:"principal_type" db:"principal_type"`
+	PrincipalID   uuid.UUID  `json:"principal_id" db:"principal_id"`
+	PrincipalName string     `json:"principal_name"`
+	Access        string     `json:"access" db:"access"`
+	GrantedBy     *uuid.UUID `json:"granted_by" db:"granted_by"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
 }
 
 type AuditLog struct {
@@ -67,8 +106,89 @@ type RegisterRequest struct {
 	Password string `json:"password"`
 }
 
+type AccessRequest struct {
+	ID              uuid.UUID  `json:"id" db:"id"`
+	UserID          uuid.UUID  `json:"user_id" db:"user_id"`
+	Username        string     `json:"username"`
+	RoleID          uuid.UUID  `json:"role_id" db:"role_id"`
+	RoleName        string     `json:"role_name"`
+	Justification   string     `json:"justification" db:"justification"`
+	DurationSeconds int        `json:"duration_seconds" db:"duration_seconds"`
+	Status          string     `json:"status" db:"status"`
+	DecidedBy       *uuid.UUID `json:"decided_by" db:"decided_by"`
+	DecisionReason  *string    `json:"decision_reason" db:"decision_reason"`
+	DecidedAt       *time.Time `json:"decided_at" db:"decided_at"`
+	ExpiresAt       *time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+}
+
+type RewrapJob struct {
+	ID            uuid.UUID  `json:"id" db:"id"`
+	TargetVersion int        `json:"target_version" db:"target_version"`
+	Status        string     `json:"status" db:"status"`
+	Total         int        `json:"total" db:"total"`
+	Processed     int        `json:"processed" db:"processed"`
+	Reencrypted   int        `json:"reencrypted" db:"reencrypted"`
+	Error         *string    `json:"error,omitempty" db:"error"`
+	StartedBy     *uuid.UUID `json:"started_by" db:"started_by"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+	CompletedAt   *time.Time `json:"completed_at" db:"completed_at"`
+}
+
+type DatabaseRole struct {
+	ID                uuid.UUID  `json:"id" db:"id"`
+	Name              string     `json:"name" db:"name"`
+	Description       string     `json:"description" db:"description"`
+	GrantStatements   string     `json:"grant_statements" db:"grant_statements"`
+	DefaultTTLSeconds int        `json:"default_ttl_seconds" db:"default_ttl_seconds"`
+	MaxTTLSeconds     int        `json:"max_ttl_seconds" db:"max_ttl_seconds"`
+	AllowedRoleIDs    []string   `json:"allowed_role_ids" db:"allowed_role_ids"`
+	ActiveLeases      int        `json:"active_leases"`
+	CreatedBy         *uuid.UUID `json:"created_by" db:"created_by"`
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+type PKIRole struct {
+	ID                uuid.UUID  `json:"id" db:"id"`
+	Name              string     `json:"name" db:"name"`
+	Description       string     `json:"description" db:"description"`
+	AllowedDomains    []string   `json:"allowed_domains" db:"allowed_domains"`
+	AllowSubdomains   bool       `json:"allow_subdomains" db:"allow_subdomains"`
+	AllowIPSANs       bool       `json:"allow_ip_sans" db:"allow_ip_sans"`
+	ServerAuth        bool       `json:"server_auth" db:"server_auth"`
+	ClientAuth        bool       `json:"client_auth" db:"client_auth"`
+	DefaultTTLSeconds int        `json:"default_ttl_seconds" db:"default_ttl_seconds"`
+	MaxTTLSeconds     int        `json:"max_ttl_seconds" db:"max_ttl_seconds"`
+	AllowedRoleIDs    []string   `json:"allowed_role_ids" db:"allowed_role_ids"`
+	CreatedBy         *uuid.UUID `json:"created_by" db:"created_by"`
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+type SSHRolePolicy struct {
+	RoleID        uuid.UUID  `json:"role_id" db:"role_id"`
+	RoleName      string     `json:"role_name"`
+	Principals    []string   `json:"principals" db:"principals"`
+	Extensions    []string   `json:"extensions" db:"extensions"`
+	MaxTTLSeconds int        `json:"max_ttl_seconds" db:"max_ttl_seconds"`
+	UpdatedBy     *uuid.UUID `json:"updated_by" db:"updated_by"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+}
+
 type CreateSecretRequest struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Data        string `json:"data"`
-}
\ No newline at end of file
+	Path             string `json:"path"`
+	Name             string `json:"name"`
+	Description      string `json:"description"`
+	Data             string `json:"data"`
+	MaxVersions      *int   `json:"max_versions,omitempty"`
+	CheckoutRequired bool   `json:"checkout_required"`
+}
+
+type UpdateSecretRequest struct {
+	Description      *string `json:"description,omitempty"`
+	Data             *string `json:"data,omitempty"`
+	MaxVersions      *int    `json:"max_versions,omitempty"`
+	CheckoutRequired *bool   `json:"checkout_required,omitempty"`
+}
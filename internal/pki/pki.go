@@ -0,0 +1,309 @@
+// Package pki runs an internal X.509 certificate authority: a root CA that
+// only signs the intermediate, and an intermediate that signs TLS
+// certificates from role-bound templates. Both private keys are stored
+// encrypted by the encryption service.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/encryption"
+	"idam-pam-platform/internal/rbac"
+
+	"github.com/google/uuid"
+)
+
+const (
+	KindRoot         = "root"
+	KindIntermediate = "intermediate"
+)
+
+// Config names the CAs and sets their lifetimes. BaseURL is where the
+// platform is reachable; issued certificates point there for the CRL and
+// the issuing CA.
+type Config struct {
+	Name            string
+	RootTTL         time.Duration
+	IntermediateTTL time.Duration
+	CRLTTL          time.Duration
+	BaseURL         string
+}
+
+// CA issues and revokes certificates with the active intermediate.
+type CA struct {
+	db            *sql.DB
+	encryptionSvc *encryption.Service
+	resolver      *rbac.Resolver
+	cfg           Config
+}
+
+// authority is a loaded CA certificate with its decrypted key.
+type authority struct {
+	id     uuid.UUID
+	cert   *x509.Certificate
+	pem    string
+	signer crypto.Signer
+}
+
+// NewCA loads the CA hierarchy, creating the root and intermediate on first
+// start.
+func NewCA(db *sql.DB, encryptionSvc *encryption.Service, resolver *rbac.Resolver, cfg Config) (*CA, error) {
+	ca := &CA{
+		db:            db,
+		encryptionSvc: encryptionSvc,
+		resolver:      resolver,
+		cfg:           cfg,
+	}
+	if err := ca.bootstrap(); err != nil {
+		return nil, fmt.Errorf("failed to initialise PKI: %v", err)
+	}
+	return ca, nil
+}
+
+func (ca *CA) bootstrap() error {
+	tx, err := ca.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only one instance creates the hierarchy
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('pki_cas'))`); err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM pki_cas WHERE kind = $1)`, KindIntermediate).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	rootTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: ca.cfg.Name + " Root CA", Organization: []string{ca.cfg.Name}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(ca.cfg.RootTTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+	}
+	root, err := ca.createAuthority(tx, KindRoot, nil, rootTemplate, rootKey, nil)
+	if err != nil {
+		return err
+	}
+
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	intermediateTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: ca.cfg.Name + " Intermediate CA", Organization: []string{ca.cfg.Name}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(ca.cfg.IntermediateTTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            0,
+		MaxPathLenZero:        true,
+	}
+	if _, err := ca.createAuthority(tx, KindIntermediate, &root.id, intermediateTemplate, intermediateKey, root); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// createAuthority self-signs template, or signs it with parent, and stores
+// the result with its key encrypted.
+func (ca *CA) createAuthority(tx *sql.Tx, kind string, parentID *uuid.UUID, template *x509.Certificate, key crypto.Signer, parent *authority) (*authority, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	issuer, issuerKey := template, key
+	if parent != nil {
+		issuer, issuerKey = parent.cert, parent.signer
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := ca.encryptionSvc.Encrypt(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt CA key: %v", err)
+	}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	a := &authority{cert: cert, pem: certPEM, signer: key}
+	if err := tx.QueryRow(`
+		INSERT INTO pki_cas (kind, parent_id, common_name, serial, certificate, private_key, not_before, not_after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`,
+		kind, parentID, cert.Subject.CommonName, formatSerial(cert.SerialNumber), certPEM, encryptedKey,
+		cert.NotBefore, cert.NotAfter,
+	).Scan(&a.id); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadAuthority returns the newest CA of kind with its key decrypted.
+func (ca *CA) loadAuthority(kind string) (*authority, error) {
+	var (
+		a            authority
+		encryptedKey string
+	)
+	err := ca.db.QueryRow(`
+		SELECT id, certificate, private_key FROM pki_cas
+		WHERE kind = $1
+		ORDER BY created_at DESC LIMIT 1`,
+		kind,
+	).Scan(&a.id, &a.pem, &encryptedKey)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no %s CA", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if a.cert, err = parseCertificatePEM(a.pem); err != nil {
+		return nil, err
+	}
+	keyPEM, err := ca.encryptionSvc.Decrypt(encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s CA key: %v", kind, err)
+	}
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("invalid CA key PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key cannot sign")
+	}
+	a.signer = signer
+	return &a, nil
+}
+
+// Chain returns the intermediate and root certificates as PEM, in the
+// order a server presents them after its own certificate.
+func (ca *CA) Chain() (string, error) {
+	rows, err := ca.db.Query(`
+		SELECT certificate FROM pki_cas
+		WHERE not_after > CURRENT_TIMESTAMP
+		ORDER BY kind = $1, created_at DESC`,
+		KindRoot,
+	)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var b strings.Builder
+	for rows.Next() {
+		var certPEM string
+		if err := rows.Scan(&certPEM); err != nil {
+			return "", err
+		}
+		b.WriteString(certPEM)
+	}
+	return b.String(), rows.Err()
+}
+
+// CAInfo describes one CA certificate of the hierarchy.
+type CAInfo struct {
+	ID          uuid.UUID  `json:"id"`
+	Kind        string     `json:"kind"`
+	ParentID    *uuid.UUID `json:"parent_id,omitempty"`
+	CommonName  string     `json:"common_name"`
+	Serial      string     `json:"serial"`
+	Certificate string     `json:"certificate"`
+	NotBefore   time.Time  `json:"not_before"`
+	NotAfter    time.Time  `json:"not_after"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Authorities lists the CA certificates, root first.
+func (ca *CA) Authorities() ([]CAInfo, error) {
+	rows, err := ca.db.Query(`
+		SELECT id, kind, parent_id, common_name, serial, certificate, not_before, not_after, created_at
+		FROM pki_cas
+		ORDER BY kind <> $1, created_at DESC`,
+		KindRoot,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cas := []CAInfo{}
+	for rows.Next() {
+		var info CAInfo
+		if err := rows.Scan(&info.ID, &info.Kind, &info.ParentID, &info.CommonName, &info.Serial,
+			&info.Certificate, &info.NotBefore, &info.NotAfter, &info.CreatedAt); err != nil {
+			return nil, err
+		}
+		cas = append(cas, info)
+	}
+	return cas, rows.Err()
+}
+
+func parseCertificatePEM(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("invalid certificate PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// randomSerial returns a positive 128-bit serial, well above the 64 bits of
+// entropy CAs are expected to use.
+func randomSerial() (*big.Int, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return n.Add(n, big.NewInt(1)), nil
+}
+
+// formatSerial renders a serial the way openssl does, as colon-free hex.
+func formatSerial(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
+
+func parseSerial(serial string) (*big.Int, bool) {
+	return new(big.Int).SetString(strings.ToLower(strings.ReplaceAll(serial, ":", "")), 16)
+}
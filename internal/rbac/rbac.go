@@ -0,0 +1,121 @@
+package rbac
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Resolver answers "does this user hold that permission" by walking
+// user_roles -> role_permissions -> permissions. Results are cached per user
+// for a short TTL; handlers that change role bindings invalidate the cache.
+type Resolver struct {
+	db  *sql.DB
+	ttl time.Duration
+
+	mu    sync.RWMutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	permissions map[string]bool
+	expiresAt   time.Time
+}
+
+func NewResolver(db *sql.DB, ttl time.Duration) *Resolver {
+	return &Resolver{
+		db:    db,
+		ttl:   ttl,
+		cache: map[string]cacheEntry{},
+	}
+}
+
+// Permissions returns the set of permission names granted to the user.
+func (r *Resolver) Permissions(userID string) (map[string]bool, error) {
+	r.mu.RLock()
+	entry, ok := r.cache[userID]
+	r.mu.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.permissions, nil
+	}
+
+	// Time-bound assignments count only until they lapse
+	rows, err := r.db.Query(`
+		SELECT p.name, ur.expires_at
+		FROM user_roles ur
+		JOIN role_permissions rp ON rp.role_id = ur.role_id
+		JOIN permissions p ON p.id = rp.permission_id
+		WHERE ur.user_id = $1
+		  AND (ur.expires_at IS NULL OR ur.expires_at > CURRENT_TIMESTAMP)`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := map[string]bool{}
+	cacheUntil := time.Now().Add(r.ttl)
+	for rows.Next() {
+		var name string
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&name, &expiresAt); err != nil {
+			return nil, err
+		}
+		permissions[name] = true
+		// Never cache a grant past its expiry
+		if expiresAt.Valid && expiresAt.Time.Before(cacheUntil) {
+			cacheUntil = expiresAt.Time
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.cache[userID] = cacheEntry{permissions: permissions, expiresAt: cacheUntil}
+	r.mu.Unlock()
+
+	return permissions, nil
+}
+
+func (r *Resolver) HasPermission(userID, permission string) (bool, error) {
+	permissions, err := r.Permissions(userID)
+	if err != nil {
+		return false, err
+	}
+	return permissions[permission], nil
+}
+
+// HoldsAnyRole reports whether the user currently holds one of roleIDs.
+// It is not cached, so a role removed or lapsed stops counting at once.
+func (r *Resolver) HoldsAnyRole(userID string, roleIDs []string) (bool, error) {
+	var holds bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM user_roles ur
+			WHERE ur.user_id = $1 AND ur.role_id = ANY($2::uuid[])
+			  AND (ur.expires_at IS NULL OR ur.expires_at > CURRENT_TIMESTAMP)
+		)`,
+		userID, pq.Array(roleIDs),
+	).Scan(&holds)
+	return holds, err
+}
+
+// Invalidate drops the cached permissions of one user, e.g. after a role
+// was assigned to or removed from them.
+func (r *Resolver) Invalidate(userID string) {
+	r.mu.Lock()
+	delete(r.cache, userID)
+	r.mu.Unlock()
+}
+
+// InvalidateAll drops every cached entry, e.g. after a role's permissions
+// changed and any number of users may be affected.
+func (r *Resolver) InvalidateAll() {
+	r.mu.Lock()
+	r.cache = map[string]cacheEntry{}
+	r.mu.Unlock()
+}
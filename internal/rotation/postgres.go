@@ -0,0 +1,74 @@
+package rotation
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+// Postgres rotates a PostgreSQL login role's password. It signs in as the
+// role with the currently stored password and runs ALTER ROLE on itself, so
+// no administrator credentials are needed.
+type Postgres struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Database string `json:"database"`
+	Username string `json:"username"`
+	SSLMode  string `json:"sslmode"`
+	Length   int    `json:"length"`
+}
+
+func (p *Postgres) validate() error {
+	if p.Host == "" || p.Username == "" {
+		return fmt.Errorf("postgres rotator requires host and username")
+	}
+	if p.Port == 0 {
+		p.Port = 5432
+	}
+	if p.Database == "" {
+		p.Database = "postgres"
+	}
+	if p.SSLMode == "" {
+		p.SSLMode = "require"
+	}
+	if p.Length == 0 {
+		p.Length = DefaultPasswordLength
+	}
+	return nil
+}
+
+func (p *Postgres) Rotate(ctx context.Context, current string) (string, error) {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(p.Username, current),
+		Host:     net.JoinHostPort(p.Host, strconv.Itoa(p.Port)),
+		Path:     "/" + p.Database,
+		RawQuery: url.Values{"sslmode": {p.SSLMode}}.Encode(),
+	}
+
+	db, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	password, err := GeneratePassword(p.Length)
+	if err != nil {
+		return "", err
+	}
+
+	// ALTER ROLE takes no bind parameters, so the identifier and literal
+	// are quoted explicitly
+	_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER ROLE %s WITH PASSWORD %s",
+		pq.QuoteIdentifier(p.Username), pq.QuoteLiteral(password)))
+	if err != nil {
+		return "", fmt.Errorf("alter role %s: %v", p.Username, err)
+	}
+
+	return password, nil
+}
@@ -0,0 +1,37 @@
+package rotation
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+)
+
+// DefaultPasswordLength is used when a rotator does not set a length.
+const DefaultPasswordLength = 32
+
+const passwordAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789!#%+-.:=@^_~"
+
+// RandomPassword replaces the stored value with a fresh random password. It
+// suits credentials the vault is the source of truth for.
+type RandomPassword struct {
+	Length int `json:"length"`
+}
+
+func (r *RandomPassword) Rotate(ctx context.Context, current string) (string, error) {
+	return GeneratePassword(r.Length)
+}
+
+// GeneratePassword returns a random password drawn uniformly from an
+// alphabet that is safe to paste into shells and connection strings.
+func GeneratePassword(length int) (string, error) {
+	max := big.NewInt(int64(len(passwordAlphabet)))
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = passwordAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
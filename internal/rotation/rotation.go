@@ -0,0 +1,52 @@
+package rotation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	KindRandomPassword = "random_password"
+	KindPostgres       = "postgres"
+)
+
+// Rotator replaces a credential. It receives the value currently stored in
+// the vault and returns the new value once the target system accepts it.
+type Rotator interface {
+	Rotate(ctx context.Context, current string) (string, error)
+}
+
+// New builds the rotator of the given kind from its JSON configuration. It
+// is also used to validate configuration before a policy is saved.
+func New(kind string, config json.RawMessage) (Rotator, error) {
+	if len(config) == 0 || string(config) == "null" {
+		config = json.RawMessage("{}")
+	}
+
+	switch kind {
+	case KindRandomPassword:
+		var r RandomPassword
+		if err := json.Unmarshal(config, &r); err != nil {
+			return nil, fmt.Errorf("invalid random_password config: %v", err)
+		}
+		if r.Length == 0 {
+			r.Length = DefaultPasswordLength
+		}
+		if r.Length < 12 || r.Length > 256 {
+			return nil, fmt.Errorf("length must be between 12 and 256")
+		}
+		return &r, nil
+	case KindPostgres:
+		var r Postgres
+		if err := json.Unmarshal(config, &r); err != nil {
+			return nil, fmt.Errorf("invalid postgres config: %v", err)
+		}
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		return &r, nil
+	default:
+		return nil, fmt.Errorf("unknown rotator %q", kind)
+	}
+}
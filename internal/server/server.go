@@ -1,12 +1,27 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"sync"
+	"time"
 
+	"idam-pam-platform/internal/alerts"
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/auth"
 	"idam-pam-platform/internal/config"
+	"idam-pam-platform/internal/dynamic"
 	"idam-pam-platform/internal/encryption"
 	"idam-pam-platform/internal/handlers"
+	"idam-pam-platform/internal/jobs"
+	"idam-pam-platform/internal/lockout"
 	"idam-pam-platform/internal/middleware"
+	"idam-pam-platform/internal/pki"
+	"idam-pam-platform/internal/rbac"
+	"idam-pam-platform/internal/siem"
+	"idam-pam-platform/internal/sshca"
+	"idam-pam-platform/internal/transit"
+	"idam-pam-platform/internal/vault"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -14,7 +29,26 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/recover"
 )
 
-func New(cfg *config.Config, db *sql.DB) *fiber.App {
+// Server is the API server.
+type Server struct {
+	*fiber.App
+
+	// done is closed as shutdown starts, ending audit streams that would
+	// otherwise keep their connections busy and hold it up
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Shutdown ends open streams and stops the server, closing connections
+// still busy after timeout. Background jobs are stopped and queued audit
+// events flushed either way.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.doneOnce.Do(func() { close(s.done) })
+	return s.App.ShutdownWithTimeout(timeout)
+}
+
+func New(cfg *config.Config, db *sql.DB) (*Server, error) {
+	done := make(chan struct{})
 	app := fiber.New(fiber.Config{
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
@@ -36,13 +70,129 @@ func New(cfg *config.Config, db *sql.DB) *fiber.App {
 	}))
 
 	// Initialize services
-	encryptionSvc := encryption.NewService(cfg.AWSRegion, cfg.KMSKeyID)
+	keyProvider, err := encryption.NewProvider(encryption.ProviderConfig{
+		Type:           cfg.KeyProvider,
+		MasterKey:      cfg.MasterKey,
+		MasterKeyFile:  cfg.MasterKeyFile,
+		Passphrase:     cfg.Passphrase,
+		PassphraseSalt: cfg.PassphraseSalt,
+		AWSRegion:      cfg.AWSRegion,
+		KMSKeyID:       cfg.KMSKeyID,
+		KMSEndpoint:    cfg.KMSEndpoint,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encryptionSvc, err := encryption.NewService(db, keyProvider)
+	if err != nil {
+		return nil, err
+	}
+	keySet, err := auth.NewKeySet(db, encryptionSvc, auth.KeySetConfig{
+		Algorithm:      cfg.JWTSigningAlg,
+		Issuer:         cfg.JWTIssuer,
+		RotationWindow: cfg.JWTKeyRotation,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resolver := rbac.NewResolver(db, cfg.PermissionTTL)
+	secretStore := vault.NewStore(db, encryptionSvc, cfg.SecretVersions)
+	leaseManager := dynamic.NewManager(db, encryptionSvc, resolver)
+	sshCA, err := sshca.NewCA(db, encryptionSvc, cfg.SSHCertMaxTTL)
+	if err != nil {
+		return nil, err
+	}
+	pkiCA, err := pki.NewCA(db, encryptionSvc, resolver, pki.Config{
+		Name:            cfg.PKIName,
+		RootTTL:         cfg.PKIRootTTL,
+		IntermediateTTL: cfg.PKIInterTTL,
+		CRLTTL:          cfg.PKICRLTTL,
+		BaseURL:         cfg.JWTIssuer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	checkpointer, err := audit.NewCheckpointer(db, encryptionSvc)
+	if err != nil {
+		return nil, err
+	}
+	auditLog := audit.NewLogger(db, audit.Config{
+		BufferSize: cfg.AuditBuffer,
+		BatchSize:  cfg.AuditBatchSize,
+	})
+	auditSinks, err := siem.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	notifiers, err := alerts.NewNotifiers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// The alert engine reads the log like any other sink
+	auditSinks = append(auditSinks, alerts.NewEngine(db, notifiers))
+	archiveStore, err := audit.NewArchiveStore(audit.ArchiveConfig{
+		Dir:      cfg.ArchiveDir,
+		Bucket:   cfg.ArchiveBucket,
+		Prefix:   cfg.ArchivePrefix,
+		Region:   cfg.AWSRegion,
+		Endpoint: cfg.ArchiveEndpoint,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Background jobs stop when the app shuts down, then queued audit
+	// events are flushed
+	ctx, cancel := context.WithCancel(context.Background())
+	app.Hooks().OnShutdown(func() error {
+		cancel()
+		auditLog.Close()
+		return nil
+	})
+	go jobs.NewRoleExpirer(db, resolver, cfg.RoleExpiryCheck).Run(ctx)
+	rewrapper := jobs.NewRewrapper(db, encryptionSvc, cfg.RewrapBatchSize)
+	go rewrapper.Run(ctx)
+	go jobs.NewCheckoutExpirer(db, secretStore, cfg.CheckoutExpiry, auditLog).Run(ctx)
+	go jobs.NewRotationScheduler(db, secretStore, cfg.RotationCheck, cfg.RotationRetry, cfg.RotationBackoff, auditLog).Run(ctx)
+	go jobs.NewLeaseExpirer(db, leaseManager, cfg.LeaseExpiry, auditLog).Run(ctx)
+	go jobs.NewAuditCheckpointer(checkpointer, cfg.AuditCheckpoint).Run(ctx)
+	limiter := lockout.NewLimiter(db, lockout.Policy{
+		UserThreshold:   cfg.LockoutUser,
+		IPThreshold:     cfg.LockoutIP,
+		LockDuration:    cfg.LockoutTime,
+		MaxLockDuration: cfg.LockoutMaxTime,
+		BackoffBase:     cfg.LoginBackoff,
+		BackoffMax:      cfg.LoginBackoffMax,
+		ResetAfter:      cfg.LockoutReset,
+	})
+	go jobs.NewLoginAttemptPruner(limiter, cfg.LockoutReset).Run(ctx)
+	if archiveStore != nil {
+		archiver := audit.NewArchiver(db, archiveStore, checkpointer, cfg.ArchiveBatch)
+		go jobs.NewAuditArchiver(archiver, cfg.ArchiveInterval).Run(ctx)
+	}
+	go jobs.NewAlertNotifier(alerts.NewDeliverer(db, notifiers, cfg.AlertNotifyMax), cfg.AlertNotifyPoll).Run(ctx)
+	for _, sink := range auditSinks {
+		forwarder := audit.NewForwarder(db, sink, cfg.AuditBatchSize)
+		go jobs.NewAuditForwarder(forwarder, cfg.AuditBatchSize, cfg.AuditSinkPoll).Run(ctx)
+	}
 
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(db, cfg.JWTSecret)
-	userHandler := handlers.NewUserHandler(db)
-	secretHandler := handlers.NewSecretHandler(db, encryptionSvc)
-	auditHandler := handlers.NewAuditHandler(db)
+	authHandler := handlers.NewAuthHandler(db, keySet, cfg.AccessTokenTTL, cfg.RefreshTokenTTL, limiter, auditLog)
+	oidcHandler := handlers.NewOIDCHandler(db, keySet, authHandler, cfg.AccessTokenTTL)
+	userHandler := handlers.NewUserHandler(db, resolver, auditLog)
+	roleHandler := handlers.NewRoleHandler(db, resolver, auditLog)
+	accessRequestHandler := handlers.NewAccessRequestHandler(db, resolver, cfg.MaxAccessTTL, auditLog)
+	secretHandler := handlers.NewSecretHandler(db, secretStore, resolver, cfg.MaxCheckout, auditLog)
+	auditHandler := handlers.NewAuditHandler(db, resolver, done, auditLog)
+	encryptionHandler := handlers.NewEncryptionHandler(db, encryptionSvc, rewrapper, auditLog)
+	databaseHandler := handlers.NewDatabaseHandler(db, leaseManager, resolver, auditLog)
+	sshHandler := handlers.NewSSHHandler(db, sshCA, resolver, auditLog)
+	pkiHandler := handlers.NewPKIHandler(db, pkiCA, resolver, auditLog)
+	transitHandler := handlers.NewTransitHandler(db, transit.NewEngine(db, encryptionSvc, resolver), auditLog)
+	auditSinkHandler := handlers.NewAuditSinkHandler(db, auditSinks, auditLog)
+	retentionHandler := handlers.NewRetentionHandler(db, auditLog)
+	alertHandler := handlers.NewAlertHandler(db, auditLog)
+	lockoutHandler := handlers.NewLockoutHandler(db, limiter, auditLog)
 
 	// Routes
 	api := app.Group("/api/v1")
@@ -51,41 +201,218 @@ func New(cfg *config.Config, db *sql.DB) *fiber.App {
 	auth := api.Group("/auth")
 	auth.Post("/register", authHandler.Register)
 	auth.Post("/login", authHandler.Login)
+	auth.Post("/refresh", authHandler.Refresh)
+	auth.Post("/logout", middleware.JWTAuth(keySet, db), authHandler.Logout)
+
+	// SSH CA public keys for hosts' TrustedUserCAKeys; registered before the
+	// protected middleware so hosts can fetch them without a token
+	api.Get("/ssh/ca.pub", sshHandler.CAPublicKeys)
 
-	// Protected routes
-	protected := api.Use(middleware.JWTAuth(cfg.JWTSecret))
+	// CA chain and CRL; certificates point relying parties here
+	api.Get("/pki/ca.pem", pkiHandler.CAChain)
+	api.Get("/pki/crl", pkiHandler.CRL)
+
+	// Protected routes. Every route below declares the permission it needs;
+	// routes without one are self-service for any authenticated user.
+	protected := api.Use(middleware.JWTAuth(keySet, db))
 	protected.Use(middleware.EnsureUser(db))
+	perm := func(permission string) fiber.Handler {
+		return middleware.RequirePermission(resolver, permission)
+	}
 
 	// User routes
 	users := protected.Group("/users")
-	// Read endpoints available to all authenticated users
-	users.Get("/", userHandler.GetUsers)
-	users.Get("/:id", userHandler.GetUser)
-	// Write endpoints restricted to admins
-	usersAdmin := users.Group("")
-	usersAdmin.Use(middleware.RequireAdmin(db))
-	usersAdmin.Put("/:id", userHandler.UpdateUser)
-	usersAdmin.Post("/:id/roles", userHandler.AssignRole)
+	users.Get("/", perm("users.read"), userHandler.GetUsers)
+	users.Get("/:id", perm("users.read"), userHandler.GetUser)
+	users.Put("/:id", perm("users.write"), userHandler.UpdateUser)
+	users.Post("/:id/roles", perm("roles.write"), userHandler.AssignRole)
+	users.Delete("/:id/roles/:roleId", perm("roles.write"), userHandler.RemoveRole)
+	users.Post("/:id/unlock", perm("users.unlock"), lockoutHandler.UnlockUser)
+
+	// Failed-login lockouts
+	lockouts := protected.Group("/lockouts")
+	lockouts.Get("/", perm("users.unlock"), lockoutHandler.GetLockouts)
+	lockouts.Post("/unlock", perm("users.unlock"), lockoutHandler.UnlockIP)
+
+	// Role and permission management
+	roles := protected.Group("/roles")
+	roles.Get("/", perm("roles.read"), roleHandler.GetRoles)
+	roles.Post("/", perm("roles.write"), roleHandler.CreateRole)
+	roles.Get("/:id", perm("roles.read"), roleHandler.GetRole)
+	roles.Put("/:id", perm("roles.write"), roleHandler.UpdateRole)
+	roles.Delete("/:id", perm("roles.write"), roleHandler.DeleteRole)
+	roles.Get("/:id/permissions", perm("roles.read"), roleHandler.GetRolePermissions)
+	roles.Post("/:id/permissions", perm("roles.write"), roleHandler.GrantPermission)
+	roles.Delete("/:id/permissions/:permissionId", perm("roles.write"), roleHandler.RevokePermission)
+
+	permissions := protected.Group("/permissions")
+	permissions.Get("/", perm("roles.read"), roleHandler.GetPermissions)
+	permissions.Post("/", perm("roles.write"), roleHandler.CreatePermission)
+	permissions.Put("/:id", perm("roles.write"), roleHandler.UpdatePermission)
+	permissions.Delete("/:id", perm("roles.write"), roleHandler.DeletePermission)
+
+	// Just-in-time access requests
+	accessRequests := protected.Group("/access-requests")
+	accessRequests.Get("/", accessRequestHandler.GetRequests)
+	accessRequests.Post("/", perm("access.request"), accessRequestHandler.CreateRequest)
+	accessRequests.Get("/:id", accessRequestHandler.GetRequest)
+	accessRequests.Post("/:id/approve", perm("access.approve"), accessRequestHandler.Approve)
+	accessRequests.Post("/:id/deny", perm("access.approve"), accessRequestHandler.Deny)
+	accessRequests.Post("/:id/cancel", accessRequestHandler.Cancel)
 
 	// Secret routes
 	secrets := protected.Group("/secrets")
-	secrets.Get("/", secretHandler.GetSecrets)
-	secrets.Post("/", secretHandler.CreateSecret)
-	secrets.Get("/:id", secretHandler.GetSecret)
-	secrets.Delete("/:id", secretHandler.DeleteSecret)
+	secrets.Get("/", perm("secrets.read"), secretHandler.GetSecrets)
+	secrets.Post("/", perm("secrets.write"), secretHandler.CreateSecret)
+	secrets.Get("/:id", perm("secrets.read"), secretHandler.GetSecret)
+	secrets.Put("/:id", perm("secrets.write"), secretHandler.UpdateSecret)
+	secrets.Get("/:id/versions", perm("secrets.read"), secretHandler.GetSecretVersions)
+	secrets.Get("/:id/versions/:version", perm("secrets.read"), secretHandler.GetSecretVersion)
+	secrets.Post("/:id/versions/:version/rollback", perm("secrets.write"), secretHandler.RollbackSecret)
+	secrets.Delete("/:id", perm("secrets.write"), secretHandler.DeleteSecret)
+	secrets.Get("/:id/rotation", perm("secrets.read"), secretHandler.GetRotationPolicy)
+	secrets.Put("/:id/rotation", perm("secrets.write"), secretHandler.SetRotationPolicy)
+	secrets.Delete("/:id/rotation", perm("secrets.write"), secretHandler.DeleteRotationPolicy)
+	secrets.Post("/:id/rotate", perm("secrets.write"), secretHandler.RotateSecret)
+	secrets.Get("/:id/checkout", perm("secrets.read"), secretHandler.GetCheckout)
+	secrets.Post("/:id/checkout", perm("secrets.read"), secretHandler.CheckOut)
+	secrets.Delete("/:id/checkout/queue", perm("secrets.read"), secretHandler.LeaveQueue)
+	secrets.Post("/:id/checkin", perm("secrets.read"), secretHandler.CheckIn)
+	secrets.Post("/:id/checkin/force", perm("checkouts.force"), secretHandler.ForceCheckIn)
+	secrets.Get("/:id/acl", perm("secrets.read"), secretHandler.GetSecretACL)
+	secrets.Post("/:id/acl", perm("secrets.write"), secretHandler.GrantSecretAccess)
+	secrets.Delete("/:id/acl/:aclId", perm("secrets.write"), secretHandler.RevokeSecretAccess)
+
+	protected.Get("/checkouts", perm("secrets.read"), secretHandler.GetMyCheckouts)
+
+	// Folder ACLs; the path is passed in the query or body since it has slashes
+	folders := protected.Group("/folders")
+	folders.Get("/acl", perm("secrets.read"), secretHandler.GetFolderACL)
+	folders.Post("/acl", perm("secrets.write"), secretHandler.GrantFolderAccess)
+	folders.Delete("/acl/:aclId", perm("secrets.write"), secretHandler.RevokeFolderAccess)
+
+	// Dynamic database credentials
+	database := protected.Group("/database")
+	database.Get("/roles", perm("database.request"), databaseHandler.GetRoles)
+	database.Post("/roles", perm("database.manage"), databaseHandler.CreateRole)
+	database.Get("/roles/:id", perm("database.request"), databaseHandler.GetRole)
+	database.Put("/roles/:id", perm("database.manage"), databaseHandler.UpdateRole)
+	database.Delete("/roles/:id", perm("database.manage"), databaseHandler.DeleteRole)
+	database.Post("/roles/:id/credentials", perm("database.request"), databaseHandler.IssueCredentials)
+	database.Get("/leases", perm("database.request"), databaseHandler.GetLeases)
+	database.Get("/leases/:id", perm("database.request"), databaseHandler.GetLease)
+	database.Post("/leases/:id/renew", perm("database.request"), databaseHandler.RenewLease)
+	database.Delete("/leases/:id", perm("database.request"), databaseHandler.RevokeLease)
+
+	// SSH user certificates
+	sshRoutes := protected.Group("/ssh")
+	sshRoutes.Get("/profile", perm("ssh.sign"), sshHandler.GetProfile)
+	sshRoutes.Post("/sign", perm("ssh.sign"), sshHandler.SignKey)
+	sshRoutes.Get("/certificates", perm("ssh.sign"), sshHandler.GetCertificates)
+	sshRoutes.Get("/policies", perm("ssh.manage"), sshHandler.GetPolicies)
+	sshRoutes.Get("/policies/:roleId", perm("ssh.manage"), sshHandler.GetPolicy)
+	sshRoutes.Put("/policies/:roleId", perm("ssh.manage"), sshHandler.SetPolicy)
+	sshRoutes.Delete("/policies/:roleId", perm("ssh.manage"), sshHandler.DeletePolicy)
+	sshRoutes.Get("/ca/keys", perm("ssh.manage"), sshHandler.GetCAKeys)
+	sshRoutes.Post("/ca/rotate", perm("ssh.manage"), sshHandler.RotateCA)
+
+	// X.509 certificates
+	pkiRoutes := protected.Group("/pki")
+	pkiRoutes.Get("/cas", perm("pki.issue"), pkiHandler.GetAuthorities)
+	pkiRoutes.Get("/roles", perm("pki.issue"), pkiHandler.GetRoles)
+	pkiRoutes.Post("/roles", perm("pki.manage"), pkiHandler.CreateRole)
+	pkiRoutes.Get("/roles/:id", perm("pki.issue"), pkiHandler.GetRole)
+	pkiRoutes.Put("/roles/:id", perm("pki.manage"), pkiHandler.UpdateRole)
+	pkiRoutes.Delete("/roles/:id", perm("pki.manage"), pkiHandler.DeleteRole)
+	pkiRoutes.Post("/roles/:id/issue", perm("pki.issue"), pkiHandler.IssueCertificate)
+	pkiRoutes.Get("/certificates", perm("pki.issue"), pkiHandler.GetCertificates)
+	pkiRoutes.Get("/certificates/:serial", perm("pki.issue"), pkiHandler.GetCertificate)
+	pkiRoutes.Post("/certificates/:serial/renew", perm("pki.issue"), pkiHandler.RenewCertificate)
+	pkiRoutes.Post("/certificates/:serial/revoke", perm("pki.issue"), pkiHandler.RevokeCertificate)
+
+	// Encryption as a service with named transit keys
+	transitRoutes := protected.Group("/transit")
+	transitRoutes.Get("/keys", perm("transit.manage"), transitHandler.GetKeys)
+	transitRoutes.Post("/keys", perm("transit.manage"), transitHandler.CreateKey)
+	transitRoutes.Get("/keys/:name", perm("transit.manage"), transitHandler.GetKey)
+	transitRoutes.Put("/keys/:name", perm("transit.manage"), transitHandler.UpdateKey)
+	transitRoutes.Post("/keys/:name/rotate", perm("transit.manage"), transitHandler.RotateKey)
+	transitRoutes.Delete("/keys/:name", perm("transit.manage"), transitHandler.DeleteKey)
+	transitRoutes.Post("/encrypt/:name", perm("transit.encrypt"), transitHandler.Encrypt)
+	transitRoutes.Post("/decrypt/:name", perm("transit.decrypt"), transitHandler.Decrypt)
+	transitRoutes.Post("/rewrap/:name", perm("transit.encrypt"), transitHandler.Rewrap)
+	transitRoutes.Post("/sign/:name", perm("transit.sign"), transitHandler.Sign)
+	transitRoutes.Post("/verify/:name", perm("transit.verify"), transitHandler.Verify)
+	transitRoutes.Post("/hmac/:name", perm("transit.hmac"), transitHandler.HMAC)
 
 	// Audit routes
-	audit := protected.Group("/audit")
-	audit.Get("/", auditHandler.GetAuditLogs)
+	auditRoutes := protected.Group("/audit")
+	auditRoutes.Get("/", perm("audit.read"), auditHandler.GetAuditLogs)
+	auditRoutes.Get("/export", perm("audit.export"), auditHandler.ExportAuditLogs)
+	auditRoutes.Get("/stream", perm("audit.read"), auditHandler.StreamAuditLogs)
+	auditRoutes.Get("/verify", perm("audit.verify"), auditHandler.VerifyChain)
+	auditRoutes.Get("/sinks", perm("audit.sinks"), auditSinkHandler.GetSinks)
+	auditRoutes.Get("/dead-letters", perm("audit.sinks"), auditSinkHandler.GetDeadLetters)
+	auditRoutes.Post("/dead-letters/:id/retry", perm("audit.sinks"), auditSinkHandler.RetryDeadLetter)
+	auditRoutes.Delete("/dead-letters/:id", perm("audit.sinks"), auditSinkHandler.DiscardDeadLetter)
+	auditRoutes.Get("/retention", perm("audit.retention"), retentionHandler.GetRules)
+	auditRoutes.Put("/retention", perm("audit.retention"), retentionHandler.SetRule)
+	auditRoutes.Delete("/retention/:id", perm("audit.retention"), retentionHandler.DeleteRule)
+	auditRoutes.Get("/archives", perm("audit.retention"), retentionHandler.GetArchives)
+	auditRoutes.Get("/legal-holds", perm("audit.legal_hold"), retentionHandler.GetLegalHolds)
+	auditRoutes.Post("/legal-holds", perm("audit.legal_hold"), retentionHandler.CreateLegalHold)
+	auditRoutes.Delete("/legal-holds/:id", perm("audit.legal_hold"), retentionHandler.ReleaseLegalHold)
+
+	// Alert routes
+	alertRoutes := protected.Group("/alerts")
+	alertRoutes.Get("/", perm("alerts.read"), alertHandler.GetAlerts)
+	alertRoutes.Get("/rules", perm("alerts.rules"), alertHandler.GetRules)
+	alertRoutes.Post("/rules", perm("alerts.rules"), alertHandler.CreateRule)
+	alertRoutes.Put("/rules/:id", perm("alerts.rules"), alertHandler.UpdateRule)
+	alertRoutes.Delete("/rules/:id", perm("alerts.rules"), alertHandler.DeleteRule)
+	alertRoutes.Get("/:id", perm("alerts.read"), alertHandler.GetAlert)
+	alertRoutes.Post("/:id/acknowledge", perm("alerts.manage"), alertHandler.AcknowledgeAlert)
+	alertRoutes.Post("/:id/resolve", perm("alerts.manage"), alertHandler.ResolveAlert)
 
-	// TOTP routes
+	// TOTP routes (self-service)
 	totp := protected.Group("/totp")
 	totp.Post("/enable", authHandler.EnableTOTP)
 
+	// Signing key routes
+	keys := protected.Group("/keys")
+	keys.Get("/", perm("keys.read"), authHandler.GetSigningKeys)
+	keys.Post("/rotate", perm("keys.write"), authHandler.RotateSigningKey)
+
+	// Master key keyring and re-encryption
+	encryptionKeys := protected.Group("/encryption")
+	encryptionKeys.Get("/keys", perm("encryption.read"), encryptionHandler.GetKeys)
+	encryptionKeys.Post("/keys/rotate", perm("encryption.write"), encryptionHandler.RotateKey)
+	encryptionKeys.Get("/jobs", perm("encryption.read"), encryptionHandler.GetRewrapJobs)
+	encryptionKeys.Get("/jobs/:id", perm("encryption.read"), encryptionHandler.GetRewrapJob)
+	encryptionKeys.Post("/jobs/:id/resume", perm("encryption.write"), encryptionHandler.ResumeRewrapJob)
+
+	// OIDC client registration
+	oidcClients := protected.Group("/oidc/clients")
+	oidcClients.Get("/", perm("clients.read"), oidcHandler.GetClients)
+	oidcClients.Post("/", perm("clients.write"), oidcHandler.CreateClient)
+	oidcClients.Delete("/:clientId", perm("clients.write"), oidcHandler.DeleteClient)
+
+	// Public keys for offline token verification
+	app.Get("/.well-known/jwks.json", authHandler.JWKS)
+
+	// OpenID Connect provider
+	app.Get("/.well-known/openid-configuration", oidcHandler.Discovery)
+	oauth := app.Group("/oauth2")
+	oauth.Get("/authorize", oidcHandler.Authorize)
+	oauth.Post("/authorize", oidcHandler.AuthorizeLogin)
+	oauth.Post("/token", oidcHandler.Token)
+	oauth.Get("/userinfo", middleware.ClientTokenAuth(keySet, db), oidcHandler.UserInfo)
+	oauth.Post("/userinfo", middleware.ClientTokenAuth(keySet, db), oidcHandler.UserInfo)
+
 	// Health check
 	app.Get("/health", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"status": "healthy"})
 	})
 
-	return app
+	return &Server{App: app, done: done}, nil
 }
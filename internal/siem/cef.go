@@ -0,0 +1,74 @@
+package siem
+
+import (
+	"fmt"
+	"strings"
+
+	"idam-pam-platform/internal/audit"
+)
+
+const (
+	cefVendor  = "IDAM-PAM"
+	cefProduct = "IDAM-PAM Platform"
+	cefVersion = "1.0"
+)
+
+// NewCEF returns a syslog sink whose messages are ArcSight CEF events,
+// for collectors that parse CEF rather than RFC 5424 structured data.
+func NewCEF(name, rawURL, caFile string) (*Syslog, error) {
+	return newSyslog(name, rawURL, caFile, cef)
+}
+
+// cef renders CEF:Version|Vendor|Product|Version|SignatureID|Name|Severity|Extension
+func cef(r audit.Record) (string, string) {
+	sev := 3
+	if severity(r.Action) == severityWarning {
+		sev = 7
+	}
+
+	ext := []string{
+		extension("rt", fmt.Sprint(r.CreatedAt.UnixMilli())),
+		extension("externalId", fmt.Sprint(r.Seq)),
+		extension("act", r.Action),
+		extension("cs1Label", "resource"),
+		extension("cs1", r.Resource),
+	}
+	if r.ResourceID != nil {
+		ext = append(ext, extension("cs2Label", "resourceId"), extension("cs2", r.ResourceID.String()))
+	}
+	if r.UserID != nil {
+		ext = append(ext, extension("suid", r.UserID.String()))
+	}
+	if r.Username != "" {
+		ext = append(ext, extension("suser", r.Username))
+	}
+	if r.IPAddress != "" {
+		ext = append(ext, extension("src", r.IPAddress))
+	}
+	if r.UserAgent != "" {
+		ext = append(ext, extension("requestClientApplication", r.UserAgent))
+	}
+	if len(r.Details) > 0 && string(r.Details) != "null" {
+		ext = append(ext, extension("msg", string(r.Details)))
+	}
+
+	msg := fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		cefHeader.Replace(cefVendor),
+		cefHeader.Replace(cefProduct),
+		cefHeader.Replace(cefVersion),
+		cefHeader.Replace(r.Action),
+		cefHeader.Replace(r.Action),
+		sev,
+		strings.Join(ext, " "),
+	)
+	return "-", msg
+}
+
+func extension(key, value string) string {
+	return key + "=" + cefExtension.Replace(value)
+}
+
+var (
+	cefHeader    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtension = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
@@ -0,0 +1,36 @@
+// Package siem forwards audit entries to external collectors.
+package siem
+
+import (
+	"idam-pam-platform/internal/audit"
+	"idam-pam-platform/internal/config"
+)
+
+// New builds a sink for every destination configured. Sink names are the
+// keys their cursors and dead letters are stored under, so they must stay
+// the same across restarts.
+func New(cfg *config.Config) ([]audit.Sink, error) {
+	var sinks []audit.Sink
+	if cfg.AuditSyslogURL != "" {
+		s, err := NewSyslog("syslog", cfg.AuditSyslogURL, cfg.AuditSyslogCA, cfg.AuditSyslogPEN)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if cfg.AuditCEFURL != "" {
+		s, err := NewCEF("cef", cfg.AuditCEFURL, cfg.AuditSyslogCA)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if cfg.AuditWebhookURL != "" {
+		s, err := NewWebhook("webhook", cfg.AuditWebhookURL, cfg.AuditWebhookKey)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
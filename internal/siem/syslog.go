@@ -0,0 +1,243 @@
+package siem
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+)
+
+const (
+	appName     = "idam-pam"
+	dialTimeout = 10 * time.Second
+	sendTimeout = 30 * time.Second
+
+	// Syslog facility authpriv, for security messages
+	facility = 10
+
+	severityWarning = 4
+	severityInfo    = 6
+)
+
+// formatter renders one audit entry as a syslog message: the structured
+// data and the free-form message.
+type formatter func(r audit.Record) (sd, msg string)
+
+// Syslog sends entries as RFC 5424 messages over UDP, TCP or TLS. Stream
+// transports use octet-counting framing (RFC 6587), so messages may
+// contain newlines.
+type Syslog struct {
+	name    string
+	network string
+	addr    string
+	tls     *tls.Config
+	host    string
+	format  formatter
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslog parses a URL of the form udp://host:port, tcp://host:port or
+// tls://host:port. caFile, when set, replaces the system roots for TLS.
+// enterpriseID is the IANA private enterprise number the structured data
+// is named under; without one, messages carry no structured data.
+func NewSyslog(name, rawURL, caFile string, enterpriseID int) (*Syslog, error) {
+	if enterpriseID < 0 {
+		return nil, fmt.Errorf("%s enterprise number must be positive", name)
+	}
+	return newSyslog(name, rawURL, caFile, rfc5424(enterpriseID))
+}
+
+func newSyslog(name, rawURL, caFile string, format formatter) (*Syslog, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s URL: %w", name, err)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("%s URL must include a port", name)
+	}
+
+	s := &Syslog{
+		name:   name,
+		addr:   u.Host,
+		format: format,
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		s.network = u.Scheme
+	case "tls":
+		s.network = "tcp"
+		s.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s CA file: %w", name, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s CA file contains no certificates", name)
+			}
+			s.tls.RootCAs = pool
+		}
+	default:
+		return nil, fmt.Errorf("unsupported %s transport: %s", name, u.Scheme)
+	}
+
+	if s.host, err = os.Hostname(); err != nil || s.host == "" {
+		s.host = "-"
+	}
+	return s, nil
+}
+
+func (s *Syslog) Name() string {
+	return s.name
+}
+
+// Send writes records over a connection kept open between batches. A
+// failed write drops the connection so the next attempt dials again.
+func (s *Syslog) Send(records []audit.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(sendTimeout))
+	for _, r := range records {
+		msg := s.message(r)
+		if s.network == "tcp" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+		if _, err := s.conn.Write([]byte(msg)); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *Syslog) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if s.tls != nil {
+		return tls.DialWithDialer(dialer, s.network, s.addr, s.tls)
+	}
+	return dialer.Dial(s.network, s.addr)
+}
+
+// message renders the RFC 5424 header followed by the formatted entry:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+func (s *Syslog) message(r audit.Record) string {
+	sd, msg := s.format(r)
+	return fmt.Sprintf("<%d>1 %s %s %s - %s %s %s",
+		facility*8+severity(r.Action),
+		r.CreatedAt.UTC().Format(time.RFC3339Nano),
+		s.host,
+		appName,
+		msgID(r.Action),
+		sd,
+		msg,
+	)
+}
+
+// rfc5424 carries the entry's fields as structured data named
+// audit@<enterpriseID> and the whole entry as JSON in the message.
+func rfc5424(enterpriseID int) formatter {
+	return func(r audit.Record) (string, string) {
+		if enterpriseID == 0 {
+			return "-", string(encode(r))
+		}
+		return structuredData(enterpriseID, r), string(encode(r))
+	}
+}
+
+func structuredData(enterpriseID int, r audit.Record) string {
+	params := []string{
+		param("seq", fmt.Sprint(r.Seq)),
+		param("id", r.ID.String()),
+		param("action", r.Action),
+		param("resource", r.Resource),
+	}
+	if r.ResourceID != nil {
+		params = append(params, param("resource_id", r.ResourceID.String()))
+	}
+	if r.UserID != nil {
+		params = append(params, param("user_id", r.UserID.String()))
+	}
+	if r.Username != "" {
+		params = append(params, param("username", r.Username))
+	}
+	if r.IPAddress != "" {
+		params = append(params, param("ip", r.IPAddress))
+	}
+
+	return fmt.Sprintf("[audit@%d %s]", enterpriseID, strings.Join(params, " "))
+}
+
+func param(name, value string) string {
+	return name + `="` + sdEscape.Replace(value) + `"`
+}
+
+var sdEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// msgID is the action, cut to the 32 printable ASCII characters RFC 5424
+// allows.
+func msgID(action string) string {
+	id := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, action)
+	if id == "" {
+		return "-"
+	}
+	if len(id) > 32 {
+		id = id[:32]
+	}
+	return id
+}
+
+// warningActions are the failures and denials sent as warnings; every
+// other action is informational.
+var warningActions = map[string]bool{
+	"auth.login.failed":            true,
+	"auth.lockout":                 true,
+	"auth.refresh.reuse_detected":  true,
+	"access.request.deny":          true,
+	"database.credentials.failed":  true,
+	"database.lease.expire.failed": true,
+	"secrets.rotate.failed":        true,
+}
+
+func severity(action string) int {
+	if warningActions[action] {
+		return severityWarning
+	}
+	return severityInfo
+}
@@ -0,0 +1,131 @@
+package siem
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"idam-pam-platform/internal/audit"
+)
+
+// Webhook POSTs batches of entries as JSON. Each request is signed with
+// HMAC-SHA256 over "<timestamp>.<body>" so receivers can check it came
+// from us and reject replays:
+//
+//	X-Audit-Timestamp: 1700000000
+//	X-Audit-Signature: sha256=<hex>
+type Webhook struct {
+	name   string
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhook requires an https URL, except on loopback where a local
+// forwarder may terminate TLS.
+func NewWebhook(name, rawURL, secret string) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s URL: %w", name, err)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && IsLoopback(u.Hostname())) {
+		return nil, fmt.Errorf("%s URL must use https", name)
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("%s requires a signing secret", name)
+	}
+
+	return &Webhook{
+		name:   name,
+		url:    rawURL,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: sendTimeout},
+	}, nil
+}
+
+func (w *Webhook) Name() string {
+	return w.name
+}
+
+// Send succeeds only on a 2xx response. Other client errors mean the body
+// was refused and are returned as *audit.RejectedError, except those that
+// point at the receiver's setup or load rather than the entries.
+func (w *Webhook) Send(records []audit.Record) error {
+	body, err := json.Marshal(map[string]interface{}{"events": records})
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", appName+"-audit")
+	req.Header.Set("X-Audit-Timestamp", timestamp)
+	req.Header.Set("X-Audit-Signature", Sign(w.secret, timestamp, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("%s responded %s", w.name, resp.Status)
+		if rejects(resp.StatusCode) {
+			return &audit.RejectedError{Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+func rejects(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 400 && status <= 499
+}
+
+func (w *Webhook) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// Sign returns the signature header value for a webhook body sent at
+// timestamp: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsLoopback reports whether host is this machine, where plain http is
+// allowed for a local forwarder.
+func IsLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func encode(r audit.Record) []byte {
+	encoded, _ := json.Marshal(r)
+	return encoded
+}
@@ -0,0 +1,539 @@
+// Package sshca signs short-lived SSH user certificates. The CA key lives in
+// the ssh_ca_keys table with its private half encrypted; principals, TTL and
+// extensions come from SSH policies attached to the roles a user holds.
+package sshca
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/encryption"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrNoPolicy is returned when none of the user's roles has an SSH policy.
+	ErrNoPolicy = errors.New("no SSH policy applies to your roles")
+	// ErrPrincipalNotAllowed is returned when a requested principal is not
+	// in the user's profile.
+	ErrPrincipalNotAllowed = errors.New("principal not allowed")
+	// ErrTTLTooLong is returned when a certificate would outlive the
+	// profile's max TTL.
+	ErrTTLTooLong = errors.New("ttl exceeds the maximum allowed by your roles")
+	// ErrInvalidKey is returned when the key to sign is malformed or refused.
+	ErrInvalidKey = errors.New("invalid public_key")
+)
+
+// clockSkew backdates valid_after so hosts with a slightly slow clock still
+// accept a fresh certificate.
+const clockSkew = time.Minute
+
+// Extensions are the standard OpenSSH certificate extensions a policy may
+// grant.
+var Extensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// reservedPrincipals are system and shared accounts a {{username}}
+// principal may never turn into, so that whoever can pick a username
+// cannot pick a login on every host. A policy that means to grant one of
+// them has to name it outright.
+var reservedPrincipals = map[string]bool{
+	"root":          true,
+	"admin":         true,
+	"administrator": true,
+	"toor":          true,
+	"daemon":        true,
+	"bin":           true,
+	"sys":           true,
+	"sync":          true,
+	"nobody":        true,
+	"ubuntu":        true,
+	"ec2-user":      true,
+	"centos":        true,
+	"debian":        true,
+	"fedora":        true,
+	"azureuser":     true,
+	"opc":           true,
+	"core":          true,
+	"git":           true,
+	"postgres":      true,
+	"www-data":      true,
+}
+
+// CA signs user certificates with the active CA key.
+type CA struct {
+	db            *sql.DB
+	encryptionSvc *encryption.Service
+	maxTTL        time.Duration
+}
+
+// NewCA loads the CA, generating its first key if there is none. maxTTL caps
+// every certificate, and is how long a retired key stays trusted.
+func NewCA(db *sql.DB, encryptionSvc *encryption.Service, maxTTL time.Duration) (*CA, error) {
+	ca := &CA{
+		db:            db,
+		encryptionSvc: encryptionSvc,
+		maxTTL:        maxTTL,
+	}
+
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM ssh_ca_keys WHERE retired_at IS NULL)`).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to load SSH CA keys: %v", err)
+	}
+	if !exists {
+		if _, err := ca.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return ca, nil
+}
+
+// CAKey is the public half of a CA key.
+type CAKey struct {
+	ID          uuid.UUID  `json:"id"`
+	Algorithm   string     `json:"algorithm"`
+	PublicKey   string     `json:"public_key"`
+	Fingerprint string     `json:"fingerprint"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// TrustedKeys returns the CA keys hosts should trust, active key first.
+// Retired keys stay listed until certificates they signed have expired.
+func (ca *CA) TrustedKeys() ([]CAKey, error) {
+	rows, err := ca.db.Query(`
+		SELECT id, algorithm, public_key, created_at, retired_at, expires_at
+		FROM ssh_ca_keys
+		WHERE expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP
+		ORDER BY retired_at IS NOT NULL, created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []CAKey{}
+	for rows.Next() {
+		var k CAKey
+		if err := rows.Scan(&k.ID, &k.Algorithm, &k.PublicKey, &k.CreatedAt, &k.RetiredAt, &k.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.PublicKey)); err == nil {
+			k.Fingerprint = ssh.FingerprintSHA256(pub)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// Rotate generates a new CA key. The previous key stops signing straight
+// away but stays trusted for maxTTL, so certificates it issued keep working.
+func (ca *CA) Rotate() (*CAKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	encryptedPrivate, err := ca.encryptionSvc.Encrypt(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt SSH CA key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	tx, err := ca.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialize rotations across instances
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('ssh_ca_keys'))`); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE ssh_ca_keys
+		SET retired_at = CURRENT_TIMESTAMP,
+		    expires_at = CURRENT_TIMESTAMP + make_interval(secs => $1)
+		WHERE retired_at IS NULL`,
+		ca.maxTTL.Seconds(),
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM ssh_ca_keys WHERE expires_at <= CURRENT_TIMESTAMP`); err != nil {
+		return nil, err
+	}
+
+	var key CAKey
+	if err := tx.QueryRow(`
+		INSERT INTO ssh_ca_keys (algorithm, private_key, public_key)
+		VALUES ($1, $2, $3)
+		RETURNING id, algorithm, public_key, created_at`,
+		signer.PublicKey().Type(), encryptedPrivate, publicKey,
+	).Scan(&key.ID, &key.Algorithm, &key.PublicKey, &key.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	key.Fingerprint = ssh.FingerprintSHA256(signer.PublicKey())
+	return &key, nil
+}
+
+// activeSigner loads and decrypts the key that signs new certificates.
+func (ca *CA) activeSigner() (uuid.UUID, ssh.Signer, error) {
+	var (
+		id               uuid.UUID
+		encryptedPrivate string
+	)
+	err := ca.db.QueryRow(`
+		SELECT id, private_key FROM ssh_ca_keys
+		WHERE retired_at IS NULL
+		ORDER BY created_at DESC LIMIT 1`,
+	).Scan(&id, &encryptedPrivate)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, nil, errors.New("no active SSH CA key")
+	}
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+
+	privatePEM, err := ca.encryptionSvc.Decrypt(encryptedPrivate)
+	if err != nil {
+		return uuid.Nil, nil, fmt.Errorf("decrypt SSH CA key: %v", err)
+	}
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return uuid.Nil, nil, errors.New("invalid SSH CA key PEM")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	cryptoSigner, ok := private.(crypto.Signer)
+	if !ok {
+		return uuid.Nil, nil, errors.New("SSH CA key cannot sign")
+	}
+	signer, err := ssh.NewSignerFromSigner(cryptoSigner)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	return id, signer, nil
+}
+
+// Profile is what a user may be issued, merged from the SSH policies of
+// every role they currently hold.
+type Profile struct {
+	Principals    []string      `json:"principals"`
+	Extensions    []string      `json:"extensions"`
+	MaxTTL        time.Duration `json:"-"`
+	MaxTTLSeconds int           `json:"max_ttl_seconds"`
+}
+
+// Profile merges the user's role policies: the union of their principals
+// and extensions, and the longest of their TTLs, capped by the CA's limit.
+// {{username}} in a principal becomes the user's username; a principal
+// that would come out reserved or malformed is left out.
+func (ca *CA) Profile(userID uuid.UUID, username string) (*Profile, error) {
+	rows, err := ca.db.Query(`
+		SELECT p.principals, p.extensions, p.max_ttl_seconds
+		FROM ssh_role_policies p
+		JOIN user_roles ur ON ur.role_id = p.role_id
+		WHERE ur.user_id = $1
+		  AND (ur.expires_at IS NULL OR ur.expires_at > CURRENT_TIMESTAMP)`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		profile    Profile
+		found      bool
+		principals = map[string]bool{}
+		extensions = map[string]bool{}
+	)
+	for rows.Next() {
+		var (
+			rolePrincipals, roleExtensions []string
+			maxSeconds                     int
+		)
+		if err := rows.Scan(pq.Array(&rolePrincipals), pq.Array(&roleExtensions), &maxSeconds); err != nil {
+			return nil, err
+		}
+		found = true
+		for _, p := range rolePrincipals {
+			p, ok := expandPrincipal(p, username)
+			if !ok {
+				continue
+			}
+			if !principals[p] {
+				principals[p] = true
+				profile.Principals = append(profile.Principals, p)
+			}
+		}
+		for _, e := range roleExtensions {
+			if !extensions[e] {
+				extensions[e] = true
+				profile.Extensions = append(profile.Extensions, e)
+			}
+		}
+		if ttl := time.Duration(maxSeconds) * time.Second; ttl > profile.MaxTTL {
+			profile.MaxTTL = ttl
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !found || len(profile.Principals) == 0 {
+		return nil, ErrNoPolicy
+	}
+
+	if profile.MaxTTL > ca.maxTTL {
+		profile.MaxTTL = ca.maxTTL
+	}
+	if profile.Extensions == nil {
+		profile.Extensions = []string{}
+	}
+	profile.MaxTTLSeconds = int(profile.MaxTTL.Seconds())
+	return &profile, nil
+}
+
+// Certificate is an entry of the issued certificate inventory.
+type Certificate struct {
+	Serial      uint64    `json:"serial,string"`
+	UserID      uuid.UUID `json:"user_id"`
+	Username    string    `json:"username"`
+	KeyID       string    `json:"key_id"`
+	Principals  []string  `json:"principals"`
+	Fingerprint string    `json:"public_key_fingerprint"`
+	CAKeyID     uuid.UUID `json:"ca_key_id"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// SignedCertificate is a certificate together with its OpenSSH encoding,
+// ready to save as id_<type>-cert.pub.
+type SignedCertificate struct {
+	Certificate
+	SignedKey string `json:"certificate"`
+}
+
+// Sign issues a certificate for publicKey, given in authorized_keys format.
+// An empty principals list means every principal in the user's profile; a
+// zero ttl means the profile's max TTL.
+func (ca *CA) Sign(userID uuid.UUID, username, publicKey string, principals []string, ttl time.Duration) (*SignedCertificate, error) {
+	pub, err := parseUserKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := ca.Profile(userID, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(principals) == 0 {
+		principals = profile.Principals
+	}
+	for _, p := range principals {
+		if !contains(profile.Principals, p) {
+			return nil, fmt.Errorf("%w: %s", ErrPrincipalNotAllowed, p)
+		}
+	}
+	if ttl == 0 {
+		ttl = profile.MaxTTL
+	}
+	if ttl > profile.MaxTTL {
+		return nil, ErrTTLTooLong
+	}
+
+	caKeyID, signer, err := ca.activeSigner()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	permissions := ssh.Permissions{Extensions: map[string]string{}}
+	for _, e := range profile.Extensions {
+		permissions.Extensions[e] = ""
+	}
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           username,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-clockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(ttl).Unix()),
+		Permissions:     permissions,
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return nil, err
+	}
+
+	signed := &SignedCertificate{
+		Certificate: Certificate{
+			Serial:      serial,
+			UserID:      userID,
+			Username:    username,
+			KeyID:       cert.KeyId,
+			Principals:  principals,
+			Fingerprint: ssh.FingerprintSHA256(pub),
+			CAKeyID:     caKeyID,
+			ValidAfter:  time.Unix(int64(cert.ValidAfter), 0).UTC(),
+			ValidBefore: time.Unix(int64(cert.ValidBefore), 0).UTC(),
+		},
+		SignedKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))),
+	}
+
+	if err := ca.db.QueryRow(`
+		INSERT INTO ssh_certificates (serial, user_id, key_id, principals, public_key_fingerprint,
+		                              ca_key_id, valid_after, valid_before)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING created_at`,
+		int64(serial), userID, cert.KeyId, pq.Array(principals), signed.Fingerprint,
+		caKeyID, signed.ValidAfter, signed.ValidBefore,
+	).Scan(&signed.CreatedAt); err != nil {
+		return nil, err
+	}
+	return signed, nil
+}
+
+// Certificates lists issued certificates, newest first. A nil userID lists
+// everyone's.
+func (ca *CA) Certificates(userID *uuid.UUID) ([]Certificate, error) {
+	rows, err := ca.db.Query(`
+		SELECT c.serial, c.user_id, u.username, c.key_id, c.principals, c.public_key_fingerprint,
+		       c.ca_key_id, c.valid_after, c.valid_before, c.created_at
+		FROM ssh_certificates c
+		JOIN users u ON u.id = c.user_id
+		WHERE $1::uuid IS NULL OR c.user_id = $1
+		ORDER BY c.created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	certs := []Certificate{}
+	for rows.Next() {
+		var (
+			c      Certificate
+			serial int64
+		)
+		if err := rows.Scan(&serial, &c.UserID, &c.Username, &c.KeyID, pq.Array(&c.Principals),
+			&c.Fingerprint, &c.CAKeyID, &c.ValidAfter, &c.ValidBefore, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		c.Serial = uint64(serial)
+		certs = append(certs, c)
+	}
+	return certs, rows.Err()
+}
+
+// expandPrincipal substitutes username into a policy principal. It reports
+// false when a templated principal names a reserved account or is not a
+// valid principal.
+func expandPrincipal(principal, username string) (string, bool) {
+	if !strings.Contains(principal, "{{username}}") {
+		return principal, true
+	}
+	p := strings.ReplaceAll(principal, "{{username}}", username)
+	if username == "" || strings.ContainsAny(p, " \t\r\n,") {
+		return "", false
+	}
+	return p, !reservedPrincipals[strings.ToLower(p)]
+}
+
+// ValidatePolicy checks a role policy's principals and extensions before
+// it is saved.
+func ValidatePolicy(principals, extensions []string) error {
+	if len(principals) == 0 {
+		return errors.New("principals must name at least one principal")
+	}
+	for _, p := range principals {
+		if p == "" || strings.ContainsAny(p, " \t\r\n,") {
+			return fmt.Errorf("invalid principal %q", p)
+		}
+	}
+	for _, e := range extensions {
+		if !contains(Extensions, e) {
+			return fmt.Errorf("unknown extension %q", e)
+		}
+	}
+	return nil
+}
+
+// parseUserKey accepts a plain public key in authorized_keys format.
+// Certificates and keys too weak to trust are refused.
+func parseUserKey(publicKey string) (ssh.PublicKey, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return nil, fmt.Errorf("%w: not an OpenSSH public key", ErrInvalidKey)
+	}
+	if _, ok := pub.(*ssh.Certificate); ok {
+		return nil, fmt.Errorf("%w: certificates cannot be signed", ErrInvalidKey)
+	}
+	switch pub.Type() {
+	case ssh.KeyAlgoDSA:
+		return nil, fmt.Errorf("%w: DSA keys are not accepted", ErrInvalidKey)
+	case ssh.KeyAlgoRSA:
+		if cryptoPub, ok := pub.(ssh.CryptoPublicKey); ok {
+			if rsaPub, ok := cryptoPub.CryptoPublicKey().(interface{ Size() int }); ok && rsaPub.Size()*8 < 2048 {
+				return nil, fmt.Errorf("%w: RSA keys must be at least 2048 bits", ErrInvalidKey)
+			}
+		}
+	}
+	return pub, nil
+}
+
+// randomSerial returns a random serial that also fits a signed BIGINT.
+func randomSerial() (uint64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return 0, err
+	}
+	return n.Uint64() + 1, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
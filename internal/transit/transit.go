@@ -0,0 +1,622 @@
+// Package transit performs cryptographic operations with named,
+// platform-held keys so applications can encrypt, sign and MAC data without
+// storing it in the vault or ever seeing key material. Every key has
+// numbered versions; new data uses the latest and older versions keep
+// decrypting and verifying until min_decryption_version moves past them.
+package transit
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"idam-pam-platform/internal/encryption"
+	"idam-pam-platform/internal/rbac"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	TypeAES256GCM = "aes256-gcm"
+	TypeEd25519   = "ed25519"
+	TypeECDSAP256 = "ecdsa-p256"
+
+	// prefix starts every ciphertext, signature and HMAC so the key version
+	// travels with the value: transit:v3:<base64>.
+	prefix = "transit:v"
+)
+
+var (
+	// ErrNotFound is returned when a transit key does not exist.
+	ErrNotFound = errors.New("transit key not found")
+	// ErrNotAllowed is returned when the user holds none of the key's
+	// allowed roles.
+	ErrNotAllowed = errors.New("not allowed to use this transit key")
+	// ErrUnsupported is returned when the key's type cannot perform the
+	// operation, such as signing with an AES key.
+	ErrUnsupported = errors.New("operation not supported by this key type")
+	// ErrInvalidInput is returned for malformed ciphertext, signatures or
+	// parameters.
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrVersionRetired is returned when a value was produced by a version
+	// below the key's min_decryption_version.
+	ErrVersionRetired = errors.New("key version is below min_decryption_version")
+)
+
+var keyNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,99}$`)
+
+// Key describes a transit key. Key material is never part of it.
+type Key struct {
+	ID                   uuid.UUID  `json:"id"`
+	Name                 string     `json:"name"`
+	Type                 string     `json:"type"`
+	LatestVersion        int        `json:"latest_version"`
+	MinDecryptionVersion int        `json:"min_decryption_version"`
+	AllowedRoleIDs       []string   `json:"allowed_role_ids"`
+	CreatedBy            *uuid.UUID `json:"created_by"`
+	CreatedAt            time.Time  `json:"created_at"`
+	RotatedAt            *time.Time `json:"rotated_at,omitempty"`
+	// PublicKeys maps versions of signing keys to their PEM public keys,
+	// so verifiers outside the platform can check signatures.
+	PublicKeys map[string]string `json:"public_keys,omitempty"`
+}
+
+// Engine runs transit operations. Key material is stored encrypted by the
+// encryption service and only decrypted for the duration of a call.
+type Engine struct {
+	db            *sql.DB
+	encryptionSvc *encryption.Service
+	resolver      *rbac.Resolver
+}
+
+func NewEngine(db *sql.DB, encryptionSvc *encryption.Service, resolver *rbac.Resolver) *Engine {
+	return &Engine{
+		db:            db,
+		encryptionSvc: encryptionSvc,
+		resolver:      resolver,
+	}
+}
+
+// ValidateKey checks a new key's name and type.
+func ValidateKey(name, keyType string) error {
+	if !keyNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: name must be 1-100 letters, digits, '.', '_' or '-'", ErrInvalidInput)
+	}
+	switch keyType {
+	case TypeAES256GCM, TypeEd25519, TypeECDSAP256:
+		return nil
+	}
+	return fmt.Errorf("%w: type must be %s, %s or %s", ErrInvalidInput, TypeAES256GCM, TypeEd25519, TypeECDSAP256)
+}
+
+const keySelect = `
+	SELECT id, name, type, latest_version, min_decryption_version, allowed_role_ids,
+	       created_by, created_at, rotated_at
+	FROM transit_keys`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(row rowScanner) (*Key, error) {
+	var k Key
+	if err := row.Scan(&k.ID, &k.Name, &k.Type, &k.LatestVersion, &k.MinDecryptionVersion,
+		pq.Array(&k.AllowedRoleIDs), &k.CreatedBy, &k.CreatedAt, &k.RotatedAt); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// Create generates version 1 of a new key.
+func (e *Engine) Create(name, keyType string, allowedRoleIDs []string, createdBy uuid.UUID) (*Key, error) {
+	if err := ValidateKey(name, keyType); err != nil {
+		return nil, err
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var keyID uuid.UUID
+	if err := tx.QueryRow(`
+		INSERT INTO transit_keys (name, type, allowed_role_ids, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`,
+		name, keyType, pq.Array(allowedRoleIDs), createdBy,
+	).Scan(&keyID); err != nil {
+		return nil, err
+	}
+	if err := e.addVersion(tx, keyID, keyType, 1); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return e.Key(name)
+}
+
+// Rotate adds a new latest version. Existing values stay readable.
+func (e *Engine) Rotate(name string) (*Key, error) {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		keyID   uuid.UUID
+		keyType string
+		version int
+	)
+	err = tx.QueryRow(`
+		UPDATE transit_keys
+		SET latest_version = latest_version + 1, rotated_at = CURRENT_TIMESTAMP
+		WHERE name = $1
+		RETURNING id, type, latest_version`,
+		name,
+	).Scan(&keyID, &keyType, &version)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := e.addVersion(tx, keyID, keyType, version); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return e.Key(name)
+}
+
+// SetMinDecryptionVersion stops versions below min from decrypting and
+// verifying, so values still under them must be rewrapped first.
+func (e *Engine) SetMinDecryptionVersion(name string, min int) (*Key, error) {
+	result, err := e.db.Exec(`
+		UPDATE transit_keys SET min_decryption_version = $2
+		WHERE name = $1 AND $2 BETWEEN 1 AND latest_version`,
+		name, min,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		if _, err := e.Key(name); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: min_decryption_version must be between 1 and the latest version", ErrInvalidInput)
+	}
+	return e.Key(name)
+}
+
+// SetAllowedRoles replaces the roles whose members may use the key.
+func (e *Engine) SetAllowedRoles(name string, allowedRoleIDs []string) (*Key, error) {
+	result, err := e.db.Exec(`UPDATE transit_keys SET allowed_role_ids = $2 WHERE name = $1`,
+		name, pq.Array(allowedRoleIDs))
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, ErrNotFound
+	}
+	return e.Key(name)
+}
+
+// Delete removes a key and every version of it. Anything still encrypted
+// under it becomes unreadable.
+func (e *Engine) Delete(name string) error {
+	result, err := e.db.Exec(`DELETE FROM transit_keys WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Key returns a key by name, with public keys for signing types.
+func (e *Engine) Key(name string) (*Key, error) {
+	key, err := scanKey(e.db.QueryRow(keySelect+` WHERE name = $1`, name))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if key.Type != TypeAES256GCM {
+		rows, err := e.db.Query(`
+			SELECT version, public_key FROM transit_key_versions
+			WHERE key_id = $1 AND version >= $2
+			ORDER BY version`,
+			key.ID, key.MinDecryptionVersion,
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		key.PublicKeys = map[string]string{}
+		for rows.Next() {
+			var (
+				version   int
+				publicKey sql.NullString
+			)
+			if err := rows.Scan(&version, &publicKey); err != nil {
+				return nil, err
+			}
+			key.PublicKeys[strconv.Itoa(version)] = publicKey.String
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// Keys lists every key, by name.
+func (e *Engine) Keys() ([]Key, error) {
+	rows, err := e.db.Query(keySelect + ` ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []Key{}
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// Authorize loads a key for userID, who must hold one of its allowed roles.
+func (e *Engine) Authorize(name string, userID uuid.UUID) (*Key, error) {
+	key, err := scanKey(e.db.QueryRow(keySelect+` WHERE name = $1`, name))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := e.resolver.HoldsAnyRole(userID.String(), key.AllowedRoleIDs)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, ErrNotAllowed
+	}
+	return key, nil
+}
+
+// Encrypt encrypts plaintext under the key's latest version.
+func (e *Engine) Encrypt(key *Key, plaintext []byte) (string, error) {
+	if key.Type != TypeAES256GCM {
+		return "", ErrUnsupported
+	}
+	material, _, err := e.material(key, key.LatestVersion)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(material)
+
+	sealed, err := encryption.Seal(material, plaintext)
+	if err != nil {
+		return "", err
+	}
+	return encode(key.LatestVersion, sealed), nil
+}
+
+// Decrypt reverses Encrypt with whichever version produced ciphertext.
+func (e *Engine) Decrypt(key *Key, ciphertext string) ([]byte, error) {
+	if key.Type != TypeAES256GCM {
+		return nil, ErrUnsupported
+	}
+	version, data, err := e.decode(key, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	material, _, err := e.material(key, version)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(material)
+
+	plaintext, err := encryption.Open(material, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: ciphertext does not decrypt", ErrInvalidInput)
+	}
+	return plaintext, nil
+}
+
+// Rewrap moves ciphertext onto the latest version without the plaintext
+// leaving the server.
+func (e *Engine) Rewrap(key *Key, ciphertext string) (string, error) {
+	plaintext, err := e.Decrypt(key, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(plaintext)
+	return e.Encrypt(key, plaintext)
+}
+
+// Sign signs input with the latest version of a signing key. ECDSA keys
+// sign its SHA-256 digest; Ed25519 signs input itself.
+func (e *Engine) Sign(key *Key, input []byte) (string, error) {
+	if key.Type == TypeAES256GCM {
+		return "", ErrUnsupported
+	}
+	material, _, err := e.material(key, key.LatestVersion)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(material)
+
+	private, err := x509.ParsePKCS8PrivateKey(material)
+	if err != nil {
+		return "", err
+	}
+	var signature []byte
+	switch k := private.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, input)
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(input)
+		if signature, err = ecdsa.SignASN1(rand.Reader, k, digest[:]); err != nil {
+			return "", err
+		}
+	default:
+		return "", ErrUnsupported
+	}
+	return encode(key.LatestVersion, signature), nil
+}
+
+// Verify checks a signature made by Sign.
+func (e *Engine) Verify(key *Key, input []byte, signature string) (bool, error) {
+	if key.Type == TypeAES256GCM {
+		return false, ErrUnsupported
+	}
+	version, sig, err := e.decode(key, signature)
+	if err != nil {
+		return false, err
+	}
+
+	var publicPEM string
+	err = e.db.QueryRow(`SELECT public_key FROM transit_key_versions WHERE key_id = $1 AND version = $2`,
+		key.ID, version).Scan(&publicPEM)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("%w: unknown key version", ErrInvalidInput)
+	}
+	if err != nil {
+		return false, err
+	}
+	public, err := parsePublicKey(publicPEM)
+	if err != nil {
+		return false, err
+	}
+
+	switch k := public.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, input, sig), nil
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(input)
+		return ecdsa.VerifyASN1(k, digest[:], sig), nil
+	}
+	return false, ErrUnsupported
+}
+
+// HMAC computes an HMAC of input with the latest version's HMAC key, which
+// every key type has. algorithm is sha256 (the default) or sha512.
+func (e *Engine) HMAC(key *Key, input []byte, algorithm string) (string, error) {
+	newHash, err := hmacHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	_, hmacKey, err := e.material(key, key.LatestVersion)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(hmacKey)
+
+	mac := hmac.New(newHash, hmacKey)
+	mac.Write(input)
+	return encode(key.LatestVersion, mac.Sum(nil)), nil
+}
+
+// VerifyHMAC checks an HMAC made by HMAC in constant time.
+func (e *Engine) VerifyHMAC(key *Key, input []byte, algorithm, expected string) (bool, error) {
+	newHash, err := hmacHash(algorithm)
+	if err != nil {
+		return false, err
+	}
+	version, sum, err := e.decode(key, expected)
+	if err != nil {
+		return false, err
+	}
+	_, hmacKey, err := e.material(key, version)
+	if err != nil {
+		return false, err
+	}
+	defer wipe(hmacKey)
+
+	mac := hmac.New(newHash, hmacKey)
+	mac.Write(input)
+	return hmac.Equal(mac.Sum(nil), sum), nil
+}
+
+// addVersion generates and stores key material for version.
+func (e *Engine) addVersion(tx *sql.Tx, keyID uuid.UUID, keyType string, version int) error {
+	var (
+		material  []byte
+		publicPEM *string
+		err       error
+	)
+	switch keyType {
+	case TypeAES256GCM:
+		material = make([]byte, 32)
+		_, err = io.ReadFull(rand.Reader, material)
+	case TypeEd25519:
+		var private ed25519.PrivateKey
+		if _, private, err = ed25519.GenerateKey(rand.Reader); err == nil {
+			material, publicPEM, err = marshalSigner(private)
+		}
+	case TypeECDSAP256:
+		var private *ecdsa.PrivateKey
+		if private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err == nil {
+			material, publicPEM, err = marshalSigner(private)
+		}
+	default:
+		err = ErrUnsupported
+	}
+	if err != nil {
+		return err
+	}
+	defer wipe(material)
+
+	hmacKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, hmacKey); err != nil {
+		return err
+	}
+	defer wipe(hmacKey)
+
+	encryptedMaterial, err := e.encryptionSvc.Encrypt(base64.StdEncoding.EncodeToString(material))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt transit key: %v", err)
+	}
+	encryptedHMAC, err := e.encryptionSvc.Encrypt(base64.StdEncoding.EncodeToString(hmacKey))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt transit key: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO transit_key_versions (key_id, version, key_material, hmac_key, public_key)
+		VALUES ($1, $2, $3, $4, $5)`,
+		keyID, version, encryptedMaterial, encryptedHMAC, publicPEM,
+	)
+	return err
+}
+
+// material decrypts a version's key material and HMAC key.
+func (e *Engine) material(key *Key, version int) ([]byte, []byte, error) {
+	var encryptedMaterial, encryptedHMAC string
+	err := e.db.QueryRow(`
+		SELECT key_material, hmac_key FROM transit_key_versions
+		WHERE key_id = $1 AND version = $2`,
+		key.ID, version,
+	).Scan(&encryptedMaterial, &encryptedHMAC)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("%w: unknown key version", ErrInvalidInput)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decode := func(encrypted string) ([]byte, error) {
+		encoded, err := e.encryptionSvc.Decrypt(encrypted)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt transit key: %v", err)
+		}
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+	material, err := decode(encryptedMaterial)
+	if err != nil {
+		return nil, nil, err
+	}
+	hmacKey, err := decode(encryptedHMAC)
+	if err != nil {
+		return nil, nil, err
+	}
+	return material, hmacKey, nil
+}
+
+func encode(version int, data []byte) string {
+	return prefix + strconv.Itoa(version) + ":" + base64.StdEncoding.EncodeToString(data)
+}
+
+// decode splits a transit:v<n>:<base64> value and checks that the key may
+// still use version n.
+func (e *Engine) decode(key *Key, value string) (int, []byte, error) {
+	rest, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: value must start with %q", ErrInvalidInput, prefix)
+	}
+	versionText, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: malformed value", ErrInvalidInput)
+	}
+	version, err := strconv.Atoi(versionText)
+	if err != nil || version < 1 || version > key.LatestVersion {
+		return 0, nil, fmt.Errorf("%w: unknown key version", ErrInvalidInput)
+	}
+	if version < key.MinDecryptionVersion {
+		return 0, nil, ErrVersionRetired
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: value is not valid base64", ErrInvalidInput)
+	}
+	return version, data, nil
+}
+
+func marshalSigner(private crypto.Signer) ([]byte, *string, error) {
+	material, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+	return material, &publicPEM, nil
+}
+
+func parsePublicKey(publicPEM string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicPEM))
+	if block == nil {
+		return nil, errors.New("invalid public key PEM")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func hmacHash(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case "", "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("%w: algorithm must be sha256 or sha512", ErrInvalidInput)
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,123 @@
+package vault
+
+import (
+	"database/sql"
+
+	"github.com/google/uuid"
+)
+
+// Access is a caller's level on a secret. Each level includes the ones
+// below it.
+type Access int
+
+const (
+	AccessNone Access = iota
+	AccessRead
+	AccessWrite
+	AccessManage
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessRead:
+		return "read"
+	case AccessWrite:
+		return "write"
+	case AccessManage:
+		return "manage"
+	default:
+		return "none"
+	}
+}
+
+// ParseAccess parses an ACL entry's access level.
+func ParseAccess(s string) (Access, bool) {
+	switch s {
+	case "read":
+		return AccessRead, true
+	case "write":
+		return AccessWrite, true
+	case "manage":
+		return AccessManage, true
+	default:
+		return AccessNone, false
+	}
+}
+
+// principalMatchSQL matches ACL rows aliased a that name the user bound to
+// $1, directly or through a currently held role.
+const principalMatchSQL = `((a.principal_type = 'user' AND a.principal_id = $1)
+		OR (a.principal_type = 'role' AND a.principal_id IN (
+		    SELECT ur.role_id FROM user_roles ur
+		    WHERE ur.user_id = $1
+		      AND (ur.expires_at IS NULL OR ur.expires_at > CURRENT_TIMESTAMP))))`
+
+const accessLevelCase = `MAX(CASE a.access WHEN 'read' THEN 1 WHEN 'write' THEN 2 WHEN 'manage' THEN 3 END)`
+
+// AccessLevelSQL evaluates to the caller's Access on the secret aliased s,
+// with the caller's user ID bound to $1. The creator always has manage;
+// everyone else gets the highest level granted on the secret itself or on
+// any folder above it.
+const AccessLevelSQL = `(CASE WHEN s.created_by = $1 THEN 3 ELSE COALESCE((
+		SELECT ` + accessLevelCase + `
+		FROM (
+			SELECT principal_type, principal_id, access FROM secret_acls
+			WHERE secret_id = s.id
+			UNION ALL
+			SELECT principal_type, principal_id, access FROM folder_acls
+			WHERE s.folder = path OR left(s.folder, length(path) + 1) = path || '/'
+		) a
+		WHERE ` + principalMatchSQL + `
+	), 0) END)`
+
+// AccessFor returns the user's access to a secret along with its path.
+// A missing secret reports AccessNone and ErrNotFound.
+func (s *Store) AccessFor(secretID, userID uuid.UUID) (Access, string, error) {
+	var (
+		level int
+		path  string
+	)
+	err := s.db.QueryRow(`
+		SELECT `+AccessLevelSQL+`, `+PathSQL+`
+		FROM secrets s WHERE s.id = $2`,
+		userID, secretID,
+	).Scan(&level, &path)
+	if err == sql.ErrNoRows {
+		return AccessNone, "", ErrNotFound
+	}
+	if err != nil {
+		return AccessNone, "", err
+	}
+	return Access(level), path, nil
+}
+
+// FolderAccessFor returns the user's access inherited on a folder, and
+// whether any ACL covers the folder at all. Unclaimed folders are open for
+// anyone to create secrets in.
+func (s *Store) FolderAccessFor(folder string, userID uuid.UUID) (Access, bool, error) {
+	if folder == "" {
+		return AccessNone, false, nil
+	}
+
+	var (
+		level   int
+		claimed bool
+	)
+	err := s.db.QueryRow(`
+		SELECT
+			COALESCE((
+				SELECT `+accessLevelCase+` FROM folder_acls a
+				WHERE ($2 = a.path OR left($2, length(a.path) + 1) = a.path || '/')
+				  AND `+principalMatchSQL+`
+			), 0),
+			EXISTS (
+				SELECT 1 FROM folder_acls
+				WHERE $2 = path OR left($2, length(path) + 1) = path || '/'
+			)`,
+		userID, folder,
+	).Scan(&level, &claimed)
+	if err != nil {
+		return AccessNone, false, err
+	}
+	return Access(level), claimed, nil
+}
@@ -0,0 +1,385 @@
+package vault
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrCheckedOut is returned when another user holds the secret.
+	ErrCheckedOut = errors.New("secret is checked out by another user")
+	// ErrNotCheckedOut is returned when checking in a secret nobody holds.
+	ErrNotCheckedOut = errors.New("secret is not checked out")
+	// ErrCheckoutNotRequired is returned for secrets without exclusive access.
+	ErrCheckoutNotRequired = errors.New("secret does not require check-out")
+)
+
+type Checkout struct {
+	ID           uuid.UUID  `json:"id"`
+	SecretID     uuid.UUID  `json:"secret_id"`
+	UserID       uuid.UUID  `json:"user_id"`
+	Username     string     `json:"username"`
+	CheckedOutAt time.Time  `json:"checked_out_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	CheckedInAt  *time.Time `json:"checked_in_at,omitempty"`
+	Reason       *string    `json:"checkin_reason,omitempty"`
+}
+
+type QueueEntry struct {
+	UserID          uuid.UUID `json:"user_id"`
+	Username        string    `json:"username"`
+	DurationSeconds int       `json:"duration_seconds"`
+	RequestedAt     time.Time `json:"requested_at"`
+	Position        int       `json:"position"`
+}
+
+// CheckinResult describes what a check-in did: the closed checkout, the
+// version the value was rotated to, the next holder if one was queued,
+// and the queued users skipped because they lost access or were
+// deactivated while they waited. If the rotator failed, Version is 0 and
+// RotationError says why; the check-in still completes and the rotation
+// is retried by the scheduler.
+type CheckinResult struct {
+	Checkout      *Checkout
+	Version       int
+	RotationError error
+	Handoff       *Checkout
+	Dropped       []uuid.UUID
+}
+
+const checkoutSelect = `
+	SELECT c.id, c.secret_id, c.user_id, u.username, c.checked_out_at, c.expires_at,
+	       c.checked_in_at, c.checkin_reason
+	FROM secret_checkouts c
+	JOIN users u ON u.id = c.user_id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCheckout(row rowScanner) (*Checkout, error) {
+	var c Checkout
+	if err := row.Scan(&c.ID, &c.SecretID, &c.UserID, &c.Username, &c.CheckedOutAt,
+		&c.ExpiresAt, &c.CheckedInAt, &c.Reason); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// CheckOut gives the user exclusive access to a secret for duration. A user
+// who already holds the secret gets their existing checkout back.
+func (s *Store) CheckOut(secretID, userID uuid.UUID, duration time.Duration) (*Checkout, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockCheckoutSecret(tx, secretID); err != nil {
+		return nil, err
+	}
+
+	holder, err := scanCheckout(tx.QueryRow(checkoutSelect+`
+		WHERE c.secret_id = $1 AND c.checked_in_at IS NULL`, secretID))
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	case holder.UserID == userID:
+		return holder, nil
+	default:
+		return nil, ErrCheckedOut
+	}
+
+	checkout, err := insertCheckout(tx, secretID, userID, duration)
+	if err != nil {
+		return nil, err
+	}
+	return checkout, tx.Commit()
+}
+
+// Enqueue queues the user for a secret someone else holds and returns their
+// position. The secret is handed to the head of the queue on check-in.
+func (s *Store) Enqueue(secretID, userID uuid.UUID, duration time.Duration) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockCheckoutSecret(tx, secretID); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO secret_checkout_queue (secret_id, user_id, duration_seconds)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (secret_id, user_id) DO UPDATE SET duration_seconds = EXCLUDED.duration_seconds`,
+		secretID, userID, int(duration.Seconds()),
+	); err != nil {
+		return 0, err
+	}
+
+	var position int
+	if err := tx.QueryRow(`
+		SELECT COUNT(*) FROM secret_checkout_queue q
+		WHERE q.secret_id = $1
+		  AND q.requested_at <= (SELECT requested_at FROM secret_checkout_queue WHERE secret_id = $1 AND user_id = $2)`,
+		secretID, userID,
+	).Scan(&position); err != nil {
+		return 0, err
+	}
+
+	return position, tx.Commit()
+}
+
+// Dequeue removes the user from a secret's queue.
+func (s *Store) Dequeue(secretID, userID uuid.UUID) (bool, error) {
+	result, err := s.db.Exec(`
+		DELETE FROM secret_checkout_queue WHERE secret_id = $1 AND user_id = $2`,
+		secretID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// CheckIn ends the active checkout, hands the secret to the next queued
+// user, and then rotates the value with the secret's rotator so the
+// released copy is useless. The rotation runs after the check-in is
+// committed, so a slow target does not keep the secret locked. When holder
+// is set, the check-in only succeeds if that user holds the secret.
+func (s *Store) CheckIn(secretID uuid.UUID, holder *uuid.UUID, reason string) (*CheckinResult, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockCheckoutSecret(tx, secretID); err != nil {
+		return nil, err
+	}
+
+	checkout, err := scanCheckout(tx.QueryRow(checkoutSelect+`
+		WHERE c.secret_id = $1 AND c.checked_in_at IS NULL`, secretID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotCheckedOut
+	}
+	if err != nil {
+		return nil, err
+	}
+	if holder != nil && checkout.UserID != *holder {
+		return nil, ErrCheckedOut
+	}
+
+	if err := tx.QueryRow(`
+		UPDATE secret_checkouts SET checked_in_at = CURRENT_TIMESTAMP, checkin_reason = $2
+		WHERE id = $1
+		RETURNING checked_in_at`,
+		checkout.ID, reason,
+	).Scan(&checkout.CheckedInAt); err != nil {
+		return nil, err
+	}
+	checkout.Reason = &reason
+
+	result := &CheckinResult{Checkout: checkout}
+	if result.Handoff, result.Dropped, err = handOff(tx, secretID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rotateTimeout)
+	defer cancel()
+	if result.Version, err = s.rotateReleased(ctx, secretID); err != nil {
+		// Returning the secret must not hinge on the target system; retry
+		// the rotation on the scheduler's next pass
+		var rotationErr *RotationError
+		if errors.As(err, &rotationErr) {
+			err = rotationErr.Err
+		}
+		result.RotationError = err
+		if _, err := recordRotationFailure(s.db, secretID, result.RotationError, 0); err != nil {
+			log.Println("Failed to record rotation failure:", secretID, err)
+		}
+	}
+	return result, nil
+}
+
+// handOff gives the secret to the first queued user who can still read it
+// and is still active. Users queued ahead of them who cannot are removed
+// from the queue and returned as dropped.
+func handOff(tx *sql.Tx, secretID uuid.UUID) (*Checkout, []uuid.UUID, error) {
+	var dropped []uuid.UUID
+	for {
+		var (
+			nextUser        uuid.UUID
+			durationSeconds int
+		)
+		err := tx.QueryRow(`
+			DELETE FROM secret_checkout_queue
+			WHERE id = (
+				SELECT id FROM secret_checkout_queue
+				WHERE secret_id = $1
+				ORDER BY requested_at
+				LIMIT 1
+			)
+			RETURNING user_id, duration_seconds`,
+			secretID,
+		).Scan(&nextUser, &durationSeconds)
+		if err == sql.ErrNoRows {
+			return nil, dropped, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var eligible bool
+		err = tx.QueryRow(`
+			SELECT u.is_active AND `+AccessLevelSQL+` >= 1
+			FROM secrets s, users u
+			WHERE u.id = $1 AND s.id = $2`,
+			nextUser, secretID,
+		).Scan(&eligible)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, err
+		}
+		if !eligible {
+			dropped = append(dropped, nextUser)
+			continue
+		}
+
+		checkout, err := insertCheckout(tx, secretID, nextUser, time.Duration(durationSeconds)*time.Second)
+		if err != nil {
+			return nil, nil, err
+		}
+		return checkout, dropped, nil
+	}
+}
+
+// ActiveCheckout returns the current holder of a secret, or nil.
+func (s *Store) ActiveCheckout(secretID uuid.UUID) (*Checkout, error) {
+	checkout, err := scanCheckout(s.db.QueryRow(checkoutSelect+`
+		WHERE c.secret_id = $1 AND c.checked_in_at IS NULL`, secretID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return checkout, err
+}
+
+// Queue lists the users waiting for a secret in order.
+func (s *Store) Queue(secretID uuid.UUID) ([]QueueEntry, error) {
+	rows, err := s.db.Query(`
+		SELECT q.user_id, u.username, q.duration_seconds, q.requested_at
+		FROM secret_checkout_queue q
+		JOIN users u ON u.id = q.user_id
+		WHERE q.secret_id = $1
+		ORDER BY q.requested_at`,
+		secretID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queue []QueueEntry
+	for rows.Next() {
+		var e QueueEntry
+		if err := rows.Scan(&e.UserID, &e.Username, &e.DurationSeconds, &e.RequestedAt); err != nil {
+			return nil, err
+		}
+		e.Position = len(queue) + 1
+		queue = append(queue, e)
+	}
+	return queue, rows.Err()
+}
+
+// CanRead reports whether the user may read a secret's value right now:
+// always for ordinary secrets, only while holding an unexpired checkout for
+// secrets that require one.
+func (s *Store) CanRead(secretID, userID uuid.UUID) (bool, error) {
+	var allowed bool
+	err := s.db.QueryRow(`
+		SELECT NOT s.checkout_required OR EXISTS (
+			SELECT 1 FROM secret_checkouts c
+			WHERE c.secret_id = s.id AND c.user_id = $2
+			  AND c.checked_in_at IS NULL AND c.expires_at > CURRENT_TIMESTAMP
+		)
+		FROM secrets s WHERE s.id = $1`,
+		secretID, userID,
+	).Scan(&allowed)
+	if err == sql.ErrNoRows {
+		return false, ErrNotFound
+	}
+	return allowed, err
+}
+
+// ExpiredCheckouts lists secrets whose active checkout has run out.
+func (s *Store) ExpiredCheckouts() ([]uuid.UUID, error) {
+	rows, err := s.db.Query(`
+		SELECT secret_id FROM secret_checkouts
+		WHERE checked_in_at IS NULL AND expires_at <= CURRENT_TIMESTAMP`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var secretIDs []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		secretIDs = append(secretIDs, id)
+	}
+	return secretIDs, rows.Err()
+}
+
+// lockCheckoutSecret serializes checkout changes on a secret and rejects
+// secrets that do not use checkout.
+func lockCheckoutSecret(tx *sql.Tx, secretID uuid.UUID) error {
+	var required bool
+	err := tx.QueryRow(`
+		SELECT checkout_required FROM secrets WHERE id = $1 FOR UPDATE`,
+		secretID,
+	).Scan(&required)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !required {
+		return ErrCheckoutNotRequired
+	}
+	return nil
+}
+
+func insertCheckout(tx *sql.Tx, secretID, userID uuid.UUID, duration time.Duration) (*Checkout, error) {
+	if _, err := tx.Exec(`
+		DELETE FROM secret_checkout_queue WHERE secret_id = $1 AND user_id = $2`,
+		secretID, userID,
+	); err != nil {
+		return nil, err
+	}
+
+	var checkoutID uuid.UUID
+	if err := tx.QueryRow(`
+		INSERT INTO secret_checkouts (secret_id, user_id, expires_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP + make_interval(secs => $3))
+		RETURNING id`,
+		secretID, userID, duration.Seconds(),
+	).Scan(&checkoutID); err != nil {
+		return nil, err
+	}
+
+	return scanCheckout(tx.QueryRow(checkoutSelect+` WHERE c.id = $1`, checkoutID))
+}
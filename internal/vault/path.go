@@ -0,0 +1,71 @@
+package vault
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PathSQL evaluates to the full path of the secret aliased s.
+const PathSQL = `(CASE WHEN s.folder = '' THEN s.name ELSE s.folder || '/' || s.name END)`
+
+// CleanFolder normalizes a folder path such as "/teams/payments/" to
+// "teams/payments". The empty string is the root folder.
+func CleanFolder(p string) (string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "", nil
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if err := validSegment(segment); err != nil {
+			return "", err
+		}
+	}
+	return p, nil
+}
+
+// SplitPath splits a secret path such as "teams/payments/prod/db" into its
+// folder and name.
+func SplitPath(p string) (string, string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "", "", fmt.Errorf("path is required")
+	}
+
+	folder, name := "", p
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		folder, name = p[:i], p[i+1:]
+	}
+	if err := validSegment(name); err != nil {
+		return "", "", err
+	}
+	folder, err := CleanFolder(folder)
+	if err != nil {
+		return "", "", err
+	}
+	return folder, name, nil
+}
+
+// JoinPath is the inverse of SplitPath.
+func JoinPath(folder, name string) string {
+	if folder == "" {
+		return name
+	}
+	return folder + "/" + name
+}
+
+func validSegment(segment string) error {
+	switch {
+	case segment == "":
+		return fmt.Errorf("path segments cannot be empty")
+	case segment == "." || segment == "..":
+		return fmt.Errorf("path segments cannot be %q", segment)
+	case len(segment) > 255:
+		return fmt.Errorf("path segments are limited to 255 characters")
+	}
+	for _, r := range segment {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("path segments cannot contain control characters")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package vault
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"idam-pam-platform/internal/rotation"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotDue is returned when a scheduled rotation was already handled, for
+// example by another instance.
+var ErrNotDue = errors.New("rotation is not due")
+
+// RotationError wraps a failure reported by a rotator, as opposed to a
+// failure storing its result.
+type RotationError struct {
+	Err error
+}
+
+func (e *RotationError) Error() string { return "rotation failed: " + e.Err.Error() }
+
+func (e *RotationError) Unwrap() error { return e.Err }
+
+// rotateTimeout bounds rotations that are not given a deadline by the caller.
+const rotateTimeout = 30 * time.Second
+
+type RotationPolicy struct {
+	SecretID            uuid.UUID       `json:"secret_id"`
+	Rotator             string          `json:"rotator"`
+	Config              json.RawMessage `json:"config"`
+	IntervalSeconds     *int            `json:"interval_seconds,omitempty"`
+	MaxAgeSeconds       *int            `json:"max_age_seconds,omitempty"`
+	Enabled             bool            `json:"enabled"`
+	LastRotatedAt       *time.Time      `json:"last_rotated_at"`
+	LastStatus          *string         `json:"last_status"`
+	LastError           *string         `json:"last_error,omitempty"`
+	ConsecutiveFailures int             `json:"consecutive_failures"`
+	NextRotationAt      *time.Time      `json:"next_rotation_at"`
+	CreatedBy           *uuid.UUID      `json:"created_by"`
+	CreatedAt           time.Time       `json:"created_at"`
+	UpdatedAt           time.Time       `json:"updated_at"`
+}
+
+// rotationScheduleSQL is when policy p is next due on its schedule. Max age
+// is measured from the current version, so a manual update resets it.
+const rotationScheduleSQL = `
+	CASE WHEN p.interval_seconds IS NOT NULL
+	     THEN COALESCE(p.last_rotated_at, p.created_at) + make_interval(secs => p.interval_seconds)
+	     ELSE COALESCE((SELECT MAX(v.created_at) FROM secret_versions v WHERE v.secret_id = p.secret_id), p.created_at)
+	          + make_interval(secs => p.max_age_seconds)
+	END`
+
+// rotationNextSQL is when policy p will next be attempted: the pending
+// retry after a failure, otherwise its schedule.
+const rotationNextSQL = `COALESCE(p.next_retry_at, ` + rotationScheduleSQL + `)`
+
+const rotationPolicySelect = `
+	SELECT p.secret_id, p.rotator, p.config, p.interval_seconds, p.max_age_seconds, p.enabled,
+	       p.last_rotated_at, p.last_status, p.last_error, p.consecutive_failures,
+	       ` + rotationNextSQL + `, p.created_by, p.created_at, p.updated_at
+	FROM secret_rotation_policies p`
+
+func scanRotationPolicy(row rowScanner) (*RotationPolicy, error) {
+	var (
+		p      RotationPolicy
+		config []byte
+	)
+	if err := row.Scan(&p.SecretID, &p.Rotator, &config, &p.IntervalSeconds, &p.MaxAgeSeconds,
+		&p.Enabled, &p.LastRotatedAt, &p.LastStatus, &p.LastError, &p.ConsecutiveFailures,
+		&p.NextRotationAt, &p.CreatedBy, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	p.Config = config
+	return &p, nil
+}
+
+// RotationPolicy returns a secret's rotation policy.
+func (s *Store) RotationPolicy(secretID uuid.UUID) (*RotationPolicy, error) {
+	policy, err := scanRotationPolicy(s.db.QueryRow(rotationPolicySelect+` WHERE p.secret_id = $1`, secretID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return policy, err
+}
+
+// SetRotationPolicy creates or replaces a secret's rotation policy. The
+// rotator configuration is validated before it is saved. Changing the
+// policy clears any pending retry.
+func (s *Store) SetRotationPolicy(p *RotationPolicy, setBy uuid.UUID) (*RotationPolicy, error) {
+	if _, err := rotation.New(p.Rotator, p.Config); err != nil {
+		return nil, err
+	}
+	if (p.IntervalSeconds == nil) == (p.MaxAgeSeconds == nil) {
+		return nil, errors.New("set exactly one of interval or max_age")
+	}
+	if len(p.Config) == 0 {
+		p.Config = json.RawMessage("{}")
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO secret_rotation_policies (secret_id, rotator, config, interval_seconds, max_age_seconds, enabled, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (secret_id) DO UPDATE
+		SET rotator = EXCLUDED.rotator, config = EXCLUDED.config,
+		    interval_seconds = EXCLUDED.interval_seconds, max_age_seconds = EXCLUDED.max_age_seconds,
+		    enabled = EXCLUDED.enabled, next_retry_at = NULL, consecutive_failures = 0,
+		    updated_at = CURRENT_TIMESTAMP`,
+		p.SecretID, p.Rotator, []byte(p.Config), p.IntervalSeconds, p.MaxAgeSeconds, p.Enabled, setBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s.RotationPolicy(p.SecretID)
+}
+
+// DeleteRotationPolicy removes a secret's rotation policy. Check-in then
+// falls back to a random password.
+func (s *Store) DeleteRotationPolicy(secretID uuid.UUID) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM secret_rotation_policies WHERE secret_id = $1`, secretID)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// DueRotations lists secrets whose enabled policy is due or whose retry
+// time has come, oldest first.
+func (s *Store) DueRotations(limit int) ([]uuid.UUID, error) {
+	rows, err := s.db.Query(`
+		SELECT p.secret_id FROM secret_rotation_policies p
+		WHERE p.enabled AND `+rotationNextSQL+` <= CURRENT_TIMESTAMP
+		ORDER BY `+rotationNextSQL+`
+		LIMIT $1`,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var secretIDs []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		secretIDs = append(secretIDs, id)
+	}
+	return secretIDs, rows.Err()
+}
+
+// Rotate replaces a secret's value now using its policy's rotator, or a
+// random password if it has none. A checked-out secret is only rotated by
+// its holder; pass a nil holder for system rotations.
+func (s *Store) Rotate(ctx context.Context, secretID uuid.UUID, holder *uuid.UUID) (int, error) {
+	return s.rotate(ctx, secretID, holder, false)
+}
+
+// RotateDue rotates a secret for the scheduler. It returns ErrNotDue if the
+// policy was rotated or changed since DueRotations listed it, and
+// ErrCheckedOut while someone holds the secret; its check-in rotates it.
+func (s *Store) RotateDue(ctx context.Context, secretID uuid.UUID) (int, error) {
+	return s.rotate(ctx, secretID, nil, true)
+}
+
+func (s *Store) rotate(ctx context.Context, secretID uuid.UUID, holder *uuid.UUID, dueOnly bool) (int, error) {
+	// The transaction deliberately ignores ctx: once the rotator has
+	// changed the credential, the new value must be stored.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockRotation(tx, secretID); err != nil {
+		return 0, err
+	}
+
+	if dueOnly {
+		var due bool
+		err := tx.QueryRow(`
+			SELECT p.enabled AND `+rotationNextSQL+` <= CURRENT_TIMESTAMP
+			FROM secret_rotation_policies p
+			WHERE p.secret_id = $1
+			FOR UPDATE SKIP LOCKED`,
+			secretID,
+		).Scan(&due)
+		if err == sql.ErrNoRows || (err == nil && !due) {
+			return 0, ErrNotDue
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var current *uuid.UUID
+	err = tx.QueryRow(`
+		SELECT c.user_id FROM secrets s
+		LEFT JOIN secret_checkouts c ON c.secret_id = s.id AND c.checked_in_at IS NULL
+		WHERE s.id = $1
+		FOR UPDATE OF s`,
+		secretID,
+	).Scan(&current)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if current != nil && (holder == nil || *current != *holder) {
+		return 0, ErrCheckedOut
+	}
+
+	version, err := s.rotateLocked(ctx, tx, secretID)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Rotated secret but failed to store the new value:", secretID, err)
+		return 0, err
+	}
+	return version, nil
+}
+
+// rotateReleased rotates a secret that has just been checked in. Only the
+// rotation lock is held while the rotator runs; the secret's row is locked
+// by the write alone, so reads and checkouts are not held up by a slow
+// target.
+func (s *Store) rotateReleased(ctx context.Context, secretID uuid.UUID) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockRotation(tx, secretID); err != nil {
+		return 0, err
+	}
+	version, err := s.rotateLocked(ctx, tx, secretID)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Rotated secret but failed to store the new value:", secretID, err)
+		return 0, err
+	}
+	return version, nil
+}
+
+// lockRotation serializes rotations of a secret until tx ends, so two
+// rotators never change the same credential at once.
+func lockRotation(tx *sql.Tx, secretID uuid.UUID) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('secret_rotation/' || $1::text))`, secretID)
+	return err
+}
+
+// rotateLocked runs the secret's rotator and writes the result as a new
+// version. The caller holds the secret's rotation lock. Rotator failures
+// are returned as *RotationError and leave tx usable.
+func (s *Store) rotateLocked(ctx context.Context, tx *sql.Tx, secretID uuid.UUID) (int, error) {
+	var (
+		kind                        string
+		config                      []byte
+		encryptedData, encryptedKey string
+	)
+	err := tx.QueryRow(`
+		SELECT COALESCE(p.rotator, ''), COALESCE(p.config, '{}'),
+		       s.encrypted_data, COALESCE(s.encrypted_data_key, '')
+		FROM secrets s
+		LEFT JOIN secret_rotation_policies p ON p.secret_id = s.id
+		WHERE s.id = $1`,
+		secretID,
+	).Scan(&kind, &config, &encryptedData, &encryptedKey)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var rotator rotation.Rotator = &rotation.RandomPassword{Length: rotation.DefaultPasswordLength}
+	if kind != "" {
+		if rotator, err = rotation.New(kind, config); err != nil {
+			return 0, &RotationError{Err: err}
+		}
+	}
+
+	current, err := s.Decrypt(encryptedData, encryptedKey)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := rotator.Rotate(ctx, current)
+	if err != nil {
+		return 0, &RotationError{Err: err}
+	}
+
+	version, err := s.WriteVersion(tx, secretID, value, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE secret_rotation_policies
+		SET last_rotated_at = CURRENT_TIMESTAMP, last_status = 'success', last_error = NULL,
+		    consecutive_failures = 0, next_retry_at = NULL
+		WHERE secret_id = $1`,
+		secretID,
+	); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// RecordRotationFailure notes a failed rotation and schedules a retry after
+// retryIn. It returns the number of consecutive failures.
+func (s *Store) RecordRotationFailure(secretID uuid.UUID, cause error, retryIn time.Duration) (int, error) {
+	return recordRotationFailure(s.db, secretID, cause, retryIn)
+}
+
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func recordRotationFailure(q rowQuerier, secretID uuid.UUID, cause error, retryIn time.Duration) (int, error) {
+	var failures int
+	err := q.QueryRow(`
+		UPDATE secret_rotation_policies
+		SET last_status = 'failed', last_error = $2, consecutive_failures = consecutive_failures + 1,
+		    next_retry_at = CURRENT_TIMESTAMP + make_interval(secs => $3)
+		WHERE secret_id = $1
+		RETURNING consecutive_failures`,
+		secretID, cause.Error(), retryIn.Seconds(),
+	).Scan(&failures)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return failures, err
+}
@@ -0,0 +1,133 @@
+package vault
+
+import (
+	"database/sql"
+	"errors"
+
+	"idam-pam-platform/internal/encryption"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned when a secret or version does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Store writes and reads secret values. Every write becomes a new version in
+// secret_versions; the secrets row mirrors the current one so plain reads stay
+// a single lookup.
+type Store struct {
+	db            *sql.DB
+	encryptionSvc *encryption.Service
+	retain        int
+}
+
+// NewStore keeps up to retain versions per secret unless a secret sets its
+// own max_versions.
+func NewStore(db *sql.DB, encryptionSvc *encryption.Service, retain int) *Store {
+	return &Store{
+		db:            db,
+		encryptionSvc: encryptionSvc,
+		retain:        retain,
+	}
+}
+
+// Create inserts a secret at folder/name with plaintext as version 1.
+func (s *Store) Create(tx *sql.Tx, folder, name, description, plaintext string, maxVersions *int, createdBy uuid.UUID) (uuid.UUID, error) {
+	encryptedData, encryptedKey, err := s.encryptionSvc.EncryptEnvelope(plaintext)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	var secretID uuid.UUID
+	err = tx.QueryRow(`
+		INSERT INTO secrets (folder, name, description, encrypted_data, encrypted_data_key, current_version, max_versions, created_by)
+		VALUES ($1, $2, $3, $4, $5, 1, $6, $7)
+		RETURNING id`,
+		folder, name, description, encryptedData, encryptedKey, maxVersions, createdBy,
+	).Scan(&secretID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := s.insertVersion(tx, secretID, 1, encryptedData, encryptedKey, &createdBy); err != nil {
+		return uuid.Nil, err
+	}
+	return secretID, nil
+}
+
+// WriteVersion stores plaintext as the new current version and prunes
+// versions beyond the retention limit. createdBy is nil for system writes
+// such as scheduled rotation.
+func (s *Store) WriteVersion(tx *sql.Tx, secretID uuid.UUID, plaintext string, createdBy *uuid.UUID) (int, error) {
+	encryptedData, encryptedKey, err := s.encryptionSvc.EncryptEnvelope(plaintext)
+	if err != nil {
+		return 0, err
+	}
+
+	// The row lock serializes concurrent writers to the same secret
+	var version int
+	err = tx.QueryRow(`
+		UPDATE secrets
+		SET encrypted_data = $2, encrypted_data_key = $3,
+		    current_version = current_version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING current_version`,
+		secretID, encryptedData, encryptedKey,
+	).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.insertVersion(tx, secretID, version, encryptedData, encryptedKey, createdBy); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// ReadVersion decrypts a specific version of a secret.
+func (s *Store) ReadVersion(secretID uuid.UUID, version int) (string, error) {
+	var encryptedData, encryptedKey string
+	err := s.db.QueryRow(`
+		SELECT encrypted_data, COALESCE(encrypted_data_key, '')
+		FROM secret_versions WHERE secret_id = $1 AND version = $2`,
+		secretID, version,
+	).Scan(&encryptedData, &encryptedKey)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.encryptionSvc.DecryptEnvelope(encryptedData, encryptedKey)
+}
+
+// Decrypt reads a value loaded from the secrets table.
+func (s *Store) Decrypt(encryptedData, encryptedKey string) (string, error) {
+	return s.encryptionSvc.DecryptEnvelope(encryptedData, encryptedKey)
+}
+
+func (s *Store) insertVersion(tx *sql.Tx, secretID uuid.UUID, version int, encryptedData, encryptedKey string, createdBy *uuid.UUID) error {
+	if _, err := tx.Exec(`
+		INSERT INTO secret_versions (secret_id, version, encrypted_data, encrypted_data_key, created_by)
+		VALUES ($1, $2, $3, $4, $5)`,
+		secretID, version, encryptedData, encryptedKey, createdBy,
+	); err != nil {
+		return err
+	}
+	return s.Prune(tx, secretID)
+}
+
+// Prune drops versions beyond the secret's retention limit.
+func (s *Store) Prune(tx *sql.Tx, secretID uuid.UUID) error {
+	_, err := tx.Exec(`
+		DELETE FROM secret_versions v
+		USING secrets s
+		WHERE s.id = v.secret_id AND v.secret_id = $1
+		  AND v.version <= s.current_version - COALESCE(s.max_versions, $2)`,
+		secretID, s.retain,
+	)
+	return err
+}
@@ -15,6 +15,44 @@ const getAuthHeaders = () => {
   };
 };
 
+// Swap the stored refresh token for a new token pair. Concurrent callers share
+// one in-flight request so a rotated refresh token is never replayed.
+let refreshing: Promise<boolean> | null = null;
+
+const refreshTokens = () => {
+  if (!refreshing) {
+    refreshing = (async () => {
+      const refreshToken = localStorage.getItem('refresh_token');
+      if (!refreshToken) return false;
+      const response = await fetch(`${API_BASE_URL}/auth/refresh`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refresh_token: refreshToken }),
+      });
+      if (!response.ok) {
+        localStorage.removeItem('token');
+        localStorage.removeItem('refresh_token');
+        return false;
+      }
+      const data = await response.json();
+      localStorage.setItem('token', data.token);
+      localStorage.setItem('refresh_token', data.refresh_token);
+      return true;
+    })().finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+};
+
+const authFetch = async (url: string, init: RequestInit = {}) => {
+  const response = await fetch(url, { ...init, headers: getAuthHeaders() });
+  if (response.status === 401 && (await refreshTokens())) {
+    return fetch(url, { ...init, headers: getAuthHeaders() });
+  }
+  return response;
+};
+
 const handleResponse = async (response: Response) => {
   if (!response.ok) {
     const error = await response.json().catch(() => ({ error: 'Unknown error' }));
@@ -42,10 +80,16 @@ export const authApi = {
     return handleResponse(response);
   },
 
+  async logout() {
+    const response = await authFetch(`${API_BASE_URL}/auth/logout`, {
+      method: 'POST',
+    });
+    return handleResponse(response);
+  },
+
   async enableTOTP() {
-    const response = await fetch(`${API_BASE_URL}/totp/enable`, {
+    const response = await authFetch(`${API_BASE_URL}/totp/enable`, {
       method: 'POST',
-      headers: getAuthHeaders(),
     });
     return handleResponse(response);
   },
@@ -53,32 +97,26 @@ export const authApi = {
 
 export const userApi = {
   async getUsers() {
-    const response = await fetch(`${API_BASE_URL}/users`, {
-      headers: getAuthHeaders(),
-    });
+    const response = await authFetch(`${API_BASE_URL}/users`);
     return handleResponse(response);
   },
 
   async getUser(id: string) {
-    const response = await fetch(`${API_BASE_URL}/users/${id}`, {
-      headers: getAuthHeaders(),
-    });
+    const response = await authFetch(`${API_BASE_URL}/users/${id}`);
     return handleResponse(response);
   },
 
   async updateUser(id: string, updates: any) {
-    const response = await fetch(`${API_BASE_URL}/users/${id}`, {
+    const response = await authFetch(`${API_BASE_URL}/users/${id}`, {
       method: 'PUT',
-      headers: getAuthHeaders(),
       body: JSON.stringify(updates),
     });
     return handleResponse(response);
   },
 
   async assignRole(userId: string, roleId: string) {
-    const response = await fetch(`${API_BASE_URL}/users/${userId}/roles`, {
+    const response = await authFetch(`${API_BASE_URL}/users/${userId}/roles`, {
       method: 'POST',
-      headers: getAuthHeaders(),
       body: JSON.stringify({ role_id: roleId }),
     });
     return handleResponse(response);
@@ -87,32 +125,26 @@ export const userApi = {
 
 export const secretApi = {
   async getSecrets() {
-    const response = await fetch(`${API_BASE_URL}/secrets`, {
-      headers: getAuthHeaders(),
-    });
+    const response = await authFetch(`${API_BASE_URL}/secrets`);
     return handleResponse(response);
   },
 
   async getSecret(id: string) {
-    const response = await fetch(`${API_BASE_URL}/secrets/${id}`, {
-      headers: getAuthHeaders(),
-    });
+    const response = await authFetch(`${API_BASE_URL}/secrets/${id}`);
     return handleResponse(response);
   },
 
   async createSecret(data: { name: string; description: string; data: string }) {
-    const response = await fetch(`${API_BASE_URL}/secrets`, {
+    const response = await authFetch(`${API_BASE_URL}/secrets`, {
       method: 'POST',
-      headers: getAuthHeaders(),
       body: JSON.stringify(data),
     });
     return handleResponse(response);
   },
 
   async deleteSecret(id: string) {
-    const response = await fetch(`${API_BASE_URL}/secrets/${id}`, {
+    const response = await authFetch(`${API_BASE_URL}/secrets/${id}`, {
       method: 'DELETE',
-      headers: getAuthHeaders(),
     });
     return handleResponse(response);
   },
@@ -120,9 +152,7 @@ export const secretApi = {
 
 export const auditApi = {
   async getAuditLogs(limit = 100, offset = 0) {
-    const response = await fetch(`${API_BASE_URL}/audit?limit=${limit}&offset=${offset}`, {
-      headers: getAuthHeaders(),
-    });
+    const response = await authFetch(`${API_BASE_URL}/audit?limit=${limit}&offset=${offset}`);
     return handleResponse(response);
   },
 };
\ No newline at end of file